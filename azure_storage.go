@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	azcontainer "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+)
+
+const (
+	azureDefaultSASTTL = 7 * 24 * time.Hour
+	azureCacheControl  = "public, max-age=3600"
+)
+
+// AzureBlobStorage stores media in an Azure Blob Storage container. It
+// authenticates with an account key or SAS token from a connection string,
+// or with a managed identity when no connection string is configured.
+type AzureBlobStorage struct {
+	container *azcontainer.Client
+	name      string
+	publicURL string
+	sasTTL    time.Duration
+	presigned bool
+	// accountKey is set when the connection string holds the account key,
+	// which is needed to sign SAS URLs
+	accountKey bool
+
+	containerMu    sync.Mutex
+	containerReady bool
+}
+
+// NewAzureBlobStorage creates an Azure backend from the user storage configuration
+func NewAzureBlobStorage(config *S3Config) (*AzureBlobStorage, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("missing container (bucket) for Azure storage")
+	}
+
+	storage := &AzureBlobStorage{
+		name:      config.Bucket,
+		publicURL: config.PublicURL,
+		sasTTL:    azureDefaultSASTTL,
+	}
+
+	if config.AzureConnectionString != "" {
+		client, err := azcontainer.NewClientFromConnectionString(config.AzureConnectionString, config.Bucket, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure connection string: %w", err)
+		}
+		storage.container = client
+		storage.accountKey = azureConnectionStringHasKey(config.AzureConnectionString)
+	} else {
+		// Managed identity needs the account endpoint, e.g. https://account.blob.core.windows.net
+		if config.Endpoint == "" {
+			return nil, errors.New("endpoint is required for Azure managed identity")
+		}
+		var options *azidentity.ManagedIdentityCredentialOptions
+		if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+			options = &azidentity.ManagedIdentityCredentialOptions{ID: azidentity.ClientID(clientID)}
+		}
+		credential, err := azidentity.NewManagedIdentityCredential(options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Azure managed identity credential: %w", err)
+		}
+		containerURL := strings.TrimRight(config.Endpoint, "/") + "/" + url.PathEscape(config.Bucket)
+		client, err := azcontainer.NewClient(containerURL, credential, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure blob endpoint %q: %w", config.Endpoint, err)
+		}
+		storage.container = client
+	}
+
+	if config.URLMode == MediaURLModePresigned {
+		storage.presigned = true
+		storage.sasTTL = config.presignDuration()
+	}
+
+	return storage, nil
+}
+
+// azureConnectionStringHasKey reports whether a connection string holds the
+// account key rather than only a SAS token
+func azureConnectionStringHasKey(connectionString string) bool {
+	for _, part := range strings.Split(connectionString, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && strings.EqualFold(name, "AccountKey") && value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// azureError carries the HTTP status of a failed Azure request
+type azureError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *azureError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+func (e *azureError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *azureError) Unwrap() error {
+	return e.Err
+}
+
+// wrapAzureError exposes the HTTP status of the errors of the SDK, used to
+// tell missing blobs and permanent failures apart
+func wrapAzureError(err error) error {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return &azureError{StatusCode: respErr.StatusCode, Err: err}
+	}
+	return err
+}
+
+// blobURL returns the URL of the blob without the SAS token of the
+// connection string
+func (a *AzureBlobStorage) blobURL(key string) string {
+	blobURL := a.container.NewBlobClient(key).URL()
+	if i := strings.IndexByte(blobURL, '?'); i >= 0 {
+		blobURL = blobURL[:i]
+	}
+	return blobURL
+}
+
+// ensureContainer creates the container the first time it is needed
+func (a *AzureBlobStorage) ensureContainer(ctx context.Context) error {
+	a.containerMu.Lock()
+	defer a.containerMu.Unlock()
+
+	if a.containerReady {
+		return nil
+	}
+
+	if _, err := a.container.Create(ctx, nil); err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return fmt.Errorf("failed to create container %s: %w", a.name, wrapAzureError(err))
+	}
+
+	a.containerReady = true
+	return nil
+}
+
+// Upload stores a block blob under key
+func (a *AzureBlobStorage) Upload(ctx context.Context, key string, data []byte, mimeType string) error {
+	if err := a.ensureContainer(ctx); err != nil {
+		return err
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	cacheControl := azureCacheControl
+	_, err := a.container.NewBlockBlobClient(key).UploadBuffer(ctx, data, &blockblob.UploadBufferOptions{
+		HTTPHeaders: &blob.HTTPHeaders{
+			BlobContentType:  &mimeType,
+			BlobCacheControl: &cacheControl,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload to Azure: %w", wrapAzureError(err))
+	}
+	return nil
+}
+
+// Delete removes the blob stored under key
+func (a *AzureBlobStorage) Delete(ctx context.Context, key string) error {
+	_, err := a.container.NewBlobClient(key).Delete(ctx, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return fmt.Errorf("failed to delete from Azure: %w", wrapAzureError(err))
+	}
+	return nil
+}
+
+// Exists reports whether a blob is stored under key
+func (a *AzureBlobStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := a.container.NewBlobClient(key).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapAzureError(err)
+	}
+	return true, nil
+}
+
+// Open downloads the blob stored under key
+func (a *AzureBlobStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := a.container.NewBlobClient(key).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, wrapAzureError(err)
+	}
+	return resp.Body, nil
+}
+
+// PublicURL returns the custom public URL when configured, a read-only SAS
+// URL when the account key is known, or the plain blob URL otherwise. In
+// presigned mode the SAS URL takes precedence over the custom public URL.
+func (a *AzureBlobStorage) PublicURL(key string) string {
+	if a.presigned && a.accountKey {
+		if signed, err := a.blobSASURL(key, a.sasTTL); err == nil {
+			return signed
+		}
+	}
+	if a.publicURL != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(a.publicURL, "/"), a.name, key)
+	}
+
+	if a.accountKey {
+		if signed, err := a.blobSASURL(key, a.sasTTL); err == nil {
+			return signed
+		}
+	}
+
+	// Never hand out the connection string SAS, it usually grants write access
+	return a.blobURL(key)
+}
+
+// SignedURL returns a read-only SAS URL for the blob, which needs the account key
+func (a *AzureBlobStorage) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if !a.accountKey {
+		return "", errors.New("signed URLs require an AccountKey in the Azure connection string")
+	}
+	if ttl <= 0 {
+		ttl = a.sasTTL
+	}
+	return a.blobSASURL(key, ttl)
+}
+
+// blobSASURL returns the blob URL with a read-only service SAS
+func (a *AzureBlobStorage) blobSASURL(key string, ttl time.Duration) (string, error) {
+	return a.container.NewBlobClient(key).GetSASURL(sas.BlobPermissions{Read: true}, time.Now().UTC().Add(ttl), nil)
+}
+
+// Test makes sure the container exists and can be listed
+func (a *AzureBlobStorage) Test(ctx context.Context) error {
+	if err := a.ensureContainer(ctx); err != nil {
+		return err
+	}
+	maxResults := int32(1)
+	pager := a.container.NewListBlobsFlatPager(&azcontainer.ListBlobsFlatOptions{MaxResults: &maxResults})
+	if _, err := pager.NextPage(ctx); err != nil {
+		return wrapAzureError(err)
+	}
+	return nil
+}
+
+// DeleteOlderThan removes blobs under prefix last modified before cutoff
+func (a *AzureBlobStorage) DeleteOlderThan(ctx context.Context, prefix string, cutoff time.Time) (int64, int64, error) {
+	return a.DeleteModifiedBetween(ctx, prefix, time.Time{}, cutoff)
+}
+
+// DeleteModifiedBetween removes blobs under prefix last modified within [from, to)
+func (a *AzureBlobStorage) DeleteModifiedBetween(ctx context.Context, prefix string, from, to time.Time) (int64, int64, error) {
+	var deleted, deletedBytes int64
+	err := a.eachBlob(ctx, prefix, func(item *azcontainer.BlobItem) error {
+		if item.Properties == nil || item.Properties.LastModified == nil || !inTimeRange(*item.Properties.LastModified, from, to) {
+			return nil
+		}
+		if err := a.Delete(ctx, *item.Name); err != nil {
+			return err
+		}
+		deleted++
+		if item.Properties.ContentLength != nil {
+			deletedBytes += *item.Properties.ContentLength
+		}
+		return nil
+	})
+	return deleted, deletedBytes, err
+}
+
+// DeletePrefix removes every blob whose name starts with prefix
+func (a *AzureBlobStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	return a.eachBlob(ctx, prefix, func(item *azcontainer.BlobItem) error {
+		return a.Delete(ctx, *item.Name)
+	})
+}
+
+// eachBlob calls fn for every blob under prefix and stops at the first error
+func (a *AzureBlobStorage) eachBlob(ctx context.Context, prefix string, fn func(*azcontainer.BlobItem) error) error {
+	pager := a.container.NewListBlobsFlatPager(&azcontainer.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list Azure blobs: %w", wrapAzureError(err))
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil {
+				continue
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
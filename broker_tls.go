@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// brokerTLSConfig builds the TLS configuration of a message broker client from
+// the <prefix>_TLS, <prefix>_TLS_CA, <prefix>_TLS_CERT and <prefix>_TLS_KEY
+// environment variables. It returns nil when TLS is not enabled. The CA,
+// certificate and key variables hold PEM file paths.
+func brokerTLSConfig(prefix string) (*tls.Config, error) {
+	caFile := os.Getenv(prefix + "_TLS_CA")
+	certFile := os.Getenv(prefix + "_TLS_CERT")
+	keyFile := os.Getenv(prefix + "_TLS_KEY")
+	if strings.ToLower(os.Getenv(prefix+"_TLS")) != "true" && caFile == "" && certFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		bundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s_TLS_CA: %w", prefix, err)
+		}
+		if config.RootCAs, err = parseCABundle(string(bundle)); err != nil {
+			return nil, fmt.Errorf("invalid %s_TLS_CA: %w", prefix, err)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_TLS_CERT or %s_TLS_KEY: %w", prefix, prefix, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	defaultBulkMinDelay      = 2 * time.Second
+	defaultBulkMaxDelay      = 6 * time.Second
+	defaultBulkMaxRecipients = 1000
+	// bulkDelayFloor is the shortest delay between two messages, lower
+	// delays are raised to it so a job is never sent in a burst
+	bulkDelayFloor = time.Second
+	// bulkJobRetention is how long finished jobs can still be looked up
+	bulkJobRetention = 24 * time.Hour
+)
+
+// Bulk job and recipient states
+const (
+	BulkStatusQueued    = "queued"
+	BulkStatusRunning   = "running"
+	BulkStatusCompleted = "completed"
+	BulkStatusCancelled = "cancelled"
+	BulkStatusPending   = "pending"
+	BulkStatusSent      = "sent"
+	BulkStatusFailed    = "failed"
+)
+
+// BulkRecipient is one recipient of a bulk send and the outcome of its message
+type BulkRecipient struct {
+	Phone     string                 `json:"phone"`
+	Variables map[string]interface{} `json:"-"`
+	Status    string                 `json:"status"`
+	MessageID string                 `json:"message_id,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	SentAt    int64                  `json:"sent_at,omitempty"`
+
+	jid types.JID
+}
+
+// BulkJob sends one template to a list of recipients, one at a time with a
+// random delay between MinDelay and MaxDelay so the traffic doesn't look
+// automated
+type BulkJob struct {
+	ID         string           `json:"id"`
+	UserID     string           `json:"-"`
+	Template   string           `json:"template,omitempty"`
+	Status     string           `json:"status"`
+	Total      int              `json:"total"`
+	Sent       int              `json:"sent"`
+	Failed     int              `json:"failed"`
+	MinDelayMs int64            `json:"min_delay_ms"`
+	MaxDelayMs int64            `json:"max_delay_ms"`
+	CreatedAt  int64            `json:"created_at"`
+	StartedAt  int64            `json:"started_at,omitempty"`
+	FinishedAt int64            `json:"finished_at,omitempty"`
+	Recipients []*BulkRecipient `json:"recipients"`
+
+	template *MessageTemplate
+	// media is the template media, uploaded once for the whole job
+	media  *templateMedia
+	cancel chan struct{}
+}
+
+// BulkSender runs the bulk jobs of each user in order, so two jobs of a user
+// never double its sending rate. Jobs are only kept in memory, the ones
+// queued or running when the server stops are lost.
+type BulkSender struct {
+	mu      sync.Mutex
+	jobs    map[string]*BulkJob
+	queues  map[string][]*BulkJob
+	running map[string]bool
+}
+
+var bulkSender = &BulkSender{
+	jobs:    make(map[string]*BulkJob),
+	queues:  make(map[string][]*BulkJob),
+	running: make(map[string]bool),
+}
+
+// bulkDelayDefault reads a delay from the environment
+func bulkDelayDefault(name string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+// newBulkJob checks the recipients and renders the template for each of them,
+// so a job never stops halfway on a bad phone number or a missing variable.
+// minDelay and maxDelay default to BULK_SEND_MIN_DELAY and BULK_SEND_MAX_DELAY
+// when zero, and are never lower than bulkDelayFloor.
+func newBulkJob(userID string, template *MessageTemplate, recipients []*BulkRecipient, minDelay, maxDelay time.Duration) (*BulkJob, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("missing Recipients in Payload")
+	}
+	if limit := envInt("BULK_SEND_MAX_RECIPIENTS", defaultBulkMaxRecipients); len(recipients) > limit {
+		return nil, fmt.Errorf("too many recipients, at most %d per job", limit)
+	}
+	if minDelay == 0 {
+		minDelay = bulkDelayDefault("BULK_SEND_MIN_DELAY", defaultBulkMinDelay)
+	}
+	if maxDelay == 0 {
+		maxDelay = bulkDelayDefault("BULK_SEND_MAX_DELAY", defaultBulkMaxDelay)
+		if maxDelay < minDelay {
+			maxDelay = minDelay
+		}
+	}
+	if minDelay < 0 || maxDelay < minDelay {
+		return nil, errors.New("MaxDelay must not be lower than MinDelay")
+	}
+	if minDelay < bulkDelayFloor {
+		minDelay = bulkDelayFloor
+	}
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+
+	for i, recipient := range recipients {
+		if recipient.Phone == "" {
+			return nil, fmt.Errorf("missing Phone for recipient %d", i)
+		}
+		jid, ok := parseJID(recipient.Phone)
+		if !ok {
+			return nil, fmt.Errorf("could not parse Phone %q", recipient.Phone)
+		}
+		if _, _, err := template.Render(recipient.Variables); err != nil {
+			return nil, fmt.Errorf("recipient %s: %v", recipient.Phone, err)
+		}
+		if _, err := template.RenderButtons(recipient.Variables); err != nil {
+			return nil, fmt.Errorf("recipient %s: %v", recipient.Phone, err)
+		}
+		recipient.jid = jid
+		recipient.Status = BulkStatusPending
+	}
+
+	id, err := GenerateRandomID()
+	if err != nil {
+		return nil, err
+	}
+	return &BulkJob{
+		ID:         id,
+		UserID:     userID,
+		Template:   template.Name,
+		Status:     BulkStatusQueued,
+		Total:      len(recipients),
+		MinDelayMs: minDelay.Milliseconds(),
+		MaxDelayMs: maxDelay.Milliseconds(),
+		CreatedAt:  time.Now().Unix(),
+		Recipients: recipients,
+		template:   template,
+		cancel:     make(chan struct{}),
+	}, nil
+}
+
+// Enqueue adds a job behind the other jobs of its user
+func (b *BulkSender) Enqueue(job *BulkJob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireLocked()
+	b.jobs[job.ID] = job
+	b.queues[job.UserID] = append(b.queues[job.UserID], job)
+	if !b.running[job.UserID] {
+		b.running[job.UserID] = true
+		go b.run(job.UserID)
+	}
+}
+
+// Get returns a copy of a job of the user, safe to encode
+func (b *BulkSender) Get(userID string, jobID string) (*BulkJob, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job, ok := b.jobs[jobID]
+	if !ok || job.UserID != userID {
+		return nil, false
+	}
+	snapshot := *job
+	snapshot.Recipients = make([]*BulkRecipient, len(job.Recipients))
+	for i, recipient := range job.Recipients {
+		copied := *recipient
+		snapshot.Recipients[i] = &copied
+	}
+	return &snapshot, true
+}
+
+// Cancel stops a queued or running job, the recipients not reached yet are
+// marked cancelled
+func (b *BulkSender) Cancel(userID string, jobID string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job, ok := b.jobs[jobID]
+	if !ok || job.UserID != userID {
+		return false, nil
+	}
+	if job.Status != BulkStatusQueued && job.Status != BulkStatusRunning {
+		return true, fmt.Errorf("job is already %s", job.Status)
+	}
+	select {
+	case <-job.cancel:
+		return true, errors.New("job is already being cancelled")
+	default:
+		close(job.cancel)
+	}
+	if job.Status == BulkStatusQueued {
+		b.finishLocked(job, BulkStatusCancelled, "")
+	}
+	return true, nil
+}
+
+// run sends the queued jobs of a user until there are none left
+func (b *BulkSender) run(userID string) {
+	for {
+		b.mu.Lock()
+		queue := b.queues[userID]
+		if len(queue) == 0 {
+			delete(b.queues, userID)
+			delete(b.running, userID)
+			b.mu.Unlock()
+			return
+		}
+		job := queue[0]
+		b.queues[userID] = queue[1:]
+		if job.Status != BulkStatusQueued {
+			b.mu.Unlock()
+			continue
+		}
+		job.Status = BulkStatusRunning
+		job.StartedAt = time.Now().Unix()
+		b.mu.Unlock()
+
+		b.send(job)
+	}
+}
+
+// send delivers the messages of a job, waiting a random delay between two
+func (b *BulkSender) send(job *BulkJob) {
+	for i, recipient := range job.Recipients {
+		var delay time.Duration
+		if i > 0 {
+			delay = time.Duration(job.MinDelayMs) * time.Millisecond
+			if spread := job.MaxDelayMs - job.MinDelayMs; spread > 0 {
+				delay += time.Duration(rand.Int63n(spread+1)) * time.Millisecond
+			}
+		}
+		select {
+		case <-job.cancel:
+			b.mu.Lock()
+			b.finishLocked(job, BulkStatusCancelled, "")
+			b.mu.Unlock()
+			return
+		case <-time.After(delay):
+		}
+
+		client := clientManager.GetWhatsmeowClient(job.UserID)
+		if client == nil || !client.IsConnected() {
+			b.mu.Lock()
+			b.finishLocked(job, BulkStatusFailed, "no session")
+			b.mu.Unlock()
+			log.Warn().Str("userID", job.UserID).Str("job", job.ID).Msg("Bulk send stopped, the instance is not connected")
+			return
+		}
+
+		messageID, err := b.sendMessage(client, job, recipient)
+
+		b.mu.Lock()
+		if err != nil {
+			recipient.Status = BulkStatusFailed
+			recipient.Error = err.Error()
+			job.Failed++
+		} else {
+			recipient.Status = BulkStatusSent
+			recipient.MessageID = messageID
+			recipient.SentAt = time.Now().Unix()
+			job.Sent++
+		}
+		b.mu.Unlock()
+		if err != nil {
+			log.Warn().Err(err).Str("userID", job.UserID).Str("job", job.ID).Str("phone", recipient.Phone).Msg("Bulk message failed")
+		} else {
+			recordMessageSent(job.UserID)
+		}
+	}
+
+	// A cancel received while the last message was being sent still counts
+	status := BulkStatusCompleted
+	select {
+	case <-job.cancel:
+		status = BulkStatusCancelled
+	default:
+	}
+	b.mu.Lock()
+	b.finishLocked(job, status, "")
+	b.mu.Unlock()
+	log.Info().Str("userID", job.UserID).Str("job", job.ID).Str("status", status).Int("sent", job.Sent).Int("failed", job.Failed).Msg("Bulk send finished")
+}
+
+// finishLocked ends a job, the recipients still pending get reason as error,
+// or are cancelled when there is none. b.mu must be held.
+func (b *BulkSender) finishLocked(job *BulkJob, status string, reason string) {
+	job.Status = status
+	job.FinishedAt = time.Now().Unix()
+	for _, recipient := range job.Recipients {
+		if recipient.Status != BulkStatusPending {
+			continue
+		}
+		if reason == "" {
+			recipient.Status = BulkStatusCancelled
+			continue
+		}
+		recipient.Status = BulkStatusFailed
+		recipient.Error = reason
+		job.Failed++
+	}
+}
+
+// expireLocked forgets the jobs finished more than bulkJobRetention ago. b.mu
+// must be held.
+func (b *BulkSender) expireLocked() {
+	cutoff := time.Now().Add(-bulkJobRetention).Unix()
+	for id, job := range b.jobs {
+		if job.FinishedAt > 0 && job.FinishedAt < cutoff {
+			delete(b.jobs, id)
+		}
+	}
+}
+
+// sendMessage renders and sends the message of one recipient. The template
+// media is uploaded with the first message and reused afterwards. Only the
+// goroutine running the job writes job.media, under b.mu as Get copies the job.
+func (b *BulkSender) sendMessage(client *whatsmeow.Client, job *BulkJob, recipient *BulkRecipient) (string, error) {
+	if job.template.Type != "text" && job.media == nil {
+		media, err := uploadTemplateMedia(client, job.template)
+		if err != nil {
+			return "", err
+		}
+		b.mu.Lock()
+		job.media = media
+		b.mu.Unlock()
+	}
+	msg, err := renderTemplateMessage(job.template, recipient.Variables, job.media)
+	if err != nil {
+		return "", err
+	}
+	messageID := client.GenerateMessageID()
+	resp, err := client.SendMessage(context.Background(), recipient.jid, msg, whatsmeow.SendRequestExtra{ID: messageID})
+	if err != nil {
+		return "", fmt.Errorf("error sending message: %v", err)
+	}
+	rememberSentMessage(job.UserID, recipient.jid, messageID, resp.Timestamp)
+	return messageID, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContactCard is a contact sent or received as a vCard. When sending, either
+// Vcard or Name and Phones are set, the vCard is then built from the fields.
+type ContactCard struct {
+	Name   string         `json:"name"`
+	Phones []ContactPhone `json:"phones,omitempty"`
+	Emails []string       `json:"emails,omitempty"`
+	Org    string         `json:"org,omitempty"`
+	Vcard  string         `json:"vcard,omitempty"`
+}
+
+// ContactPhone is a phone number of a contact card. WaID is the WhatsApp
+// number, it lets the receiver open a chat from the card.
+type ContactPhone struct {
+	Number string `json:"number"`
+	Type   string `json:"type,omitempty"`
+	WaID   string `json:"wa_id,omitempty"`
+}
+
+// Normalize builds the vCard of a card given by fields, or takes the name of
+// a raw vCard when it is missing
+func (c *ContactCard) Normalize() error {
+	if c.Vcard != "" {
+		if c.Name == "" {
+			c.Name = parseVCard(c.Vcard).Name
+		}
+		if c.Name == "" {
+			return errors.New("missing Name for contact, the vCard has no FN")
+		}
+		return nil
+	}
+
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("missing Name for contact")
+	}
+	if len(c.Phones) == 0 {
+		return errors.New("missing Phones or Vcard for contact " + c.Name)
+	}
+	for i, phone := range c.Phones {
+		if onlyDigits(phone.Number) == "" {
+			return fmt.Errorf("invalid phone number %q for contact %s", phone.Number, c.Name)
+		}
+		if phone.WaID == "" {
+			c.Phones[i].WaID = onlyDigits(phone.Number)
+		}
+	}
+	c.Vcard = buildVCard(c)
+	return nil
+}
+
+func onlyDigits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var vcardEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+
+// buildVCard writes a vCard 3.0 in the form WhatsApp clients send
+func buildVCard(c *ContactCard) string {
+	var b strings.Builder
+	name := vcardEscaper.Replace(c.Name)
+	b.WriteString("BEGIN:VCARD\nVERSION:3.0\n")
+	b.WriteString("N:;" + name + ";;;\n")
+	b.WriteString("FN:" + name + "\n")
+	if c.Org != "" {
+		b.WriteString("ORG:" + vcardEscaper.Replace(c.Org) + ";\n")
+	}
+	for _, phone := range c.Phones {
+		phoneType := strings.ToUpper(phone.Type)
+		if phoneType == "" {
+			phoneType = "CELL"
+		}
+		b.WriteString("TEL;type=" + phoneType + ";type=VOICE")
+		if phone.WaID != "" {
+			b.WriteString(";waid=" + phone.WaID)
+		}
+		b.WriteString(":" + vcardEscaper.Replace(phone.Number) + "\n")
+	}
+	for _, email := range c.Emails {
+		b.WriteString("EMAIL;type=INTERNET:" + vcardEscaper.Replace(email) + "\n")
+	}
+	b.WriteString("END:VCARD")
+	return b.String()
+}
+
+var vcardUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\:`, ":")
+
+// parseVCard reads the name, organization, phones and emails of a vCard.
+// Unknown properties are skipped, a card that can't be read gives an empty
+// result.
+func parseVCard(vcard string) ContactCard {
+	card := ContactCard{Vcard: vcard}
+	var structuredName string
+
+	// Lines starting with a space or a tab continue the previous one
+	unfolded := strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(vcard)
+	for _, line := range strings.Split(unfolded, "\n") {
+		line = strings.TrimRight(line, "\r")
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		params := strings.Split(key, ";")
+		property := strings.ToUpper(params[0])
+		// Apple clients group properties as item1.TEL
+		if _, after, grouped := strings.Cut(property, "."); grouped {
+			property = after
+		}
+
+		switch property {
+		case "FN":
+			card.Name = vcardUnescaper.Replace(value)
+		case "N":
+			parts := strings.Split(value, ";")
+			names := []string{}
+			// Given, additional and family name, in reading order
+			for _, i := range []int{1, 2, 0} {
+				if i < len(parts) && parts[i] != "" {
+					names = append(names, vcardUnescaper.Replace(parts[i]))
+				}
+			}
+			structuredName = strings.Join(names, " ")
+		case "ORG":
+			card.Org = vcardUnescaper.Replace(strings.TrimRight(value, ";"))
+		case "TEL":
+			phone := ContactPhone{Number: vcardUnescaper.Replace(value)}
+			for _, param := range params[1:] {
+				name, paramValue, _ := strings.Cut(param, "=")
+				switch strings.ToLower(name) {
+				case "waid":
+					phone.WaID = paramValue
+				case "type":
+					// VOICE is implied, the other type tells which phone it is
+					if !strings.EqualFold(paramValue, "VOICE") && !strings.EqualFold(paramValue, "pref") && phone.Type == "" {
+						phone.Type = strings.ToUpper(paramValue)
+					}
+				}
+			}
+			card.Phones = append(card.Phones, phone)
+		case "EMAIL":
+			card.Emails = append(card.Emails, vcardUnescaper.Replace(value))
+		}
+	}
+	if card.Name == "" {
+		card.Name = structuredName
+	}
+	return card
+}
+
+// buildContactMessage sends a single card as a contact message and several as
+// a contacts array
+func buildContactMessage(cards []ContactCard, contextInfo *waE2E.ContextInfo) *waE2E.Message {
+	contacts := make([]*waE2E.ContactMessage, len(cards))
+	for i := range cards {
+		contacts[i] = &waE2E.ContactMessage{
+			DisplayName: proto.String(cards[i].Name),
+			Vcard:       proto.String(cards[i].Vcard),
+		}
+	}
+	if len(contacts) == 1 {
+		contacts[0].ContextInfo = contextInfo
+		return &waE2E.Message{ContactMessage: contacts[0]}
+	}
+	return &waE2E.Message{ContactsArrayMessage: &waE2E.ContactsArrayMessage{
+		DisplayName: proto.String(fmt.Sprintf("%d contacts", len(contacts))),
+		Contacts:    contacts,
+		ContextInfo: contextInfo,
+	}}
+}
+
+// contactCardsFromMessage reads the contacts of a received contact or contacts
+// array message, nil for other messages
+func contactCardsFromMessage(msg *waE2E.Message) []ContactCard {
+	var contacts []*waE2E.ContactMessage
+	if contact := msg.GetContactMessage(); contact != nil {
+		contacts = append(contacts, contact)
+	}
+	if array := msg.GetContactsArrayMessage(); array != nil {
+		contacts = append(contacts, array.GetContacts()...)
+	}
+	if len(contacts) == 0 {
+		return nil
+	}
+
+	cards := make([]ContactCard, 0, len(contacts))
+	for _, contact := range contacts {
+		card := parseVCard(contact.GetVcard())
+		if contact.GetDisplayName() != "" {
+			card.Name = contact.GetDisplayName()
+		}
+		cards = append(cards, card)
+	}
+	return cards
+}
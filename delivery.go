@@ -0,0 +1,725 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+// Delivery channels
+const (
+	DeliveryChannelWebhook       = "webhook"
+	DeliveryChannelGlobalWebhook = "global_webhook"
+	DeliveryChannelRabbitMQ      = "rabbitmq"
+	DeliveryChannelUserRabbitMQ  = "user_rabbitmq"
+	DeliveryChannelKafka         = "kafka"
+	DeliveryChannelNATS          = "nats"
+	DeliveryChannelUserNATS      = "user_nats"
+	DeliveryChannelSQS           = "sqs"
+	DeliveryChannelSNS           = "sns"
+	DeliveryChannelPubSub        = "pubsub"
+	DeliveryChannelRedis         = "redis"
+)
+
+// knownDeliveryChannel reports whether channel is one of the delivery channels
+func knownDeliveryChannel(channel string) bool {
+	switch channel {
+	case DeliveryChannelWebhook, DeliveryChannelGlobalWebhook, DeliveryChannelRabbitMQ, DeliveryChannelKafka,
+		DeliveryChannelNATS, DeliveryChannelUserNATS, DeliveryChannelSQS, DeliveryChannelSNS,
+		DeliveryChannelPubSub, DeliveryChannelRedis, DeliveryChannelUserRabbitMQ:
+		return true
+	}
+	return false
+}
+
+// Delivery statuses
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	DeliveryStatusFailed    = "failed"
+	// DeliveryStatusRetrying marks a failed attempt that will be retried in
+	// the delivery history
+	DeliveryStatusRetrying = "retrying"
+)
+
+// Defaults for users without a delivery policy
+const (
+	deliveryMaxRetries     = 5
+	deliveryRetryBaseDelay = 2 * time.Second
+	deliveryMaxRetryDelay  = 5 * time.Minute
+	deliveryTimeout        = 30 * time.Second
+	deliveryPollInterval   = time.Second
+	// deliveryRetention is how long delivered and failed rows, and the
+	// delivery history, are kept
+	deliveryRetention     = 7 * 24 * time.Hour
+	deliveryPruneInterval = time.Hour
+)
+
+// DeliveryEvent is an event waiting to be delivered to one channel, stored in
+// the delivery_events table so pending events survive a restart. The payload
+// is stored in delivery_payloads under PayloadID, its hash, once for all the
+// channels of an event. Token is not stored, it is looked up from UserID when
+// the event is sent.
+type DeliveryEvent struct {
+	ID          string `db:"id" json:"id"`
+	UserID      string `db:"user_id" json:"user_id"`
+	Token       string `db:"-" json:"-"`
+	Channel     string `db:"channel" json:"channel"`
+	Destination string `db:"destination" json:"destination"`
+	EventType   string `db:"event_type" json:"event_type"`
+	Payload     string `db:"payload" json:"payload"`
+	PayloadID   string `db:"payload_id" json:"-"`
+	// Replayed is set on user webhook events sent again by Replay, the
+	// actions in their response were already run the first time
+	Replayed      bool   `db:"replayed" json:"replayed,omitempty"`
+	Status        string `db:"status" json:"status"`
+	Attempts      int    `db:"attempts" json:"attempts"`
+	LastError     string `db:"last_error" json:"last_error,omitempty"`
+	NextAttemptAt int64  `db:"next_attempt_at" json:"next_attempt_at"`
+	CreatedAt     int64  `db:"created_at" json:"created_at"`
+	UpdatedAt     int64  `db:"updated_at" json:"updated_at"`
+
+	inFlight bool
+	// seq orders events created in the same second
+	seq uint64
+	// queuedAt is when the event was added to memory, for batching
+	queuedAt time.Time
+	// persisted is set once the event has a row in delivery_events
+	persisted bool
+}
+
+// DeliveryManager delivers events to webhooks and brokers with retries. Every
+// event is written to the database before the first attempt and marked
+// delivered or failed afterwards.
+type DeliveryManager struct {
+	mu            sync.Mutex
+	db            *sqlx.DB
+	pendingEvents map[string]*DeliveryEvent
+	policies      map[string]*DeliveryPolicy
+	rateLimits    map[string]*DeliveryRateLimit
+	buckets       map[bucketKey]*tokenBucket
+	tlsClients    map[string]*resty.Client
+	headers       map[string]map[string]string
+	wake          chan struct{}
+	started       bool
+	seq           uint64
+
+	// Failover webhooks, see webhook_failover.go
+	failovers      map[string]*WebhookFailover
+	failoverStates map[string]*failoverState
+
+	// Per-user NATS publishers, see nats.go
+	natsSettings map[string]*NATSSettings
+	natsClients  map[string]*natsClient
+
+	// Per-user SQS queues and SNS topics, see sqs.go
+	sqsSettings map[string]*SQSSettings
+	sqsClients  map[string]*sqsClients
+
+	// Per-user Pub/Sub topics, see pubsub.go
+	pubsubSettings map[string]*PubSubSettings
+	pubsubClients  map[string]*pubsubPublisher
+
+	// Per-user AMQP brokers, see rabbitmq_user.go
+	amqpSettings   map[string]*AMQPSettings
+	amqpPublishers map[string]*amqpPublisher
+
+	// Shutdown state, see delivery_shutdown.go
+	closing bool
+	stop    chan struct{}
+	stopped chan struct{}
+	running sync.WaitGroup
+
+	// Recently seen events, see delivery_dedup.go
+	dedup     *cache.Cache
+	dedupOnce sync.Once
+
+	// Worker pool, see delivery_pool.go
+	queue       chan []*DeliveryEvent
+	workers     int
+	memoryLimit int
+	spilled     bool
+	spillSeq    int64
+	stats       deliveryPoolStats
+}
+
+// Global delivery manager instance
+var deliveryManager = &DeliveryManager{
+	pendingEvents:  make(map[string]*DeliveryEvent),
+	policies:       make(map[string]*DeliveryPolicy),
+	rateLimits:     make(map[string]*DeliveryRateLimit),
+	buckets:        make(map[bucketKey]*tokenBucket),
+	tlsClients:     make(map[string]*resty.Client),
+	headers:        make(map[string]map[string]string),
+	failovers:      make(map[string]*WebhookFailover),
+	failoverStates: make(map[string]*failoverState),
+	natsSettings:   make(map[string]*NATSSettings),
+	natsClients:    make(map[string]*natsClient),
+	sqsSettings:    make(map[string]*SQSSettings),
+	sqsClients:     make(map[string]*sqsClients),
+	pubsubSettings: make(map[string]*PubSubSettings),
+	pubsubClients:  make(map[string]*pubsubPublisher),
+	amqpSettings:   make(map[string]*AMQPSettings),
+	amqpPublishers: make(map[string]*amqpPublisher),
+	wake:           make(chan struct{}, 1),
+	stop:           make(chan struct{}),
+	stopped:        make(chan struct{}),
+}
+
+// GetDeliveryManager returns the global delivery manager instance
+func GetDeliveryManager() *DeliveryManager {
+	return deliveryManager
+}
+
+// InitDeliveryManager loads the events left pending by the previous run and
+// starts the dispatcher and its workers
+func InitDeliveryManager(db *sqlx.DB) error {
+	m := GetDeliveryManager()
+
+	m.mu.Lock()
+	m.db = db
+	m.memoryLimit = envInt("DELIVERY_MEMORY_LIMIT", defaultDeliveryMemoryLimit)
+	loadDeliveryCompression()
+	// Pending rows are loaded like events spilled by this process
+	m.spilled = true
+	start := !m.started
+	m.started = true
+	m.mu.Unlock()
+
+	loaded, err := m.refill()
+	if err != nil {
+		return fmt.Errorf("failed to load pending deliveries: %w", err)
+	}
+	if loaded > 0 {
+		log.Info().Int("events", loaded).Msg("Resuming pending deliveries")
+	}
+	if start {
+		m.startWorkers()
+		go m.run()
+	}
+	return nil
+}
+
+const deliveryEventColumns = `id, user_id, channel, destination, event_type, payload_id, replayed,
+	status, attempts, last_error, next_attempt_at, created_at, updated_at`
+
+// deliveryEventSelect reads events with their payload
+const deliveryEventSelect = `SELECT e.id, e.user_id, e.channel, e.destination, e.event_type, e.payload_id,
+	e.replayed, p.payload, e.status, e.attempts, e.last_error, e.next_attempt_at, e.created_at, e.updated_at
+	FROM delivery_events e JOIN delivery_payloads p ON p.id = e.payload_id`
+
+// deliveryPayloadID is the key of a payload in delivery_payloads, the rows of
+// every channel an event is sent to refer to the same one
+func deliveryPayloadID(payload string) string {
+	hash := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(hash[:])
+}
+
+// storeDeliveryEvent writes an event and its payload in one transaction. A
+// payload already stored for another channel is only marked as used again.
+func storeDeliveryEvent(db *sqlx.DB, event *DeliveryEvent) error {
+	event.PayloadID = deliveryPayloadID(event.Payload)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO delivery_payloads (id, payload, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET updated_at = excluded.updated_at`,
+		event.PayloadID, event.Payload, event.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.NamedExec(`INSERT INTO delivery_events (`+deliveryEventColumns+`)
+		VALUES (:id, :user_id, :channel, :destination, :event_type, :payload_id, :replayed,
+		:status, :attempts, :last_error, :next_attempt_at, :created_at, :updated_at)
+		ON CONFLICT (id) DO NOTHING`, event)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Enqueue stores an event and schedules its delivery. Without a database the
+// event is only kept in memory. Events for channels the user disabled are
+// dropped.
+func (m *DeliveryManager) Enqueue(event *DeliveryEvent) {
+	if !m.Policy(event.UserID).channelEnabled(event.Channel) {
+		log.Debug().Str("userID", event.UserID).Str("channel", event.Channel).Msg("Delivery channel disabled by policy")
+		return
+	}
+
+	id, err := GenerateRandomID()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate delivery ID")
+		return
+	}
+	now := time.Now().Unix()
+	event.ID = id
+	event.Status = DeliveryStatusPending
+	event.NextAttemptAt = now
+	event.CreatedAt = now
+	event.UpdatedAt = now
+
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+
+	persisted := false
+	if db != nil {
+		if err := storeDeliveryEvent(db, event); err != nil {
+			log.Error().Err(err).Str("userID", event.UserID).Str("channel", event.Channel).Msg("Failed to persist delivery, keeping it in memory")
+		} else {
+			persisted = true
+		}
+	}
+	event.persisted = persisted
+
+	// Persisted events over the memory limit wait in the database until
+	// refill loads them. During shutdown they wait for the next start.
+	m.mu.Lock()
+	if m.closing {
+		m.mu.Unlock()
+		if !persisted {
+			log.Error().Str("userID", event.UserID).Str("channel", event.Channel).Msg("Delivery manager is shutting down, dropping event")
+		}
+		return
+	}
+	if !(persisted && m.spillLocked()) {
+		if _, ok := m.pendingEvents[event.ID]; !ok {
+			m.addLocked(event)
+		}
+	}
+	m.mu.Unlock()
+
+	m.notify()
+}
+
+// addLocked adds an event to the pending events. The caller must hold mu.
+func (m *DeliveryManager) addLocked(event *DeliveryEvent) {
+	m.seq++
+	event.seq = m.seq
+	event.queuedAt = time.Now()
+	m.pendingEvents[event.ID] = event
+}
+
+// notify wakes the dispatcher without waiting for the next tick
+func (m *DeliveryManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run hands due events to the workers until the process exits
+func (m *DeliveryManager) run() {
+	defer close(m.stopped)
+	ticker := time.NewTicker(deliveryPollInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+	var batchTimer *time.Timer
+	var batchWake time.Time
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.wake:
+		case <-m.stop:
+			if batchTimer != nil {
+				batchTimer.Stop()
+			}
+			return
+		}
+
+		if _, err := m.refill(); err != nil {
+			log.Error().Err(err).Msg("Failed to load spilled deliveries")
+		}
+		due, wakeAt := m.dueEvents()
+		m.dispatch(m.queue, due)
+		// Wake up for the next batch deadline when it comes before the tick
+		if !wakeAt.IsZero() && !wakeAt.Equal(batchWake) && time.Until(wakeAt) < deliveryPollInterval {
+			if batchTimer != nil {
+				batchTimer.Stop()
+			}
+			batchTimer = time.AfterFunc(time.Until(wakeAt), m.notify)
+			batchWake = wakeAt
+		}
+
+		if time.Since(lastPrune) > deliveryPruneInterval {
+			m.prune()
+			lastPrune = time.Now()
+		}
+	}
+}
+
+// dueEvents returns the pending events whose next attempt is due, oldest
+// first, marking them in flight. Each entry is sent in one request: a single
+// event, or a batch when the user batches webhook events. A request over the
+// rate limit of its destination waits for a later round together with the
+// newer events to it. wakeAt is the deadline of the oldest incomplete batch.
+func (m *DeliveryManager) dueEvents() (due [][]*DeliveryEvent, wakeAt time.Time) {
+	now := time.Now()
+
+	m.mu.Lock()
+	var candidates []*DeliveryEvent
+	users := make(map[string]bool)
+	for _, event := range m.pendingEvents {
+		if !event.inFlight && event.NextAttemptAt <= now.Unix() {
+			candidates = append(candidates, event)
+			users[event.UserID] = true
+		}
+	}
+	m.mu.Unlock()
+	if len(candidates) == 0 {
+		return nil, time.Time{}
+	}
+
+	limits := make(map[string]*DeliveryRateLimit, len(users))
+	policies := make(map[string]*DeliveryPolicy, len(users))
+	for userID := range users {
+		limits[userID] = m.RateLimit(userID)
+		policies[userID] = m.Policy(userID)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].CreatedAt != candidates[j].CreatedAt {
+			return candidates[i].CreatedAt < candidates[j].CreatedAt
+		}
+		return candidates[i].seq < candidates[j].seq
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	blocked := make(map[bucketKey]bool)
+	take := func(key bucketKey, request []*DeliveryEvent) bool {
+		if blocked[key] || !m.allowLocked(request[0], limits[key.userID], now) {
+			blocked[key] = true
+			return false
+		}
+		for _, event := range request {
+			event.inFlight = true
+		}
+		due = append(due, request)
+		return true
+	}
+
+	// First attempts to batching webhooks are grouped per destination
+	batches := make(map[bucketKey][]*DeliveryEvent)
+	var batchKeys []bucketKey
+	for _, event := range candidates {
+		key := bucketKey{userID: event.UserID, destination: event.Destination}
+		if _, ok := m.pendingEvents[event.ID]; !ok || event.inFlight || blocked[key] {
+			continue
+		}
+		// Events outside the delivery window wait without using an attempt
+		if policies[event.UserID].waiting(event, now) {
+			continue
+		}
+		if policies[event.UserID].batching(event) {
+			if _, ok := batches[key]; !ok {
+				batchKeys = append(batchKeys, key)
+			}
+			batches[key] = append(batches[key], event)
+			continue
+		}
+		take(key, []*DeliveryEvent{event})
+	}
+
+	for _, key := range batchKeys {
+		policy := policies[key.userID]
+		events := batches[key]
+		for len(events) >= policy.BatchSize {
+			if !take(key, events[:policy.BatchSize]) {
+				break
+			}
+			events = events[policy.BatchSize:]
+		}
+		if len(events) == 0 || len(events) >= policy.BatchSize || blocked[key] {
+			continue
+		}
+		// An incomplete batch is sent once its oldest event waited long enough
+		deadline := events[0].queuedAt.Add(policy.batchWait())
+		if !now.Before(deadline) {
+			take(key, events)
+		} else if wakeAt.IsZero() || deadline.Before(wakeAt) {
+			wakeAt = deadline
+		}
+	}
+	return due, wakeAt
+}
+
+// deliver makes one delivery attempt for a request and records the outcome
+// of each of its events
+func (m *DeliveryManager) deliver(request []*DeliveryEvent) {
+	first := request[0]
+	ctx, cancel := context.WithTimeout(context.Background(), m.Policy(first.UserID).timeout())
+	defer cancel()
+
+	if token := m.userToken(first.UserID); token != "" {
+		for _, event := range request {
+			event.Token = token
+		}
+	}
+
+	start := time.Now()
+	var err error
+	if len(request) == 1 {
+		err = m.send(ctx, first)
+	} else {
+		err = m.sendBatch(ctx, request)
+	}
+	latency := time.Since(start)
+	for _, event := range request {
+		m.complete(event, err, latency)
+	}
+}
+
+// send delivers an event to its channel
+func (m *DeliveryManager) send(ctx context.Context, event *DeliveryEvent) error {
+	switch event.Channel {
+	case DeliveryChannelWebhook:
+		data := map[string]string{
+			"jsonData":     formatPayload(event),
+			"token":        event.Token,
+			"instanceName": instanceName(event.Token),
+		}
+		destination, failover := m.webhookTarget(event.UserID, event.Destination)
+		body, err := postWebhook(ctx, userWebhookClient(event.UserID), destination, data, deliveryHeaders(m.WebhookHeaders(event.UserID), event))
+		m.webhookResult(event, failover, err)
+		if err != nil {
+			return err
+		}
+		// The user webhook may answer with actions for the session, a replayed
+		// event must not send the same reply again
+		if !event.Replayed {
+			runWebhookActions(event, body)
+		}
+		return nil
+
+	case DeliveryChannelGlobalWebhook:
+		data := map[string]string{
+			"jsonData":     formatPayload(event),
+			"token":        event.Token,
+			"userID":       event.UserID,
+			"instanceName": instanceName(event.Token),
+		}
+		_, err := postWebhook(ctx, webhookHTTPClient(event.UserID), event.Destination, data, deliveryHeaders(nil, event))
+		return err
+
+	case DeliveryChannelRabbitMQ:
+		if !rabbitEnabled {
+			return errors.New("RabbitMQ is not connected")
+		}
+		body, encoding, err := encodePayload(event)
+		if err != nil {
+			return err
+		}
+		msg := rabbitEventPublishing(event, body, encoding)
+		return publishToRabbitWithHeaders(ctx, event.Destination, msg)
+
+	case DeliveryChannelUserRabbitMQ:
+		return m.publishToUserRabbit(ctx, event)
+
+	case DeliveryChannelKafka:
+		return publishToKafka(ctx, event)
+
+	case DeliveryChannelNATS, DeliveryChannelUserNATS:
+		return m.publishToNATS(ctx, event)
+
+	case DeliveryChannelSQS, DeliveryChannelSNS:
+		return m.publishToSQS(ctx, event)
+
+	case DeliveryChannelPubSub:
+		return m.publishToPubSub(ctx, event)
+
+	case DeliveryChannelRedis:
+		return publishToRedis(ctx, event)
+	}
+	return fmt.Errorf("unknown delivery channel %q", event.Channel)
+}
+
+// deliveryHeaders adds the idempotency headers of an attempt to the extra
+// headers of a destination. Retries of an event keep its X-Delivery-ID so
+// receivers can drop deliveries they already processed.
+func deliveryHeaders(extra map[string]string, events ...*DeliveryEvent) map[string]string {
+	headers := make(map[string]string, len(extra)+2)
+	for name, value := range extra {
+		headers[name] = value
+	}
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	headers["X-Delivery-ID"] = strings.Join(ids, ",")
+	headers["X-Attempt"] = strconv.Itoa(events[0].Attempts + 1)
+	return headers
+}
+
+// tokenHash is the SHA-256 of a user token in hex, so brokers can tell the
+// instances apart without seeing their tokens
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// complete records the outcome of an attempt. The status change and the
+// history entry are written in one transaction so a restart never sees a half
+// updated event.
+func (m *DeliveryManager) complete(event *DeliveryEvent, deliveryErr error, latency time.Duration) {
+	policy := m.Policy(event.UserID)
+
+	m.mu.Lock()
+	event.Attempts++
+	event.UpdatedAt = time.Now().Unix()
+	switch {
+	case deliveryErr == nil:
+		event.Status = DeliveryStatusDelivered
+		event.LastError = ""
+	case event.Attempts >= policy.MaxRetries:
+		event.Status = DeliveryStatusFailed
+		event.LastError = deliveryErr.Error()
+	default:
+		event.LastError = deliveryErr.Error()
+		event.NextAttemptAt = time.Now().Add(policy.backoff(event.Attempts)).Unix()
+	}
+	// Finished events stay in flight until their row is updated, so refill
+	// can't load them again
+	if event.Status == DeliveryStatusPending {
+		event.inFlight = false
+	}
+	db := m.db
+	snapshot := *event
+	m.mu.Unlock()
+
+	switch snapshot.Status {
+	case DeliveryStatusDelivered:
+		recordDeliveryAttempt(snapshot.UserID, snapshot.Channel, deliveryOutcomeDelivered)
+		log.Debug().Str("userID", snapshot.UserID).Str("channel", snapshot.Channel).Str("destination", snapshot.Destination).Msg("Event delivered")
+	case DeliveryStatusFailed:
+		recordDeliveryAttempt(snapshot.UserID, snapshot.Channel, deliveryOutcomeFailed)
+		log.Error().Err(deliveryErr).Str("userID", snapshot.UserID).Str("channel", snapshot.Channel).Str("destination", snapshot.Destination).Int("attempts", snapshot.Attempts).Msg("Event delivery failed, giving up")
+	default:
+		recordDeliveryAttempt(snapshot.UserID, snapshot.Channel, deliveryOutcomeRetry)
+		log.Warn().Err(deliveryErr).Str("userID", snapshot.UserID).Str("channel", snapshot.Channel).Int("attempt", snapshot.Attempts).Msg("Event delivery failed, retrying")
+	}
+
+	if db != nil {
+		if err := m.persistOutcome(db, &snapshot, latency); err != nil {
+			log.Error().Err(err).Str("deliveryID", snapshot.ID).Msg("Failed to record delivery outcome")
+		}
+	}
+
+	if snapshot.Status != DeliveryStatusPending {
+		m.mu.Lock()
+		delete(m.pendingEvents, snapshot.ID)
+		m.mu.Unlock()
+	}
+}
+
+// persistOutcome writes the status of an attempt and adds it to the history
+func (m *DeliveryManager) persistOutcome(db *sqlx.DB, event *DeliveryEvent, latency time.Duration) error {
+	result, err := newDeliveryResult(event, latency)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE delivery_events SET status = $1, attempts = $2, last_error = $3,
+		next_attempt_at = $4, updated_at = $5 WHERE id = $6 AND status = $7`,
+		event.Status, event.Attempts, event.LastError, event.NextAttemptAt, event.UpdatedAt,
+		event.ID, DeliveryStatusPending)
+	if err != nil {
+		return err
+	}
+	if err := insertDeliveryResult(tx, result); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// prune removes finished deliveries and history older than deliveryRetention,
+// and idle rate limiter buckets
+func (m *DeliveryManager) prune() {
+	m.mu.Lock()
+	m.pruneBucketsLocked(time.Now())
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-deliveryRetention).Unix()
+	_, err := db.Exec("DELETE FROM delivery_events WHERE status != $1 AND updated_at < $2", DeliveryStatusPending, cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to prune delivery events")
+	}
+	// Payloads are kept as long as an event refers to them, and for the
+	// retention after they were last used so a new event can't lose its own
+	_, err = db.Exec(`DELETE FROM delivery_payloads WHERE updated_at < $1 AND NOT EXISTS
+		(SELECT 1 FROM delivery_events WHERE delivery_events.payload_id = delivery_payloads.id)`, cutoff)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to prune delivery payloads")
+	}
+	if _, err := db.Exec("DELETE FROM delivery_results WHERE created_at < $1", cutoff); err != nil {
+		log.Error().Err(err).Msg("Failed to prune delivery history")
+	}
+}
+
+// userToken returns the current token of a user, from its session or from
+// the database for events resumed after a restart
+func (m *DeliveryManager) userToken(userID string) string {
+	if mycli := clientManager.GetMyClient(userID); mycli != nil && mycli.token != "" {
+		return mycli.token
+	}
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return ""
+	}
+	var token string
+	if err := db.Get(&token, "SELECT token FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to look up the token of a delivery")
+	}
+	return token
+}
+
+// instanceName returns the name of the instance a token belongs to
+func instanceName(token string) string {
+	if userinfo, found := userinfocache.Get(token); found {
+		return userinfo.(Values).Get("Name")
+	}
+	return ""
+}
+
+// webhookHTTPClient returns the HTTP client of a user, or a default one when
+// the user isn't connected, e.g. for events resumed after a restart
+func webhookHTTPClient(userID string) *resty.Client {
+	if client := clientManager.GetHTTPClient(userID); client != nil {
+		return client
+	}
+	return defaultWebhookClient
+}
+
+var defaultWebhookClient = resty.New().
+	SetTimeout(deliveryTimeout).
+	SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
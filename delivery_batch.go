@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// sendBatch posts several events of one user to the user webhook in a single
+// request. jsonData holds the event payloads as a JSON array, oldest first,
+// and X-Delivery-ID their IDs in the same order. With EVENT_FORMAT=cloudevents
+// the array is a CloudEvents batch.
+// Webhook actions are not run for batches since the response can't be tied to
+// one event.
+func (m *DeliveryManager) sendBatch(ctx context.Context, batch []*DeliveryEvent) error {
+	payloads := make([]json.RawMessage, 0, len(batch))
+	for _, event := range batch {
+		payloads = append(payloads, json.RawMessage(formatPayload(event)))
+	}
+	jsonData, err := json.Marshal(payloads)
+	if err != nil {
+		return err
+	}
+
+	first := batch[0]
+	data := map[string]string{
+		"jsonData":     string(jsonData),
+		"token":        first.Token,
+		"instanceName": instanceName(first.Token),
+	}
+	destination, failover := m.webhookTarget(first.UserID, first.Destination)
+	_, err = postWebhook(ctx, userWebhookClient(first.UserID), destination, data, deliveryHeaders(m.WebhookHeaders(first.UserID), batch...))
+	m.webhookResult(first, failover, err)
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+// Payload compression of the broker channels, configured with
+// DELIVERY_COMPRESSION as channel=encoding pairs such as
+// "rabbitmq=gzip,kafka=zstd". Payloads smaller than
+// DELIVERY_COMPRESSION_MIN_SIZE bytes are always sent as they are.
+const (
+	PayloadEncodingGzip = "gzip"
+	PayloadEncodingZstd = "zstd"
+
+	defaultDeliveryCompressionMinSize = 1024
+)
+
+// compressibleChannels are the channels that can carry compressed payloads.
+// Webhooks post form fields, so they are left out.
+var compressibleChannels = map[string]bool{
+	DeliveryChannelRabbitMQ:     true,
+	DeliveryChannelUserRabbitMQ: true,
+	DeliveryChannelKafka:        true,
+	DeliveryChannelNATS:         true,
+	DeliveryChannelUserNATS:     true,
+	DeliveryChannelSQS:          true,
+	DeliveryChannelSNS:          true,
+	DeliveryChannelPubSub:       true,
+	DeliveryChannelRedis:        true,
+}
+
+var (
+	deliveryCompressionOnce    sync.Once
+	deliveryCompression        map[string]string
+	deliveryCompressionMinSize int
+)
+
+// parseDeliveryCompression decodes DELIVERY_COMPRESSION into the encoding of
+// each channel. Invalid entries are left out and reported in the error, the
+// valid ones are returned either way.
+func parseDeliveryCompression(value string) (map[string]string, error) {
+	encodings := make(map[string]string)
+	var errs []error
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		channel, encoding, ok := strings.Cut(entry, "=")
+		channel = strings.TrimSpace(channel)
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if !ok {
+			errs = append(errs, fmt.Errorf("invalid entry %q, expected <channel>=<encoding>", entry))
+			continue
+		}
+		if channel == DeliveryChannelWebhook || channel == DeliveryChannelGlobalWebhook {
+			errs = append(errs, fmt.Errorf("invalid entry %q, webhooks post form fields and are never compressed", entry))
+			continue
+		}
+		if !compressibleChannels[channel] {
+			errs = append(errs, fmt.Errorf("invalid entry %q, unknown broker channel %q", entry, channel))
+			continue
+		}
+		switch encoding {
+		case PayloadEncodingGzip, PayloadEncodingZstd:
+			encodings[channel] = encoding
+		case "none":
+		default:
+			errs = append(errs, fmt.Errorf("invalid entry %q, unknown encoding %q", entry, encoding))
+		}
+	}
+	return encodings, errors.Join(errs...)
+}
+
+// loadDeliveryCompression reads the compression settings once. Invalid
+// entries are logged and skipped, the other channels keep their encoding.
+func loadDeliveryCompression() {
+	deliveryCompressionOnce.Do(func() {
+		encodings, err := parseDeliveryCompression(os.Getenv("DELIVERY_COMPRESSION"))
+		if err != nil {
+			log.Error().Err(err).Msg("Ignoring invalid DELIVERY_COMPRESSION entries, their channels are sent uncompressed")
+		}
+		deliveryCompression = encodings
+		deliveryCompressionMinSize = envInt("DELIVERY_COMPRESSION_MIN_SIZE", defaultDeliveryCompressionMinSize)
+		for channel, encoding := range encodings {
+			log.Info().Str("channel", channel).Str("encoding", encoding).Msg("Delivery payload compression enabled")
+		}
+	})
+}
+
+// encodePayload returns the payload of an event as it is published, in the
+// configured format and encoding, with its Content-Encoding, empty when the
+// payload is not compressed
+func encodePayload(event *DeliveryEvent) ([]byte, string, error) {
+	loadDeliveryCompression()
+	var payload []byte
+	if protobufChannel(event.Channel) {
+		var err error
+		if payload, err = marshalEventProto(event); err != nil {
+			return nil, "", err
+		}
+	} else {
+		payload = []byte(formatPayload(event))
+	}
+	encoding := deliveryCompression[event.Channel]
+	if encoding == "" || len(payload) < deliveryCompressionMinSize {
+		return payload, "", nil
+	}
+
+	compressed, err := compressPayload(encoding, payload)
+	if err != nil {
+		return nil, "", err
+	}
+	return compressed, encoding, nil
+}
+
+// zstdEncoder compresses zstd payloads, EncodeAll is safe to use from several
+// goroutines
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// compressPayload compresses a payload with one of the payload encodings
+func compressPayload(encoding string, payload []byte) ([]byte, error) {
+	switch encoding {
+	case PayloadEncodingGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case PayloadEncodingZstd:
+		return zstdEncoder.EncodeAll(payload, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown payload encoding %q", encoding)
+	}
+}
+
+// payloadDecoding is the payloadDecoding header sent next to Content-Encoding.
+// It names the encoding and tells consumers how to get the payload back,
+// base64 is set when the compressed body was base64 encoded as well.
+func payloadDecoding(event *DeliveryEvent, encoding string, base64 bool) string {
+	codec := "gzip (RFC 1952)"
+	if encoding == PayloadEncodingZstd {
+		codec = "Zstandard (RFC 8878)"
+	}
+	steps := "decompress the body with " + codec
+	if base64 {
+		steps = "base64 decode the body, then decompress it with " + codec
+	}
+	return fmt.Sprintf("%s; %s to get the %s payload", encoding, steps, payloadContentType(event))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestParseDeliveryCompression(t *testing.T) {
+	encodings, err := parseDeliveryCompression("rabbitmq=gzip, kafka=zstd, nats=none, webhook=gzip, redis=brotli")
+	if err == nil {
+		t.Error("parseDeliveryCompression() error = nil, want the webhook and brotli entries reported")
+	}
+	want := map[string]string{DeliveryChannelRabbitMQ: PayloadEncodingGzip, DeliveryChannelKafka: PayloadEncodingZstd}
+	if len(encodings) != len(want) {
+		t.Fatalf("parseDeliveryCompression() = %v, want %v", encodings, want)
+	}
+	for channel, encoding := range want {
+		if encodings[channel] != encoding {
+			t.Errorf("encodings[%q] = %q, want %q", channel, encodings[channel], encoding)
+		}
+	}
+}
+
+func TestCompressPayloadRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"type":"Message","event":{"Info":{"Chat":"5491155553934@s.whatsapp.net"}}}`, 100))
+
+	for _, encoding := range []string{PayloadEncodingGzip, PayloadEncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			compressed, err := compressPayload(encoding, payload)
+			if err != nil {
+				t.Fatalf("compressPayload: %v", err)
+			}
+			if len(compressed) >= len(payload) {
+				t.Errorf("compressed %d bytes into %d", len(payload), len(compressed))
+			}
+
+			var r io.Reader
+			switch encoding {
+			case PayloadEncodingGzip:
+				zr, err := gzip.NewReader(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				r = zr
+			case PayloadEncodingZstd:
+				zr, err := zstd.NewReader(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatalf("zstd.NewReader: %v", err)
+				}
+				defer zr.Close()
+				r = zr
+			}
+			decoded, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+			if !bytes.Equal(decoded, payload) {
+				t.Error("decompressed payload differs from the original")
+			}
+		})
+	}
+}
+
+func TestPayloadDecoding(t *testing.T) {
+	event := &DeliveryEvent{Channel: DeliveryChannelSQS}
+	got := payloadDecoding(event, PayloadEncodingZstd, true)
+	if !strings.HasPrefix(got, "zstd; base64 decode the body, then decompress it with Zstandard") {
+		t.Errorf("payloadDecoding() = %q", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultDeliveryDedupTTL = 5 * time.Minute
+
+var deliveryDuplicatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "wuzapi_delivery_duplicates_suppressed_total",
+	Help: "Events dropped because the same event about the same message was seen within the dedup window.",
+}, []string{"event_type"})
+
+func init() {
+	metricsRegistry.MustRegister(deliveryDuplicatesTotal)
+}
+
+// deliveryDedupTTL reads DELIVERY_DEDUP_TTL (a Go duration such as 10m), how
+// long an event is remembered. Zero or "off" disables deduplication.
+func deliveryDedupTTL() time.Duration {
+	v := strings.TrimSpace(os.Getenv("DELIVERY_DEDUP_TTL"))
+	if v == "" {
+		return defaultDeliveryDedupTTL
+	}
+	if v == "off" || v == "0" {
+		return 0
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		log.Warn().Str("value", v).Msg("Invalid DELIVERY_DEDUP_TTL, using default")
+		return defaultDeliveryDedupTTL
+	}
+	return ttl
+}
+
+// Duplicate reports whether the same event about the same message was seen
+// within the dedup window, so it can be dropped before any channel gets it.
+// Events without a message ID are never duplicates.
+func (m *DeliveryManager) Duplicate(userID, messageID, eventType string) bool {
+	if messageID == "" {
+		return false
+	}
+	m.dedupOnce.Do(func() {
+		if ttl := deliveryDedupTTL(); ttl > 0 {
+			m.dedup = cache.New(ttl, 2*ttl)
+		}
+	})
+	if m.dedup == nil {
+		return false
+	}
+
+	key := userID + "|" + eventType + "|" + messageID
+	if err := m.dedup.Add(key, struct{}{}, cache.DefaultExpiration); err == nil {
+		return false
+	}
+
+	deliveryDuplicatesTotal.WithLabelValues(eventType).Inc()
+	log.Debug().Str("userID", userID).Str("messageID", messageID).Str("eventType", eventType).Msg("Duplicate event suppressed")
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Event formats, set with EVENT_FORMAT
+const (
+	// EventFormatNative sends the event JSON as it is
+	EventFormatNative = "native"
+	// EventFormatCloudEvents wraps the event JSON in a CloudEvents 1.0
+	// envelope, in structured mode
+	EventFormatCloudEvents = "cloudevents"
+)
+
+var (
+	eventFormatOnce sync.Once
+	eventFormat     string
+)
+
+// CloudEvent is the JSON envelope of the cloudevents format
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// currentEventFormat reads EVENT_FORMAT once, native when unset or invalid
+func currentEventFormat() string {
+	eventFormatOnce.Do(func() {
+		eventFormat = strings.ToLower(strings.TrimSpace(os.Getenv("EVENT_FORMAT")))
+		switch eventFormat {
+		case "":
+			eventFormat = EventFormatNative
+		case EventFormatNative, EventFormatCloudEvents:
+		default:
+			log.Warn().Str("value", eventFormat).Msg("Invalid EVENT_FORMAT, using native")
+			eventFormat = EventFormatNative
+		}
+	})
+	return eventFormat
+}
+
+// payloadContentType is the content type of the payload of an event sent to
+// a broker
+func payloadContentType(event *DeliveryEvent) string {
+	if protobufChannel(event.Channel) {
+		return protobufContentType
+	}
+	if currentEventFormat() == EventFormatCloudEvents {
+		return "application/cloudevents+json"
+	}
+	return "application/json"
+}
+
+// formatPayload returns the payload of an event in the configured format.
+// The CloudEvents ID is the delivery ID and the time its creation time, set
+// by Enqueue and stored with the event, so retries keep both. The source is
+// the instance and the subject the chat of the event.
+func formatPayload(event *DeliveryEvent) string {
+	if currentEventFormat() != EventFormatCloudEvents {
+		return event.Payload
+	}
+	envelope, err := json.Marshal(CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              event.ID,
+		Source:          "/wuzapi/instances/" + event.UserID,
+		Type:            "wuzapi.event." + event.EventType,
+		Subject:         eventChatJID(event.Payload),
+		Time:            time.Unix(event.CreatedAt, 0).UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		Data:            json.RawMessage(event.Payload),
+	})
+	if err != nil {
+		// Not valid JSON, which the envelope can't carry either
+		log.Warn().Err(err).Str("id", event.ID).Msg("Could not wrap event in a CloudEvent, sending it as it is")
+		return event.Payload
+	}
+	return string(envelope)
+}
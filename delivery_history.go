@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultDeliveryHistoryLimit = 50
+	maxDeliveryHistoryLimit     = 500
+)
+
+// DeliveryResult is the outcome of one delivery attempt, kept in the
+// delivery_results table as an audit log
+type DeliveryResult struct {
+	ID          string `db:"id" json:"id"`
+	DeliveryID  string `db:"delivery_id" json:"delivery_id"`
+	UserID      string `db:"user_id" json:"user_id"`
+	Channel     string `db:"channel" json:"channel"`
+	Destination string `db:"destination" json:"destination"`
+	EventType   string `db:"event_type" json:"event_type"`
+	// Status is delivered, retrying or failed
+	Status    string `db:"status" json:"status"`
+	Attempt   int    `db:"attempt" json:"attempt"`
+	LatencyMs int64  `db:"latency_ms" json:"latency_ms"`
+	Error     string `db:"error" json:"error,omitempty"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+const deliveryResultColumns = `id, delivery_id, user_id, channel, destination, event_type,
+	status, attempt, latency_ms, error, created_at`
+
+// DeliveryHistoryFilter selects delivery results. Empty fields match everything.
+type DeliveryHistoryFilter struct {
+	UserID    string
+	EventType string
+	Channel   string
+	Status    string
+	From      time.Time
+	To        time.Time
+	Limit     int
+	Offset    int
+}
+
+// newDeliveryResult describes the attempt that brought event to its current state
+func newDeliveryResult(event *DeliveryEvent, latency time.Duration) (*DeliveryResult, error) {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return nil, err
+	}
+	status := event.Status
+	if status == DeliveryStatusPending {
+		status = DeliveryStatusRetrying
+	}
+	return &DeliveryResult{
+		ID:          id,
+		DeliveryID:  event.ID,
+		UserID:      event.UserID,
+		Channel:     event.Channel,
+		Destination: event.Destination,
+		EventType:   event.EventType,
+		Status:      status,
+		Attempt:     event.Attempts,
+		LatencyMs:   latency.Milliseconds(),
+		Error:       event.LastError,
+		CreatedAt:   event.UpdatedAt,
+	}, nil
+}
+
+// insertDeliveryResult adds a result to the audit log
+func insertDeliveryResult(tx *sqlx.Tx, result *DeliveryResult) error {
+	_, err := tx.NamedExec(`INSERT INTO delivery_results (`+deliveryResultColumns+`)
+		VALUES (:id, :delivery_id, :user_id, :channel, :destination, :event_type,
+		:status, :attempt, :latency_ms, :error, :created_at)`, result)
+	return err
+}
+
+// validate normalizes the filter and applies the page size limits
+func (f *DeliveryHistoryFilter) validate() error {
+	if f.Channel != "" && !knownDeliveryChannel(f.Channel) {
+		return fmt.Errorf("unknown delivery channel %q", f.Channel)
+	}
+	switch f.Status {
+	case "", DeliveryStatusDelivered, DeliveryStatusRetrying, DeliveryStatusFailed:
+	default:
+		return errors.New("status must be 'delivered', 'retrying' or 'failed'")
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && f.To.Before(f.From) {
+		return errors.New("to must not be before from")
+	}
+	if f.Limit < 0 || f.Offset < 0 {
+		return errors.New("limit and offset must not be negative")
+	}
+	if f.Limit == 0 {
+		f.Limit = defaultDeliveryHistoryLimit
+	}
+	if f.Limit > maxDeliveryHistoryLimit {
+		f.Limit = maxDeliveryHistoryLimit
+	}
+	return nil
+}
+
+// History returns a page of delivery results, newest first, and the number of
+// results matching the filter
+func (m *DeliveryManager) History(filter DeliveryHistoryFilter) ([]DeliveryResult, int, error) {
+	if err := filter.validate(); err != nil {
+		return nil, 0, err
+	}
+
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return nil, 0, errors.New("delivery manager not initialized")
+	}
+
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.UserID != "" {
+		add("user_id = $%d", filter.UserID)
+	}
+	if filter.EventType != "" {
+		add("event_type = $%d", filter.EventType)
+	}
+	if filter.Channel != "" {
+		add("channel = $%d", filter.Channel)
+	}
+	if filter.Status != "" {
+		add("status = $%d", filter.Status)
+	}
+	if !filter.From.IsZero() {
+		add("created_at >= $%d", filter.From.Unix())
+	}
+	if !filter.To.IsZero() {
+		add("created_at < $%d", filter.To.Unix())
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.Get(&total, "SELECT COUNT(*) FROM delivery_results"+where, args...); err != nil {
+		return nil, 0, fmt.Errorf("failed to count delivery results: %w", err)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM delivery_results%s ORDER BY created_at DESC, id LIMIT $%d OFFSET $%d",
+		deliveryResultColumns, where, len(args)+1, len(args)+2)
+	results := []DeliveryResult{}
+	if err := db.Select(&results, query, append(args, filter.Limit, filter.Offset)...); err != nil {
+		return nil, 0, fmt.Errorf("failed to get delivery results: %w", err)
+	}
+	return results, total, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Backoff strategies between delivery attempts
+const (
+	BackoffExponential = "exponential"
+	BackoffFixed       = "fixed"
+)
+
+const (
+	maxDeliveryRetries        = 50
+	maxDeliveryTimeoutSeconds = 300
+	maxDeliveryBackoffSeconds = 24 * 3600
+	maxDeliveryBatchSize      = 500
+	maxDeliveryBatchWaitMs    = 60000
+	defaultDeliveryBatchWait  = time.Second
+)
+
+// DeliveryPolicy tunes how the events of a user are delivered, stored as
+// JSON in the delivery_policy column. Zero values fall back to the defaults.
+type DeliveryPolicy struct {
+	// MaxRetries is the number of attempts before an event is marked failed
+	MaxRetries int `json:"max_retries"`
+	// TimeoutSeconds bounds a single attempt
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// Backoff is "exponential" or "fixed"
+	Backoff string `json:"backoff"`
+	// BackoffSeconds is the delay after the first failed attempt
+	BackoffSeconds int `json:"backoff_seconds"`
+	// MaxBackoffSeconds caps exponential delays
+	MaxBackoffSeconds int `json:"max_backoff_seconds"`
+	// Channels disables delivery channels by setting them to false, channels
+	// not listed stay enabled
+	Channels map[string]bool `json:"channels,omitempty"`
+	// BatchSize sends up to this many user webhook events in one request,
+	// 0 or 1 sends every event on its own
+	BatchSize int `json:"batch_size,omitempty"`
+	// BatchWaitMs is how long an incomplete batch waits for more events
+	BatchWaitMs int `json:"batch_wait_ms,omitempty"`
+	// Window restricts deliveries to some hours of the day
+	Window *DeliveryWindow `json:"window,omitempty"`
+}
+
+// defaultDeliveryPolicy is used for users without a policy of their own
+func defaultDeliveryPolicy() *DeliveryPolicy {
+	return &DeliveryPolicy{
+		MaxRetries:        deliveryMaxRetries,
+		TimeoutSeconds:    int(deliveryTimeout / time.Second),
+		Backoff:           BackoffExponential,
+		BackoffSeconds:    int(deliveryRetryBaseDelay / time.Second),
+		MaxBackoffSeconds: int(deliveryMaxRetryDelay / time.Second),
+	}
+}
+
+// parseDeliveryPolicy decodes the delivery_policy column, filling the defaults
+func parseDeliveryPolicy(raw string) (*DeliveryPolicy, error) {
+	policy := defaultDeliveryPolicy()
+	if raw == "" {
+		return policy, nil
+	}
+	if err := json.Unmarshal([]byte(raw), policy); err != nil {
+		return defaultDeliveryPolicy(), fmt.Errorf("invalid delivery policy: %w", err)
+	}
+	if err := policy.validate(); err != nil {
+		return defaultDeliveryPolicy(), err
+	}
+	return policy, nil
+}
+
+// encode returns the JSON stored in the delivery_policy column
+func (p *DeliveryPolicy) encode() (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate checks the policy and fills unset fields with the defaults
+func (p *DeliveryPolicy) validate() error {
+	defaults := defaultDeliveryPolicy()
+	if p.MaxRetries == 0 {
+		p.MaxRetries = defaults.MaxRetries
+	}
+	if p.TimeoutSeconds == 0 {
+		p.TimeoutSeconds = defaults.TimeoutSeconds
+	}
+	if p.BackoffSeconds == 0 {
+		p.BackoffSeconds = defaults.BackoffSeconds
+	}
+	if p.MaxBackoffSeconds == 0 {
+		p.MaxBackoffSeconds = defaults.MaxBackoffSeconds
+	}
+
+	p.Backoff = strings.ToLower(strings.TrimSpace(p.Backoff))
+	if p.Backoff == "" {
+		p.Backoff = defaults.Backoff
+	}
+	if p.Backoff != BackoffExponential && p.Backoff != BackoffFixed {
+		return errors.New("backoff must be 'exponential' or 'fixed'")
+	}
+
+	if p.MaxRetries < 1 || p.MaxRetries > maxDeliveryRetries {
+		return fmt.Errorf("max_retries must be between 1 and %d", maxDeliveryRetries)
+	}
+	if p.TimeoutSeconds < 1 || p.TimeoutSeconds > maxDeliveryTimeoutSeconds {
+		return fmt.Errorf("timeout_seconds must be between 1 and %d", maxDeliveryTimeoutSeconds)
+	}
+	if p.BackoffSeconds < 1 || p.BackoffSeconds > maxDeliveryBackoffSeconds {
+		return fmt.Errorf("backoff_seconds must be between 1 and %d", maxDeliveryBackoffSeconds)
+	}
+	if p.MaxBackoffSeconds < p.BackoffSeconds || p.MaxBackoffSeconds > maxDeliveryBackoffSeconds {
+		return fmt.Errorf("max_backoff_seconds must be between backoff_seconds and %d", maxDeliveryBackoffSeconds)
+	}
+
+	for channel := range p.Channels {
+		if !knownDeliveryChannel(channel) {
+			return fmt.Errorf("unknown delivery channel %q", channel)
+		}
+	}
+
+	if p.BatchSize < 0 || p.BatchSize > maxDeliveryBatchSize {
+		return fmt.Errorf("batch_size must be between 0 and %d", maxDeliveryBatchSize)
+	}
+	if p.BatchWaitMs < 0 || p.BatchWaitMs > maxDeliveryBatchWaitMs {
+		return fmt.Errorf("batch_wait_ms must be between 0 and %d", maxDeliveryBatchWaitMs)
+	}
+	if p.Window != nil {
+		return p.Window.validate()
+	}
+	return nil
+}
+
+// channelEnabled reports whether events may be delivered to a channel
+func (p *DeliveryPolicy) channelEnabled(channel string) bool {
+	enabled, ok := p.Channels[channel]
+	return !ok || enabled
+}
+
+func (p *DeliveryPolicy) timeout() time.Duration {
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
+// waiting reports whether an event is held back by the delivery window
+func (p *DeliveryPolicy) waiting(event *DeliveryEvent, now time.Time) bool {
+	return p.Window != nil && p.Window.applies(event.Channel) && !p.Window.open(now)
+}
+
+// batching reports whether an event is sent in a batch. Only first attempts
+// to the user webhook are batched, retries go out on their own.
+func (p *DeliveryPolicy) batching(event *DeliveryEvent) bool {
+	return p.BatchSize > 1 && event.Channel == DeliveryChannelWebhook && event.Attempts == 0
+}
+
+func (p *DeliveryPolicy) batchWait() time.Duration {
+	if p.BatchWaitMs <= 0 {
+		return defaultDeliveryBatchWait
+	}
+	return time.Duration(p.BatchWaitMs) * time.Millisecond
+}
+
+// backoff returns the delay before the next attempt
+func (p *DeliveryPolicy) backoff(attempts int) time.Duration {
+	base := time.Duration(p.BackoffSeconds) * time.Second
+	if p.Backoff == BackoffFixed {
+		return base
+	}
+	limit := time.Duration(p.MaxBackoffSeconds) * time.Second
+	delay := base << (attempts - 1)
+	if delay <= 0 || delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// Policy returns the delivery policy of a user, loading it on first use
+func (m *DeliveryManager) Policy(userID string) *DeliveryPolicy {
+	m.mu.Lock()
+	policy, ok := m.policies[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok {
+		return policy
+	}
+	if db == nil {
+		return defaultDeliveryPolicy()
+	}
+
+	var raw string
+	if err := db.Get(&raw, "SELECT delivery_policy FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load delivery policy, using defaults")
+		return defaultDeliveryPolicy()
+	}
+	policy, err := parseDeliveryPolicy(raw)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Ignoring delivery policy")
+	}
+
+	m.mu.Lock()
+	m.policies[userID] = policy
+	m.mu.Unlock()
+	return policy
+}
+
+// SetPolicy stores the delivery policy of a user, nil restores the defaults
+func (m *DeliveryManager) SetPolicy(userID string, policy *DeliveryPolicy) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw := ""
+	if policy != nil {
+		var err error
+		if raw, err = policy.encode(); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec("UPDATE users SET delivery_policy = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.policies, userID)
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Delivery worker pool, tunable with DELIVERY_WORKERS, DELIVERY_QUEUE_SIZE and
+// DELIVERY_MEMORY_LIMIT
+const (
+	defaultDeliveryWorkers     = 16
+	defaultDeliveryQueueSize   = 1000
+	defaultDeliveryMemoryLimit = 10000
+)
+
+// deliveryPoolStats are the backpressure counters of the worker pool
+type deliveryPoolStats struct {
+	busyWorkers  atomic.Int64
+	queueFull    atomic.Int64
+	spilledTotal atomic.Int64
+}
+
+func init() {
+	m := GetDeliveryManager()
+	metricsRegistry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "wuzapi_delivery_workers",
+			Help: "Delivery workers.",
+		}, func() float64 {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return float64(m.workers)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "wuzapi_delivery_busy_workers",
+			Help: "Delivery workers sending an event.",
+		}, func() float64 { return float64(m.stats.busyWorkers.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "wuzapi_delivery_queue_length",
+			Help: "Requests waiting for a free delivery worker.",
+		}, func() float64 {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return float64(len(m.queue))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "wuzapi_delivery_queue_capacity",
+			Help: "Size of the delivery worker queue.",
+		}, func() float64 {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return float64(cap(m.queue))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "wuzapi_delivery_queue_full_total",
+			Help: "Dispatch rounds cut short because the delivery queue was full.",
+		}, func() float64 { return float64(m.stats.queueFull.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "wuzapi_delivery_pending_events",
+			Help: "Pending deliveries held in memory.",
+		}, func() float64 {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return float64(len(m.pendingEvents))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "wuzapi_delivery_spilled",
+			Help: "1 while pending deliveries are held in the database because the memory limit was reached.",
+		}, func() float64 {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.spilled {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "wuzapi_delivery_spilled_events_total",
+			Help: "Events left in the database because the memory limit was reached.",
+		}, func() float64 { return float64(m.stats.spilledTotal.Load()) }),
+	)
+}
+
+// startWorkers creates the dispatch queue and the workers draining it
+func (m *DeliveryManager) startWorkers() {
+	workers := envInt("DELIVERY_WORKERS", defaultDeliveryWorkers)
+	queue := make(chan []*DeliveryEvent, envInt("DELIVERY_QUEUE_SIZE", defaultDeliveryQueueSize))
+
+	m.mu.Lock()
+	m.workers = workers
+	m.queue = queue
+	m.mu.Unlock()
+
+	m.running.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.worker(queue)
+	}
+	log.Info().Int("workers", workers).Int("queue", cap(queue)).Msg("Delivery workers started")
+}
+
+func (m *DeliveryManager) worker(queue <-chan []*DeliveryEvent) {
+	defer m.running.Done()
+	for request := range queue {
+		// Requests still queued at shutdown are left for the next start
+		if m.release(request) {
+			continue
+		}
+		m.stats.busyWorkers.Add(1)
+		m.deliver(request)
+		m.stats.busyWorkers.Add(-1)
+		// Events left behind by a full queue are dispatched as soon as it drains
+		if len(queue) == 0 {
+			m.notify()
+		}
+	}
+}
+
+// dispatch hands due requests to the workers. When the queue is full the
+// rest stay pending and are picked up on a later tick.
+func (m *DeliveryManager) dispatch(queue chan<- []*DeliveryEvent, due [][]*DeliveryEvent) {
+	for i, request := range due {
+		select {
+		case queue <- request:
+		default:
+			m.stats.queueFull.Add(1)
+			m.mu.Lock()
+			for _, skipped := range due[i:] {
+				for _, event := range skipped {
+					event.inFlight = false
+				}
+			}
+			m.mu.Unlock()
+			return
+		}
+	}
+}
+
+// spillLocked reports whether a new event should be left in the database
+// instead of memory, because the memory limit is reached or older events are
+// still waiting there. The caller must hold mu.
+func (m *DeliveryManager) spillLocked() bool {
+	if m.memoryLimit <= 0 || (!m.spilled && len(m.pendingEvents) < m.memoryLimit) {
+		return false
+	}
+	m.spilled = true
+	m.spillSeq++
+	m.stats.spilledTotal.Add(1)
+	return true
+}
+
+// refill loads the oldest pending events that were spilled to the database,
+// as far as the memory limit allows, and returns how many were loaded
+func (m *DeliveryManager) refill() (int, error) {
+	m.mu.Lock()
+	db := m.db
+	spilled := m.spilled
+	seq := m.spillSeq
+	limit := m.memoryLimit
+	room := limit - len(m.pendingEvents)
+	m.mu.Unlock()
+	if db == nil || !spilled || room <= 0 {
+		return 0, nil
+	}
+
+	// The events in memory are always the oldest pending ones, so the missing
+	// ones are found among the first memoryLimit rows
+	var ids []string
+	err := db.Select(&ids, "SELECT id FROM delivery_events WHERE status = $1 ORDER BY created_at, id LIMIT $2", DeliveryStatusPending, limit+1)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	var missing []string
+	for _, id := range ids {
+		if _, ok := m.pendingEvents[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	m.mu.Unlock()
+
+	drained := len(ids) <= limit && len(missing) <= room
+	if len(missing) > room {
+		missing = missing[:room]
+	}
+
+	var events []*DeliveryEvent
+	if len(missing) > 0 {
+		query, args, err := sqlx.In(deliveryEventSelect+" WHERE e.id IN (?) AND e.status = ?", missing, DeliveryStatusPending)
+		if err == nil {
+			err = db.Select(&events, db.Rebind(query), args...)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].CreatedAt != events[j].CreatedAt {
+			return events[i].CreatedAt < events[j].CreatedAt
+		}
+		return events[i].ID < events[j].ID
+	})
+
+	m.mu.Lock()
+	for _, event := range events {
+		if _, ok := m.pendingEvents[event.ID]; !ok {
+			event.persisted = true
+			m.addLocked(event)
+		}
+	}
+	// Events spilled while the rows were read are loaded on the next tick
+	if drained && seq == m.spillSeq {
+		m.spilled = false
+	}
+	m.mu.Unlock()
+	return len(events), nil
+}
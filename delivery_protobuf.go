@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+
+	"wuzapi/proto/eventsv1"
+)
+
+//go:generate protoc -I proto --go_out=. --go_opt=module=wuzapi events.proto
+
+// Event encodings, set with EVENT_ENCODING. Protobuf applies to RabbitMQ and
+// Kafka, the other channels always send JSON. The schema is proto/events.proto,
+// proto/eventsv1 holds the Go types generated from it.
+const (
+	EventEncodingJSON     = "json"
+	EventEncodingProtobuf = "protobuf"
+
+	protobufContentType = "application/x-protobuf; messageType=wuzapi.events.v1.Event"
+)
+
+var (
+	eventEncodingOnce sync.Once
+	eventEncoding     string
+)
+
+// protobufChannels are the channels that publish protobuf events
+var protobufChannels = map[string]bool{
+	DeliveryChannelRabbitMQ:     true,
+	DeliveryChannelUserRabbitMQ: true,
+	DeliveryChannelKafka:        true,
+}
+
+// protobufChannel reports whether events of a channel are sent as protobuf
+func protobufChannel(channel string) bool {
+	eventEncodingOnce.Do(func() {
+		eventEncoding = strings.ToLower(strings.TrimSpace(os.Getenv("EVENT_ENCODING")))
+		switch eventEncoding {
+		case "":
+			eventEncoding = EventEncodingJSON
+		case EventEncodingJSON, EventEncodingProtobuf:
+		default:
+			log.Warn().Str("value", eventEncoding).Msg("Invalid EVENT_ENCODING, using json")
+			eventEncoding = EventEncodingJSON
+		}
+	})
+	return eventEncoding == EventEncodingProtobuf && protobufChannels[channel]
+}
+
+// unixTime returns the seconds of a time, 0 for the zero time
+func unixTime(t time.Time) int64 {
+	if t.IsZero() || t.Unix() < 0 {
+		return 0
+	}
+	return t.Unix()
+}
+
+// protoSource is the message source shared by whatsmeow events
+type protoSource struct {
+	Chat     string
+	Sender   string
+	IsFromMe bool
+	IsGroup  bool
+}
+
+// protoPayload holds the fields of the JSON payload the schema carries
+type protoPayload struct {
+	Type     string          `json:"type"`
+	State    string          `json:"state"`
+	Base64   string          `json:"base64"`
+	MimeType string          `json:"mimeType"`
+	FileName string          `json:"fileName"`
+	Event    json.RawMessage `json:"event"`
+	S3       *struct {
+		URL      string `json:"url"`
+		Key      string `json:"key"`
+		Size     int64  `json:"size"`
+		MimeType string `json:"mimeType"`
+		FileName string `json:"fileName"`
+	} `json:"s3"`
+}
+
+// marshalEventProto encodes an event as a wuzapi.events.v1.Event
+func marshalEventProto(event *DeliveryEvent) ([]byte, error) {
+	var payload protoPayload
+	if err := json.Unmarshal([]byte(event.Payload), &payload); err != nil {
+		return nil, err
+	}
+
+	msg := &eventsv1.Event{
+		Id:           event.ID,
+		InstanceId:   event.UserID,
+		InstanceName: instanceName(event.Token),
+		Type:         event.EventType,
+		Timestamp:    event.CreatedAt,
+	}
+	switch event.EventType {
+	case "Message":
+		body, err := messageProto(&payload)
+		if err != nil {
+			return nil, err
+		}
+		msg.Body = &eventsv1.Event_Message{Message: body}
+	case "ReadReceipt":
+		body, err := receiptProto(&payload)
+		if err != nil {
+			return nil, err
+		}
+		msg.Body = &eventsv1.Event_Receipt{Receipt: body}
+	case "Presence":
+		body, err := presenceProto(&payload)
+		if err != nil {
+			return nil, err
+		}
+		msg.Body = &eventsv1.Event_Presence{Presence: body}
+	case "ChatPresence":
+		body, err := chatPresenceProto(&payload)
+		if err != nil {
+			return nil, err
+		}
+		msg.Body = &eventsv1.Event_ChatPresence{ChatPresence: body}
+	default:
+		msg.Json = []byte(event.Payload)
+	}
+	return proto.Marshal(msg)
+}
+
+func messageProto(payload *protoPayload) (*eventsv1.Message, error) {
+	var evt struct {
+		Info struct {
+			protoSource
+			ID        string
+			Type      string
+			PushName  string
+			Timestamp time.Time
+			MediaType string
+		}
+		Message struct {
+			Conversation        string `json:"conversation"`
+			ExtendedTextMessage struct {
+				Text string `json:"text"`
+			} `json:"extendedTextMessage"`
+			ImageMessage struct {
+				Caption string `json:"caption"`
+			} `json:"imageMessage"`
+			VideoMessage struct {
+				Caption string `json:"caption"`
+			} `json:"videoMessage"`
+			DocumentMessage struct {
+				Caption string `json:"caption"`
+			} `json:"documentMessage"`
+		}
+	}
+	if err := json.Unmarshal(payload.Event, &evt); err != nil {
+		return nil, err
+	}
+	text := evt.Message.Conversation
+	for _, v := range []string{
+		evt.Message.ExtendedTextMessage.Text,
+		evt.Message.ImageMessage.Caption,
+		evt.Message.VideoMessage.Caption,
+		evt.Message.DocumentMessage.Caption,
+	} {
+		if text == "" {
+			text = v
+		}
+	}
+
+	msg := &eventsv1.Message{
+		Id:        evt.Info.ID,
+		Chat:      evt.Info.Chat,
+		Sender:    evt.Info.Sender,
+		FromMe:    evt.Info.IsFromMe,
+		IsGroup:   evt.Info.IsGroup,
+		PushName:  evt.Info.PushName,
+		Timestamp: unixTime(evt.Info.Timestamp),
+		Type:      evt.Info.Type,
+		MediaType: evt.Info.MediaType,
+		Text:      text,
+	}
+
+	if payload.Base64 != "" || payload.S3 != nil {
+		media := &eventsv1.Media{
+			MimeType: payload.MimeType,
+			FileName: payload.FileName,
+		}
+		if payload.Base64 != "" {
+			// Sent as raw bytes, a third smaller than the base64
+			data, err := base64.StdEncoding.DecodeString(payload.Base64)
+			if err != nil {
+				return nil, err
+			}
+			media.Data = data
+		}
+		if payload.S3 != nil {
+			if media.MimeType == "" {
+				media.MimeType = payload.S3.MimeType
+			}
+			if media.FileName == "" {
+				media.FileName = payload.S3.FileName
+			}
+			media.Url = payload.S3.URL
+			media.Key = payload.S3.Key
+			media.Size = payload.S3.Size
+		}
+		msg.Media = media
+	}
+	return msg, nil
+}
+
+func receiptProto(payload *protoPayload) (*eventsv1.Receipt, error) {
+	var evt struct {
+		protoSource
+		MessageIDs []string
+		Type       string
+		Timestamp  time.Time
+	}
+	if err := json.Unmarshal(payload.Event, &evt); err != nil {
+		return nil, err
+	}
+	return &eventsv1.Receipt{
+		MessageIds: evt.MessageIDs,
+		Chat:       evt.Chat,
+		Sender:     evt.Sender,
+		IsGroup:    evt.IsGroup,
+		Type:       evt.Type,
+		State:      payload.State,
+		Timestamp:  unixTime(evt.Timestamp),
+	}, nil
+}
+
+func presenceProto(payload *protoPayload) (*eventsv1.Presence, error) {
+	var evt struct {
+		From        string
+		Unavailable bool
+		LastSeen    time.Time
+	}
+	if err := json.Unmarshal(payload.Event, &evt); err != nil {
+		return nil, err
+	}
+	return &eventsv1.Presence{
+		From:        evt.From,
+		Unavailable: evt.Unavailable,
+		LastSeen:    unixTime(evt.LastSeen),
+		State:       payload.State,
+	}, nil
+}
+
+func chatPresenceProto(payload *protoPayload) (*eventsv1.ChatPresence, error) {
+	var evt struct {
+		protoSource
+		State string
+		Media string
+	}
+	if err := json.Unmarshal(payload.Event, &evt); err != nil {
+		return nil, err
+	}
+	return &eventsv1.ChatPresence{
+		Chat:    evt.Chat,
+		Sender:  evt.Sender,
+		IsGroup: evt.IsGroup,
+		State:   evt.State,
+		Media:   evt.Media,
+	}, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/patrickmn/go-cache"
+	"google.golang.org/protobuf/proto"
+
+	"wuzapi/proto/eventsv1"
+)
+
+// decodeEventProto encodes an event and decodes it again with the types
+// generated from proto/events.proto
+func decodeEventProto(t *testing.T, event *DeliveryEvent) *eventsv1.Event {
+	t.Helper()
+	data, err := marshalEventProto(event)
+	if err != nil {
+		t.Fatalf("marshalEventProto: %v", err)
+	}
+	var decoded eventsv1.Event
+	if err := proto.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("proto.Unmarshal: %v", err)
+	}
+	return &decoded
+}
+
+func TestEventProtoMessage(t *testing.T) {
+	userinfocache.Set("proto-token", Values{m: map[string]string{"Name": "sales"}}, cache.NoExpiration)
+	defer userinfocache.Delete("proto-token")
+
+	media := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	event := &DeliveryEvent{
+		ID:        "delivery-1",
+		UserID:    "user-1",
+		Token:     "proto-token",
+		EventType: "Message",
+		CreatedAt: 1700000000,
+		Payload: `{"type":"Message","mimeType":"image/png","fileName":"photo.png","base64":"` + base64.StdEncoding.EncodeToString(media) + `",` +
+			`"event":{"Info":{"Chat":"123@g.us","Sender":"456@s.whatsapp.net","IsFromMe":true,"IsGroup":true,` +
+			`"ID":"3EB0ABC","Type":"media","PushName":"Ana","Timestamp":"2023-11-14T22:13:20Z","MediaType":"image"},` +
+			`"Message":{"imageMessage":{"caption":"look"}}}}`,
+	}
+
+	decoded := decodeEventProto(t, event)
+	if decoded.GetId() != "delivery-1" || decoded.GetInstanceId() != "user-1" || decoded.GetInstanceName() != "sales" ||
+		decoded.GetType() != "Message" || decoded.GetTimestamp() != 1700000000 {
+		t.Fatalf("unexpected envelope: %v", decoded)
+	}
+	if decoded.GetJson() != nil {
+		t.Errorf("json is set for a Message event")
+	}
+	msg := decoded.GetMessage()
+	if msg == nil {
+		t.Fatalf("message is not set: %v", decoded)
+	}
+	want := &eventsv1.Message{
+		Id:        "3EB0ABC",
+		Chat:      "123@g.us",
+		Sender:    "456@s.whatsapp.net",
+		FromMe:    true,
+		IsGroup:   true,
+		PushName:  "Ana",
+		Timestamp: 1700000000,
+		Type:      "media",
+		MediaType: "image",
+		Text:      "look",
+		Media: &eventsv1.Media{
+			MimeType: "image/png",
+			FileName: "photo.png",
+			Data:     media,
+		},
+	}
+	if !proto.Equal(msg, want) {
+		t.Errorf("message = %v, want %v", msg, want)
+	}
+}
+
+func TestEventProtoS3Media(t *testing.T) {
+	event := &DeliveryEvent{
+		ID:        "delivery-2",
+		UserID:    "user-1",
+		EventType: "Message",
+		Payload: `{"type":"Message","s3":{"url":"https://bucket.example/k","key":"k","size":42,"mimeType":"video/mp4","fileName":"v.mp4"},` +
+			`"event":{"Info":{"Chat":"1@s.whatsapp.net","ID":"X"},"Message":{}}}`,
+	}
+
+	media := decodeEventProto(t, event).GetMessage().GetMedia()
+	want := &eventsv1.Media{
+		MimeType: "video/mp4",
+		FileName: "v.mp4",
+		Url:      "https://bucket.example/k",
+		Key:      "k",
+		Size:     42,
+	}
+	if !proto.Equal(media, want) {
+		t.Errorf("media = %v, want %v", media, want)
+	}
+}
+
+func TestEventProtoReceiptAndPresence(t *testing.T) {
+	receipt := decodeEventProto(t, &DeliveryEvent{
+		EventType: "ReadReceipt",
+		Payload: `{"type":"ReadReceipt","state":"Read","event":{"Chat":"1@s.whatsapp.net","Sender":"2@s.whatsapp.net",` +
+			`"IsGroup":false,"MessageIDs":["A","B"],"Type":"read","Timestamp":"2023-11-14T22:13:20Z"}}`,
+	}).GetReceipt()
+	wantReceipt := &eventsv1.Receipt{
+		MessageIds: []string{"A", "B"},
+		Chat:       "1@s.whatsapp.net",
+		Sender:     "2@s.whatsapp.net",
+		Type:       "read",
+		State:      "Read",
+		Timestamp:  1700000000,
+	}
+	if !proto.Equal(receipt, wantReceipt) {
+		t.Errorf("receipt = %v, want %v", receipt, wantReceipt)
+	}
+
+	presence := decodeEventProto(t, &DeliveryEvent{
+		EventType: "Presence",
+		Payload:   `{"type":"Presence","state":"offline","event":{"From":"2@s.whatsapp.net","Unavailable":true,"LastSeen":"2023-11-14T22:13:20Z"}}`,
+	}).GetPresence()
+	wantPresence := &eventsv1.Presence{From: "2@s.whatsapp.net", Unavailable: true, LastSeen: 1700000000, State: "offline"}
+	if !proto.Equal(presence, wantPresence) {
+		t.Errorf("presence = %v, want %v", presence, wantPresence)
+	}
+
+	chatPresence := decodeEventProto(t, &DeliveryEvent{
+		EventType: "ChatPresence",
+		Payload:   `{"type":"ChatPresence","event":{"Chat":"1@g.us","Sender":"2@s.whatsapp.net","IsGroup":true,"State":"composing","Media":"audio"}}`,
+	}).GetChatPresence()
+	wantChatPresence := &eventsv1.ChatPresence{Chat: "1@g.us", Sender: "2@s.whatsapp.net", IsGroup: true, State: "composing", Media: "audio"}
+	if !proto.Equal(chatPresence, wantChatPresence) {
+		t.Errorf("chat presence = %v, want %v", chatPresence, wantChatPresence)
+	}
+}
+
+func TestEventProtoOtherTypes(t *testing.T) {
+	payload := `{"type":"Connected","event":{}}`
+	decoded := decodeEventProto(t, &DeliveryEvent{EventType: "Connected", Payload: payload})
+	if decoded.GetBody() != nil {
+		t.Errorf("body is set for a Connected event: %v", decoded.GetBody())
+	}
+	if !bytes.Equal(decoded.GetJson(), []byte(payload)) {
+		t.Errorf("json = %q, want %q", decoded.GetJson(), payload)
+	}
+}
+
+func TestEventProtoEmptyBody(t *testing.T) {
+	// The oneof is set even when every field of the body is empty, so
+	// consumers can switch on it
+	decoded := decodeEventProto(t, &DeliveryEvent{EventType: "ChatPresence", Payload: `{"event":{}}`})
+	if _, ok := decoded.GetBody().(*eventsv1.Event_ChatPresence); !ok {
+		t.Errorf("body = %T, want chat presence", decoded.GetBody())
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxDeliveryRate  = 1000
+	maxDeliveryBurst = 10000
+	// deliveryBucketIdle is how long an unused bucket is kept
+	deliveryBucketIdle = time.Hour
+)
+
+// DeliveryRateLimit caps how fast the events of a user are sent to each
+// destination, stored as JSON in the delivery_rate_limit column. Events over
+// the limit wait in order for the next free slot.
+type DeliveryRateLimit struct {
+	// Rate is the number of events per second sent to one destination
+	Rate float64 `json:"rate"`
+	// Burst is the number of events that may be sent at once after an idle period
+	Burst int `json:"burst"`
+}
+
+// parseDeliveryRateLimit decodes the delivery_rate_limit column, nil when
+// deliveries are not limited
+func parseDeliveryRateLimit(raw string) (*DeliveryRateLimit, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var limit DeliveryRateLimit
+	if err := json.Unmarshal([]byte(raw), &limit); err != nil {
+		return nil, fmt.Errorf("invalid delivery rate limit: %w", err)
+	}
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+	return &limit, nil
+}
+
+// encode returns the JSON stored in the delivery_rate_limit column
+func (l *DeliveryRateLimit) encode() (string, error) {
+	if l == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate checks the limit, the burst defaults to one second of events
+func (l *DeliveryRateLimit) validate() error {
+	if l.Rate <= 0 || l.Rate > maxDeliveryRate {
+		return fmt.Errorf("rate must be greater than 0 and at most %d events per second", maxDeliveryRate)
+	}
+	if l.Burst == 0 {
+		l.Burst = int(math.Max(1, math.Ceil(l.Rate)))
+	}
+	if l.Burst < 1 || l.Burst > maxDeliveryBurst {
+		return fmt.Errorf("burst must be between 1 and %d", maxDeliveryBurst)
+	}
+	return nil
+}
+
+// tokenBucket is the rate limiter of one user and destination
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if one is available
+func (b *tokenBucket) take(limit *DeliveryRateLimit, now time.Time) bool {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimit returns the delivery rate limit of a user, nil when unlimited,
+// loading it on first use
+func (m *DeliveryManager) RateLimit(userID string) *DeliveryRateLimit {
+	m.mu.Lock()
+	limit, ok := m.rateLimits[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok || db == nil {
+		return limit
+	}
+
+	var raw string
+	if err := db.Get(&raw, "SELECT delivery_rate_limit FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load delivery rate limit, not limiting")
+		return nil
+	}
+	limit, err := parseDeliveryRateLimit(raw)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Ignoring delivery rate limit")
+	}
+
+	m.mu.Lock()
+	m.rateLimits[userID] = limit
+	m.mu.Unlock()
+	return limit
+}
+
+// SetRateLimit stores the delivery rate limit of a user, nil removes it
+func (m *DeliveryManager) SetRateLimit(userID string, limit *DeliveryRateLimit) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw, err := limit.encode()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET delivery_rate_limit = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.rateLimits, userID)
+	for key := range m.buckets {
+		if key.userID == userID {
+			delete(m.buckets, key)
+		}
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// bucketKey identifies the token bucket of a user and destination
+type bucketKey struct {
+	userID      string
+	destination string
+}
+
+// allowLocked reports whether an event may be sent to its destination now.
+// The caller must hold mu.
+func (m *DeliveryManager) allowLocked(event *DeliveryEvent, limit *DeliveryRateLimit, now time.Time) bool {
+	if limit == nil {
+		return true
+	}
+	key := bucketKey{userID: event.UserID, destination: event.Destination}
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[key] = bucket
+	}
+	return bucket.take(limit, now)
+}
+
+// pruneBucketsLocked drops buckets that have been idle long enough to be full
+// again. The caller must hold mu.
+func (m *DeliveryManager) pruneBucketsLocked(now time.Time) {
+	for key, bucket := range m.buckets {
+		if now.Sub(bucket.last) > deliveryBucketIdle {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxDeliveryReplayEvents caps the events re-sent by one replay
+const maxDeliveryReplayEvents = 10000
+
+var errDeliveryReplayTooLarge = fmt.Errorf("more than %d events match, narrow the time range", maxDeliveryReplayEvents)
+
+// DeliveryReplayFilter selects the stored events of a user to send again
+type DeliveryReplayFilter struct {
+	UserID    string
+	EventType string
+	From      time.Time
+	To        time.Time
+}
+
+// validate checks that the filter selects a time range of one user
+func (f *DeliveryReplayFilter) validate() error {
+	if f.UserID == "" {
+		return errors.New("user is required")
+	}
+	if f.From.IsZero() || f.To.IsZero() {
+		return errors.New("from and to are required")
+	}
+	if !f.To.After(f.From) {
+		return errors.New("to must be after from")
+	}
+	return nil
+}
+
+// replayEvent is an event stored in delivery_events, once for all the
+// channels it was sent to
+type replayEvent struct {
+	EventType string `db:"event_type"`
+	Payload   string `db:"payload"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// Replay sends the events of a user created in the filter range again, oldest
+// first, to the channels currently configured: the user webhook, the global
+// webhook, RabbitMQ, the RabbitMQ broker of the user, Kafka, NATS, SQS or SNS,
+// Pub/Sub and Redis. Events are replayed whatever their delivery outcome was,
+// as long as they are still within the delivery retention. Actions in the
+// user webhook response are not run again. It returns the number of events
+// queued.
+func (m *DeliveryManager) Replay(filter DeliveryReplayFilter) (int, error) {
+	if err := filter.validate(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return 0, errors.New("delivery manager not initialized")
+	}
+
+	var user struct {
+		Token   string `db:"token"`
+		Webhook string `db:"webhook"`
+	}
+	if err := db.Get(&user, "SELECT token, webhook FROM users WHERE id = $1", filter.UserID); err != nil {
+		return 0, err
+	}
+
+	conditions := []string{"e.user_id = $1", "e.created_at >= $2", "e.created_at < $3"}
+	args := []interface{}{filter.UserID, filter.From.Unix(), filter.To.Unix()}
+	if filter.EventType != "" {
+		args = append(args, filter.EventType)
+		conditions = append(conditions, fmt.Sprintf("e.event_type = $%d", len(args)))
+	}
+	// Every channel has its own row of the event, they share the payload
+	query := fmt.Sprintf(`SELECT e.event_type, p.payload, MIN(e.created_at) AS created_at
+		FROM delivery_events e JOIN delivery_payloads p ON p.id = e.payload_id
+		WHERE %s GROUP BY e.event_type, e.payload_id, p.payload ORDER BY created_at LIMIT %d`,
+		strings.Join(conditions, " AND "), maxDeliveryReplayEvents+1)
+	var events []replayEvent
+	if err := db.Select(&events, query, args...); err != nil {
+		return 0, fmt.Errorf("failed to get events to replay: %w", err)
+	}
+	if len(events) > maxDeliveryReplayEvents {
+		return 0, errDeliveryReplayTooLarge
+	}
+
+	for _, event := range events {
+		jsonData := []byte(event.Payload)
+		if user.Webhook != "" {
+			m.Enqueue(&DeliveryEvent{
+				UserID:      filter.UserID,
+				Token:       user.Token,
+				Channel:     DeliveryChannelWebhook,
+				Destination: user.Webhook,
+				EventType:   event.EventType,
+				Payload:     event.Payload,
+				Replayed:    true,
+			})
+		}
+		sendToGlobalWebHook(jsonData, user.Token, filter.UserID, event.EventType)
+		sendToGlobalRabbit(jsonData, filter.UserID, event.EventType)
+		sendToKafka(jsonData, filter.UserID, user.Token, event.EventType)
+		sendToNATS(jsonData, filter.UserID, user.Token, event.EventType)
+		sendToSQS(jsonData, filter.UserID, user.Token, event.EventType)
+		sendToPubSub(jsonData, filter.UserID, user.Token, event.EventType)
+		sendToRedis(jsonData, filter.UserID, user.Token, event.EventType)
+		sendToUserRabbit(jsonData, filter.UserID, user.Token, event.EventType)
+	}
+	return len(events), nil
+}
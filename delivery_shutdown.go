@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultDeliveryShutdownTimeout is how long Shutdown waits for deliveries in
+// flight, tunable with DELIVERY_SHUTDOWN_TIMEOUT
+const defaultDeliveryShutdownTimeout = 30 * time.Second
+
+func deliveryShutdownTimeout() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("DELIVERY_SHUTDOWN_TIMEOUT")); err == nil && v > 0 {
+		return v
+	}
+	return defaultDeliveryShutdownTimeout
+}
+
+// Shutdown stops the delivery manager. New events are only written to the
+// database, requests still queued are not sent, and the deliveries in flight
+// are given until ctx is done to finish. Pending events that only live in
+// memory are then persisted so the next start delivers them. Deliveries still
+// running when ctx is done are attempted again on the next start.
+func (m *DeliveryManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closing {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closing = true
+	started := m.started
+	queue := m.queue
+	m.mu.Unlock()
+
+	var err error
+	if started {
+		close(m.stop)
+		err = waitContext(ctx, func() {
+			<-m.stopped
+			// The dispatcher was the only sender, the workers exit once the
+			// queue is empty
+			close(queue)
+			m.running.Wait()
+		})
+		if err != nil {
+			log.Warn().Err(err).Int64("deliveries", m.stats.busyWorkers.Load()).Msg("Deliveries still in flight at shutdown")
+		}
+	}
+
+	saved, persistErr := m.persistPending()
+	if saved > 0 {
+		log.Info().Int("events", saved).Msg("Persisted pending deliveries for the next start")
+	}
+	if persistErr != nil {
+		return persistErr
+	}
+	return err
+}
+
+// waitContext runs fn and returns when it finishes or ctx is done
+func waitContext(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives the events of a request back to the pending events without
+// sending them when the manager is shutting down
+func (m *DeliveryManager) release(request []*DeliveryEvent) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closing {
+		return false
+	}
+	for _, event := range request {
+		event.inFlight = false
+	}
+	return true
+}
+
+// persistPending writes the pending events that have no row in delivery_events
+// yet, because the database was unavailable when they were created
+func (m *DeliveryManager) persistPending() (int, error) {
+	m.mu.Lock()
+	db := m.db
+	var events []DeliveryEvent
+	for _, event := range m.pendingEvents {
+		if !event.persisted && event.Status == DeliveryStatusPending {
+			events = append(events, *event)
+		}
+	}
+	m.mu.Unlock()
+	if db == nil {
+		if len(events) > 0 {
+			log.Warn().Int("events", len(events)).Msg("No database, pending deliveries are lost")
+		}
+		return 0, nil
+	}
+
+	saved := 0
+	for i := range events {
+		if err := storeDeliveryEvent(db, &events[i]); err != nil {
+			return saved, err
+		}
+		saved++
+	}
+	return saved, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// deliveryStatsWindows are the periods statistics can be computed over
+var deliveryStatsWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+const defaultDeliveryStatsWindow = "24h"
+
+// DeliveryChannelStats counts the attempts to one channel by outcome
+type DeliveryChannelStats struct {
+	Attempts  int `json:"attempts"`
+	Delivered int `json:"delivered"`
+	Retrying  int `json:"retrying"`
+	Failed    int `json:"failed"`
+}
+
+// DeliveryStats summarizes the delivery history of a user over a window
+type DeliveryStats struct {
+	UserID string `json:"user_id"`
+	Window string `json:"window"`
+	// Attempts counts every attempt, Retries the ones after the first
+	Attempts int `json:"attempts"`
+	Retries  int `json:"retries"`
+	// Delivered and Failed count the deliveries that finished in the window
+	Delivered int `json:"delivered"`
+	Failed    int `json:"failed"`
+	// SuccessRate is the share of finished deliveries that were delivered
+	SuccessRate  float64                          `json:"success_rate"`
+	LatencyP50Ms int64                            `json:"latency_p50_ms"`
+	LatencyP95Ms int64                            `json:"latency_p95_ms"`
+	LatencyP99Ms int64                            `json:"latency_p99_ms"`
+	Channels     map[string]*DeliveryChannelStats `json:"channels"`
+}
+
+// Stats computes the delivery statistics of a user over one of the
+// deliveryStatsWindows from the delivery history
+func (m *DeliveryManager) Stats(userID string, window string) (*DeliveryStats, error) {
+	if window == "" {
+		window = defaultDeliveryStatsWindow
+	}
+	period, ok := deliveryStatsWindows[window]
+	if !ok {
+		return nil, errors.New("window must be '1h', '24h' or '7d'")
+	}
+
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return nil, errors.New("delivery manager not initialized")
+	}
+
+	since := time.Now().Add(-period).Unix()
+	stats := &DeliveryStats{UserID: userID, Window: window, Channels: map[string]*DeliveryChannelStats{}}
+
+	var counts []struct {
+		Channel string `db:"channel"`
+		Status  string `db:"status"`
+		Total   int    `db:"total"`
+		Retries int    `db:"retries"`
+	}
+	err := db.Select(&counts, `SELECT channel, status, COUNT(*) AS total,
+		SUM(CASE WHEN attempt > 1 THEN 1 ELSE 0 END) AS retries
+		FROM delivery_results WHERE user_id = $1 AND created_at >= $2 GROUP BY channel, status`, userID, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count delivery results: %w", err)
+	}
+	for _, count := range counts {
+		channel, ok := stats.Channels[count.Channel]
+		if !ok {
+			channel = &DeliveryChannelStats{}
+			stats.Channels[count.Channel] = channel
+		}
+		channel.Attempts += count.Total
+		stats.Attempts += count.Total
+		stats.Retries += count.Retries
+		switch count.Status {
+		case DeliveryStatusDelivered:
+			channel.Delivered += count.Total
+			stats.Delivered += count.Total
+		case DeliveryStatusRetrying:
+			channel.Retrying += count.Total
+		case DeliveryStatusFailed:
+			channel.Failed += count.Total
+			stats.Failed += count.Total
+		}
+	}
+	if finished := stats.Delivered + stats.Failed; finished > 0 {
+		stats.SuccessRate = math.Round(float64(stats.Delivered)/float64(finished)*10000) / 10000
+	}
+	if stats.Attempts == 0 {
+		return stats, nil
+	}
+
+	// Percentiles are read from the database so the latencies aren't loaded
+	for _, p := range []struct {
+		percentile float64
+		value      *int64
+	}{
+		{0.50, &stats.LatencyP50Ms},
+		{0.95, &stats.LatencyP95Ms},
+		{0.99, &stats.LatencyP99Ms},
+	} {
+		offset := int(math.Ceil(p.percentile*float64(stats.Attempts))) - 1
+		if offset < 0 {
+			offset = 0
+		}
+		err := db.Get(p.value, `SELECT latency_ms FROM delivery_results
+			WHERE user_id = $1 AND created_at >= $2 ORDER BY latency_ms LIMIT 1 OFFSET $3`, userID, since, offset)
+		// Results pruned meanwhile leave the percentile at zero
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to get delivery latency: %w", err)
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DeliveryWindow limits deliveries to the hours of the day between Start and
+// End in Timezone. Events created outside the window stay pending, in order,
+// until it opens; they are not attempted, so they don't use up retries.
+type DeliveryWindow struct {
+	// Start and End are HH:MM, a window ending before it starts spans midnight
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is an IANA time zone name, UTC when empty
+	Timezone string `json:"timezone,omitempty"`
+	// Channels are the channels the window applies to, the user webhook when
+	// empty
+	Channels []string `json:"channels,omitempty"`
+
+	start, end int
+	location   *time.Location
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// validate checks the window and prepares it for open
+func (w *DeliveryWindow) validate() error {
+	var err error
+	if w.start, err = parseClock(w.Start); err != nil {
+		return errors.New("window start must be HH:MM")
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return errors.New("window end must be HH:MM")
+	}
+	if w.start == w.end {
+		return errors.New("window start and end must differ")
+	}
+	if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", w.Timezone)
+	}
+	for _, channel := range w.Channels {
+		if !knownDeliveryChannel(channel) {
+			return fmt.Errorf("unknown delivery channel %q", channel)
+		}
+	}
+	return nil
+}
+
+// applies reports whether the window holds back events of a channel
+func (w *DeliveryWindow) applies(channel string) bool {
+	if len(w.Channels) == 0 {
+		return channel == DeliveryChannelWebhook
+	}
+	for _, c := range w.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// open reports whether deliveries may be sent at now
+func (w *DeliveryWindow) open(now time.Time) bool {
+	local := now.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
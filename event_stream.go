@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultEventStreamBuffer = 100
+	eventStreamKeepAlive     = 25 * time.Second
+	// eventStreamQueue is how many events a client may fall behind before it
+	// is disconnected, to catch up with Last-Event-ID
+	eventStreamQueue = 256
+	eventStreamRetry = 3 * time.Second
+)
+
+// streamEvent is an event sent on /events/stream
+type streamEvent struct {
+	id        uint64
+	eventType string
+	data      []byte
+}
+
+// eventStreamClient is an open /events/stream connection
+type eventStreamClient struct {
+	events chan *streamEvent
+}
+
+// EventStreams fans the events of each user out to its open /events/stream
+// connections and keeps the last SSE_BUFFER_SIZE events of the users that
+// opened a stream, for clients reconnecting with Last-Event-ID
+type EventStreams struct {
+	mu         sync.Mutex
+	lastID     uint64
+	bufferSize int
+	buffers    map[string][]*streamEvent
+	clients    map[string]map[*eventStreamClient]struct{}
+}
+
+var eventStreams = &EventStreams{
+	// Starting from the clock keeps IDs growing across restarts, so an ID of
+	// the previous run replays the whole buffer instead of nothing
+	lastID:  uint64(time.Now().UnixMicro()),
+	buffers: make(map[string][]*streamEvent),
+	clients: make(map[string]map[*eventStreamClient]struct{}),
+}
+
+// Usage - like sendToGlobalRabbit, for the live streams of the user. Events
+// are only kept for users that opened a stream since the start.
+func sendToEventStream(jsonData []byte, userID string, eventType string) {
+	eventStreams.publish(userID, eventType, jsonData)
+}
+
+func (es *EventStreams) publish(userID string, eventType string, data []byte) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	buffer, ok := es.buffers[userID]
+	if !ok {
+		return
+	}
+	es.lastID++
+	event := &streamEvent{id: es.lastID, eventType: eventType, data: data}
+	if len(buffer) >= es.bufferSize {
+		buffer = append(buffer[:0:0], buffer[len(buffer)-es.bufferSize+1:]...)
+	}
+	es.buffers[userID] = append(buffer, event)
+
+	for client := range es.clients[userID] {
+		select {
+		case client.events <- event:
+		default:
+			// Too slow, it reconnects and replays from its last event
+			delete(es.clients[userID], client)
+			close(client.events)
+		}
+	}
+}
+
+// subscribe opens a stream for a user, returning the buffered events after
+// lastID. The replay and the subscription are taken under one lock so no
+// event falls in between.
+func (es *EventStreams) subscribe(userID string, lastID uint64) (*eventStreamClient, []*streamEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.bufferSize == 0 {
+		es.bufferSize = envInt("SSE_BUFFER_SIZE", defaultEventStreamBuffer)
+	}
+	if _, ok := es.buffers[userID]; !ok {
+		es.buffers[userID] = nil
+	}
+	var replay []*streamEvent
+	if lastID > 0 {
+		for _, event := range es.buffers[userID] {
+			if event.id > lastID {
+				replay = append(replay, event)
+			}
+		}
+	}
+	client := &eventStreamClient{events: make(chan *streamEvent, eventStreamQueue)}
+	if es.clients[userID] == nil {
+		es.clients[userID] = make(map[*eventStreamClient]struct{})
+	}
+	es.clients[userID][client] = struct{}{}
+	return client, replay
+}
+
+func (es *EventStreams) unsubscribe(userID string, client *eventStreamClient) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if _, ok := es.clients[userID][client]; ok {
+		delete(es.clients[userID], client)
+		close(client.events)
+	}
+}
+
+// serveEventStream streams the events of a user as Server-Sent Events until
+// the client goes away. eventTypes filters the events, all when empty.
+func serveEventStream(w http.ResponseWriter, r *http.Request, userID string, eventTypes []string, lastID uint64) {
+	rc := http.NewResponseController(w)
+	// The server write timeout would cut the stream
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Debug().Err(err).Msg("Event stream keeps the server write timeout")
+	}
+
+	client, replay := eventStreams.subscribe(userID, lastID)
+	defer eventStreams.unsubscribe(userID, client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stops nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetry.Milliseconds())
+
+	write := func(event *streamEvent) error {
+		if len(eventTypes) > 0 && !Find(eventTypes, event.eventType) {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.id, event.eventType, event.data)
+		return err
+	}
+	for _, event := range replay {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		log.Warn().Err(err).Msg("Event stream can't be flushed")
+		return
+	}
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const gcsDefaultEndpoint = "https://storage.googleapis.com"
+
+// GCSStorage stores media in a Google Cloud Storage bucket
+type GCSStorage struct {
+	bucket    *storage.BucketHandle
+	name      string
+	endpoint  string
+	publicURL string
+}
+
+// NewGCSStorage creates a GCS backend from the user storage configuration.
+// Endpoint may point to an emulator, in which case credentials are optional.
+func NewGCSStorage(config *S3Config) (*GCSStorage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("missing bucket for GCS storage")
+	}
+
+	endpoint := strings.TrimRight(config.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = gcsDefaultEndpoint
+	}
+
+	ctx := context.Background()
+	var opts []option.ClientOption
+	if endpoint != gcsDefaultEndpoint {
+		opts = append(opts, option.WithEndpoint(endpoint+"/storage/v1/"))
+	}
+	if config.GCSCredentials != "" {
+		credentials, err := google.CredentialsFromJSON(ctx, []byte(config.GCSCredentials), storage.ScopeReadWrite)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCS credentials: %w", err)
+		}
+		opts = append(opts, option.WithCredentials(credentials))
+	} else if endpoint != gcsDefaultEndpoint {
+		// Emulators don't need authentication
+		opts = append(opts, option.WithoutAuthentication())
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+
+	return &GCSStorage{
+		bucket:    client.Bucket(config.Bucket),
+		name:      config.Bucket,
+		endpoint:  endpoint,
+		publicURL: config.PublicURL,
+	}, nil
+}
+
+// gcsError carries the HTTP status of a failed GCS request
+type gcsError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *gcsError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+func (e *gcsError) Error() string {
+	return fmt.Sprintf("GCS request failed with status %d: %v", e.StatusCode, e.Err)
+}
+
+func (e *gcsError) Unwrap() error {
+	return e.Err
+}
+
+// wrapGCSError exposes the HTTP status of the errors of the client library,
+// used to tell missing objects and permanent failures apart
+func wrapGCSError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) || errors.Is(err, storage.ErrBucketNotExist) {
+		return &gcsError{StatusCode: http.StatusNotFound, Err: err}
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return &gcsError{StatusCode: apiErr.Code, Err: err}
+	}
+	return err
+}
+
+// Upload stores an object under key
+func (g *GCSStorage) Upload(ctx context.Context, key string, data []byte, mimeType string) error {
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	writer := g.bucket.Object(key).NewWriter(ctx)
+	writer.ContentType = mimeType
+	// The data is already in memory, send it in a single request
+	writer.ChunkSize = 0
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload to GCS: %w", wrapGCSError(err))
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to upload to GCS: %w", wrapGCSError(err))
+	}
+	return nil
+}
+
+// Delete removes the object stored under key
+func (g *GCSStorage) Delete(ctx context.Context, key string) error {
+	if err := g.bucket.Object(key).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete from GCS: %w", wrapGCSError(err))
+	}
+	return nil
+}
+
+// Exists reports whether an object is stored under key
+func (g *GCSStorage) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := g.bucket.Object(key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapGCSError(err)
+	}
+	return true, nil
+}
+
+// Open downloads the object stored under key
+func (g *GCSStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := g.bucket.Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, wrapGCSError(err)
+	}
+	return reader, nil
+}
+
+// PublicURL returns the URL the object can be downloaded from
+func (g *GCSStorage) PublicURL(key string) string {
+	if g.publicURL != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(g.publicURL, "/"), g.name, key)
+	}
+	return fmt.Sprintf("%s/%s/%s", g.endpoint, g.name, key)
+}
+
+// Test checks that the bucket is reachable with the configured credentials
+func (g *GCSStorage) Test(ctx context.Context) error {
+	query := &storage.Query{}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return err
+	}
+	it := g.bucket.Objects(ctx, query)
+	it.PageInfo().MaxSize = 1
+	if _, err := it.Next(); err != nil && err != iterator.Done {
+		return wrapGCSError(err)
+	}
+	return nil
+}
+
+// DeleteOlderThan removes objects under prefix created before cutoff
+func (g *GCSStorage) DeleteOlderThan(ctx context.Context, prefix string, cutoff time.Time) (int64, int64, error) {
+	return g.DeleteModifiedBetween(ctx, prefix, time.Time{}, cutoff)
+}
+
+// DeleteModifiedBetween removes objects under prefix created within [from, to)
+func (g *GCSStorage) DeleteModifiedBetween(ctx context.Context, prefix string, from, to time.Time) (int64, int64, error) {
+	var deleted, deletedBytes int64
+	err := g.eachObject(ctx, prefix, []string{"Name", "Size", "Created"}, func(attrs *storage.ObjectAttrs) error {
+		if !inTimeRange(attrs.Created, from, to) {
+			return nil
+		}
+		if err := g.Delete(ctx, attrs.Name); err != nil {
+			return err
+		}
+		deleted++
+		deletedBytes += attrs.Size
+		return nil
+	})
+	return deleted, deletedBytes, err
+}
+
+// DeletePrefix removes every object whose name starts with prefix
+func (g *GCSStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	return g.eachObject(ctx, prefix, []string{"Name"}, func(attrs *storage.ObjectAttrs) error {
+		return g.Delete(ctx, attrs.Name)
+	})
+}
+
+// eachObject calls fn for every object under prefix, fetching only the given
+// attributes, and stops at the first error
+func (g *GCSStorage) eachObject(ctx context.Context, prefix string, attrs []string, fn func(*storage.ObjectAttrs) error) error {
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection(attrs); err != nil {
+		return err
+	}
+	it := g.bucket.Objects(ctx, query)
+	for {
+		object, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list GCS objects: %w", wrapGCSError(err))
+		}
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+}
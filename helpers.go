@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 
+	"github.com/go-resty/resty/v2"
 	"github.com/jmoiron/sqlx"
 	"github.com/rs/zerolog/log"
 )
@@ -22,6 +25,16 @@ func Find(slice []string, val string) bool {
 	return false
 }
 
+// sortedKeys returns map keys in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func isHTTPURL(input string) bool {
 	parsed, err := url.ParseRequestURI(input)
 	if err != nil {
@@ -70,9 +83,11 @@ func updateUserInfo(values interface{}, field string, value string) interface{}
 	return values
 }
 
-// webhook for regular messages
-func callHook(myurl string, payload map[string]string, id string) {
-	log.Info().Str("url", myurl).Msg("Sending POST to client " + id)
+// postWebhook sends an event to a webhook, failing on transport errors and
+// non 2xx responses so the delivery can be retried. The response body is
+// returned on success.
+func postWebhook(ctx context.Context, client *resty.Client, myurl string, payload map[string]string, headers map[string]string) ([]byte, error) {
+	log.Info().Str("url", myurl).Msg("Sending POST to client")
 
 	// Log the payload map
 	log.Debug().Msg("Payload:")
@@ -80,7 +95,7 @@ func callHook(myurl string, payload map[string]string, id string) {
 		log.Debug().Str(key, value).Msg("")
 	}
 
-	client := clientManager.GetHTTPClient(id)
+	request := client.R().SetContext(ctx).SetHeaders(headers)
 
 	format := os.Getenv("WEBHOOK_FORMAT")
 	if format == "json" {
@@ -90,33 +105,39 @@ func callHook(myurl string, payload map[string]string, id string) {
 		var body interface{} = payload
 		if jsonStr, ok := payload["jsonData"]; ok {
 			var postmap map[string]interface{}
-			err := json.Unmarshal([]byte(jsonStr), &postmap)
-			if err == nil {
+			var batch []map[string]interface{}
+			if err := json.Unmarshal([]byte(jsonStr), &postmap); err == nil {
 				postmap["token"] = payload["token"]
 				body = postmap
+			} else if err := json.Unmarshal([]byte(jsonStr), &batch); err == nil {
+				// Batched events are sent as an array, each with the token
+				for _, event := range batch {
+					event["token"] = payload["token"]
+				}
+				body = batch
 			}
 		}
-		_, err := client.R().
-			SetHeader("Content-Type", "application/json").
-			SetBody(body).
-			Post(myurl)
-		if err != nil {
-			log.Debug().Str("error", err.Error())
-		}
+		request.SetHeader("Content-Type", "application/json").SetBody(body)
 	} else {
 		// Default: send as form-urlencoded
-		_, err := client.R().SetFormData(payload).Post(myurl)
-		if err != nil {
-			log.Debug().Str("error", err.Error())
-		}
+		request.SetFormData(payload)
+	}
+
+	resp, err := request.Post(myurl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send POST request: %w", err)
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("webhook returned status %d", resp.StatusCode())
 	}
+	return resp.Body(), nil
 }
 
 // webhook for messages with file attachments
 func callHookFile(myurl string, payload map[string]string, id string, file string) error {
 	log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST")
 
-	client := clientManager.GetHTTPClient(id)
+	client := userWebhookClient(id)
 
 	// Create final payload map
 	finalPayload := make(map[string]string)
@@ -129,6 +150,7 @@ func callHookFile(myurl string, payload map[string]string, id string, file strin
 	log.Debug().Interface("finalPayload", finalPayload).Msg("Final payload to be sent")
 
 	resp, err := client.R().
+		SetHeaders(GetDeliveryManager().WebhookHeaders(id)).
 		SetFiles(map[string]string{
 			"file": file,
 		}).
@@ -160,14 +182,20 @@ func ProcessOutgoingMedia(userID string, contactJID string, messageID string, da
 	var s3Config struct {
 		Enabled       bool   `db:"s3_enabled"`
 		MediaDelivery string `db:"media_delivery"`
+		StripMetadata bool   `db:"strip_metadata"`
 	}
-	err := db.Get(&s3Config, "SELECT s3_enabled, media_delivery FROM users WHERE id = $1", userID)
+	err := db.Get(&s3Config, "SELECT s3_enabled, media_delivery, strip_metadata FROM users WHERE id = $1", userID)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get S3 config")
 		s3Config.Enabled = false
 		s3Config.MediaDelivery = "base64"
 	}
 
+	// Remove EXIF and other metadata before the media is stored or returned
+	if s3Config.StripMetadata {
+		data = stripMediaMetadataOrKeep(userID, data, mimeType)
+	}
+
 	// Process S3 upload if enabled
 	if s3Config.Enabled && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
 		// Process S3 upload (outgoing messages are always in outbox)
@@ -181,9 +209,24 @@ func ProcessOutgoingMedia(userID string, contactJID string, messageID string, da
 			fileName,
 			false, // isIncoming = false for sent messages
 		)
-		if err != nil {
+		if verdict := rejectedMediaVerdict(err); verdict != nil {
+			// Infected media is dropped, not even delivered as base64
+			return map[string]interface{}{
+				"scan":    verdict,
+				"s3Error": err.Error(),
+			}, nil
+		} else if err != nil {
 			log.Error().Err(err).Msg("Failed to upload media to S3")
-			// Continue even if S3 upload fails
+			// Fall back to base64 when S3 is the only delivery method, so the
+			// media isn't dropped while the bucket is unreachable
+			if s3Config.MediaDelivery == "s3" {
+				return map[string]interface{}{
+					"base64":   base64.StdEncoding.EncodeToString(data),
+					"mimeType": mimeType,
+					"fileName": fileName,
+					"s3Error":  err.Error(),
+				}, nil
+			}
 		} else {
 			return s3Data, nil
 		}
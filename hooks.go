@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	defaultHookTimeoutMs     = 50
+	maxHookTimeoutMs         = 5000
+	minHookMemoryLimitKB     = 64
+	defaultHookMemoryLimitKB = 1024
+	maxHookMemoryLimitKB     = 1024 * 64
+	hookLuaCallStackSize     = 120
+	hookLuaEntryPoint        = "process"
+	hookStatePoolSize        = 8 // prepared Lua states kept per hook
+)
+
+// EventHook is a user provided script that runs on every event before delivery
+type EventHook struct {
+	ID            string `db:"id" json:"id"`
+	UserID        string `db:"user_id" json:"-"`
+	Name          string `db:"name" json:"name"`
+	Runtime       string `db:"runtime" json:"runtime"`
+	Script        string `db:"script" json:"script"`
+	Enabled       bool   `db:"enabled" json:"enabled"`
+	TimeoutMs     int    `db:"timeout_ms" json:"timeout_ms"`
+	MemoryLimitKB int    `db:"memory_limit_kb" json:"memory_limit_kb"`
+	Priority      int    `db:"priority" json:"priority"`
+
+	proto   *lua.FunctionProto
+	metrics *HookMetrics
+	// states holds sandboxes that already ran the top level of the script
+	states chan *hookSandbox
+}
+
+// HookMetrics holds execution counters for a single hook
+type HookMetrics struct {
+	Invocations   int64 `json:"invocations"`
+	Modified      int64 `json:"modified"`
+	Dropped       int64 `json:"dropped"`
+	Errors        int64 `json:"errors"`
+	Timeouts      int64 `json:"timeouts"`
+	TotalDuration int64 `json:"total_duration_us"`
+	lastError     atomic.Value
+}
+
+// Snapshot returns a copy of the counters suitable for JSON output
+func (hm *HookMetrics) Snapshot() map[string]interface{} {
+	invocations := atomic.LoadInt64(&hm.Invocations)
+	total := atomic.LoadInt64(&hm.TotalDuration)
+	avg := int64(0)
+	if invocations > 0 {
+		avg = total / invocations
+	}
+	lastError, _ := hm.lastError.Load().(string)
+	return map[string]interface{}{
+		"invocations":       invocations,
+		"modified":          atomic.LoadInt64(&hm.Modified),
+		"dropped":           atomic.LoadInt64(&hm.Dropped),
+		"errors":            atomic.LoadInt64(&hm.Errors),
+		"timeouts":          atomic.LoadInt64(&hm.Timeouts),
+		"total_duration_us": total,
+		"avg_duration_us":   avg,
+		"last_error":        lastError,
+	}
+}
+
+// HookManager loads, compiles and runs event hooks per user
+type HookManager struct {
+	mu      sync.RWMutex
+	db      *sqlx.DB
+	hooks   map[string][]*EventHook
+	loaded  map[string]bool
+	metrics map[string]*HookMetrics
+}
+
+// Global hook manager instance
+var hookManager = &HookManager{
+	hooks:   make(map[string][]*EventHook),
+	loaded:  make(map[string]bool),
+	metrics: make(map[string]*HookMetrics),
+}
+
+// GetHookManager returns the global hook manager instance
+func GetHookManager() *HookManager {
+	return hookManager
+}
+
+// SetDB sets the database used to load hooks
+func (m *HookManager) SetDB(db *sqlx.DB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.db = db
+}
+
+// Invalidate drops the cached hooks of a user so they are reloaded on next use
+func (m *HookManager) Invalidate(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hooks, userID)
+	delete(m.loaded, userID)
+}
+
+// GetMetrics returns the metrics for a hook, creating them if needed
+func (m *HookManager) GetMetrics(hookID string) *HookMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hm, ok := m.metrics[hookID]
+	if !ok {
+		hm = &HookMetrics{}
+		m.metrics[hookID] = hm
+	}
+	return hm
+}
+
+// RemoveMetrics discards the metrics of a deleted hook
+func (m *HookManager) RemoveMetrics(hookID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.metrics, hookID)
+}
+
+// getUserHooks returns the compiled, enabled hooks of a user ordered by priority
+func (m *HookManager) getUserHooks(userID string) []*EventHook {
+	m.mu.RLock()
+	if m.loaded[userID] {
+		hooks := m.hooks[userID]
+		m.mu.RUnlock()
+		return hooks
+	}
+	db := m.db
+	m.mu.RUnlock()
+
+	if db == nil {
+		return nil
+	}
+
+	var rows []*EventHook
+	err := db.Select(&rows, `
+		SELECT id, user_id, name, runtime, script, enabled, timeout_ms, memory_limit_kb, priority
+		FROM event_hooks WHERE user_id = $1 AND enabled = $2 ORDER BY priority ASC, created_at ASC`, userID, true)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to load event hooks")
+		return nil
+	}
+
+	var hooks []*EventHook
+	for _, hook := range rows {
+		if err := hook.Compile(); err != nil {
+			log.Error().Err(err).Str("userID", userID).Str("hook", hook.Name).Msg("Failed to compile event hook, skipping")
+			continue
+		}
+		hook.metrics = m.GetMetrics(hook.ID)
+		hooks = append(hooks, hook)
+	}
+
+	m.mu.Lock()
+	m.hooks[userID] = hooks
+	m.loaded[userID] = true
+	m.mu.Unlock()
+
+	return hooks
+}
+
+// Normalize validates the hook settings and applies defaults
+func (h *EventHook) Normalize() error {
+	if h.Name == "" {
+		return errors.New("missing name")
+	}
+	if h.Runtime == "" {
+		h.Runtime = "lua"
+	}
+	if h.Runtime != "lua" {
+		return fmt.Errorf("unsupported runtime %q, only lua is supported", h.Runtime)
+	}
+	if strings.TrimSpace(h.Script) == "" {
+		return errors.New("missing script")
+	}
+	if h.TimeoutMs <= 0 {
+		h.TimeoutMs = defaultHookTimeoutMs
+	}
+	if h.TimeoutMs > maxHookTimeoutMs {
+		return fmt.Errorf("timeout_ms must not exceed %d", maxHookTimeoutMs)
+	}
+	if h.MemoryLimitKB <= 0 {
+		h.MemoryLimitKB = defaultHookMemoryLimitKB
+	}
+	if h.MemoryLimitKB < minHookMemoryLimitKB || h.MemoryLimitKB > maxHookMemoryLimitKB {
+		return fmt.Errorf("memory_limit_kb must be between %d and %d", minHookMemoryLimitKB, maxHookMemoryLimitKB)
+	}
+	return nil
+}
+
+// timeout is the time limit of every run of the hook, including the top
+// level of the script
+func (h *EventHook) timeout() time.Duration {
+	if h.TimeoutMs <= 0 {
+		return defaultHookTimeoutMs * time.Millisecond
+	}
+	return time.Duration(h.TimeoutMs) * time.Millisecond
+}
+
+// memoryLimitKB is how much memory every run of the hook may allocate
+func (h *EventHook) memoryLimitKB() int {
+	if h.MemoryLimitKB <= 0 {
+		return defaultHookMemoryLimitKB
+	}
+	return h.MemoryLimitKB
+}
+
+// Compile parses the script and checks that it defines the entry point. The
+// state the script was loaded in is kept for the first run.
+func (h *EventHook) Compile() error {
+	chunk, err := parse.Parse(strings.NewReader(h.Script), h.Name)
+	if err != nil {
+		return fmt.Errorf("syntax error: %w", err)
+	}
+	chunk, err = rewriteHookChunk(chunk)
+	if err != nil {
+		return fmt.Errorf("compile error: %w", err)
+	}
+	proto, err := lua.Compile(chunk, h.Name)
+	if err != nil {
+		return fmt.Errorf("compile error: %w", err)
+	}
+
+	h.proto = proto
+	sandbox, err := h.prepare()
+	if err != nil {
+		return fmt.Errorf("failed to load script: %w", err)
+	}
+	h.states = make(chan *hookSandbox, hookStatePoolSize)
+	h.states <- sandbox
+	return nil
+}
+
+// prepare creates a sandbox and runs the top level of the script in it,
+// under the same limits as the events
+func (h *EventHook) prepare() (*hookSandbox, error) {
+	sandbox := newHookSandbox(h.memoryLimitKB())
+	L := sandbox.L
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	if err := sandbox.load(h.proto); err != nil {
+		sandbox.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("it ran longer than %s", h.timeout())
+		}
+		return nil, err
+	}
+	if L.GetGlobal(hookLuaEntryPoint).Type() != lua.LTFunction {
+		sandbox.Close()
+		return nil, fmt.Errorf("script must define a global function %q", hookLuaEntryPoint)
+	}
+	return sandbox, nil
+}
+
+// getState takes a prepared sandbox from the pool, or prepares a new one
+// when all of them are in use
+func (h *EventHook) getState() (*hookSandbox, error) {
+	select {
+	case sandbox := <-h.states:
+		return sandbox, nil
+	default:
+		return h.prepare()
+	}
+}
+
+// putState gives a sandbox back to the pool, it is closed when the pool is
+// full
+func (h *EventHook) putState(sandbox *hookSandbox) {
+	select {
+	case h.states <- sandbox:
+	default:
+		sandbox.Close()
+	}
+}
+
+// Run executes the hook against an event. It returns the modified event, nil
+// when the hook left it unchanged, whether the event must be delivered and any
+// execution error. The process function is called in a pooled state, so the
+// globals a script sets are kept between the events run in that state. A
+// state whose run failed is discarded.
+func (h *EventHook) Run(event map[string]interface{}) (map[string]interface{}, bool, error) {
+	sandbox, err := h.getState()
+	if err != nil {
+		return event, true, err
+	}
+	L := sandbox.L
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+	L.SetContext(ctx)
+	sandbox.used = 0
+
+	result, keep, err := h.call(sandbox, event)
+	L.RemoveContext()
+	if err != nil {
+		sandbox.Close()
+		if ctx.Err() != nil {
+			return event, true, context.DeadlineExceeded
+		}
+		return event, true, err
+	}
+	h.putState(sandbox)
+	return result, keep, nil
+}
+
+// call passes an event to the process function of a prepared sandbox
+func (h *EventHook) call(sandbox *hookSandbox, event map[string]interface{}) (map[string]interface{}, bool, error) {
+	L := sandbox.L
+
+	// Round trip through JSON so that the script only sees plain values
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return event, true, err
+	}
+	var plain interface{}
+	if err := json.Unmarshal(raw, &plain); err != nil {
+		return event, true, err
+	}
+
+	err = L.CallByParam(lua.P{
+		Fn:      L.GetGlobal(hookLuaEntryPoint),
+		NRet:    1,
+		Protect: true,
+	}, toLuaValue(L, plain))
+	if err != nil {
+		return event, true, err
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	switch ret.Type() {
+	case lua.LTNil:
+		// A hook that returns nothing leaves the event alone, only false
+		// drops it
+		return nil, true, nil
+	case lua.LTBool:
+		return nil, lua.LVAsBool(ret), nil
+	case lua.LTTable:
+		value, err := fromLuaValue(ret)
+		if err != nil {
+			return event, true, err
+		}
+		result, ok := value.(map[string]interface{})
+		if !ok {
+			return event, true, errors.New("process must return a table with string keys, a boolean or nothing")
+		}
+		// Returning the event as it came in doesn't modify it
+		if reflect.DeepEqual(result, plain) {
+			return nil, true, nil
+		}
+		return result, true, nil
+	default:
+		return event, true, fmt.Errorf("process returned unsupported type %s", ret.Type().String())
+	}
+}
+
+// RunEventHooks runs all enabled hooks of a user in priority order. It returns
+// the (possibly modified) event and false if a hook dropped it. Failing hooks
+// are skipped so the event is delivered unchanged by them.
+func (m *HookManager) RunEventHooks(userID string, event map[string]interface{}) (map[string]interface{}, bool) {
+	hooks := m.getUserHooks(userID)
+	if len(hooks) == 0 {
+		return event, true
+	}
+
+	for _, hook := range hooks {
+		start := time.Now()
+		result, keep, err := hook.Run(event)
+		atomic.AddInt64(&hook.metrics.Invocations, 1)
+		atomic.AddInt64(&hook.metrics.TotalDuration, time.Since(start).Microseconds())
+
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				atomic.AddInt64(&hook.metrics.Timeouts, 1)
+			} else {
+				atomic.AddInt64(&hook.metrics.Errors, 1)
+			}
+			hook.metrics.lastError.Store(err.Error())
+			log.Warn().Err(err).Str("userID", userID).Str("hook", hook.Name).Msg("Event hook failed, ignoring its result")
+			continue
+		}
+
+		if !keep {
+			atomic.AddInt64(&hook.metrics.Dropped, 1)
+			log.Debug().Str("userID", userID).Str("hook", hook.Name).Msg("Event dropped by hook")
+			return nil, false
+		}
+
+		if result != nil {
+			if _, ok := result["type"]; !ok {
+				result["type"] = event["type"]
+			}
+			atomic.AddInt64(&hook.metrics.Modified, 1)
+			event = result
+		}
+	}
+
+	return event, true
+}
+
+func toLuaValue(L *lua.LState, v interface{}) lua.LValue {
+	switch val := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(val)
+	case float64:
+		return lua.LNumber(val)
+	case string:
+		return lua.LString(val)
+	case []interface{}:
+		tbl := L.NewTable()
+		for _, item := range val {
+			tbl.Append(toLuaValue(L, item))
+		}
+		return tbl
+	case map[string]interface{}:
+		tbl := L.NewTable()
+		for key, item := range val {
+			tbl.RawSetString(key, toLuaValue(L, item))
+		}
+		return tbl
+	default:
+		return lua.LString(fmt.Sprintf("%v", val))
+	}
+}
+
+// hookMaxValueDepth is how deeply the tables returned by a hook may nest
+const hookMaxValueDepth = 64
+
+// fromLuaValue converts the value returned by a hook to plain Go values. A
+// table that contains itself, or nests deeper than hookMaxValueDepth, is an
+// error.
+func fromLuaValue(lv lua.LValue) (interface{}, error) {
+	return fromLuaValueDepth(lv, make(map[*lua.LTable]bool), 0)
+}
+
+// fromLuaValueDepth converts a value nested depth tables deep, visiting holds
+// the tables being converted around it
+func fromLuaValueDepth(lv lua.LValue, visiting map[*lua.LTable]bool, depth int) (interface{}, error) {
+	switch val := lv.(type) {
+	case lua.LBool:
+		return bool(val), nil
+	case lua.LNumber:
+		return float64(val), nil
+	case lua.LString:
+		return string(val), nil
+	case *lua.LTable:
+		if visiting[val] {
+			return nil, errors.New("process returned a table that contains itself")
+		}
+		if depth >= hookMaxValueDepth {
+			return nil, fmt.Errorf("process returned tables nested deeper than %d levels", hookMaxValueDepth)
+		}
+		visiting[val] = true
+		defer delete(visiting, val)
+
+		// Tables with only sequential integer keys are arrays
+		if length := val.Len(); length > 0 {
+			isArray := true
+			count := 0
+			val.ForEach(func(key, _ lua.LValue) {
+				count++
+				if _, ok := key.(lua.LNumber); !ok {
+					isArray = false
+				}
+			})
+			if isArray && count == length {
+				arr := make([]interface{}, 0, length)
+				for i := 1; i <= length; i++ {
+					item, err := fromLuaValueDepth(val.RawGetInt(i), visiting, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					arr = append(arr, item)
+				}
+				return arr, nil
+			}
+		}
+		obj := make(map[string]interface{})
+		var err error
+		val.ForEach(func(key, item lua.LValue) {
+			if err != nil {
+				return
+			}
+			obj[key.String()], err = fromLuaValueDepth(item, visiting, depth+1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+const (
+	hookLuaRegistrySize = 1024 * 20 // Lua registry (value stack) slots, bounds recursion
+	hookTableBytes      = 64        // charged for every table a hook creates
+	hookSlotBytes       = 32        // charged for every table slot a hook fills
+
+	// Names the sandbox adds to scripts, they can't be used by the script
+	hookReservedPrefix = "__hook_"
+	hookConcatName     = "__hook_concat"
+	hookSetName        = "__hook_set"
+	hookTableName      = "__hook_table"
+)
+
+// hookSandbox is a Lua state a hook is loaded in, reused for many events.
+// The strings and tables the script builds during a run are counted and the
+// script fails once they add up to more than its memory limit.
+//
+// A single VM instruction, like a concatenation of two large strings, can
+// allocate any amount of memory before the timeout gets a chance to stop the
+// script. Scripts are therefore rewritten by rewriteHookChunk so that
+// concatenations, assignments to table fields and table constructors call the
+// sandbox, and the string and table functions that build values are replaced
+// by ones that count what they allocate.
+type hookSandbox struct {
+	L     *lua.LState
+	limit int
+	used  int
+}
+
+// newHookSandbox creates a sandboxed Lua state without file system or OS
+// access that can allocate up to memoryLimitKB kilobytes
+func newHookSandbox(memoryLimitKB int) *hookSandbox {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       hookLuaCallStackSize,
+		RegistrySize:        1024,
+		RegistryMaxSize:     hookLuaRegistrySize,
+		MinimizeStackMemory: true,
+	})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	s := &hookSandbox{L: L, limit: memoryLimitKB * 1024}
+
+	if str, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		gmatch := L.NewFunction(s.gmatch)
+		str.RawSetString("gmatch", gmatch)
+		str.RawSetString("gfind", gmatch)
+		str.RawSetString("gsub", L.NewFunction(s.gsub))
+		str.RawSetString("rep", L.NewFunction(s.rep))
+		s.chargeBefore(str, "format", hookFormatCost)
+		for _, name := range []string{"upper", "lower", "reverse"} {
+			s.chargeBefore(str, name, func(L *lua.LState) int { return len(L.CheckString(1)) })
+		}
+	}
+	if tbl, ok := L.GetGlobal(lua.TabLibName).(*lua.LTable); ok {
+		s.chargeBefore(tbl, "concat", hookTableConcatCost)
+		s.chargeBefore(tbl, "insert", func(*lua.LState) int { return hookSlotBytes })
+	}
+	if base, ok := L.Get(lua.GlobalsIndex).(*lua.LTable); ok {
+		s.chargeBefore(base, "rawset", func(L *lua.LState) int {
+			return hookNewSlotCost(L.CheckTable(1), L.Get(2), L.Get(3))
+		})
+	}
+	return s
+}
+
+// Close releases the Lua state
+func (s *hookSandbox) Close() {
+	s.L.Close()
+}
+
+// load runs the top level of a script rewritten by rewriteHookChunk
+func (s *hookSandbox) load(proto *lua.FunctionProto) error {
+	L := s.L
+	L.Push(L.NewFunctionFromProto(proto))
+	L.Push(L.NewFunction(s.concat))
+	L.Push(L.NewFunction(s.set))
+	L.Push(L.NewFunction(s.table))
+	return L.PCall(3, lua.MultRet, nil)
+}
+
+// charge counts n more bytes and raises an error once the limit is exceeded.
+// Memory that is no longer used isn't given back, so the limit bounds all
+// the allocations of a run.
+func (s *hookSandbox) charge(n int) {
+	if n > s.limit-s.used {
+		s.used = s.limit + 1
+		s.L.RaiseError("memory limit of %d KB exceeded", s.limit/1024)
+	}
+	s.used += n
+}
+
+// chargeBefore replaces the Go function name of lib by one that charges
+// cost bytes before calling it
+func (s *hookSandbox) chargeBefore(lib *lua.LTable, name string, cost func(*lua.LState) int) {
+	fn, ok := lib.RawGetString(name).(*lua.LFunction)
+	if !ok || !fn.IsG {
+		return
+	}
+	orig := fn.GFunction
+	lib.RawSetString(name, s.L.NewFunction(func(L *lua.LState) int {
+		s.charge(cost(L))
+		return orig(L)
+	}))
+}
+
+// checkTimeout stops a library function that loops in Go once the run has
+// used up its time
+func (s *hookSandbox) checkTimeout() {
+	if ctx := s.L.Context(); ctx != nil && ctx.Err() != nil {
+		s.L.RaiseError("%v", ctx.Err())
+	}
+}
+
+// concat replaces the .. operator
+func (s *hookSandbox) concat(L *lua.LState) int {
+	lhs, rhs := L.Get(1), L.Get(2)
+	if lua.LVCanConvToString(lhs) && lua.LVCanConvToString(rhs) {
+		a, b := lua.LVAsString(lhs), lua.LVAsString(rhs)
+		s.charge(len(a) + len(b))
+		L.Push(lua.LString(a + b))
+		return 1
+	}
+	op := L.GetMetaField(lhs, "__concat")
+	if op == lua.LNil {
+		op = L.GetMetaField(rhs, "__concat")
+	}
+	if op.Type() != lua.LTFunction {
+		L.RaiseError("cannot perform concat operation between %v and %v", lhs.Type().String(), rhs.Type().String())
+	}
+	L.Push(op)
+	L.Push(lhs)
+	L.Push(rhs)
+	L.Call(2, 1)
+	return 1
+}
+
+// set replaces assignments to table fields, obj[key] = value
+func (s *hookSandbox) set(L *lua.LState) int {
+	obj, key, value := L.Get(1), L.Get(2), L.Get(3)
+	if tbl, ok := obj.(*lua.LTable); ok {
+		s.charge(hookNewSlotCost(tbl, key, value))
+	}
+	L.SetTable(obj, key, value)
+	return 0
+}
+
+// table is called with every table built by a table constructor
+func (s *hookSandbox) table(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	slots := 0
+	tbl.ForEach(func(lua.LValue, lua.LValue) { slots++ })
+	s.charge(hookTableBytes + slots*hookSlotBytes)
+	L.Push(tbl)
+	return 1
+}
+
+// rep replaces string.rep, which builds its result in a single call
+func (s *hookSandbox) rep(L *lua.LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n <= 0 || str == "" {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if n > s.limit/len(str) {
+		s.charge(s.limit + 1)
+	}
+	s.charge(len(str) * n)
+	L.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// gsub replaces string.gsub, counting the result as it is built instead of
+// building it in one go
+func (s *hookSandbox) gsub(L *lua.LState) int {
+	str := L.CheckString(1)
+	pat := L.CheckString(2)
+	L.CheckTypes(3, lua.LTString, lua.LTTable, lua.LTFunction)
+	repl := L.Get(3)
+	limit := L.OptInt(4, -1)
+
+	src := []byte(str)
+	var out strings.Builder
+	count, offset := 0, 0
+	for offset <= len(src) && (limit < 0 || count < limit) {
+		s.checkTimeout()
+		mds, err := pm.Find(pat, src, offset, 1)
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		if len(mds) == 0 {
+			break
+		}
+		md := mds[0]
+		start, end := md.Capture(0), md.Capture(1)
+		replacement := s.gsubReplacement(L, str, md, repl)
+		s.charge(start - offset + len(replacement))
+		out.WriteString(str[offset:start])
+		out.WriteString(replacement)
+		count++
+		offset = end
+		if end == start {
+			// An empty match keeps the next character and moves past it
+			if start < len(str) {
+				s.charge(1)
+				out.WriteByte(str[start])
+			}
+			offset = start + 1
+		}
+		if strings.HasPrefix(pat, "^") {
+			break
+		}
+	}
+	if offset < len(str) {
+		s.charge(len(str) - offset)
+		out.WriteString(str[offset:])
+	}
+	L.Push(lua.LString(out.String()))
+	L.Push(lua.LNumber(count))
+	return 2
+}
+
+// gsubReplacement returns what a match of gsub is replaced with
+func (s *hookSandbox) gsubReplacement(L *lua.LState, str string, md *pm.MatchData, repl lua.LValue) string {
+	var value lua.LValue
+	switch r := repl.(type) {
+	case lua.LString:
+		return s.expandReplacement(L, str, md, string(r))
+	case *lua.LTable:
+		value = L.GetTable(r, hookCapture(L, md, str, 1))
+	case *lua.LFunction:
+		L.Push(r)
+		captures := hookCaptures(L, md, str)
+		for _, capture := range captures {
+			L.Push(capture)
+		}
+		L.Call(len(captures), 1)
+		value = L.Get(-1)
+		L.Pop(1)
+	}
+	if lua.LVIsFalse(value) {
+		return str[md.Capture(0):md.Capture(1)]
+	}
+	if !lua.LVCanConvToString(value) {
+		L.RaiseError("invalid replacement value (a %s)", value.Type().String())
+	}
+	return lua.LVAsString(value)
+}
+
+// expandReplacement replaces %0 to %9 in the replacement string of gsub with
+// the captures of a match
+func (s *hookSandbox) expandReplacement(L *lua.LState, str string, md *pm.MatchData, repl string) string {
+	// Count the result first, %0 repeated many times over a long match is
+	// large
+	size := 0
+	for i := 0; i < len(repl); i++ {
+		if repl[i] == '%' && i+1 < len(repl) {
+			i++
+			if c := repl[i]; c >= '0' && c <= '9' {
+				size += len(lua.LVAsString(hookCapture(L, md, str, int(c-'0'))))
+				continue
+			}
+		}
+		size++
+	}
+	s.charge(size)
+
+	var out strings.Builder
+	out.Grow(size)
+	for i := 0; i < len(repl); i++ {
+		if repl[i] == '%' && i+1 < len(repl) {
+			i++
+			if c := repl[i]; c >= '0' && c <= '9' {
+				out.WriteString(lua.LVAsString(hookCapture(L, md, str, int(c-'0'))))
+				continue
+			}
+		}
+		out.WriteByte(repl[i])
+	}
+	return out.String()
+}
+
+// gmatch replaces string.gmatch, finding one match per call instead of all of
+// them upfront
+func (s *hookSandbox) gmatch(L *lua.LState) int {
+	str := L.CheckString(1)
+	pat := L.CheckString(2)
+	src := []byte(str)
+	offset := 0
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		if offset > len(src) {
+			return 0
+		}
+		mds, err := pm.Find(pat, src, offset, 1)
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		if len(mds) == 0 {
+			offset = len(src) + 1
+			return 0
+		}
+		md := mds[0]
+		offset = md.Capture(1)
+		if offset == md.Capture(0) {
+			offset++
+		}
+		if strings.HasPrefix(pat, "^") {
+			offset = len(src) + 1
+		}
+		captures := hookCaptures(L, md, str)
+		for _, capture := range captures {
+			L.Push(capture)
+		}
+		return len(captures)
+	}))
+	return 1
+}
+
+// hookCapture returns capture n of a match, 0 being the whole match. %1 is
+// the whole match of a pattern without captures.
+func hookCapture(L *lua.LState, md *pm.MatchData, str string, n int) lua.LValue {
+	idx := 2 * n
+	if idx >= md.CaptureLength() {
+		if n != 1 {
+			L.RaiseError("invalid capture index")
+		}
+		idx = 0
+	}
+	if md.IsPosCapture(idx) {
+		return lua.LNumber(md.Capture(idx))
+	}
+	return lua.LString(str[md.Capture(idx):md.Capture(idx+1)])
+}
+
+// hookCaptures returns the captures of a match, or the whole match when the
+// pattern has none
+func hookCaptures(L *lua.LState, md *pm.MatchData, str string) []lua.LValue {
+	if md.CaptureLength() <= 2 {
+		return []lua.LValue{hookCapture(L, md, str, 0)}
+	}
+	captures := make([]lua.LValue, 0, md.CaptureLength()/2-1)
+	for n := 1; 2*n < md.CaptureLength(); n++ {
+		captures = append(captures, hookCapture(L, md, str, n))
+	}
+	return captures
+}
+
+// hookNewSlotCost is what storing value at key of tbl costs
+func hookNewSlotCost(tbl *lua.LTable, key, value lua.LValue) int {
+	if value == lua.LNil || key == lua.LNil || tbl.RawGet(key) != lua.LNil {
+		return 0
+	}
+	return hookSlotBytes
+}
+
+// hookTableConcatCost is the length of the string table.concat builds
+func hookTableConcatCost(L *lua.LState) int {
+	tbl := L.CheckTable(1)
+	sep := L.OptString(2, "")
+	i := L.OptInt(3, 1)
+	j := L.OptInt(4, tbl.Len())
+	if j > tbl.Len() {
+		j = tbl.Len()
+	}
+	cost := 0
+	for ; i <= j; i++ {
+		v := tbl.RawGetInt(i)
+		if !lua.LVCanConvToString(v) {
+			break
+		}
+		cost += len(lua.LVAsString(v)) + len(sep)
+	}
+	return cost
+}
+
+// hookFormatCost is an upper bound of the length of the string
+// string.format builds. Widths and precisions are limited to two digits like
+// in Lua, so a single directive can't pad its value to any size.
+func hookFormatCost(L *lua.LState) int {
+	format := L.CheckString(1)
+	cost := len(format)
+	arg := 2
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			continue
+		}
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		width := 0
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			i++
+			width++
+		}
+		precision := 0
+		if i < len(format) && format[i] == '.' {
+			i++
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				i++
+				precision++
+			}
+		}
+		if width > 2 || precision > 2 {
+			L.RaiseError("invalid format (width or precision too long)")
+		}
+
+		// Numbers print at most a few hundred digits, %q escapes a byte
+		// into at most six
+		cost += 200
+		if str, ok := L.Get(arg).(lua.LString); ok {
+			if i < len(format) && format[i] == 'q' {
+				cost += 6 * len(str)
+			} else {
+				cost += len(str)
+			}
+		} else {
+			cost += 400
+		}
+		arg++
+	}
+	return cost
+}
+
+// rewriteHookChunk rewrites a parsed script so that it allocates strings and
+// tables through the sandbox. Concatenations become calls of __hook_concat,
+// assignments to table fields calls of __hook_set and table constructors are
+// passed to __hook_table. These helpers are locals of the chunk, which
+// receives them as arguments from hookSandbox.load.
+func rewriteHookChunk(chunk []ast.Stmt) ([]ast.Stmt, error) {
+	r := &hookRewriter{}
+	chunk = r.stmts(chunk)
+	if r.err != nil {
+		return nil, r.err
+	}
+	helpers := &ast.LocalAssignStmt{
+		Names: []string{hookConcatName, hookSetName, hookTableName},
+		Exprs: []ast.Expr{&ast.Comma3Expr{}},
+	}
+	return append([]ast.Stmt{helpers}, chunk...), nil
+}
+
+// hookRewriter walks the syntax tree of a script for rewriteHookChunk
+type hookRewriter struct {
+	err  error
+	temp int
+}
+
+func (r *hookRewriter) name(line int, name string) {
+	if r.err == nil && strings.HasPrefix(name, hookReservedPrefix) {
+		r.err = fmt.Errorf("line %d: names starting with %s are reserved", line, hookReservedPrefix)
+	}
+}
+
+func (r *hookRewriter) stmts(stmts []ast.Stmt) []ast.Stmt {
+	for i, stmt := range stmts {
+		stmts[i] = r.stmt(stmt)
+	}
+	return stmts
+}
+
+func (r *hookRewriter) exprs(exprs []ast.Expr) []ast.Expr {
+	for i, expr := range exprs {
+		exprs[i] = r.expr(expr)
+	}
+	return exprs
+}
+
+func (r *hookRewriter) stmt(stmt ast.Stmt) ast.Stmt {
+	switch st := stmt.(type) {
+	case *ast.AssignStmt:
+		return r.assign(st)
+	case *ast.LocalAssignStmt:
+		for _, name := range st.Names {
+			r.name(st.Line(), name)
+		}
+		r.exprs(st.Exprs)
+	case *ast.FuncCallStmt:
+		r.expr(st.Expr)
+	case *ast.DoBlockStmt:
+		r.stmts(st.Stmts)
+	case *ast.WhileStmt:
+		st.Condition = r.expr(st.Condition)
+		r.stmts(st.Stmts)
+	case *ast.RepeatStmt:
+		st.Condition = r.expr(st.Condition)
+		r.stmts(st.Stmts)
+	case *ast.IfStmt:
+		st.Condition = r.expr(st.Condition)
+		r.stmts(st.Then)
+		r.stmts(st.Else)
+	case *ast.NumberForStmt:
+		r.name(st.Line(), st.Name)
+		st.Init = r.expr(st.Init)
+		st.Limit = r.expr(st.Limit)
+		if st.Step != nil {
+			st.Step = r.expr(st.Step)
+		}
+		r.stmts(st.Stmts)
+	case *ast.GenericForStmt:
+		for _, name := range st.Names {
+			r.name(st.Line(), name)
+		}
+		r.exprs(st.Exprs)
+		r.stmts(st.Stmts)
+	case *ast.FuncDefStmt:
+		if st.Name.Func != nil {
+			r.expr(st.Name.Func)
+		}
+		if st.Name.Receiver != nil {
+			r.expr(st.Name.Receiver)
+		}
+		r.expr(st.Func)
+	case *ast.ReturnStmt:
+		r.exprs(st.Exprs)
+	}
+	return stmt
+}
+
+// assign rewrites assignments to table fields. a.b = v becomes
+// __hook_set(a, "b", v), and when several values are assigned at once they
+// are kept in temporary locals first, as Lua evaluates all of them before
+// assigning any.
+func (r *hookRewriter) assign(st *ast.AssignStmt) ast.Stmt {
+	fields := false
+	for _, lhs := range st.Lhs {
+		switch target := lhs.(type) {
+		case *ast.IdentExpr:
+			r.name(st.Line(), target.Value)
+		case *ast.AttrGetExpr:
+			target.Object = r.expr(target.Object)
+			target.Key = r.expr(target.Key)
+			fields = true
+		}
+	}
+	r.exprs(st.Rhs)
+	if !fields {
+		return st
+	}
+
+	if len(st.Lhs) == 1 {
+		target := st.Lhs[0].(*ast.AttrGetExpr)
+		return r.setStmt(st.Line(), target, st.Rhs...)
+	}
+
+	values := &ast.LocalAssignStmt{Exprs: st.Rhs}
+	values.SetLine(st.Line())
+	block := &ast.DoBlockStmt{Stmts: []ast.Stmt{values}}
+	block.SetLine(st.Line())
+	for _, lhs := range st.Lhs {
+		r.temp++
+		name := fmt.Sprintf("%s%d", hookReservedPrefix, r.temp)
+		values.Names = append(values.Names, name)
+		value := &ast.IdentExpr{Value: name}
+		value.SetLine(st.Line())
+		if target, ok := lhs.(*ast.AttrGetExpr); ok {
+			block.Stmts = append(block.Stmts, r.setStmt(st.Line(), target, value))
+			continue
+		}
+		assign := &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Rhs: []ast.Expr{value}}
+		assign.SetLine(st.Line())
+		block.Stmts = append(block.Stmts, assign)
+	}
+	return block
+}
+
+func (r *hookRewriter) setStmt(line int, target *ast.AttrGetExpr, values ...ast.Expr) ast.Stmt {
+	args := append([]ast.Expr{target.Object, target.Key}, values...)
+	st := &ast.FuncCallStmt{Expr: hookHelperCall(line, hookSetName, args...)}
+	st.SetLine(line)
+	return st
+}
+
+func (r *hookRewriter) expr(expr ast.Expr) ast.Expr {
+	switch ex := expr.(type) {
+	case *ast.IdentExpr:
+		r.name(ex.Line(), ex.Value)
+	case *ast.AttrGetExpr:
+		ex.Object = r.expr(ex.Object)
+		ex.Key = r.expr(ex.Key)
+	case *ast.TableExpr:
+		for _, field := range ex.Fields {
+			if field.Key != nil {
+				field.Key = r.expr(field.Key)
+			}
+			field.Value = r.expr(field.Value)
+		}
+		return hookHelperCall(ex.Line(), hookTableName, ex)
+	case *ast.FuncCallExpr:
+		if ex.Func != nil {
+			ex.Func = r.expr(ex.Func)
+		}
+		if ex.Receiver != nil {
+			ex.Receiver = r.expr(ex.Receiver)
+		}
+		r.exprs(ex.Args)
+	case *ast.LogicalOpExpr:
+		ex.Lhs = r.expr(ex.Lhs)
+		ex.Rhs = r.expr(ex.Rhs)
+	case *ast.RelationalOpExpr:
+		ex.Lhs = r.expr(ex.Lhs)
+		ex.Rhs = r.expr(ex.Rhs)
+	case *ast.ArithmeticOpExpr:
+		ex.Lhs = r.expr(ex.Lhs)
+		ex.Rhs = r.expr(ex.Rhs)
+	case *ast.StringConcatOpExpr:
+		return hookHelperCall(ex.Line(), hookConcatName, r.expr(ex.Lhs), r.expr(ex.Rhs))
+	case *ast.UnaryMinusOpExpr:
+		ex.Expr = r.expr(ex.Expr)
+	case *ast.UnaryNotOpExpr:
+		ex.Expr = r.expr(ex.Expr)
+	case *ast.UnaryLenOpExpr:
+		ex.Expr = r.expr(ex.Expr)
+	case *ast.FunctionExpr:
+		for _, name := range ex.ParList.Names {
+			r.name(ex.Line(), name)
+		}
+		r.stmts(ex.Stmts)
+	}
+	return expr
+}
+
+// hookHelperCall builds a call of one of the sandbox helpers that returns a
+// single value
+func hookHelperCall(line int, helper string, args ...ast.Expr) *ast.FuncCallExpr {
+	fn := &ast.IdentExpr{Value: helper}
+	fn.SetLine(line)
+	call := &ast.FuncCallExpr{Func: fn, Args: args, AdjustRet: true}
+	call.SetLine(line)
+	call.SetLastLine(line)
+	return call
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookCompileTimeout(t *testing.T) {
+	hook := &EventHook{
+		Name:      "loop",
+		Script:    "while true do end\nfunction process(event) return event end",
+		TimeoutMs: 20,
+	}
+	if err := hook.Normalize(); err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- hook.Compile() }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "ran longer than") {
+			t.Errorf("Compile() = %v, want a timeout error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Compile did not stop the script at its timeout")
+	}
+}
+
+func TestHookRunRejectsCyclicTable(t *testing.T) {
+	hook := &EventHook{
+		Name:   "cycle",
+		Script: "function process(event) local t = {} t.self = t return t end",
+	}
+	if err := hook.Normalize(); err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+	if err := hook.Compile(); err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	event := map[string]interface{}{"type": "Message"}
+	result, keep, err := hook.Run(event)
+	if err == nil || !strings.Contains(err.Error(), "contains itself") {
+		t.Fatalf("Run() error = %v, want a cycle error", err)
+	}
+	if !keep || result["type"] != "Message" {
+		t.Errorf("Run() = %v, %v, want the event unchanged", result, keep)
+	}
+}
+
+func TestHookRunRejectsDeepTables(t *testing.T) {
+	hook := &EventHook{
+		Name:   "deep",
+		Script: "function process(event) local t = {} for i = 1, 100 do t = {inner = t} end return t end",
+	}
+	if err := hook.Normalize(); err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+	if err := hook.Compile(); err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	if _, _, err := hook.Run(map[string]interface{}{"type": "Message"}); err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Fatalf("Run() error = %v, want a depth error", err)
+	}
+}
+
+func TestHookRunSharedTable(t *testing.T) {
+	// The same table twice is not a cycle
+	hook := &EventHook{
+		Name:   "shared",
+		Script: "function process(event) local t = {a = 1} return {x = t, y = t} end",
+	}
+	if err := hook.Normalize(); err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+	if err := hook.Compile(); err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	result, _, err := hook.Run(map[string]interface{}{"type": "Message"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, ok := result["y"].(map[string]interface{}); !ok {
+		t.Errorf("Run() = %v, want y converted", result)
+	}
+}
+
+func TestHookRunStopsStringDoubling(t *testing.T) {
+	hook := &EventHook{
+		Name:      "doubling",
+		Script:    `function process(event) local s = "x" while true do s = s .. s end end`,
+		TimeoutMs: maxHookTimeoutMs,
+	}
+	if err := hook.Normalize(); err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+	if err := hook.Compile(); err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	start := time.Now()
+	_, keep, err := hook.Run(map[string]interface{}{"type": "Message"})
+	if err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Fatalf("Run() error = %v, want a memory limit error", err)
+	}
+	if !keep {
+		t.Error("Run() dropped the event of a failing hook")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run() took %s, want it stopped by the memory limit long before the timeout", elapsed)
+	}
+}
+
+func TestHookRunStopsLibraryAllocations(t *testing.T) {
+	for name, script := range map[string]string{
+		"rep":    `function process(event) return {s = string.rep("x", 1e9)} end`,
+		"gsub":   `function process(event) local s = "xxxxxxxx" for i = 1, 40 do s = s:gsub("x", "xx") end end`,
+		"format": `function process(event) return {s = string.format("%999999999d", 1)} end`,
+		"table":  `function process(event) local t = {} for i = 1, 1e8 do t[i] = i end end`,
+		"insert": `function process(event) local t = {} for i = 1, 1e8 do table.insert(t, i) end end`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			hook := &EventHook{Name: name, Script: script, TimeoutMs: maxHookTimeoutMs}
+			if err := hook.Normalize(); err != nil {
+				t.Fatalf("Normalize: %v", err)
+			}
+			if err := hook.Compile(); err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			if _, _, err := hook.Run(map[string]interface{}{"type": "Message"}); err == nil {
+				t.Fatal("Run() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestHookRunRewrittenOperations(t *testing.T) {
+	hook := &EventHook{
+		Name: "operations",
+		Script: `
+local prefix = "customer-"
+function process(event)
+	local out = {id = prefix .. event.id .. 1}
+	out.list = {}
+	out.list[1], out.list[2] = "a", "b"
+	out.redacted = ("call 555-1234 now"):gsub("%d", "#")
+	out.swapped = ("hello world"):gsub("(%w+) (%w+)", "%2 %1")
+	out.upper = ("a,b"):gsub("%a", string.upper)
+	local words = {}
+	for word in ("one two"):gmatch("%a+") do words[#words + 1] = word end
+	out.joined = table.concat(words, "+")
+	return out
+end`,
+	}
+	if err := hook.Normalize(); err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+	if err := hook.Compile(); err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	result, keep, err := hook.Run(map[string]interface{}{"type": "Message", "id": "42"})
+	if err != nil || !keep {
+		t.Fatalf("Run() = %v, %v, %v", result, keep, err)
+	}
+	want := map[string]interface{}{
+		"id":       "customer-421",
+		"redacted": "call ###-#### now",
+		"swapped":  "world hello",
+		"upper":    "A,B",
+		"joined":   "one+two",
+	}
+	for key, value := range want {
+		if result[key] != value {
+			t.Errorf("result[%q] = %v, want %v", key, result[key], value)
+		}
+	}
+	if list, ok := result["list"].([]interface{}); !ok || len(list) != 2 || list[0] != "a" || list[1] != "b" {
+		t.Errorf("result[\"list\"] = %v, want [a b]", result["list"])
+	}
+}
+
+func TestHookCompileRejectsReservedNames(t *testing.T) {
+	hook := &EventHook{
+		Name:   "reserved",
+		Script: "__hook_set = rawset function process(event) return event end",
+	}
+	if err := hook.Normalize(); err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+	if err := hook.Compile(); err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Errorf("Compile() = %v, want a reserved name error", err)
+	}
+}
+
+func TestHookRunReturnValues(t *testing.T) {
+	for name, tc := range map[string]struct {
+		script string
+		keep   bool
+	}{
+		"nothing": {"function process(event) event.crm_id = 1 end", true},
+		"nil":     {"function process(event) return nil end", true},
+		"true":    {"function process(event) return true end", true},
+		"false":   {"function process(event) return false end", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			hook := &EventHook{Name: name, Script: tc.script}
+			if err := hook.Normalize(); err != nil {
+				t.Fatalf("Normalize: %v", err)
+			}
+			if err := hook.Compile(); err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			result, keep, err := hook.Run(map[string]interface{}{"type": "Message"})
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if keep != tc.keep || result != nil {
+				t.Errorf("Run() = %v, %v, want nil, %v", result, keep, tc.keep)
+			}
+		})
+	}
+}
+
+func TestHookRunReusesLoadedState(t *testing.T) {
+	// The top level runs once per state and the memory limit applies to each
+	// event on its own
+	hook := &EventHook{
+		Name: "counter",
+		Script: `loads = (loads or 0) + 1
+seen = 0
+function process(event)
+  seen = seen + 1
+  local s = string.rep("x", 600 * 1024)
+  event.loads = loads
+  event.seen = seen
+  return event
+end`,
+		MemoryLimitKB: 1024,
+	}
+	if err := hook.Normalize(); err != nil {
+		t.Fatalf("Normalize: %v", err)
+	}
+	if err := hook.Compile(); err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		result, keep, err := hook.Run(map[string]interface{}{"type": "Message"})
+		if err != nil || !keep {
+			t.Fatalf("Run() = %v, %v, %v", result, keep, err)
+		}
+		if result["loads"] != float64(1) || result["seen"] != float64(i) {
+			t.Errorf("run %d: loads = %v, seen = %v, want 1 and %d", i, result["loads"], result["seen"], i)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// Kafka topic modes
+const (
+	// KafkaTopicModeSingle publishes every event to KAFKA_TOPIC
+	KafkaTopicModeSingle = "single"
+	// KafkaTopicModeEventType publishes to KAFKA_TOPIC.<event type>
+	KafkaTopicModeEventType = "event_type"
+)
+
+var (
+	kafkaProducer  *kgo.Client
+	kafkaEnabled   bool
+	kafkaTopic     string
+	kafkaTopicMode string
+)
+
+// kafkaTopicInvalid matches the characters Kafka doesn't allow in topic names
+var kafkaTopicInvalid = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// InitKafka connects the Kafka producer when KAFKA_BROKERS is set
+func InitKafka() {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		kafkaEnabled = false
+		log.Info().Msg("KAFKA_BROKERS is not set. Kafka publishing disabled.")
+		return
+	}
+
+	kafkaTopic = os.Getenv("KAFKA_TOPIC")
+	if kafkaTopic == "" {
+		kafkaTopic = "whatsapp_events"
+	}
+	kafkaTopicMode = strings.ToLower(os.Getenv("KAFKA_TOPIC_MODE"))
+	if kafkaTopicMode == "" {
+		kafkaTopicMode = KafkaTopicModeSingle
+	}
+	if kafkaTopicMode != KafkaTopicModeSingle && kafkaTopicMode != KafkaTopicModeEventType {
+		log.Error().Str("mode", kafkaTopicMode).Msg("KAFKA_TOPIC_MODE must be 'single' or 'event_type', Kafka publishing disabled")
+		return
+	}
+
+	tlsConfig, err := brokerTLSConfig("KAFKA")
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid Kafka TLS settings, Kafka publishing disabled")
+		return
+	}
+	var seeds []string
+	for _, broker := range strings.Split(brokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			seeds = append(seeds, broker)
+		}
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(seeds...),
+		kgo.ClientID("wuzapi"),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		// Topics are created by the broker on first use when it allows it
+		kgo.AllowAutoTopicCreation(),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	mechanism, err := kafkaSASL(strings.ToUpper(os.Getenv("KAFKA_SASL_MECHANISM")), os.Getenv("KAFKA_USERNAME"), os.Getenv("KAFKA_PASSWORD"))
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid Kafka SASL settings, Kafka publishing disabled")
+		return
+	}
+	if mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not create Kafka producer")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		client.Close()
+		log.Error().Err(err).Msg("Could not connect to Kafka")
+		return
+	}
+
+	kafkaProducer = client
+	kafkaEnabled = true
+	log.Info().
+		Strs("brokers", seeds).
+		Str("topic", kafkaTopic).
+		Str("mode", kafkaTopicMode).
+		Msg("Kafka connection established.")
+}
+
+// kafkaSASL returns the SASL mechanism of KAFKA_SASL_MECHANISM, nil to
+// connect without authentication
+func kafkaSASL(mechanism string, username string, password string) (sasl.Mechanism, error) {
+	switch mechanism {
+	case "":
+		return nil, nil
+	case "PLAIN":
+		return plain.Auth{User: username, Pass: password}.AsMechanism(), nil
+	case "SCRAM-SHA-256":
+		return scram.Auth{User: username, Pass: password}.AsSha256Mechanism(), nil
+	case "SCRAM-SHA-512":
+		return scram.Auth{User: username, Pass: password}.AsSha512Mechanism(), nil
+	}
+	return nil, errors.New("unsupported SASL mechanism " + mechanism + ", must be PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512")
+}
+
+// kafkaTopicFor returns the topic events of a type are published to
+func kafkaTopicFor(eventType string) string {
+	if kafkaTopicMode == KafkaTopicModeEventType && eventType != "" {
+		return kafkaTopic + "." + kafkaTopicInvalid.ReplaceAllString(eventType, "_")
+	}
+	return kafkaTopic
+}
+
+// Usage - like sendToGlobalRabbit
+func sendToKafka(jsonData []byte, userID string, token string, eventType string) {
+	if !kafkaEnabled {
+		return
+	}
+	GetDeliveryManager().Enqueue(&DeliveryEvent{
+		UserID:      userID,
+		Token:       token,
+		Channel:     DeliveryChannelKafka,
+		Destination: kafkaTopicFor(eventType),
+		EventType:   eventType,
+		Payload:     string(jsonData),
+	})
+}
+
+// publishToKafka sends an event with the same JSON payload as RabbitMQ. The
+// record key is the user ID, so the events of an instance keep their order,
+// and the instance is described in the record headers.
+func publishToKafka(ctx context.Context, event *DeliveryEvent) error {
+	if !kafkaEnabled {
+		return errors.New("Kafka is not connected")
+	}
+	body, encoding, err := encodePayload(event)
+	if err != nil {
+		return err
+	}
+	headers := deliveryHeaders(nil, event)
+	headers["instanceId"] = event.UserID
+	headers["instanceName"] = instanceName(event.Token)
+	headers["eventType"] = event.EventType
+	headers["Content-Type"] = payloadContentType(event)
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+		headers["payloadDecoding"] = payloadDecoding(event, encoding, false)
+	}
+	record := &kgo.Record{
+		Topic: event.Destination,
+		Key:   []byte(event.UserID),
+		Value: body,
+	}
+	// The default partitioner hashes keys like the Java client
+	for _, name := range sortedKeys(headers) {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: name, Value: []byte(headers[name])})
+	}
+	return kafkaProducer.ProduceSync(ctx, record).FirstErr()
+}
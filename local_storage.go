@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalStorage keeps media on the local filesystem using the same key layout
+// as S3 and serves it through the authenticated /media/{key} route
+type LocalStorage struct {
+	root    string
+	baseURL string
+}
+
+// localMediaRoot returns the directory media is written to, MEDIA_LOCAL_PATH
+// or files/media next to the executable
+func localMediaRoot() string {
+	if root := os.Getenv("MEDIA_LOCAL_PATH"); root != "" {
+		return root
+	}
+	ex, err := os.Executable()
+	if err != nil {
+		return filepath.Join("files", "media")
+	}
+	return filepath.Join(filepath.Dir(ex), "files", "media")
+}
+
+// localMediaPath maps an object key to a path below the media root, refusing
+// keys that would escape it
+func localMediaPath(root, key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", errors.New("invalid media key")
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return "", errors.New("invalid media key")
+		}
+	}
+	return filepath.Join(root, filepath.FromSlash(key)), nil
+}
+
+// NewLocalStorage creates a filesystem backend. Media URLs are built from the
+// user public_url or MEDIA_BASE_URL, and are relative when neither is set.
+func NewLocalStorage(config *S3Config) (*LocalStorage, error) {
+	root := localMediaRoot()
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create media directory %s: %w", root, err)
+	}
+
+	baseURL := config.PublicURL
+	if baseURL == "" {
+		baseURL = os.Getenv("MEDIA_BASE_URL")
+	}
+
+	return &LocalStorage{
+		root:    root,
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}, nil
+}
+
+// Upload writes the object atomically so readers never see partial files
+func (l *LocalStorage) Upload(ctx context.Context, key string, data []byte, mimeType string) error {
+	return l.UploadStream(ctx, key, bytes.NewReader(data), int64(len(data)), mimeType)
+}
+
+// UploadStream copies the reader to a temporary file and moves it into place
+func (l *LocalStorage) UploadStream(ctx context.Context, key string, body io.Reader, size int64, mimeType string) error {
+	path, err := localMediaPath(l.root, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return fmt.Errorf("failed to create media directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create media file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write media file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write media file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store media file: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the object stored under key
+func (l *LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := localMediaPath(l.root, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Exists reports whether an object is stored under key
+func (l *LocalStorage) Exists(ctx context.Context, key string) (bool, error) {
+	path, err := localMediaPath(l.root, key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Open returns the file stored under key
+func (l *LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := localMediaPath(l.root, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// PublicURL returns the /media route for the object
+func (l *LocalStorage) PublicURL(key string) string {
+	return l.baseURL + "/media/" + key
+}
+
+// Test checks that the media directory is writable
+func (l *LocalStorage) Test(ctx context.Context) error {
+	probe, err := os.CreateTemp(l.root, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("media directory %s is not writable: %w", l.root, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// DeleteOlderThan removes files under prefix last modified before cutoff
+func (l *LocalStorage) DeleteOlderThan(ctx context.Context, prefix string, cutoff time.Time) (int64, int64, error) {
+	return l.DeleteModifiedBetween(ctx, prefix, time.Time{}, cutoff)
+}
+
+// DeleteModifiedBetween removes files under prefix modified within [from, to)
+func (l *LocalStorage) DeleteModifiedBetween(ctx context.Context, prefix string, from, to time.Time) (int64, int64, error) {
+	dir, err := localMediaPath(l.root, strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var deleted, deletedBytes int64
+	err = filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !inTimeRange(info.ModTime(), from, to) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		deleted++
+		deletedBytes += info.Size()
+		return nil
+	})
+	return deleted, deletedBytes, err
+}
+
+// DeletePrefix removes every object whose key starts with prefix
+func (l *LocalStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	path, err := localMediaPath(l.root, strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
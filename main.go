@@ -62,7 +62,9 @@ func init() {
 	if err != nil {
 		log.Warn().Err(err).Msg("It was not possible to load the .env file (it may not exist).")
 	}
+}
 
+func main() {
 	flag.Parse()
 
 	// Novo bloco para sobrescrever o osName pelo ENV, se existir
@@ -155,9 +157,10 @@ func init() {
 	}
 
 	InitRabbitMQ()
-}
+	InitKafka()
+	InitNATS()
+	InitRedis()
 
-func main() {
 	ex, err := os.Executable()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to get executable path")
@@ -187,6 +190,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	GetHookManager().SetDB(db)
+
+	// Resume webhook and RabbitMQ deliveries left pending by the last run
+	if err := InitDeliveryManager(db); err != nil {
+		log.Error().Err(err).Msg("Failed to initialize delivery manager")
+	}
+
+	// Load persisted S3 configurations so media offload works right after boot
+	GetS3Manager().SetDB(db)
+	if err := GetS3Manager().LoadAllConfigs(); err != nil {
+		log.Error().Err(err).Msg("Failed to load S3 configurations")
+	}
+	GetS3Manager().StartRetentionJanitor(retentionInterval())
+
 	var dbLog waLog.Logger
 	if *waDebug != "" {
 		dbLog = waLog.Stdout("Database", *waDebug, *colorOutput)
@@ -220,6 +237,8 @@ func main() {
 
 	s.connectOnStartup()
 
+	StartRabbitCommandConsumer(s.router)
+
 	srv := &http.Server{
 		Addr:              *address + ":" + *port,
 		Handler:           s.router,
@@ -245,13 +264,25 @@ func main() {
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				defer cancel()
 
+				exitCode := 0
 				if err := srv.Shutdown(ctx); err != nil {
 					log.Error().Err(err).Msg("Failed to stop server")
-					os.Exit(1)
+					exitCode = 1
 				}
+				StopRabbitCommandConsumer(ctx)
 
-				log.Info().Msg("Server Exited Properly")
-				os.Exit(0)
+				// Let deliveries in flight finish and keep the pending ones
+				deliveryCtx, deliveryCancel := context.WithTimeout(context.Background(), deliveryShutdownTimeout())
+				defer deliveryCancel()
+				if err := GetDeliveryManager().Shutdown(deliveryCtx); err != nil {
+					log.Error().Err(err).Msg("Failed to stop delivery manager")
+				}
+				CloseRabbitMQ()
+
+				if exitCode == 0 {
+					log.Info().Msg("Server Exited Properly")
+				}
+				os.Exit(exitCode)
 			})
 		}
 	}()
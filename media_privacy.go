@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+var errMalformedImage = errors.New("malformed image")
+
+// stripMetadataCache holds the strip_metadata setting by user ID, it is
+// checked for every media message
+var stripMetadataCache = cache.New(5*time.Minute, 10*time.Minute)
+
+// stripMetadataEnabled reports whether a user asked for image metadata to be
+// removed from media before it is stored or forwarded
+func stripMetadataEnabled(db *sqlx.DB, userID string) bool {
+	if enabled, found := stripMetadataCache.Get(userID); found {
+		return enabled.(bool)
+	}
+	var enabled bool
+	if err := db.Get(&enabled, "SELECT strip_metadata FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to get strip_metadata setting")
+		return false
+	}
+	stripMetadataCache.Set(userID, enabled, cache.DefaultExpiration)
+	return enabled
+}
+
+// stripMediaMetadata removes EXIF, XMP, IPTC and text metadata (GPS position,
+// device and software details) from JPEG, PNG and WebP images. Pixel data and
+// color profiles are kept as is. Other media types are returned unchanged.
+func stripMediaMetadata(data []byte, mimeType string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0])) {
+	case "image/jpeg", "image/jpg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		return stripPNGMetadata(data)
+	case "image/webp":
+		return stripWebPMetadata(data)
+	}
+	return data, nil
+}
+
+// stripMediaMetadataOrKeep strips metadata, keeping the original content when
+// the image can't be parsed
+func stripMediaMetadataOrKeep(userID string, data []byte, mimeType string) []byte {
+	stripped, err := stripMediaMetadata(data, mimeType)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Str("mimeType", mimeType).Msg("Failed to strip image metadata, keeping original")
+		return data
+	}
+	return stripped
+}
+
+// stripOutgoingMetadata strips the metadata of an image a user sends when
+// they turned strip_metadata on. The type is sniffed from the content, so
+// images sent as documents and WebP stickers are covered too.
+func stripOutgoingMetadata(db *sqlx.DB, userID string, data []byte) []byte {
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") || !stripMetadataEnabled(db, userID) {
+		return data
+	}
+	return stripMediaMetadataOrKeep(userID, data, mimeType)
+}
+
+// stripJPEGMetadata drops the APP1 (EXIF, XMP), APP13 (IPTC) and comment
+// segments. The EXIF orientation is kept in a segment of its own, or the
+// image would be shown rotated. Everything from the start of scan on is
+// copied unchanged.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errMalformedImage
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	pos := 2
+	oriented := false
+	for pos < len(data) {
+		if data[pos] != 0xFF || pos+1 >= len(data) {
+			return nil, errMalformedImage
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// Fill byte
+			pos++
+			continue
+		}
+		// Markers without a length
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out = append(out, data[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+		if marker == 0xD9 {
+			return append(out, data[pos:]...), nil
+		}
+		if pos+4 > len(data) {
+			return nil, errMalformedImage
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) || end < pos+4 {
+			return nil, errMalformedImage
+		}
+		if marker == 0xDA {
+			// Start of scan, the entropy coded data runs to the end
+			return append(out, data[pos:]...), nil
+		}
+		if marker == 0xE1 && !oriented {
+			if orientation := exifOrientation(data[pos+4 : end]); orientation > 1 {
+				out = append(out, exifOrientationSegment(orientation)...)
+				oriented = true
+			}
+		}
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return out, nil
+}
+
+// exifOrientationTag is the TIFF tag telling how the image must be rotated or
+// flipped to be displayed
+const exifOrientationTag = 0x0112
+
+// exifOrientation returns the Orientation of the EXIF block in an APP1
+// segment, 0 when there is none
+func exifOrientation(segment []byte) uint16 {
+	if len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := segment[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// A SHORT value is stored in the first bytes of the value field
+		if order.Uint16(tiff[entry:]) == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := order.Uint16(tiff[entry+8:]); orientation <= 8 {
+				return orientation
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// exifOrientationSegment builds an APP1 segment with an EXIF block holding
+// only the Orientation tag
+func exifOrientationSegment(orientation uint16) []byte {
+	segment := []byte{0xFF, 0xE1, 0x00, 0x22}
+	segment = append(segment, "Exif\x00\x00"...)
+	// Big endian TIFF header with IFD0 right after it
+	segment = append(segment, 'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08)
+	// One entry: Orientation, SHORT, count 1
+	segment = append(segment, 0x00, 0x01)
+	segment = append(segment, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01)
+	segment = append(segment, byte(orientation>>8), byte(orientation), 0x00, 0x00)
+	// No next IFD
+	return append(segment, 0x00, 0x00, 0x00, 0x00)
+}
+
+// stripPNGMetadata drops the eXIf, text and modification time chunks
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errMalformedImage
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, signature...)
+	pos := len(signature)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errMalformedImage
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return out, nil
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of extended WebP files and
+// clears their flags in the VP8X header
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errMalformedImage
+	}
+
+	const (
+		flagXMP  = 0x04
+		flagEXIF = 0x08
+	)
+
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, errMalformedImage
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			// The padding byte of the last chunk is sometimes missing
+			if end == len(data)+1 && size%2 == 1 {
+				end = len(data)
+			} else {
+				return nil, errMalformedImage
+			}
+		}
+		switch string(data[pos : pos+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[pos:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= flagEXIF | flagXMP
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
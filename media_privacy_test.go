@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testJPEG builds a JPEG with an APP0 segment, an EXIF APP1 segment holding
+// the orientation and a GPS tag, a comment and a start of scan
+func testJPEG(order binary.AppendByteOrder, orientation uint16) []byte {
+	tiff := []byte("MM")
+	if order == binary.LittleEndian {
+		tiff = []byte("II")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 2)
+	// GPSInfo pointer, then Orientation
+	tiff = order.AppendUint16(tiff, 0x8825)
+	tiff = order.AppendUint16(tiff, 4)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint32(tiff, 0x1234)
+	tiff = order.AppendUint16(tiff, exifOrientationTag)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	exif := append([]byte("Exif\x00\x00"), tiff...)
+
+	segment := func(marker byte, payload []byte) []byte {
+		return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	}
+	data := []byte{0xFF, 0xD8}
+	data = append(data, segment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))...)
+	data = append(data, segment(0xE1, exif)...)
+	data = append(data, segment(0xFE, []byte("taken at home"))...)
+	data = append(data, segment(0xDA, []byte{0x01, 0x01, 0x00, 0x00, 0x3F, 0x00})...)
+	return append(data, 0x12, 0x34, 0xFF, 0xD9)
+}
+
+func TestStripJPEGMetadataKeepsOrientation(t *testing.T) {
+	for _, order := range []binary.AppendByteOrder{binary.LittleEndian, binary.BigEndian} {
+		stripped, err := stripJPEGMetadata(testJPEG(order, 6))
+		if err != nil {
+			t.Fatalf("stripJPEGMetadata: %v", err)
+		}
+		if bytes.Contains(stripped, []byte("taken at home")) {
+			t.Error("comment was not removed")
+		}
+		if !bytes.Contains(stripped, exifOrientationSegment(6)) {
+			t.Errorf("%v: orientation segment missing", order)
+		}
+		if got := exifOrientation(exifOrientationSegment(6)[4:]); got != 6 {
+			t.Errorf("exifOrientation() = %d, want 6", got)
+		}
+		if bytes.Contains(stripped, []byte{0x88, 0x25}) || bytes.Contains(stripped, []byte{0x25, 0x88}) {
+			t.Errorf("%v: GPS tag was kept", order)
+		}
+	}
+
+	stripped, err := stripJPEGMetadata(testJPEG(binary.BigEndian, 1))
+	if err != nil {
+		t.Fatalf("stripJPEGMetadata: %v", err)
+	}
+	if bytes.Contains(stripped, []byte("Exif")) {
+		t.Error("EXIF segment kept for an image that needs no rotation")
+	}
+}
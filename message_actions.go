@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	// messageEditWindow is how long WhatsApp accepts edits of a message
+	messageEditWindow = 15 * time.Minute
+	// messageRevokeWindow is how long a message can be deleted for everyone
+	messageRevokeWindow = 48 * time.Hour
+)
+
+// sentMessage is a message sent through the API or from another device of the
+// account, remembered so edits and revokes can be checked before they are sent
+type sentMessage struct {
+	Chat      types.JID
+	Timestamp time.Time
+}
+
+var sentMessageCache = cache.New(messageRevokeWindow, time.Hour)
+
+// rememberSentMessage keeps the chat and time of a message sent by the account
+// for as long as it can be revoked
+func rememberSentMessage(userID string, chat types.JID, messageID string, timestamp time.Time) {
+	sentMessageCache.Set(userID+"/"+messageID, sentMessage{Chat: chat.ToNonAD(), Timestamp: timestamp}, cache.DefaultExpiration)
+}
+
+// checkMessageAction checks that a message was sent by the account to chat
+// and is younger than window. Messages that aren't remembered, such as the
+// ones sent before a restart, are rejected as WhatsApp ignores the edits and
+// revokes it can't apply without reporting an error.
+func checkMessageAction(userID string, chat types.JID, messageID string, window time.Duration, action string) error {
+	cached, found := sentMessageCache.Get(userID + "/" + messageID)
+	if !found {
+		return fmt.Errorf("message %s is unknown or too old to %s", messageID, action)
+	}
+	sent := cached.(sentMessage)
+	if sent.Chat != chat.ToNonAD() {
+		return fmt.Errorf("message %s was not sent to %s", messageID, chat.String())
+	}
+	if time.Since(sent.Timestamp) > window {
+		return fmt.Errorf("message %s is too old to %s, the limit is %s", messageID, action, window)
+	}
+	return nil
+}
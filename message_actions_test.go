@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestCheckMessageActionUnknownMessage(t *testing.T) {
+	chat := types.NewJID("5491155553934", types.DefaultUserServer)
+	if err := checkMessageAction("test-unknown", chat, "3EB0UNKNOWN", messageEditWindow, "edit"); err == nil || !strings.Contains(err.Error(), "unknown or too old to edit") {
+		t.Errorf("checkMessageAction() = %v, want an unknown message error", err)
+	}
+	if err := checkMessageAction("test-unknown", chat, "3EB0UNKNOWN", messageRevokeWindow, "revoke"); err == nil || !strings.Contains(err.Error(), "unknown or too old to revoke") {
+		t.Errorf("checkMessageAction() = %v, want an unknown message error", err)
+	}
+}
+
+func TestCheckMessageActionRememberedMessage(t *testing.T) {
+	chat := types.NewJID("5491155553934", types.DefaultUserServer)
+	other := types.NewJID("5491155550000", types.DefaultUserServer)
+
+	rememberSentMessage("test-known", chat, "3EB0RECENT", time.Now())
+	if err := checkMessageAction("test-known", chat, "3EB0RECENT", messageEditWindow, "edit"); err != nil {
+		t.Errorf("checkMessageAction() = %v, want nil", err)
+	}
+	if err := checkMessageAction("test-known", other, "3EB0RECENT", messageEditWindow, "edit"); err == nil || !strings.Contains(err.Error(), "was not sent to") {
+		t.Errorf("checkMessageAction() = %v, want a wrong chat error", err)
+	}
+
+	rememberSentMessage("test-known", chat, "3EB0OLD", time.Now().Add(-time.Hour))
+	if err := checkMessageAction("test-known", chat, "3EB0OLD", messageEditWindow, "edit"); err == nil || !strings.Contains(err.Error(), "too old") {
+		t.Errorf("checkMessageAction() = %v, want a too old error", err)
+	}
+	if err := checkMessageAction("test-known", chat, "3EB0OLD", messageRevokeWindow, "revoke"); err != nil {
+		t.Errorf("checkMessageAction() = %v, want nil within the revoke window", err)
+	}
+}
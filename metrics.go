@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the metrics exported on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+// authmetrics checks the admin token, also accepting it as a bearer token
+// since that is what Prometheus scrape configs send
+func (s *server) authmetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Export metrics in the Prometheus exposition format
+func (s *server) Metrics() http.HandlerFunc {
+	handler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{
+		// A broken collector must not hide the other metrics
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+	return handler.ServeHTTP
+}
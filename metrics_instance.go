@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// httpLatencyBuckets are the upper bounds, in seconds, of the HTTP latency
+// histogram
+var httpLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Delivery attempt outcomes
+const (
+	deliveryOutcomeDelivered = "delivered"
+	deliveryOutcomeRetry     = "retry"
+	deliveryOutcomeFailed    = "failed"
+)
+
+var (
+	messagesReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_messages_received_total",
+		Help: "Messages received from contacts.",
+	}, []string{"user_id"})
+	messagesSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_messages_sent_total",
+		Help: "Messages sent through the API.",
+	}, []string{"user_id"})
+	reconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_reconnects_total",
+		Help: "Connections to WhatsApp after the first one of the process.",
+	}, []string{"user_id"})
+	mediaDownloadedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_media_downloaded_bytes_total",
+		Help: "Bytes of media downloaded from WhatsApp.",
+	}, []string{"user_id"})
+	deliveryAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_delivery_attempts_total",
+		Help: "Delivery attempts by channel and outcome.",
+	}, []string{"user_id", "channel", "outcome"})
+
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wuzapi_http_requests_total",
+		Help: "API requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wuzapi_http_request_duration_seconds",
+		Help:    "API request latencies by route and method.",
+		Buckets: httpLatencyBuckets,
+	}, []string{"route", "method"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		messagesReceivedTotal,
+		messagesSentTotal,
+		reconnectsTotal,
+		mediaDownloadedBytesTotal,
+		deliveryAttemptsTotal,
+		httpRequestsTotal,
+		httpRequestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// connectedUsers holds the instances connected since the start, so the
+// connections that follow are counted as reconnects
+var connectedUsers sync.Map
+
+// recordMessageReceived counts a message received from a contact
+func recordMessageReceived(userID string) {
+	messagesReceivedTotal.WithLabelValues(userID).Inc()
+}
+
+// recordMessageSent counts a message sent through the API
+func recordMessageSent(userID string) {
+	messagesSentTotal.WithLabelValues(userID).Inc()
+}
+
+// recordConnected counts a connection to WhatsApp, all but the first of an
+// instance are reconnects
+func recordConnected(userID string) {
+	reconnects := reconnectsTotal.WithLabelValues(userID)
+	if _, seen := connectedUsers.LoadOrStore(userID, true); seen {
+		reconnects.Inc()
+	}
+}
+
+// recordMediaBytes counts media downloaded from WhatsApp
+func recordMediaBytes(userID string, size int) {
+	mediaDownloadedBytesTotal.WithLabelValues(userID).Add(float64(size))
+}
+
+// recordDeliveryAttempt counts a delivery attempt by channel and outcome
+func recordDeliveryAttempt(userID string, channel string, outcome string) {
+	deliveryAttemptsTotal.WithLabelValues(userID, channel, outcome).Inc()
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection, for streaming
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// httpMetrics records the requests and latencies of a route and counts the
+// messages sent through /chat/send routes. Bulk sends count their messages as
+// they go out.
+func httpMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		elapsed := time.Since(start).Seconds()
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		// Streams stay open for as long as the client wants
+		if route != "/events/stream" {
+			httpRequestDuration.WithLabelValues(route, r.Method).Observe(elapsed)
+		}
+
+		if strings.HasPrefix(route, "/chat/send/") && !strings.HasPrefix(route, "/chat/send/bulk") && recorder.status < 300 {
+			if userinfo, ok := r.Context().Value("userinfo").(Values); ok {
+				recordMessageSent(userinfo.Get("Id"))
+			}
+		}
+	})
+}
@@ -50,6 +50,156 @@ var migrations = []Migration{
 		Name:  "add_s3_support",
 		UpSQL: addS3SupportSQL,
 	},
+	{
+		ID:    5,
+		Name:  "add_event_hooks",
+		UpSQL: addEventHooksSQL,
+	},
+	{
+		ID:    6,
+		Name:  "add_message_templates",
+		UpSQL: addMessageTemplatesSQL,
+	},
+	{
+		ID:    7,
+		Name:  "add_storage_provider",
+		UpSQL: addStorageProviderSQL,
+	},
+	{
+		ID:    8,
+		Name:  "add_azure_storage",
+		UpSQL: addAzureStorageSQL,
+	},
+	{
+		ID:    9,
+		Name:  "add_media_url_mode",
+		UpSQL: addMediaURLModeSQL,
+	},
+	{
+		ID:    10,
+		Name:  "add_s3_server_side_encryption",
+		UpSQL: addS3ServerSideEncryptionSQL,
+	},
+	{
+		ID:    11,
+		Name:  "add_media_dedup",
+		UpSQL: addMediaDedupSQL,
+	},
+	{
+		ID:    12,
+		Name:  "add_storage_usage",
+		UpSQL: addStorageUsageSQL,
+	},
+	{
+		ID:    13,
+		Name:  "add_s3_object_metadata",
+		UpSQL: addS3ObjectMetadataSQL,
+	},
+	{
+		ID:    14,
+		Name:  "add_storage_mirror",
+		UpSQL: addStorageMirrorSQL,
+	},
+	{
+		ID:    15,
+		Name:  "add_s3_credential_mode",
+		UpSQL: addS3CredentialModeSQL,
+	},
+	{
+		ID:    16,
+		Name:  "add_s3_client_encryption",
+		UpSQL: addS3ClientEncryptionSQL,
+	},
+	{
+		ID:    17,
+		Name:  "add_s3_thumbnails",
+		UpSQL: addS3ThumbnailsSQL,
+	},
+	{
+		ID:    18,
+		Name:  "add_s3_transport_options",
+		UpSQL: addS3TransportOptionsSQL,
+	},
+	{
+		ID:    19,
+		Name:  "add_media_scan",
+		UpSQL: addMediaScanSQL,
+	},
+	{
+		ID:    20,
+		Name:  "add_strip_metadata",
+		UpSQL: addStripMetadataSQL,
+	},
+	{
+		ID:    21,
+		Name:  "create_delivery_events",
+		UpSQL: createDeliveryEventsSQL,
+	},
+	{
+		ID:    22,
+		Name:  "add_delivery_policy",
+		UpSQL: addDeliveryPolicySQL,
+	},
+	{
+		ID:    23,
+		Name:  "create_delivery_results",
+		UpSQL: createDeliveryResultsSQL,
+	},
+	{
+		ID:    24,
+		Name:  "add_delivery_rate_limit",
+		UpSQL: addDeliveryRateLimitSQL,
+	},
+	{
+		ID:    25,
+		Name:  "add_webhook_tls",
+		UpSQL: addWebhookTLSSQL,
+	},
+	{
+		ID:    26,
+		Name:  "add_webhook_headers",
+		UpSQL: addWebhookHeadersSQL,
+	},
+	{
+		ID:    27,
+		Name:  "add_webhook_failover",
+		UpSQL: addWebhookFailoverSQL,
+	},
+	{
+		ID:    28,
+		Name:  "add_nats_settings",
+		UpSQL: addNATSSettingsSQL,
+	},
+	{
+		ID:    29,
+		Name:  "add_sqs_settings",
+		UpSQL: addSQSSettingsSQL,
+	},
+	{
+		ID:    30,
+		Name:  "add_pubsub_settings",
+		UpSQL: addPubSubSettingsSQL,
+	},
+	{
+		ID:    31,
+		Name:  "add_amqp_settings",
+		UpSQL: addAMQPSettingsSQL,
+	},
+	{
+		ID:    32,
+		Name:  "add_user_disabled",
+		UpSQL: addUserDisabledSQL,
+	},
+	{
+		ID:    33,
+		Name:  "add_template_buttons",
+		UpSQL: addTemplateButtonsSQL,
+	},
+	{
+		ID:    34,
+		Name:  "create_polls",
+		UpSQL: createPollsSQL,
+	},
 }
 
 const changeIDToStringSQL = `
@@ -143,6 +293,447 @@ BEGIN
 END $$;
 `
 
+const addEventHooksSQL = `
+CREATE TABLE IF NOT EXISTS event_hooks (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    runtime TEXT NOT NULL DEFAULT 'lua',
+    script TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    timeout_ms INTEGER NOT NULL DEFAULT 50,
+    memory_limit_kb INTEGER NOT NULL DEFAULT 1024,
+    priority INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_event_hooks_user_id ON event_hooks (user_id);
+`
+
+const addMessageTemplatesSQL = `
+CREATE TABLE IF NOT EXISTS message_templates (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    type TEXT NOT NULL DEFAULT 'text',
+    body TEXT NOT NULL DEFAULT '',
+    media TEXT NOT NULL DEFAULT '',
+    mime_type TEXT NOT NULL DEFAULT '',
+    file_name TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, name)
+);
+`
+
+const addStorageProviderSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'storage_provider') THEN
+        ALTER TABLE users ADD COLUMN storage_provider TEXT DEFAULT 's3';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'gcs_credentials') THEN
+        ALTER TABLE users ADD COLUMN gcs_credentials TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addAzureStorageSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'azure_connection_string') THEN
+        ALTER TABLE users ADD COLUMN azure_connection_string TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addMediaURLModeSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_url_mode') THEN
+        ALTER TABLE users ADD COLUMN s3_url_mode TEXT DEFAULT 'public';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_presign_ttl') THEN
+        ALTER TABLE users ADD COLUMN s3_presign_ttl INTEGER DEFAULT 3600;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addS3ServerSideEncryptionSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_sse_type') THEN
+        ALTER TABLE users ADD COLUMN s3_sse_type TEXT DEFAULT '';
+    END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_kms_key_id') THEN
+        ALTER TABLE users ADD COLUMN s3_kms_key_id TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addMediaDedupSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_dedup') THEN
+        ALTER TABLE users ADD COLUMN s3_dedup BOOLEAN DEFAULT FALSE;
+    END IF;
+END $$;
+` + createMediaObjectsSQL
+
+const createMediaObjectsSQL = `
+CREATE TABLE IF NOT EXISTS media_objects (
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message_id TEXT NOT NULL,
+    sha256 TEXT NOT NULL,
+    object_key TEXT NOT NULL,
+    size BIGINT NOT NULL DEFAULT 0,
+    mime_type TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, message_id)
+);
+CREATE INDEX IF NOT EXISTS idx_media_objects_hash ON media_objects (user_id, sha256);
+`
+
+const addStorageUsageSQL = `
+CREATE TABLE IF NOT EXISTS storage_usage (
+    user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    bytes_uploaded BIGINT NOT NULL DEFAULT 0,
+    objects BIGINT NOT NULL DEFAULT 0,
+    deduplicated BIGINT NOT NULL DEFAULT 0,
+    failures BIGINT NOT NULL DEFAULT 0,
+    last_upload_at BIGINT NOT NULL DEFAULT 0,
+    last_failure_at BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const addS3ObjectMetadataSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_object_metadata') THEN
+        ALTER TABLE users ADD COLUMN s3_object_metadata BOOLEAN DEFAULT FALSE;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addStorageMirrorSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'storage_mirror') THEN
+        ALTER TABLE users ADD COLUMN storage_mirror TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addS3CredentialModeSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_credential_mode') THEN
+        ALTER TABLE users ADD COLUMN s3_credential_mode TEXT DEFAULT 'static';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_role_arn') THEN
+        ALTER TABLE users ADD COLUMN s3_role_arn TEXT DEFAULT '';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_external_id') THEN
+        ALTER TABLE users ADD COLUMN s3_external_id TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addS3ClientEncryptionSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_encryption') THEN
+        ALTER TABLE users ADD COLUMN s3_encryption TEXT DEFAULT '';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_encryption_key') THEN
+        ALTER TABLE users ADD COLUMN s3_encryption_key TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addS3ThumbnailsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_thumbnails') THEN
+        ALTER TABLE users ADD COLUMN s3_thumbnails BOOLEAN DEFAULT FALSE;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addS3TransportOptionsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_ca_bundle') THEN
+        ALTER TABLE users ADD COLUMN s3_ca_bundle TEXT DEFAULT '';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_insecure_skip_verify') THEN
+        ALTER TABLE users ADD COLUMN s3_insecure_skip_verify BOOLEAN DEFAULT FALSE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 's3_http_proxy') THEN
+        ALTER TABLE users ADD COLUMN s3_http_proxy TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addMediaScanSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'media_scan') THEN
+        ALTER TABLE users ADD COLUMN media_scan TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addStripMetadataSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'strip_metadata') THEN
+        ALTER TABLE users ADD COLUMN strip_metadata BOOLEAN DEFAULT FALSE;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const createDeliveryEventsSQL = `
+CREATE TABLE IF NOT EXISTS delivery_payloads (
+    id TEXT PRIMARY KEY,
+    payload TEXT NOT NULL,
+    updated_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS delivery_events (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    channel TEXT NOT NULL,
+    destination TEXT NOT NULL DEFAULT '',
+    event_type TEXT NOT NULL DEFAULT '',
+    payload_id TEXT NOT NULL DEFAULT '',
+    replayed BOOLEAN NOT NULL DEFAULT FALSE,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at BIGINT NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL DEFAULT 0,
+    updated_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_delivery_events_status ON delivery_events (status, updated_at);
+CREATE INDEX IF NOT EXISTS idx_delivery_events_payload ON delivery_events (payload_id);
+`
+
+const addDeliveryPolicySQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'delivery_policy') THEN
+        ALTER TABLE users ADD COLUMN delivery_policy TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const createDeliveryResultsSQL = `
+CREATE TABLE IF NOT EXISTS delivery_results (
+    id TEXT PRIMARY KEY,
+    delivery_id TEXT NOT NULL,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    channel TEXT NOT NULL,
+    destination TEXT NOT NULL DEFAULT '',
+    event_type TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    attempt INTEGER NOT NULL DEFAULT 0,
+    latency_ms BIGINT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_delivery_results_user ON delivery_results (user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_delivery_results_created ON delivery_results (created_at);
+`
+
+const addDeliveryRateLimitSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'delivery_rate_limit') THEN
+        ALTER TABLE users ADD COLUMN delivery_rate_limit TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhookTLSSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'webhook_tls') THEN
+        ALTER TABLE users ADD COLUMN webhook_tls TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhookHeadersSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'webhook_headers') THEN
+        ALTER TABLE users ADD COLUMN webhook_headers TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addWebhookFailoverSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'webhook_failover') THEN
+        ALTER TABLE users ADD COLUMN webhook_failover TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addNATSSettingsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'nats_settings') THEN
+        ALTER TABLE users ADD COLUMN nats_settings TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addSQSSettingsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'sqs_settings') THEN
+        ALTER TABLE users ADD COLUMN sqs_settings TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addPubSubSettingsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'pubsub_settings') THEN
+        ALTER TABLE users ADD COLUMN pubsub_settings TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addAMQPSettingsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'amqp_settings') THEN
+        ALTER TABLE users ADD COLUMN amqp_settings TEXT DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addUserDisabledSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'disabled_at') THEN
+        ALTER TABLE users ADD COLUMN disabled_at BIGINT DEFAULT 0;
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const addTemplateButtonsSQL = `
+-- PostgreSQL version
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'message_templates' AND column_name = 'buttons') THEN
+        ALTER TABLE message_templates ADD COLUMN buttons TEXT NOT NULL DEFAULT '';
+    END IF;
+END $$;
+
+-- SQLite version (handled in code)
+`
+
+const createPollsSQL = `
+CREATE TABLE IF NOT EXISTS polls (
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    poll_id TEXT NOT NULL,
+    chat_jid TEXT NOT NULL DEFAULT '',
+    sender_jid TEXT NOT NULL DEFAULT '',
+    question TEXT NOT NULL DEFAULT '',
+    options TEXT NOT NULL DEFAULT '[]',
+    selectable_count INTEGER NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, poll_id)
+);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    poll_id TEXT NOT NULL,
+    voter_jid TEXT NOT NULL,
+    options TEXT NOT NULL DEFAULT '[]',
+    voted_at BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, poll_id, voter_jid)
+);
+`
+
 // GenerateRandomID creates a random string ID
 func GenerateRandomID() (string, error) {
 	bytes := make([]byte, 16) // 128 bits
@@ -314,6 +905,177 @@ func applyMigration(db *sqlx.DB, migration Migration) error {
 		} else {
 			_, err = tx.Exec(migration.UpSQL)
 		}
+	} else if migration.ID == 7 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "storage_provider", "TEXT DEFAULT 's3'")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "gcs_credentials", "TEXT DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 8 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "azure_connection_string", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 9 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_url_mode", "TEXT DEFAULT 'public'")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "s3_presign_ttl", "INTEGER DEFAULT 3600")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 10 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_sse_type", "TEXT DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "s3_kms_key_id", "TEXT DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 11 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_dedup", "BOOLEAN DEFAULT 0")
+			if err == nil {
+				_, err = tx.Exec(createMediaObjectsSQL)
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 13 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_object_metadata", "BOOLEAN DEFAULT 0")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 14 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "storage_mirror", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 15 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_credential_mode", "TEXT DEFAULT 'static'")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "s3_role_arn", "TEXT DEFAULT ''")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "s3_external_id", "TEXT DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 16 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_encryption", "TEXT DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "s3_encryption_key", "TEXT DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 17 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_thumbnails", "BOOLEAN DEFAULT 0")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 18 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "s3_ca_bundle", "TEXT DEFAULT ''")
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "s3_insecure_skip_verify", "BOOLEAN DEFAULT 0")
+			}
+			if err == nil {
+				err = addColumnIfNotExistsSQLite(tx, "users", "s3_http_proxy", "TEXT DEFAULT ''")
+			}
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 19 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "media_scan", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 20 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "strip_metadata", "BOOLEAN DEFAULT 0")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 22 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "delivery_policy", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 24 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "delivery_rate_limit", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 25 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_tls", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 26 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_headers", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 27 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "webhook_failover", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 28 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "nats_settings", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 29 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "sqs_settings", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 30 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "pubsub_settings", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 31 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "amqp_settings", "TEXT DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 32 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "users", "disabled_at", "INTEGER DEFAULT 0")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
+	} else if migration.ID == 33 {
+		if db.DriverName() == "sqlite" {
+			err = addColumnIfNotExistsSQLite(tx, "message_templates", "buttons", "TEXT NOT NULL DEFAULT ''")
+		} else {
+			_, err = tx.Exec(migration.UpSQL)
+		}
 	} else {
 		_, err = tx.Exec(migration.UpSQL)
 	}
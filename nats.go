@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultNATSSubjectPrefix = "wuzapi"
+
+var (
+	natsPublisher     *natsClient
+	natsEnabled       bool
+	natsSubjectPrefix string
+	natsJetStream     bool
+)
+
+// natsTokenInvalid matches the characters not allowed in a subject token
+var natsTokenInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// natsPrefixInvalid matches the characters not allowed in a subject prefix
+var natsPrefixInvalid = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// InitNATS connects the NATS publisher when NATS_URL is set
+func InitNATS() {
+	servers := os.Getenv("NATS_URL")
+	if servers == "" {
+		natsEnabled = false
+		log.Info().Msg("NATS_URL is not set. NATS publishing disabled.")
+		return
+	}
+
+	natsSubjectPrefix = os.Getenv("NATS_SUBJECT_PREFIX")
+	if natsSubjectPrefix == "" {
+		natsSubjectPrefix = defaultNATSSubjectPrefix
+	}
+	if err := validateNATSSubjectPrefix(natsSubjectPrefix); err != nil {
+		log.Error().Err(err).Msg("Invalid NATS_SUBJECT_PREFIX, NATS publishing disabled")
+		return
+	}
+	natsJetStream = strings.ToLower(os.Getenv("NATS_JETSTREAM")) == "true"
+
+	tlsConfig, err := brokerTLSConfig("NATS")
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid NATS TLS settings, NATS publishing disabled")
+		return
+	}
+	client, err := newNATSClient(natsConfig{
+		URL:      servers,
+		Username: os.Getenv("NATS_USERNAME"),
+		Password: os.Getenv("NATS_PASSWORD"),
+		Token:    os.Getenv("NATS_TOKEN"),
+		TLS:      tlsConfig,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Could not create NATS publisher")
+		return
+	}
+	if _, _, err := client.connection(); err != nil {
+		client.Close()
+		log.Error().Err(err).Msg("Could not connect to NATS")
+		return
+	}
+
+	natsPublisher = client
+	natsEnabled = true
+	log.Info().
+		Str("prefix", natsSubjectPrefix).
+		Bool("jetstream", natsJetStream).
+		Msg("NATS connection established.")
+}
+
+func validateNATSSubjectPrefix(prefix string) error {
+	if natsPrefixInvalid.MatchString(prefix) || strings.HasPrefix(prefix, ".") || strings.HasSuffix(prefix, ".") || strings.Contains(prefix, "..") {
+		return errors.New("subject prefix must be dot separated tokens of letters, digits, '-' and '_'")
+	}
+	return nil
+}
+
+// natsSubject returns the subject of an event: <prefix>.<instance>.<event type>
+func natsSubject(prefix string, userID string, eventType string) string {
+	if eventType == "" {
+		eventType = "unknown"
+	}
+	return prefix + "." + natsTokenInvalid.ReplaceAllString(userID, "_") + "." + natsTokenInvalid.ReplaceAllString(eventType, "_")
+}
+
+// NATSSettings are the NATS server a user publishes its events to, stored as
+// JSON in the nats_settings column
+type NATSSettings struct {
+	// URL lists the servers separated by commas, nats:// or tls://
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// SubjectPrefix defaults to wuzapi
+	SubjectPrefix string `json:"subject_prefix,omitempty"`
+	// JetStream waits for a stream to acknowledge every event
+	JetStream bool `json:"jetstream"`
+}
+
+// parseNATSSettings decodes the nats_settings column, nil when not set
+func parseNATSSettings(raw string) (*NATSSettings, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var settings NATSSettings
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return nil, fmt.Errorf("invalid NATS settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// encode returns the JSON stored in the nats_settings column
+func (ns *NATSSettings) encode() (string, error) {
+	if ns == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(ns)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate checks the servers and the subject prefix, which defaults to wuzapi
+func (ns *NATSSettings) validate() error {
+	if ns.URL == "" {
+		return errors.New("url is required")
+	}
+	if _, err := newNATSClient(ns.config()); err != nil {
+		return err
+	}
+	if ns.SubjectPrefix == "" {
+		ns.SubjectPrefix = defaultNATSSubjectPrefix
+	}
+	return validateNATSSubjectPrefix(ns.SubjectPrefix)
+}
+
+func (ns *NATSSettings) config() natsConfig {
+	return natsConfig{URL: ns.URL, Username: ns.Username, Password: ns.Password, Token: ns.Token}
+}
+
+// redacted returns the settings without the password and token
+func (ns *NATSSettings) redacted() map[string]interface{} {
+	return map[string]interface{}{
+		"url":            ns.URL,
+		"username":       ns.Username,
+		"has_password":   ns.Password != "",
+		"has_token":      ns.Token != "",
+		"subject_prefix": ns.SubjectPrefix,
+		"jetstream":      ns.JetStream,
+	}
+}
+
+// NATSSettings returns the NATS settings of a user, nil when none are
+// configured, loading them on first use
+func (m *DeliveryManager) NATSSettings(userID string) *NATSSettings {
+	m.mu.Lock()
+	settings, ok := m.natsSettings[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok || db == nil {
+		return settings
+	}
+
+	var raw string
+	if err := db.Get(&raw, "SELECT nats_settings FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load NATS settings")
+		return nil
+	}
+	settings, err := parseNATSSettings(raw)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Ignoring NATS settings")
+	}
+
+	m.mu.Lock()
+	m.natsSettings[userID] = settings
+	m.mu.Unlock()
+	return settings
+}
+
+// SetNATSSettings stores the NATS settings of a user, nil removes them
+func (m *DeliveryManager) SetNATSSettings(userID string, settings *NATSSettings) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw, err := settings.encode()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET nats_settings = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	client := m.natsClients[userID]
+	delete(m.natsSettings, userID)
+	delete(m.natsClients, userID)
+	m.mu.Unlock()
+	if client != nil {
+		client.Close()
+	}
+	return nil
+}
+
+// userNATSClient returns the publisher of a user, creating it on first use
+func (m *DeliveryManager) userNATSClient(userID string) (*natsClient, *NATSSettings, error) {
+	settings := m.NATSSettings(userID)
+	if settings == nil {
+		return nil, nil, errors.New("NATS is not configured for the user")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if client, ok := m.natsClients[userID]; ok {
+		return client, settings, nil
+	}
+	client, err := newNATSClient(settings.config())
+	if err != nil {
+		return nil, nil, err
+	}
+	m.natsClients[userID] = client
+	return client, settings, nil
+}
+
+// Usage - like sendToGlobalRabbit, also publishes to the NATS server of the
+// user when one is configured
+func sendToNATS(jsonData []byte, userID string, token string, eventType string) {
+	m := GetDeliveryManager()
+	if natsEnabled {
+		m.Enqueue(&DeliveryEvent{
+			UserID:      userID,
+			Token:       token,
+			Channel:     DeliveryChannelNATS,
+			Destination: natsSubject(natsSubjectPrefix, userID, eventType),
+			EventType:   eventType,
+			Payload:     string(jsonData),
+		})
+	}
+	if settings := m.NATSSettings(userID); settings != nil {
+		m.Enqueue(&DeliveryEvent{
+			UserID:      userID,
+			Token:       token,
+			Channel:     DeliveryChannelUserNATS,
+			Destination: natsSubject(settings.SubjectPrefix, userID, eventType),
+			EventType:   eventType,
+			Payload:     string(jsonData),
+		})
+	}
+}
+
+// publishToNATS sends an event with the same JSON payload as RabbitMQ. With
+// JetStream the event only counts as delivered once a stream stored it, and
+// the delivery ID is the message ID so retries aren't stored twice.
+func (m *DeliveryManager) publishToNATS(ctx context.Context, event *DeliveryEvent) error {
+	client, jetStream := natsPublisher, natsJetStream
+	if event.Channel == DeliveryChannelUserNATS {
+		userClient, settings, err := m.userNATSClient(event.UserID)
+		if err != nil {
+			return err
+		}
+		client, jetStream = userClient, settings.JetStream
+	} else if !natsEnabled {
+		return errors.New("NATS is not connected")
+	}
+
+	body, encoding, err := encodePayload(event)
+	if err != nil {
+		return err
+	}
+	headers := deliveryHeaders(nil, event)
+	headers["instanceId"] = event.UserID
+	headers["instanceName"] = instanceName(event.Token)
+	headers["eventType"] = event.EventType
+	headers["Content-Type"] = payloadContentType(event)
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+		headers["payloadDecoding"] = payloadDecoding(event, encoding, false)
+	}
+	if jetStream {
+		return client.PublishJetStream(ctx, event.Destination, event.ID, headers, body)
+	}
+	return client.Publish(ctx, event.Destination, headers, body)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const natsDialTimeout = 10 * time.Second
+
+// natsConfig configures the connection to a NATS server
+type natsConfig struct {
+	// URL lists the servers separated by commas, nats:// or tls://
+	URL      string
+	Username string
+	Password string
+	Token    string
+	TLS      *tls.Config
+}
+
+// natsClient publishes messages to NATS. The connection is opened on first
+// use, nats.go reconnects it when it breaks.
+type natsClient struct {
+	config natsConfig
+
+	mu        sync.Mutex
+	conn      *nats.Conn
+	jetStream jetstream.JetStream
+	closed    bool
+}
+
+func newNATSClient(config natsConfig) (*natsClient, error) {
+	if len(natsServers(config.URL)) == 0 {
+		return nil, errors.New("no NATS server configured")
+	}
+	for _, server := range natsServers(config.URL) {
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" || (u.Scheme != "nats" && u.Scheme != "tls") {
+			return nil, fmt.Errorf("invalid NATS server %q, expected nats://host:port or tls://host:port", server)
+		}
+	}
+	return &natsClient{config: config}, nil
+}
+
+func natsServers(raw string) []string {
+	var servers []string
+	for _, server := range strings.Split(raw, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// Publish sends a message with core NATS and waits until the server has
+// processed it
+func (c *natsClient) Publish(ctx context.Context, subject string, headers map[string]string, data []byte) error {
+	conn, _, err := c.connection()
+	if err != nil {
+		return err
+	}
+	if err := conn.PublishMsg(natsMessage(subject, headers, data)); err != nil {
+		return err
+	}
+	return conn.FlushWithContext(ctx)
+}
+
+// PublishJetStream sends a message to the JetStream stream bound to subject
+// and waits for the stream to store it. msgID lets the stream drop copies
+// published again within its duplicate window.
+func (c *natsClient) PublishJetStream(ctx context.Context, subject string, msgID string, headers map[string]string, data []byte) error {
+	_, js, err := c.connection()
+	if err != nil {
+		return err
+	}
+	var opts []jetstream.PublishOpt
+	if msgID != "" {
+		opts = append(opts, jetstream.WithMsgID(msgID))
+	}
+	_, err = js.PublishMsg(ctx, natsMessage(subject, headers, data), opts...)
+	return err
+}
+
+// Close closes the connection, the client can't be used afterwards
+func (c *natsClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func natsMessage(subject string, headers map[string]string, data []byte) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	for name, value := range headers {
+		// Set as is, nats.Header.Set would canonicalize the names
+		msg.Header[name] = []string{value}
+	}
+	return msg
+}
+
+// connection returns the connection to the server, connecting on first use
+func (c *natsClient) connection() (*nats.Conn, jetstream.JetStream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, nil, errors.New("NATS client is closed")
+	}
+	if c.conn != nil && !c.conn.IsClosed() {
+		return c.conn, c.jetStream, nil
+	}
+
+	opts := []nats.Option{
+		nats.Name("wuzapi"),
+		nats.Timeout(natsDialTimeout),
+		// Keeps reconnecting for as long as the client is used, the outbox
+		// retries the events published meanwhile
+		nats.MaxReconnects(-1),
+	}
+	if c.config.Username != "" {
+		opts = append(opts, nats.UserInfo(c.config.Username, c.config.Password))
+	}
+	if c.config.Token != "" {
+		opts = append(opts, nats.Token(c.config.Token))
+	}
+	if c.config.TLS != nil {
+		opts = append(opts, nats.Secure(c.config.TLS))
+	}
+	conn, err := nats.Connect(strings.Join(natsServers(c.config.URL), ","), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	c.conn, c.jetStream = conn, js
+	return conn, js, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Poll is a poll sent or received by an instance, kept so the votes, which
+// only carry hashes of the option names, can be counted
+type Poll struct {
+	UserID          string `db:"user_id"`
+	PollID          string `db:"poll_id"`
+	ChatJID         string `db:"chat_jid"`
+	SenderJID       string `db:"sender_jid"`
+	Question        string `db:"question"`
+	OptionsJSON     string `db:"options"`
+	SelectableCount int    `db:"selectable_count"`
+	CreatedAt       int64  `db:"created_at"`
+}
+
+// PollOptionResult is the tally of one option
+type PollOptionResult struct {
+	Name   string   `json:"name"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
+
+// PollResults is the tally of a poll, each voter counts with their last vote
+type PollResults struct {
+	PollID          string             `json:"poll_id"`
+	ChatJID         string             `json:"chat_jid"`
+	SenderJID       string             `json:"sender_jid"`
+	Question        string             `json:"question"`
+	SelectableCount int                `json:"selectable_count"`
+	Options         []PollOptionResult `json:"options"`
+	TotalVoters     int                `json:"total_voters"`
+	CreatedAt       int64              `json:"created_at"`
+}
+
+// pollCreation returns the poll carried by a message, whatever version of the
+// poll creation message it uses
+func pollCreation(msg *waE2E.Message) (*waE2E.PollCreationMessage, bool) {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage(), true
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2(), true
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3(), true
+	}
+	return nil, false
+}
+
+// savePoll stores a poll, a poll seen twice keeps its first copy
+func savePoll(db *sqlx.DB, userID string, pollID string, chatJID string, senderJID string, poll *waE2E.PollCreationMessage) error {
+	options := make([]string, 0, len(poll.GetOptions()))
+	for _, option := range poll.GetOptions() {
+		options = append(options, option.GetOptionName())
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO polls (user_id, poll_id, chat_jid, sender_jid, question, options, selectable_count, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (user_id, poll_id) DO NOTHING`,
+		userID, pollID, chatJID, senderJID, poll.GetName(), string(encoded), int(poll.GetSelectableOptionsCount()), time.Now().Unix())
+	return err
+}
+
+func getPoll(db *sqlx.DB, userID string, pollID string) (*Poll, []string, error) {
+	var poll Poll
+	err := db.Get(&poll, `
+		SELECT user_id, poll_id, chat_jid, sender_jid, question, options, selectable_count, created_at
+		FROM polls WHERE user_id = $1 AND poll_id = $2`, userID, pollID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var options []string
+	if err := json.Unmarshal([]byte(poll.OptionsJSON), &options); err != nil {
+		return nil, nil, fmt.Errorf("invalid options of poll %s: %w", pollID, err)
+	}
+	return &poll, options, nil
+}
+
+// recordPollVote stores the vote of a voter, replacing the previous one. A
+// vote without options withdraws it. The selected options are returned by
+// name.
+func recordPollVote(db *sqlx.DB, userID string, pollID string, voterJID string, selected [][]byte) ([]string, error) {
+	_, options, err := getPoll(db, userID, pollID)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(options))
+	for i, hash := range whatsmeow.HashPollOptions(options) {
+		names[string(hash)] = options[i]
+	}
+	chosen := []string{}
+	for _, hash := range selected {
+		if name, ok := names[string(hash)]; ok {
+			chosen = append(chosen, name)
+		}
+	}
+
+	if len(chosen) == 0 {
+		_, err = db.Exec("DELETE FROM poll_votes WHERE user_id = $1 AND poll_id = $2 AND voter_jid = $3", userID, pollID, voterJID)
+		return chosen, err
+	}
+	encoded, err := json.Marshal(chosen)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+		INSERT INTO poll_votes (user_id, poll_id, voter_jid, options, voted_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, poll_id, voter_jid) DO UPDATE SET
+			options = excluded.options,
+			voted_at = excluded.voted_at`,
+		userID, pollID, voterJID, string(encoded), time.Now().Unix())
+	return chosen, err
+}
+
+// getPollResults counts the votes of a poll, returning sql.ErrNoRows when the
+// poll is unknown
+func getPollResults(db *sqlx.DB, userID string, pollID string) (*PollResults, error) {
+	poll, options, err := getPoll(db, userID, pollID)
+	if err != nil {
+		return nil, err
+	}
+
+	var votes []struct {
+		VoterJID string `db:"voter_jid"`
+		Options  string `db:"options"`
+	}
+	err = db.Select(&votes, "SELECT voter_jid, options FROM poll_votes WHERE user_id = $1 AND poll_id = $2 ORDER BY voted_at ASC, voter_jid ASC", userID, pollID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := &PollResults{
+		PollID:          poll.PollID,
+		ChatJID:         poll.ChatJID,
+		SenderJID:       poll.SenderJID,
+		Question:        poll.Question,
+		SelectableCount: poll.SelectableCount,
+		Options:         make([]PollOptionResult, len(options)),
+		TotalVoters:     len(votes),
+		CreatedAt:       poll.CreatedAt,
+	}
+	index := make(map[string]int, len(options))
+	for i, name := range options {
+		results.Options[i] = PollOptionResult{Name: name, Voters: []string{}}
+		index[name] = i
+	}
+	for _, vote := range votes {
+		var chosen []string
+		if err := json.Unmarshal([]byte(vote.Options), &chosen); err != nil {
+			log.Warn().Err(err).Str("poll", pollID).Str("voter", vote.VoterJID).Msg("Skipping unreadable poll vote")
+			continue
+		}
+		for _, name := range chosen {
+			if i, ok := index[name]; ok {
+				results.Options[i].Votes++
+				results.Options[i].Voters = append(results.Options[i].Voters, vote.VoterJID)
+			}
+		}
+	}
+	return results, nil
+}
+
+// handlePollMessage stores the polls seen by the instance and counts the
+// votes on them. The decrypted vote and the new tally of the poll are added to
+// the webhook payload of the vote.
+func (mycli *MyClient) handlePollMessage(evt *events.Message, postmap map[string]interface{}) {
+	if poll, ok := pollCreation(evt.Message); ok {
+		if err := savePoll(mycli.db, mycli.userID, evt.Info.ID, evt.Info.Chat.String(), evt.Info.Sender.ToNonAD().String(), poll); err != nil {
+			log.Error().Err(err).Str("userID", mycli.userID).Str("poll", evt.Info.ID).Msg("Failed to store poll")
+		}
+		return
+	}
+
+	update := evt.Message.GetPollUpdateMessage()
+	if update == nil {
+		return
+	}
+	pollID := update.GetPollCreationMessageKey().GetID()
+	vote, err := mycli.WAClient.DecryptPollVote(context.Background(), evt)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", mycli.userID).Str("poll", pollID).Msg("Failed to decrypt poll vote")
+		return
+	}
+
+	voter := evt.Info.Sender.ToNonAD().String()
+	chosen, err := recordPollVote(mycli.db, mycli.userID, pollID, voter, vote.GetSelectedOptions())
+	if errors.Is(err, sql.ErrNoRows) {
+		// Polls created before the instance was connected can't be counted
+		log.Debug().Str("userID", mycli.userID).Str("poll", pollID).Msg("Vote on an unknown poll")
+		return
+	} else if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Str("poll", pollID).Msg("Failed to store poll vote")
+		return
+	}
+
+	results, err := getPollResults(mycli.db, mycli.userID, pollID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", mycli.userID).Str("poll", pollID).Msg("Failed to count poll votes")
+		return
+	}
+	postmap["pollVote"] = map[string]interface{}{
+		"pollId":          pollID,
+		"voter":           voter,
+		"selectedOptions": chosen,
+	}
+	postmap["pollResults"] = results
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// pubsubTopicName matches a full topic name, projects/<project>/topics/<topic>
+var pubsubTopicName = regexp.MustCompile(`^projects/([^/]+)/topics/([^/]+)$`)
+
+// pubsubPublisher is the Pub/Sub client of a user and its topic
+type pubsubPublisher struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+}
+
+// Close sends the pending messages and closes the client
+func (p *pubsubPublisher) Close() {
+	p.topic.Stop()
+	p.client.Close()
+}
+
+// PubSubSettings are the Google Cloud Pub/Sub topic the events of a user are
+// published to, stored as JSON in the pubsub_settings column
+type PubSubSettings struct {
+	// Topic is the full name, projects/<project>/topics/<topic>
+	Topic string `json:"topic"`
+	// Credentials is a service account JSON key, empty to use the application
+	// default credentials, e.g. the metadata server
+	Credentials string `json:"credentials,omitempty"`
+	// Endpoint replaces the Pub/Sub API, https:// for a regional endpoint or
+	// http:// for the emulator, which is used without credentials
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// parsePubSubSettings decodes the pubsub_settings column, nil when not set
+func parsePubSubSettings(raw string) (*PubSubSettings, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var settings PubSubSettings
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return nil, fmt.Errorf("invalid Pub/Sub settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// encode returns the JSON stored in the pubsub_settings column
+func (ps *PubSubSettings) encode() (string, error) {
+	if ps == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(ps)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate checks the topic name, the endpoint and the service account key
+func (ps *PubSubSettings) validate() error {
+	if !pubsubTopicName.MatchString(ps.Topic) {
+		return errors.New("topic must be projects/<project>/topics/<topic>")
+	}
+	if ps.Endpoint != "" {
+		if u, err := url.Parse(ps.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("endpoint must be an http or https URL")
+		}
+	}
+	if ps.Credentials != "" {
+		if _, err := google.CredentialsFromJSON(context.Background(), []byte(ps.Credentials), pubsub.ScopePubSub); err != nil {
+			return fmt.Errorf("invalid credentials: %w", err)
+		}
+	}
+	return nil
+}
+
+// newPublisher connects a client to the topic. Messages carry ordering keys,
+// so the topic publishes with message ordering.
+func (ps *PubSubSettings) newPublisher(ctx context.Context) (*pubsubPublisher, error) {
+	name := pubsubTopicName.FindStringSubmatch(ps.Topic)
+	if name == nil {
+		return nil, errors.New("topic must be projects/<project>/topics/<topic>")
+	}
+
+	var opts []option.ClientOption
+	emulator := false
+	if ps.Endpoint != "" {
+		u, err := url.Parse(ps.Endpoint)
+		if err != nil || u.Host == "" {
+			return nil, errors.New("endpoint must be an http or https URL")
+		}
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		opts = append(opts, option.WithEndpoint(host))
+		// The emulator speaks plain gRPC and takes no credentials
+		if u.Scheme == "http" {
+			emulator = true
+			opts = append(opts,
+				option.WithoutAuthentication(),
+				option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			)
+		}
+	}
+	if ps.Credentials != "" && !emulator {
+		credentials, err := google.CredentialsFromJSON(ctx, []byte(ps.Credentials), pubsub.ScopePubSub)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials: %w", err)
+		}
+		opts = append(opts, option.WithCredentials(credentials))
+	}
+
+	client, err := pubsub.NewClient(ctx, name[1], opts...)
+	if err != nil {
+		return nil, err
+	}
+	topic := client.Topic(name[2])
+	topic.EnableMessageOrdering = true
+	return &pubsubPublisher{client: client, topic: topic}, nil
+}
+
+// redacted returns the settings without the private key of the service account
+func (ps *PubSubSettings) redacted() map[string]interface{} {
+	response := map[string]interface{}{
+		"topic":           ps.Topic,
+		"endpoint":        ps.Endpoint,
+		"has_credentials": ps.Credentials != "",
+	}
+	var account struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if json.Unmarshal([]byte(ps.Credentials), &account) == nil && account.ClientEmail != "" {
+		response["client_email"] = account.ClientEmail
+	}
+	return response
+}
+
+// PubSubSettings returns the Pub/Sub settings of a user, nil when none are
+// configured, loading them on first use
+func (m *DeliveryManager) PubSubSettings(userID string) *PubSubSettings {
+	m.mu.Lock()
+	settings, ok := m.pubsubSettings[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok || db == nil {
+		return settings
+	}
+
+	var raw string
+	if err := db.Get(&raw, "SELECT pubsub_settings FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load Pub/Sub settings")
+		return nil
+	}
+	settings, err := parsePubSubSettings(raw)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Ignoring Pub/Sub settings")
+	}
+
+	m.mu.Lock()
+	m.pubsubSettings[userID] = settings
+	m.mu.Unlock()
+	return settings
+}
+
+// SetPubSubSettings stores the Pub/Sub settings of a user, nil removes them
+func (m *DeliveryManager) SetPubSubSettings(userID string, settings *PubSubSettings) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw, err := settings.encode()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET pubsub_settings = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	publisher := m.pubsubClients[userID]
+	delete(m.pubsubSettings, userID)
+	delete(m.pubsubClients, userID)
+	m.mu.Unlock()
+	if publisher != nil {
+		publisher.Close()
+	}
+	return nil
+}
+
+// userPubSubPublisher returns the publisher of a user, creating it on first
+// use
+func (m *DeliveryManager) userPubSubPublisher(ctx context.Context, userID string) (*pubsubPublisher, error) {
+	settings := m.PubSubSettings(userID)
+	if settings == nil {
+		return nil, errors.New("Pub/Sub is not configured for the user")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if publisher, ok := m.pubsubClients[userID]; ok {
+		return publisher, nil
+	}
+	publisher, err := settings.newPublisher(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.pubsubClients[userID] = publisher
+	return publisher, nil
+}
+
+// Usage - like sendToUserWebHook, for the Pub/Sub topic of the user
+func sendToPubSub(jsonData []byte, userID string, token string, eventType string) {
+	m := GetDeliveryManager()
+	settings := m.PubSubSettings(userID)
+	if settings == nil {
+		return
+	}
+	m.Enqueue(&DeliveryEvent{
+		UserID:      userID,
+		Token:       token,
+		Channel:     DeliveryChannelPubSub,
+		Destination: settings.Topic,
+		EventType:   eventType,
+		Payload:     string(jsonData),
+	})
+}
+
+// publishToPubSub sends an event to the Pub/Sub topic of its user. The
+// ordering key is the chat of the event, so subscriptions with message
+// ordering receive the events of a chat in order. The token is sent as a
+// hash, consumers can match it without the topic exposing the token.
+func (m *DeliveryManager) publishToPubSub(ctx context.Context, event *DeliveryEvent) error {
+	publisher, err := m.userPubSubPublisher(ctx, event.UserID)
+	if err != nil {
+		return err
+	}
+
+	data, encoding, err := encodePayload(event)
+	if err != nil {
+		return err
+	}
+	attributes := deliveryHeaders(nil, event)
+	attributes["instanceId"] = event.UserID
+	attributes["eventType"] = event.EventType
+	if encoding != "" {
+		attributes["Content-Encoding"] = encoding
+		attributes["payloadDecoding"] = payloadDecoding(event, encoding, false)
+	}
+	if event.Token != "" {
+		attributes["tokenHash"] = tokenHash(event.Token)
+	}
+	orderingKey := eventChatJID(event.Payload)
+	if orderingKey == "" {
+		orderingKey = event.UserID
+	}
+
+	result := publisher.topic.Publish(ctx, &pubsub.Message{
+		Data:        data,
+		Attributes:  attributes,
+		OrderingKey: orderingKey,
+	})
+	if _, err := result.Get(ctx); err != nil {
+		// A failed publish pauses its ordering key, the outbox retries the
+		// event once it is resumed
+		publisher.topic.ResumePublish(orderingKey)
+		return err
+	}
+	return nil
+}
@@ -1,21 +1,110 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/rabbitmq/amqp091-go"
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	rabbitConn    *amqp091.Connection
-	rabbitChannel *amqp091.Channel
+	rabbitPool    *rabbitChannelPool
 	rabbitEnabled bool
 	rabbitOnce    sync.Once
 	rabbitQueue   string
+
+	// rabbitQueueArgs are the arguments queues are declared with
+	rabbitQueueArgs amqp091.Table
+	// rabbitDeclared holds the queues declared since the connection was opened
+	rabbitDeclared sync.Map
+	// rabbitDeclare is false when queues are managed outside of wuzapi
+	rabbitDeclare = true
 )
 
+// rabbitQueueArguments builds the queue arguments from RABBITMQ_QUEUE_TYPE,
+// RABBITMQ_MESSAGE_TTL, RABBITMQ_MAX_LENGTH, RABBITMQ_OVERFLOW,
+// RABBITMQ_DEAD_LETTER_EXCHANGE and RABBITMQ_DEAD_LETTER_ROUTING_KEY. They must
+// match queues that already exist, or the broker refuses the declaration.
+func rabbitQueueArguments() (amqp091.Table, error) {
+	args := amqp091.Table{}
+	switch queueType := strings.ToLower(os.Getenv("RABBITMQ_QUEUE_TYPE")); queueType {
+	case "":
+	case "classic", "quorum", "stream":
+		args["x-queue-type"] = queueType
+	default:
+		return nil, fmt.Errorf("RABBITMQ_QUEUE_TYPE must be classic, quorum or stream, not %q", queueType)
+	}
+	for _, arg := range []struct{ env, name string }{
+		{"RABBITMQ_MESSAGE_TTL", "x-message-ttl"},
+		{"RABBITMQ_MAX_LENGTH", "x-max-length"},
+	} {
+		value := os.Getenv(arg.env)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a positive number", arg.env)
+		}
+		args[arg.name] = n
+	}
+	if overflow := os.Getenv("RABBITMQ_OVERFLOW"); overflow != "" {
+		if overflow != "drop-head" && overflow != "reject-publish" && overflow != "reject-publish-dlx" {
+			return nil, errors.New("RABBITMQ_OVERFLOW must be drop-head, reject-publish or reject-publish-dlx")
+		}
+		args["x-overflow"] = overflow
+	}
+	exchange := os.Getenv("RABBITMQ_DEAD_LETTER_EXCHANGE")
+	key := os.Getenv("RABBITMQ_DEAD_LETTER_ROUTING_KEY")
+	// A routing key alone dead-letters through the default exchange
+	if exchange != "" || key != "" {
+		args["x-dead-letter-exchange"] = exchange
+	}
+	if key != "" {
+		args["x-dead-letter-routing-key"] = key
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	return args, nil
+}
+
+// declareRabbitQueue declares a durable queue with the configured arguments,
+// once per queue. With RABBITMQ_QUEUE_DECLARE=false queues are expected to
+// exist.
+func declareRabbitQueue(channel *amqp091.Channel, queueName string) error {
+	if !rabbitDeclare {
+		return nil
+	}
+	if _, ok := rabbitDeclared.Load(queueName); ok {
+		return nil
+	}
+	_, err := channel.QueueDeclare(
+		queueName,
+		true,            // durable
+		false,           // auto-delete
+		false,           // exclusive
+		false,           // no-wait
+		rabbitQueueArgs, // arguments
+	)
+	var amqpErr *amqp091.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp091.PreconditionFailed {
+		return fmt.Errorf("queue %s exists with other arguments, set the RABBITMQ_QUEUE_* options to match it or RABBITMQ_QUEUE_DECLARE=false: %w", queueName, err)
+	}
+	if err != nil {
+		return err
+	}
+	rabbitDeclared.Store(queueName, true)
+	return nil
+}
+
 // Call this in main() or initialization
 func InitRabbitMQ() {
 	rabbitURL := os.Getenv("RABBITMQ_URL")
@@ -29,72 +118,154 @@ func InitRabbitMQ() {
 		return
 	}
 	var err error
-	rabbitConn, err = amqp091.Dial(rabbitURL)
+	rabbitQueueArgs, err = rabbitQueueArguments()
 	if err != nil {
 		rabbitEnabled = false
-		log.Error().Err(err).Msg("Could not connect to RabbitMQ")
+		log.Error().Err(err).Msg("Invalid RabbitMQ queue arguments, RabbitMQ publishing disabled")
 		return
 	}
-	rabbitChannel, err = rabbitConn.Channel()
+	rabbitDeclare = strings.ToLower(os.Getenv("RABBITMQ_QUEUE_DECLARE")) != "false"
+	config, err := rabbitDialConfig(rabbitURL)
 	if err != nil {
 		rabbitEnabled = false
-		log.Error().Err(err).Msg("Could not open RabbitMQ channel")
+		log.Error().Err(err).Msg("Invalid RabbitMQ connection settings, RabbitMQ publishing disabled")
+		return
+	}
+	channels := envInt("RABBITMQ_CHANNELS", defaultRabbitChannels)
+	confirm := strings.ToLower(os.Getenv("RABBITMQ_CONFIRM")) != "false"
+	rabbitPool = newRabbitChannelPool(rabbitURL, config, channels, confirm)
+	if _, err := rabbitPool.connection(); err != nil {
+		rabbitEnabled = false
+		log.Error().Err(err).Msg("Could not connect to RabbitMQ")
 		return
 	}
 	rabbitEnabled = true
 	log.Info().
 		Str("queue", rabbitQueue).
+		Int("channels", channels).
 		Msg("RabbitMQ connection established.")
 }
 
+// CloseRabbitMQ closes the connection once nothing is published anymore
+func CloseRabbitMQ() {
+	if rabbitPool != nil {
+		rabbitPool.close()
+	}
+}
+
 // Optionally, allow overriding the queue per message
 func PublishToRabbit(data []byte, queueOverride ...string) error {
-	if !rabbitEnabled {
-		return nil
-	}
 	queueName := rabbitQueue
 	if len(queueOverride) > 0 && queueOverride[0] != "" {
 		queueName = queueOverride[0]
 	}
-	// Declare queue (idempotent)
-	_, err := rabbitChannel.QueueDeclare(
-		queueName,
-		true,  // durable
-		false, // auto-delete
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
+	return publishToRabbitWithHeaders(context.Background(), queueName, amqp091.Publishing{
+		ContentType: "application/json",
+		Body:        data,
+	})
+}
+
+// publishToRabbitWithHeaders publishes a message with its AMQP properties and
+// headers, on the first free channel of the pool, and records the outcome for
+// the status endpoint
+func publishToRabbitWithHeaders(ctx context.Context, queueName string, msg amqp091.Publishing) error {
+	if !rabbitEnabled {
+		return nil
+	}
+	rabbitStats.begin()
+	start := time.Now()
+	err := rabbitPublish(ctx, queueName, msg)
+	rabbitStats.end(time.Since(start), err)
 	if err != nil {
-		log.Error().Err(err).Str("queue", queueName).Msg("Could not declare RabbitMQ queue")
+		log.Error().Err(err).Str("queue", queueName).Msg("Could not publish to RabbitMQ")
+	} else {
+		log.Debug().Str("queue", queueName).Msg("Published message to RabbitMQ")
+	}
+	return err
+}
+
+// rabbitEventPublishing builds the message of an event. The instance, event
+// type, WhatsApp message ID and time are also set as headers, so consumers and
+// header exchanges can route without decoding the body. The token is only
+// sent as its SHA-256 hash.
+func rabbitEventPublishing(event *DeliveryEvent, body []byte, contentEncoding string) amqp091.Publishing {
+	headers := amqp091.Table{}
+	for name, value := range deliveryHeaders(nil, event) {
+		headers[name] = value
+	}
+	headers["instanceId"] = event.UserID
+	headers["instanceName"] = instanceName(event.Token)
+	headers["eventType"] = event.EventType
+	if event.Token != "" {
+		headers["tokenHash"] = tokenHash(event.Token)
+	}
+	if messageID := payloadMessageID(event.Payload); messageID != "" {
+		headers["messageId"] = messageID
+	}
+	created := time.Now()
+	if event.CreatedAt > 0 {
+		created = time.Unix(event.CreatedAt, 0)
+	}
+	headers["timestamp"] = created.Unix()
+	if contentEncoding != "" {
+		headers["payloadDecoding"] = payloadDecoding(event, contentEncoding, false)
+	}
+
+	return amqp091.Publishing{
+		ContentType:     payloadContentType(event),
+		ContentEncoding: contentEncoding,
+		Headers:         headers,
+		MessageId:       event.ID,
+		Timestamp:       created,
+		Type:            event.EventType,
+		AppId:           "wuzapi",
+		Body:            body,
+	}
+}
+
+// rabbitPublish publishes a message to a queue and, with confirms, waits
+// until the broker acknowledged it
+func rabbitPublish(ctx context.Context, queueName string, msg amqp091.Publishing) error {
+	channel, err := rabbitPool.get(ctx)
+	if err != nil {
+		return fmt.Errorf("could not open channel: %w", err)
+	}
+	defer rabbitPool.put(channel)
+	if err := declareRabbitQueue(channel, queueName); err != nil {
 		return err
 	}
-	err = rabbitChannel.Publish(
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(
+		ctx,
 		"",        // exchange (default)
 		queueName, // routing key = queue
 		false,     // mandatory
 		false,     // immediate
-		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        data,
-		},
+		msg,
 	)
+	if err != nil || confirmation == nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
 	if err != nil {
-		log.Error().Err(err).Str("queue", queueName).Msg("Could not publish to RabbitMQ")
-	} else {
-		log.Debug().Str("queue", queueName).Msg("Published message to RabbitMQ")
+		return err
 	}
-	return err
+	if !acked {
+		return errRabbitNacked
+	}
+	return nil
 }
 
 // Usage - like sendToGlobalWebhook
-func sendToGlobalRabbit(jsonData []byte, queueName ...string) {
+func sendToGlobalRabbit(jsonData []byte, userID string, eventType string) {
 	if !rabbitEnabled {
 		log.Debug().Msg("RabbitMQ publishing is disabled, not sending message")
 		return
 	}
-	err := PublishToRabbit(jsonData, queueName...)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to publish to RabbitMQ")
-	}
+	GetDeliveryManager().Enqueue(&DeliveryEvent{
+		UserID:      userID,
+		Channel:     DeliveryChannelRabbitMQ,
+		Destination: rabbitQueue,
+		EventType:   eventType,
+		Payload:     string(jsonData),
+	})
 }
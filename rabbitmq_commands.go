@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultRabbitReplyQueue      = "wuzapi_command_results"
+	defaultRabbitCommandPrefetch = 10
+	rabbitCommandConsumerTag     = "wuzapi-commands"
+	rabbitCommandTimeout         = 2 * time.Minute
+)
+
+// rabbitCommandPaths maps command types to the API endpoint executing them
+var rabbitCommandPaths = map[string]string{
+	"text":     "/chat/send/text",
+	"image":    "/chat/send/image",
+	"audio":    "/chat/send/audio",
+	"document": "/chat/send/document",
+	"video":    "/chat/send/video",
+	"sticker":  "/chat/send/sticker",
+	"location": "/chat/send/location",
+	"contact":  "/chat/send/contact",
+	"poll":     "/chat/send/poll",
+	"edit":     "/chat/send/edit",
+	"reaction": "/chat/react",
+	"markread": "/chat/markread",
+	"presence": "/chat/presence",
+}
+
+// RabbitCommand is a message of the command queue. Payload is the body of
+// the API endpoint of the command type and token selects the instance.
+type RabbitCommand struct {
+	ID      string          `json:"id"`
+	Token   string          `json:"token"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// RabbitCommandResult is published to the reply queue for every command,
+// with the response the API endpoint would have given
+type RabbitCommandResult struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Success bool        `json:"success"`
+	Code    int         `json:"code"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// rabbitCommandConsumer runs the commands of RABBITMQ_COMMAND_QUEUE
+type rabbitCommandConsumer struct {
+	handler    http.Handler
+	queue      string
+	replyQueue string
+	channel    *amqp091.Channel
+	done       chan struct{}
+}
+
+var (
+	rabbitCommands   *rabbitCommandConsumer
+	rabbitCommandsMu sync.Mutex
+)
+
+// StartRabbitCommandConsumer consumes RABBITMQ_COMMAND_QUEUE when it is set.
+// Commands are executed one at a time, in queue order, through the API routes
+// so they are validated and authorized exactly like HTTP requests.
+func StartRabbitCommandConsumer(handler http.Handler) {
+	queue := os.Getenv("RABBITMQ_COMMAND_QUEUE")
+	if queue == "" {
+		return
+	}
+	if !rabbitEnabled {
+		log.Warn().Msg("RABBITMQ_COMMAND_QUEUE is set but RabbitMQ is not connected, commands disabled")
+		return
+	}
+	replyQueue := os.Getenv("RABBITMQ_REPLY_QUEUE")
+	if replyQueue == "" {
+		replyQueue = defaultRabbitReplyQueue
+	}
+
+	var channel *amqp091.Channel
+	conn, err := rabbitPool.connection()
+	if err == nil {
+		channel, err = conn.Channel()
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Could not open RabbitMQ command channel")
+		return
+	}
+	if err := channel.Qos(envInt("RABBITMQ_COMMAND_PREFETCH", defaultRabbitCommandPrefetch), 0, false); err != nil {
+		channel.Close()
+		log.Error().Err(err).Msg("Could not set RabbitMQ command prefetch")
+		return
+	}
+	if err := declareRabbitQueue(channel, queue); err != nil {
+		channel.Close()
+		log.Error().Err(err).Str("queue", queue).Msg("Could not declare RabbitMQ command queue")
+		return
+	}
+	deliveries, err := channel.Consume(queue, rabbitCommandConsumerTag, false, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		log.Error().Err(err).Str("queue", queue).Msg("Could not consume RabbitMQ command queue")
+		return
+	}
+
+	consumer := &rabbitCommandConsumer{
+		handler:    handler,
+		queue:      queue,
+		replyQueue: replyQueue,
+		channel:    channel,
+		done:       make(chan struct{}),
+	}
+	rabbitCommandsMu.Lock()
+	rabbitCommands = consumer
+	rabbitCommandsMu.Unlock()
+
+	go consumer.run(deliveries)
+	log.Info().Str("queue", queue).Str("replyQueue", replyQueue).Msg("RabbitMQ command consumer started")
+}
+
+// StopRabbitCommandConsumer stops taking commands and waits for the one
+// being executed. Unacknowledged commands go back to the queue.
+func StopRabbitCommandConsumer(ctx context.Context) {
+	rabbitCommandsMu.Lock()
+	consumer := rabbitCommands
+	rabbitCommands = nil
+	rabbitCommandsMu.Unlock()
+	if consumer == nil {
+		return
+	}
+
+	consumer.channel.Cancel(rabbitCommandConsumerTag, false)
+	select {
+	case <-consumer.done:
+	case <-ctx.Done():
+	}
+	consumer.channel.Close()
+}
+
+func (c *rabbitCommandConsumer) run(deliveries <-chan amqp091.Delivery) {
+	defer close(c.done)
+	for delivery := range deliveries {
+		result := c.execute(delivery.Body)
+		if err := c.reply(delivery, result); err != nil {
+			log.Error().Err(err).Str("id", result.ID).Msg("Could not publish RabbitMQ command result")
+		}
+		// The command ran, sending it again could duplicate a message
+		if err := delivery.Ack(false); err != nil {
+			log.Error().Err(err).Str("id", result.ID).Msg("Could not acknowledge RabbitMQ command")
+		}
+	}
+	log.Warn().Str("queue", c.queue).Msg("RabbitMQ command consumer stopped")
+}
+
+// execute runs a command through the API endpoint of its type
+func (c *rabbitCommandConsumer) execute(body []byte) *RabbitCommandResult {
+	var command RabbitCommand
+	if err := json.Unmarshal(body, &command); err != nil {
+		return &RabbitCommandResult{Code: http.StatusBadRequest, Error: "could not decode command"}
+	}
+	result := &RabbitCommandResult{ID: command.ID, Type: command.Type}
+	path, ok := rabbitCommandPaths[strings.ToLower(command.Type)]
+	if !ok {
+		result.Code = http.StatusBadRequest
+		result.Error = fmt.Sprintf("unknown command type %q", command.Type)
+		return result
+	}
+	if command.Token == "" {
+		result.Code = http.StatusUnauthorized
+		result.Error = "missing token"
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rabbitCommandTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(command.Payload))
+	if err != nil {
+		result.Code = http.StatusInternalServerError
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("token", command.Token)
+	req.RemoteAddr = "rabbitmq"
+
+	recorder := newCommandRecorder()
+	c.handler.ServeHTTP(recorder, req)
+
+	var response struct {
+		Success bool        `json:"success"`
+		Data    interface{} `json:"data"`
+		Error   string      `json:"error"`
+	}
+	result.Code = recorder.status
+	if err := json.Unmarshal(recorder.body.Bytes(), &response); err != nil {
+		result.Error = strings.TrimSpace(recorder.body.String())
+		return result
+	}
+	result.Success = response.Success && recorder.status < 300
+	result.Data = response.Data
+	result.Error = response.Error
+	return result
+}
+
+// reply publishes the result to the reply-to queue of the command, or to
+// RABBITMQ_REPLY_QUEUE, with the correlation ID of the command
+func (c *rabbitCommandConsumer) reply(delivery amqp091.Delivery, result *RabbitCommandResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	queue := delivery.ReplyTo
+	if queue == "" {
+		queue = c.replyQueue
+		if err := declareRabbitQueue(c.channel, queue); err != nil {
+			return err
+		}
+	}
+	correlationID := delivery.CorrelationId
+	if correlationID == "" {
+		correlationID = result.ID
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return c.channel.PublishWithContext(ctx, "", queue, false, false, amqp091.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: correlationID,
+		Timestamp:     time.Now(),
+		Body:          data,
+	})
+}
+
+// commandRecorder collects the response of a command
+type commandRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newCommandRecorder() *commandRecorder {
+	return &commandRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *commandRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *commandRecorder) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+func (r *commandRecorder) WriteHeader(status int) {
+	r.status = status
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const defaultRabbitChannels = 4
+
+// rabbitChannelPool shares a few channels between the publishers, so they
+// don't all wait on the lock of a single channel. Channels closed by an error
+// are replaced and the connection is dialed again after it was lost.
+type rabbitChannelPool struct {
+	url    string
+	config amqp091.Config
+	// confirm puts the channels in confirm mode, so publishes wait until the
+	// broker took the message
+	confirm bool
+
+	mu   sync.Mutex
+	conn *amqp091.Connection
+
+	// slots holds one entry per channel, nil until the channel is opened
+	slots      chan *amqp091.Channel
+	reconnects atomic.Int64
+}
+
+// rabbitDialConfig builds the connection settings from RABBITMQ_VHOST,
+// RABBITMQ_HEARTBEAT and the RABBITMQ_TLS options
+func rabbitDialConfig(rabbitURL string) (amqp091.Config, error) {
+	config := amqp091.Config{
+		Vhost:      os.Getenv("RABBITMQ_VHOST"),
+		Heartbeat:  10 * time.Second,
+		Properties: amqp091.NewConnectionProperties(),
+	}
+	config.Properties.SetClientConnectionName("wuzapi")
+	if v := os.Getenv("RABBITMQ_HEARTBEAT"); v != "" {
+		heartbeat, err := time.ParseDuration(v)
+		if err != nil || heartbeat < 0 {
+			return config, fmt.Errorf("invalid RABBITMQ_HEARTBEAT %q", v)
+		}
+		config.Heartbeat = heartbeat
+	}
+
+	tlsConfig, err := brokerTLSConfig("RABBITMQ")
+	if err != nil {
+		return config, err
+	}
+	if tlsConfig != nil {
+		u, err := url.Parse(rabbitURL)
+		if err != nil || u.Scheme != "amqps" {
+			return config, fmt.Errorf("the RABBITMQ_TLS options need an amqps:// RABBITMQ_URL")
+		}
+		tlsConfig.ServerName = u.Hostname()
+		config.TLSClientConfig = tlsConfig
+	}
+	return config, nil
+}
+
+func newRabbitChannelPool(rabbitURL string, config amqp091.Config, size int, confirm bool) *rabbitChannelPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &rabbitChannelPool{url: rabbitURL, config: config, confirm: confirm, slots: make(chan *amqp091.Channel, size)}
+	for i := 0; i < size; i++ {
+		p.slots <- nil
+	}
+	return p
+}
+
+// connection returns the connection, dialing it again when it was closed
+func (p *rabbitChannelPool) connection() (*amqp091.Connection, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil && !p.conn.IsClosed() {
+		return p.conn, nil
+	}
+	conn, err := amqp091.DialConfig(p.url, p.config)
+	if err != nil {
+		return nil, err
+	}
+	if p.conn != nil {
+		p.reconnects.Add(1)
+	}
+	p.conn = conn
+	// Queues are declared again on the new connection
+	rabbitDeclared.Clear()
+	return conn, nil
+}
+
+// get waits for a free channel and opens it when needed. The channel must be
+// handed back with put.
+func (p *rabbitChannelPool) get(ctx context.Context) (*amqp091.Channel, error) {
+	var channel *amqp091.Channel
+	select {
+	case channel = <-p.slots:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if channel != nil && !channel.IsClosed() {
+		return channel, nil
+	}
+	conn, err := p.connection()
+	if err == nil {
+		channel, err = conn.Channel()
+	}
+	if err == nil && p.confirm {
+		if err = channel.Confirm(false); err != nil {
+			channel.Close()
+		}
+	}
+	if err != nil {
+		p.slots <- nil
+		return nil, err
+	}
+	return channel, nil
+}
+
+// put returns a channel to the pool, a closed one is replaced on next use
+func (p *rabbitChannelPool) put(channel *amqp091.Channel) {
+	if channel != nil && channel.IsClosed() {
+		channel = nil
+	}
+	p.slots <- channel
+}
+
+// connected reports whether the connection is open
+func (p *rabbitChannelPool) connected() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn != nil && !p.conn.IsClosed()
+}
+
+// close closes the connection and with it every channel
+func (p *rabbitChannelPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultRabbitHealthQueue = "wuzapi_health"
+	rabbitLatencySamples     = 1024
+	rabbitProbeTimeout       = 5 * time.Second
+)
+
+// errRabbitNacked is returned when the broker refused to take a message
+var errRabbitNacked = errors.New("RabbitMQ did not accept the message")
+
+func init() {
+	metricsRegistry.MustRegister(rabbitCollector{})
+}
+
+// rabbitPublishStats counts the publishes to the global RabbitMQ queue since
+// the start, with the latencies of the last rabbitLatencySamples publishes
+type rabbitPublishStats struct {
+	mu          sync.Mutex
+	published   int64
+	confirmed   int64
+	nacked      int64
+	failed      int64
+	pending     int64
+	latencies   []time.Duration
+	next        int
+	lastError   string
+	lastErrorAt time.Time
+}
+
+var rabbitStats = &rabbitPublishStats{latencies: make([]time.Duration, 0, rabbitLatencySamples)}
+
+// begin records a publish in flight
+func (s *rabbitPublishStats) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published++
+	s.pending++
+}
+
+// end records the outcome of a publish
+func (s *rabbitPublishStats) end(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	switch {
+	case err == nil:
+		s.confirmed++
+		if len(s.latencies) < rabbitLatencySamples {
+			s.latencies = append(s.latencies, latency)
+		} else {
+			s.latencies[s.next] = latency
+			s.next = (s.next + 1) % rabbitLatencySamples
+		}
+		return
+	case errors.Is(err, errRabbitNacked):
+		s.nacked++
+	default:
+		s.failed++
+	}
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+}
+
+// RabbitProbe is the outcome of a probe publish to the health queue
+type RabbitProbe struct {
+	Queue     string `json:"queue"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RabbitStatus is the state of the global RabbitMQ connection
+type RabbitStatus struct {
+	Enabled bool `json:"enabled"`
+	// Healthy is set when the connection is up and the probe, when one was
+	// made, got through
+	Healthy   bool `json:"healthy"`
+	Connected bool `json:"connected"`
+	// Confirms is false when RABBITMQ_CONFIRM=false, confirmed then counts
+	// the messages written to the connection
+	Confirms     bool         `json:"confirms"`
+	Channels     int          `json:"channels"`
+	Reconnects   int64        `json:"reconnects"`
+	Published    int64        `json:"published"`
+	Confirmed    int64        `json:"confirmed"`
+	Nacked       int64        `json:"nacked"`
+	Failed       int64        `json:"failed"`
+	Pending      int64        `json:"pending"`
+	LatencyP50Ms float64      `json:"latency_p50_ms"`
+	LatencyP95Ms float64      `json:"latency_p95_ms"`
+	LatencyP99Ms float64      `json:"latency_p99_ms"`
+	LastError    string       `json:"last_error,omitempty"`
+	LastErrorAt  string       `json:"last_error_at,omitempty"`
+	Probe        *RabbitProbe `json:"probe,omitempty"`
+}
+
+// rabbitStatus reports the connection and the publish counters, with a probe
+// publish to RABBITMQ_HEALTH_QUEUE when probe is set
+func rabbitStatus(ctx context.Context, probe bool) *RabbitStatus {
+	status := &RabbitStatus{Enabled: rabbitEnabled}
+	if !rabbitEnabled {
+		return status
+	}
+	status.Connected = rabbitPool.connected()
+	status.Confirms = rabbitPool.confirm
+	status.Channels = cap(rabbitPool.slots)
+	status.Reconnects = rabbitPool.reconnects.Load()
+
+	s := rabbitStats
+	s.mu.Lock()
+	status.Published = s.published
+	status.Confirmed = s.confirmed
+	status.Nacked = s.nacked
+	status.Failed = s.failed
+	status.Pending = s.pending
+	latencies := append([]time.Duration(nil), s.latencies...)
+	status.LastError = s.lastError
+	if !s.lastErrorAt.IsZero() {
+		status.LastErrorAt = s.lastErrorAt.UTC().Format(time.RFC3339)
+	}
+	s.mu.Unlock()
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p float64) float64 {
+			ms := float64(latencies[int(p*float64(len(latencies)-1))]) / float64(time.Millisecond)
+			return float64(int64(ms*100)) / 100
+		}
+		status.LatencyP50Ms = percentile(0.50)
+		status.LatencyP95Ms = percentile(0.95)
+		status.LatencyP99Ms = percentile(0.99)
+	}
+
+	if probe {
+		status.Probe = rabbitProbe(ctx)
+		// The probe dials again when the connection was lost
+		status.Connected = rabbitPool.connected()
+	}
+	status.Healthy = status.Connected && (status.Probe == nil || status.Probe.OK)
+	return status
+}
+
+// rabbitProbe publishes a short lived message to the health queue, outside
+// of the publish counters
+func rabbitProbe(ctx context.Context) *RabbitProbe {
+	queue := os.Getenv("RABBITMQ_HEALTH_QUEUE")
+	if queue == "" {
+		queue = defaultRabbitHealthQueue
+	}
+	probe := &RabbitProbe{Queue: queue}
+
+	ctx, cancel := context.WithTimeout(ctx, rabbitProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	err := rabbitPublish(ctx, queue, amqp091.Publishing{
+		ContentType: "application/json",
+		Timestamp:   start,
+		AppId:       "wuzapi",
+		Type:        "probe",
+		// Probes are dropped after a minute, nobody needs to consume them
+		Expiration: "60000",
+		Body:       []byte(`{"probe":true}`),
+	})
+	probe.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	probe.OK = true
+	return probe
+}
+
+var (
+	rabbitConnectedDesc = prometheus.NewDesc("wuzapi_rabbitmq_connected",
+		"Whether the RabbitMQ connection is open.", nil, nil)
+	rabbitReconnectsDesc = prometheus.NewDesc("wuzapi_rabbitmq_reconnects_total",
+		"Times the RabbitMQ connection was dialed again.", nil, nil)
+	rabbitPublishesDesc = prometheus.NewDesc("wuzapi_rabbitmq_publishes_total",
+		"Messages published to RabbitMQ by outcome.", []string{"result"}, nil)
+	rabbitPendingDesc = prometheus.NewDesc("wuzapi_rabbitmq_publishes_pending",
+		"Messages waiting to be confirmed by RabbitMQ.", nil, nil)
+)
+
+// rabbitCollector exports the publish counters of the global queue, only
+// when RabbitMQ is enabled
+type rabbitCollector struct{}
+
+func (rabbitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rabbitConnectedDesc
+	ch <- rabbitReconnectsDesc
+	ch <- rabbitPublishesDesc
+	ch <- rabbitPendingDesc
+}
+
+func (rabbitCollector) Collect(ch chan<- prometheus.Metric) {
+	if !rabbitEnabled {
+		return
+	}
+	status := rabbitStatus(context.Background(), false)
+	connected := 0.0
+	if status.Connected {
+		connected = 1
+	}
+	ch <- prometheus.MustNewConstMetric(rabbitConnectedDesc, prometheus.GaugeValue, connected)
+	ch <- prometheus.MustNewConstMetric(rabbitReconnectsDesc, prometheus.CounterValue, float64(status.Reconnects))
+	ch <- prometheus.MustNewConstMetric(rabbitPublishesDesc, prometheus.CounterValue, float64(status.Confirmed), "confirmed")
+	ch <- prometheus.MustNewConstMetric(rabbitPublishesDesc, prometheus.CounterValue, float64(status.Nacked), "nacked")
+	ch <- prometheus.MustNewConstMetric(rabbitPublishesDesc, prometheus.CounterValue, float64(status.Failed), "failed")
+	ch <- prometheus.MustNewConstMetric(rabbitPendingDesc, prometheus.GaugeValue, float64(status.Pending))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultAMQPExchange      = "amq.topic"
+	defaultAMQPRoutingPrefix = "wuzapi."
+)
+
+// amqpRoutingPrefixInvalid matches the characters not allowed in a routing
+// key prefix
+var amqpRoutingPrefixInvalid = regexp.MustCompile(`[^a-zA-Z0-9_.:-]`)
+
+// AMQPSettings are the broker a user publishes its events to, stored as JSON
+// in the amqp_settings column. Events are published to Exchange with the
+// routing key RoutingPrefix + event type.
+type AMQPSettings struct {
+	// URL is the broker and vhost, amqp:// or amqps://
+	URL string `json:"url"`
+	// Exchange defaults to amq.topic, which exists on every broker
+	Exchange string `json:"exchange,omitempty"`
+	// RoutingPrefix defaults to "wuzapi."
+	RoutingPrefix string `json:"routing_prefix,omitempty"`
+	// Events are the event types published, empty for all
+	Events []string `json:"events,omitempty"`
+}
+
+// parseAMQPSettings decodes the amqp_settings column, nil when not set
+func parseAMQPSettings(raw string) (*AMQPSettings, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var settings AMQPSettings
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return nil, fmt.Errorf("invalid AMQP settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// encode returns the JSON stored in the amqp_settings column
+func (as *AMQPSettings) encode() (string, error) {
+	if as == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(as)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate checks the broker URL and the event types and fills in defaults
+func (as *AMQPSettings) validate() error {
+	u, err := url.Parse(as.URL)
+	if err != nil || (u.Scheme != "amqp" && u.Scheme != "amqps") || u.Host == "" {
+		return errors.New("url must be an amqp:// or amqps:// URL")
+	}
+	if as.Exchange == "" {
+		as.Exchange = defaultAMQPExchange
+	}
+	if as.RoutingPrefix == "" {
+		as.RoutingPrefix = defaultAMQPRoutingPrefix
+	}
+	if amqpRoutingPrefixInvalid.MatchString(as.RoutingPrefix) {
+		return errors.New("routing_prefix may only contain letters, digits and . _ : -")
+	}
+	for _, event := range as.Events {
+		if event != "All" && !isValidEventType(event) {
+			return fmt.Errorf("invalid event type %q", event)
+		}
+	}
+	return nil
+}
+
+// subscribed reports whether events of a type are published
+func (as *AMQPSettings) subscribed(eventType string) bool {
+	return len(as.Events) == 0 || Find(as.Events, "All") || Find(as.Events, eventType)
+}
+
+// redacted returns the settings with the password of the URL masked
+func (as *AMQPSettings) redacted() map[string]interface{} {
+	brokerURL := as.URL
+	if u, err := url.Parse(as.URL); err == nil {
+		brokerURL = u.Redacted()
+	}
+	events := as.Events
+	if events == nil {
+		events = []string{}
+	}
+	return map[string]interface{}{
+		"url":            brokerURL,
+		"exchange":       as.Exchange,
+		"routing_prefix": as.RoutingPrefix,
+		"events":         events,
+	}
+}
+
+// amqpPublisher is the connection of a user to its broker
+type amqpPublisher struct {
+	mu      sync.Mutex
+	url     string
+	conn    *amqp091.Connection
+	channel *amqp091.Channel
+}
+
+// publish sends a message, connecting first when the connection is closed
+func (p *amqpPublisher) publish(ctx context.Context, exchange string, key string, msg amqp091.Publishing) error {
+	p.mu.Lock()
+	if p.conn == nil || p.conn.IsClosed() || p.channel == nil || p.channel.IsClosed() {
+		p.closeLocked()
+		conn, err := amqp091.Dial(p.url)
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		channel, err := conn.Channel()
+		if err != nil {
+			conn.Close()
+			p.mu.Unlock()
+			return err
+		}
+		p.conn, p.channel = conn, channel
+	}
+	channel := p.channel
+	p.mu.Unlock()
+
+	return channel.PublishWithContext(ctx, exchange, key, false, false, msg)
+}
+
+func (p *amqpPublisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeLocked()
+}
+
+func (p *amqpPublisher) closeLocked() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.channel = nil, nil
+}
+
+// AMQPSettings returns the AMQP settings of a user, nil when none are
+// configured, loading them on first use
+func (m *DeliveryManager) AMQPSettings(userID string) *AMQPSettings {
+	m.mu.Lock()
+	settings, ok := m.amqpSettings[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok || db == nil {
+		return settings
+	}
+
+	var raw string
+	if err := db.Get(&raw, "SELECT amqp_settings FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load AMQP settings")
+		return nil
+	}
+	settings, err := parseAMQPSettings(raw)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Ignoring AMQP settings")
+	}
+
+	m.mu.Lock()
+	m.amqpSettings[userID] = settings
+	m.mu.Unlock()
+	return settings
+}
+
+// SetAMQPSettings stores the AMQP settings of a user, nil removes them
+func (m *DeliveryManager) SetAMQPSettings(userID string, settings *AMQPSettings) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw, err := settings.encode()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET amqp_settings = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	publisher := m.amqpPublishers[userID]
+	delete(m.amqpSettings, userID)
+	delete(m.amqpPublishers, userID)
+	m.mu.Unlock()
+	if publisher != nil {
+		publisher.close()
+	}
+	return nil
+}
+
+// amqpPublisherFor returns the publisher of a user, creating it on first use
+func (m *DeliveryManager) amqpPublisherFor(userID string) (*amqpPublisher, *AMQPSettings, error) {
+	settings := m.AMQPSettings(userID)
+	if settings == nil {
+		return nil, nil, errors.New("AMQP is not configured for the user")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	publisher, ok := m.amqpPublishers[userID]
+	if !ok {
+		publisher = &amqpPublisher{url: settings.URL}
+		m.amqpPublishers[userID] = publisher
+	}
+	return publisher, settings, nil
+}
+
+// Usage - like sendToGlobalRabbit, for the broker of the user
+func sendToUserRabbit(jsonData []byte, userID string, token string, eventType string) {
+	m := GetDeliveryManager()
+	settings := m.AMQPSettings(userID)
+	if settings == nil || !settings.subscribed(eventType) {
+		return
+	}
+	m.Enqueue(&DeliveryEvent{
+		UserID:      userID,
+		Token:       token,
+		Channel:     DeliveryChannelUserRabbitMQ,
+		Destination: settings.RoutingPrefix + eventType,
+		EventType:   eventType,
+		Payload:     string(jsonData),
+	})
+}
+
+// publishToUserRabbit sends an event to the exchange of its user, with the
+// same payload and headers as the global RabbitMQ queue
+func (m *DeliveryManager) publishToUserRabbit(ctx context.Context, event *DeliveryEvent) error {
+	publisher, settings, err := m.amqpPublisherFor(event.UserID)
+	if err != nil {
+		return err
+	}
+	body, encoding, err := encodePayload(event)
+	if err != nil {
+		return err
+	}
+	msg := rabbitEventPublishing(event, body, encoding)
+	msg.DeliveryMode = amqp091.Persistent
+	return publisher.publish(ctx, settings.Exchange, event.Destination, msg)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultRedisStreamPrefix = "wuzapi:events:"
+	defaultRedisStreamMaxLen = 10000
+)
+
+var (
+	redisPublisher    *redis.Client
+	redisEnabled      bool
+	redisStreamPrefix string
+	redisStreamMaxLen int
+)
+
+// InitRedis connects the Redis stream publisher when REDIS_URL is set
+func InitRedis() {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		redisEnabled = false
+		log.Info().Msg("REDIS_URL is not set. Redis stream publishing disabled.")
+		return
+	}
+
+	redisStreamPrefix = os.Getenv("REDIS_STREAM_PREFIX")
+	if redisStreamPrefix == "" {
+		redisStreamPrefix = defaultRedisStreamPrefix
+	}
+	// 0 keeps every entry
+	redisStreamMaxLen = defaultRedisStreamMaxLen
+	if v, err := strconv.Atoi(os.Getenv("REDIS_STREAM_MAXLEN")); err == nil && v >= 0 {
+		redisStreamMaxLen = v
+	}
+
+	tlsConfig, err := brokerTLSConfig("REDIS")
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid Redis TLS settings, Redis stream publishing disabled")
+		return
+	}
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid REDIS_URL, expected redis://host:port/db or rediss://host:port/db")
+		return
+	}
+	if tlsConfig != nil {
+		if host, _, err := net.SplitHostPort(options.Addr); err == nil {
+			tlsConfig.ServerName = host
+		}
+		options.TLSConfig = tlsConfig
+	}
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		log.Error().Err(err).Msg("Could not connect to Redis")
+		return
+	}
+
+	redisPublisher = client
+	redisEnabled = true
+	log.Info().
+		Str("prefix", redisStreamPrefix).
+		Int("maxlen", redisStreamMaxLen).
+		Msg("Redis connection established.")
+}
+
+// Usage - like sendToGlobalRabbit, to the stream of the instance
+func sendToRedis(jsonData []byte, userID string, token string, eventType string) {
+	if !redisEnabled {
+		return
+	}
+	GetDeliveryManager().Enqueue(&DeliveryEvent{
+		UserID:      userID,
+		Token:       token,
+		Channel:     DeliveryChannelRedis,
+		Destination: redisStreamPrefix + userID,
+		EventType:   eventType,
+		Payload:     string(jsonData),
+	})
+}
+
+// publishToRedis appends an event to the stream of its instance, trimmed to
+// about REDIS_STREAM_MAXLEN entries. The entry holds the same JSON as the
+// RabbitMQ message in the event field, next to the delivery headers.
+func publishToRedis(ctx context.Context, event *DeliveryEvent) error {
+	if !redisEnabled {
+		return errors.New("Redis is not connected")
+	}
+	body, encoding, err := encodePayload(event)
+	if err != nil {
+		return err
+	}
+	headers := deliveryHeaders(nil, event)
+	values := []string{
+		"X-Delivery-ID", headers["X-Delivery-ID"],
+		"X-Attempt", headers["X-Attempt"],
+		"instanceId", event.UserID,
+		"instanceName", instanceName(event.Token),
+		"eventType", event.EventType,
+	}
+	if encoding != "" {
+		values = append(values, "Content-Encoding", encoding, "payloadDecoding", payloadDecoding(event, encoding, false))
+	}
+	values = append(values, "event", string(body))
+	args := &redis.XAddArgs{
+		Stream: event.Destination,
+		Values: values,
+	}
+	if redisStreamMaxLen > 0 {
+		// Approximate trimming removes whole nodes, which is much cheaper
+		args.MaxLen = int64(redisStreamMaxLen)
+		args.Approx = true
+	}
+	return redisPublisher.XAdd(ctx, args).Err()
+}
@@ -45,14 +45,41 @@ func (s *server) routes() {
 
 	adminRoutes := s.router.PathPrefix("/admin").Subrouter()
 	adminRoutes.Use(s.authadmin)
+	adminRoutes.Use(httpMetrics)
 	adminRoutes.Handle("/users", s.ListUsers()).Methods("GET")
 	adminRoutes.Handle("/users/{id}", s.ListUsers()).Methods("GET")
 	adminRoutes.Handle("/users", s.AddUser()).Methods("POST")
+	adminRoutes.Handle("/users/{id}", s.AdminUpdateUser()).Methods("PATCH")
 	adminRoutes.Handle("/users/{id}", s.DeleteUser()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/disable", s.AdminDisableUser()).Methods("POST")
+	adminRoutes.Handle("/users/{id}/enable", s.AdminEnableUser()).Methods("POST")
 	adminRoutes.Handle("/users/{id}/full", s.DeleteUserComplete()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/s3config", s.AdminGetS3Config()).Methods("GET")
+	adminRoutes.Handle("/users/{id}/s3config", s.AdminSetS3Config()).Methods("POST", "PUT")
+	adminRoutes.Handle("/users/{id}/s3config", s.AdminDeleteS3Config()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/s3/media/delete", s.AdminDeleteS3Media()).Methods("POST")
+	adminRoutes.Handle("/users/{id}/delivery/policy", s.AdminGetDeliveryPolicy()).Methods("GET")
+	adminRoutes.Handle("/users/{id}/delivery/policy", s.AdminSetDeliveryPolicy()).Methods("POST", "PUT")
+	adminRoutes.Handle("/users/{id}/delivery/policy", s.AdminDeleteDeliveryPolicy()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/delivery/ratelimit", s.AdminGetDeliveryRateLimit()).Methods("GET")
+	adminRoutes.Handle("/users/{id}/delivery/ratelimit", s.AdminSetDeliveryRateLimit()).Methods("POST")
+	adminRoutes.Handle("/users/{id}/delivery/ratelimit", s.AdminDeleteDeliveryRateLimit()).Methods("DELETE")
+	adminRoutes.Handle("/users/{id}/amqp", s.AdminGetAMQPSettings()).Methods("GET")
+	adminRoutes.Handle("/users/{id}/amqp", s.AdminSetAMQPSettings()).Methods("POST", "PUT")
+	adminRoutes.Handle("/users/{id}/amqp", s.AdminDeleteAMQPSettings()).Methods("DELETE")
+	adminRoutes.Handle("/delivery/history", s.AdminGetDeliveryHistory()).Methods("GET")
+	adminRoutes.Handle("/delivery/replay", s.AdminReplayDeliveries()).Methods("POST")
+	adminRoutes.Handle("/delivery/stats", s.AdminGetDeliveryStats()).Methods("GET")
+	adminRoutes.Handle("/rabbitmq/status", s.AdminGetRabbitMQStatus()).Methods("GET")
+	adminRoutes.Handle("/s3/usage", s.AdminGetS3Usage()).Methods("GET")
+	adminRoutes.Handle("/s3/retention", s.AdminGetS3Retention()).Methods("GET")
+	adminRoutes.Handle("/s3/retention/run", s.AdminRunS3Retention()).Methods("POST")
+
+	s.router.Handle("/metrics", s.authmetrics(s.Metrics())).Methods("GET")
 
 	c := alice.New()
 	c = c.Append(s.authalice)
+	c = c.Append(httpMetrics)
 	c = c.Append(hlog.NewHandler(routerLog))
 
 	c = c.Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
@@ -83,20 +110,67 @@ func (s *server) routes() {
 	s.router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
 	s.router.Handle("/webhook", c.Then(s.DeleteWebhook())).Methods("DELETE")
 	s.router.Handle("/webhook", c.Then(s.UpdateWebhook())).Methods("PUT")
+	s.router.Handle("/webhook/tls", c.Then(s.GetWebhookTLS())).Methods("GET")
+	s.router.Handle("/webhook/tls", c.Then(s.SetWebhookTLS())).Methods("POST")
+	s.router.Handle("/webhook/tls", c.Then(s.DeleteWebhookTLS())).Methods("DELETE")
+	s.router.Handle("/webhook/failover", c.Then(s.GetWebhookFailover())).Methods("GET")
+	s.router.Handle("/webhook/failover", c.Then(s.SetWebhookFailover())).Methods("POST")
+	s.router.Handle("/webhook/failover", c.Then(s.DeleteWebhookFailover())).Methods("DELETE")
+	s.router.Handle("/nats", c.Then(s.GetNATSSettings())).Methods("GET")
+	s.router.Handle("/nats", c.Then(s.SetNATSSettings())).Methods("POST")
+	s.router.Handle("/nats", c.Then(s.DeleteNATSSettings())).Methods("DELETE")
+	s.router.Handle("/sqs", c.Then(s.GetSQSSettings())).Methods("GET")
+	s.router.Handle("/sqs", c.Then(s.SetSQSSettings())).Methods("POST")
+	s.router.Handle("/sqs", c.Then(s.DeleteSQSSettings())).Methods("DELETE")
+	s.router.Handle("/pubsub", c.Then(s.GetPubSubSettings())).Methods("GET")
+	s.router.Handle("/pubsub", c.Then(s.SetPubSubSettings())).Methods("POST")
+	s.router.Handle("/pubsub", c.Then(s.DeletePubSubSettings())).Methods("DELETE")
 
 	s.router.Handle("/session/proxy", c.Then(s.SetProxy())).Methods("POST")
+	s.router.Handle("/session/privacy", c.Then(s.GetPrivacy())).Methods("GET")
+	s.router.Handle("/session/privacy", c.Then(s.SetPrivacy())).Methods("POST")
+
+	s.router.Handle("/delivery/policy", c.Then(s.GetDeliveryPolicy())).Methods("GET")
+	s.router.Handle("/delivery/policy", c.Then(s.SetDeliveryPolicy())).Methods("POST", "PUT")
+	s.router.Handle("/delivery/policy", c.Then(s.DeleteDeliveryPolicy())).Methods("DELETE")
+	s.router.Handle("/delivery/history", c.Then(s.GetDeliveryHistory())).Methods("GET")
+	s.router.Handle("/delivery/replay", c.Then(s.ReplayDeliveries())).Methods("POST")
+	s.router.Handle("/delivery/stats", c.Then(s.GetDeliveryStats())).Methods("GET")
+	s.router.Handle("/events/stream", c.Then(s.StreamEvents())).Methods("GET")
 
 	s.router.Handle("/session/s3/config", c.Then(s.ConfigureS3())).Methods("POST")
 	s.router.Handle("/session/s3/config", c.Then(s.GetS3Config())).Methods("GET")
 	s.router.Handle("/session/s3/config", c.Then(s.DeleteS3Config())).Methods("DELETE")
 	s.router.Handle("/session/s3/test", c.Then(s.TestS3Connection())).Methods("POST")
+	s.router.Handle("/session/s3/diagnose", c.Then(s.DiagnoseS3())).Methods("POST")
+	s.router.Handle("/session/s3/presign", c.Then(s.PresignMediaURL())).Methods("POST")
+	s.router.Handle("/session/s3/retention", c.Then(s.GetS3Retention())).Methods("GET")
+	s.router.Handle("/session/s3/retention/run", c.Then(s.RunS3Retention())).Methods("POST")
+	s.router.Handle("/session/s3/media/delete", c.Then(s.DeleteS3Media())).Methods("POST")
+
+	s.router.Handle("/media/{key:.+}", c.Then(s.ServeMedia())).Methods("GET")
+
+	s.router.Handle("/hooks", c.Then(s.ListHooks())).Methods("GET")
+	s.router.Handle("/hooks", c.Then(s.AddHook())).Methods("POST")
+	s.router.Handle("/hooks/{id}", c.Then(s.UpdateHook())).Methods("PUT")
+	s.router.Handle("/hooks/{id}", c.Then(s.DeleteHook())).Methods("DELETE")
+
+	s.router.Handle("/templates", c.Then(s.ListTemplates())).Methods("GET")
+	s.router.Handle("/templates", c.Then(s.AddTemplate())).Methods("POST")
+	s.router.Handle("/templates/{name}", c.Then(s.GetTemplate())).Methods("GET")
+	s.router.Handle("/templates/{name}", c.Then(s.UpdateTemplate())).Methods("PUT")
+	s.router.Handle("/templates/{name}", c.Then(s.DeleteTemplate())).Methods("DELETE")
 
 	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
 	s.router.Handle("/chat/delete", c.Then(s.DeleteMessage())).Methods("POST")
+	s.router.Handle("/chat/revoke", c.Then(s.DeleteMessage())).Methods("POST")
 	s.router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
 	s.router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
 	s.router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
-	//	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
+	s.router.Handle("/chat/send/template", c.Then(s.SendMessageTemplate())).Methods("POST")
+	s.router.Handle("/chat/send/bulk", c.Then(s.SendBulk())).Methods("POST")
+	s.router.Handle("/chat/send/bulk/{id}", c.Then(s.GetBulkJob())).Methods("GET")
+	s.router.Handle("/chat/send/bulk/{id}", c.Then(s.CancelBulkJob())).Methods("DELETE")
 	s.router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
 	s.router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
 	s.router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
@@ -105,7 +179,9 @@ func (s *server) routes() {
 	s.router.Handle("/chat/send/buttons", c.Then(s.SendButtons())).Methods("POST")
 	s.router.Handle("/chat/send/list", c.Then(s.SendList())).Methods("POST")
 	s.router.Handle("/chat/send/poll", c.Then(s.SendPoll())).Methods("POST")
+	s.router.Handle("/chat/poll/{id}/results", c.Then(s.GetPollResults())).Methods("GET")
 	s.router.Handle("/chat/send/edit", c.Then(s.SendEditMessage())).Methods("POST")
+	s.router.Handle("/chat/edit", c.Then(s.SendEditMessage())).Methods("POST")
 
 	s.router.Handle("/user/presence", c.Then(s.SendPresence())).Methods("POST")
 	s.router.Handle("/user/info", c.Then(s.GetUser())).Methods("POST")
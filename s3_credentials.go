@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// S3 credential modes
+const (
+	// CredentialModeStatic uses the access and secret key of the configuration
+	CredentialModeStatic = "static"
+	// CredentialModeDefault uses the SDK default chain: environment, shared
+	// config files, web identity, ECS task role and EC2 instance profile
+	CredentialModeDefault = "default"
+	// CredentialModeWebIdentity exchanges the service account token for a role
+	// (IAM roles for service accounts on EKS)
+	CredentialModeWebIdentity = "web_identity"
+	// CredentialModeAssumeRole assumes a role, optionally with an external ID,
+	// using the static keys or the default chain as source credentials
+	CredentialModeAssumeRole = "assume_role"
+
+	// stsFallbackRegion is used for STS when no region is configured anywhere
+	stsFallbackRegion = "us-east-1"
+)
+
+// normalizeCredentialMode validates a credential mode, defaulting to static
+func normalizeCredentialMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return CredentialModeStatic, nil
+	case CredentialModeStatic, CredentialModeDefault, CredentialModeWebIdentity, CredentialModeAssumeRole:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unsupported credential mode %q", mode)
+}
+
+// newS3Credentials builds the credentials provider for a configuration.
+// Temporary credentials are cached and refreshed before they expire. STS is
+// reached through httpClient when set, so proxy and CA settings apply to it.
+func newS3Credentials(userID string, config *S3Config, httpClient aws.HTTPClient) (aws.CredentialsProvider, error) {
+	mode, err := normalizeCredentialMode(config.CredentialMode)
+	if err != nil {
+		return nil, err
+	}
+	config.CredentialMode = mode
+
+	static := credentials.NewStaticCredentialsProvider(config.AccessKey, config.SecretKey, "")
+	if mode == CredentialModeStatic {
+		return static, nil
+	}
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if config.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(config.Region))
+	}
+	if httpClient != nil {
+		opts = append(opts, awsconfig.WithHTTPClient(httpClient))
+	}
+	base, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	if base.Region == "" {
+		base.Region = stsFallbackRegion
+	}
+
+	sessionName := "wuzapi-" + userID
+
+	switch mode {
+	case CredentialModeWebIdentity:
+		roleARN := config.RoleARN
+		if roleARN == "" {
+			roleARN = os.Getenv("AWS_ROLE_ARN")
+		}
+		tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		if roleARN == "" || tokenFile == "" {
+			return nil, fmt.Errorf("web_identity requires a role ARN and AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(base), roleARN, stscreds.IdentityTokenFile(tokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = sessionName
+		})
+		return aws.NewCredentialsCache(provider), nil
+
+	case CredentialModeAssumeRole:
+		if config.RoleARN == "" {
+			return nil, fmt.Errorf("assume_role requires a role ARN")
+		}
+		// Static keys, when given, are the identity allowed to assume the role
+		if config.AccessKey != "" {
+			base.Credentials = static
+		}
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(base), config.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = sessionName
+			if config.ExternalID != "" {
+				o.ExternalID = aws.String(config.ExternalID)
+			}
+		})
+		return aws.NewCredentialsCache(provider), nil
+	}
+
+	return base.Credentials, nil
+}
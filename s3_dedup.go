@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/rs/zerolog/log"
+)
+
+// objectChecker is implemented by backends that can cheaply tell whether an
+// object exists, used to skip uploads of deduplicated media
+type objectChecker interface {
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// GenerateDedupKey returns the content-addressed key for deduplicated media.
+// The hash is sharded by its first two characters to keep listings small.
+func (m *S3Manager) GenerateDedupKey(userID, hash, mimeType string) string {
+	return fmt.Sprintf("users/%s/objects/%s/%s%s", userID, hash[:2], hash, s3KeyExtension(mimeType))
+}
+
+// hashMediaStream computes the SHA-256 of body and returns a reader positioned
+// at the start of the content. Seekable readers are rewound, anything else is
+// buffered in memory.
+func hashMediaStream(body io.Reader, size int64) (io.Reader, int64, string, error) {
+	hasher := sha256.New()
+
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		n, err := io.Copy(hasher, seeker)
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("failed to hash media: %w", err)
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, "", fmt.Errorf("failed to rewind media: %w", err)
+		}
+		return seeker, n, hex.EncodeToString(hasher.Sum(nil)), nil
+	}
+
+	data, err := io.ReadAll(io.TeeReader(body, hasher))
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to hash media: %w", err)
+	}
+	return bytes.NewReader(data), int64(len(data)), hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// dedupObjectExists reports whether content with this hash is already stored.
+// Backends that can check objects are asked directly, otherwise the
+// media_objects mapping table is consulted.
+func (m *S3Manager) dedupObjectExists(ctx context.Context, storage MediaStorage, userID, hash, key string) bool {
+	if checker, ok := storage.(objectChecker); ok {
+		exists, err := checker.Exists(ctx, key)
+		if err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("Failed to check for deduplicated object, uploading again")
+			return false
+		}
+		return exists
+	}
+
+	m.mu.RLock()
+	db := m.db
+	m.mu.RUnlock()
+	if db == nil {
+		return false
+	}
+
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM media_objects WHERE user_id = $1 AND sha256 = $2 AND object_key = $3", userID, hash, key)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to look up deduplicated object, uploading again")
+		return false
+	}
+	return count > 0
+}
+
+// recordMediaObject stores the messageID to content hash mapping
+func (m *S3Manager) recordMediaObject(userID, messageID, hash, key string, size int64, mimeType string) {
+	m.mu.RLock()
+	db := m.db
+	m.mu.RUnlock()
+	if db == nil {
+		return
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO media_objects (user_id, message_id, sha256, object_key, size, mime_type)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, message_id) DO UPDATE SET
+			sha256 = excluded.sha256,
+			object_key = excluded.object_key,
+			size = excluded.size,
+			mime_type = excluded.mime_type`,
+		userID, messageID, hash, key, size, mimeType)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Str("messageID", messageID).Msg("Failed to record media object")
+	}
+}
+
+// deleteMediaObjects removes every mapping for a user, used when all of the
+// user's media is deleted
+func (m *S3Manager) deleteMediaObjects(userID string) {
+	m.mu.RLock()
+	db := m.db
+	m.mu.RUnlock()
+	if db == nil {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM media_objects WHERE user_id = $1", userID); err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to delete media object mappings")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MediaDeleteFilter scopes a bulk media deletion. Empty fields match everything,
+// but at least one of them must be set.
+type MediaDeleteFilter struct {
+	ContactJID string    `json:"contactJid,omitempty"`
+	Direction  string    `json:"direction,omitempty"`
+	From       time.Time `json:"from,omitempty"`
+	To         time.Time `json:"to,omitempty"`
+}
+
+// MediaDeleteResult reports what a bulk media deletion removed
+type MediaDeleteResult struct {
+	UserID         string            `json:"userId"`
+	Filter         MediaDeleteFilter `json:"filter"`
+	Prefixes       []string          `json:"prefixes"`
+	ObjectsDeleted int64             `json:"objectsDeleted"`
+	BytesDeleted   int64             `json:"bytesDeleted"`
+	DurationMs     int64             `json:"durationMs"`
+	Error          string            `json:"error,omitempty"`
+}
+
+var errEmptyDeleteFilter = errors.New("at least one of contact_jid, direction, from or to is required")
+
+// s3ContactSegment converts a JID to the contact folder used in object keys
+func s3ContactSegment(contactJID string) string {
+	contactJID = strings.ReplaceAll(contactJID, "@", "_")
+	return strings.ReplaceAll(contactJID, ":", "_")
+}
+
+// validate normalizes the filter, a bare phone number is taken as a user JID
+func (f *MediaDeleteFilter) validate() error {
+	f.ContactJID = strings.TrimSpace(f.ContactJID)
+	if f.ContactJID != "" && !strings.Contains(f.ContactJID, "@") {
+		f.ContactJID = strings.TrimPrefix(f.ContactJID, "+") + "@s.whatsapp.net"
+	}
+	if strings.ContainsAny(f.ContactJID, "/\\") {
+		return errors.New("invalid contact_jid")
+	}
+
+	f.Direction = strings.ToLower(strings.TrimSpace(f.Direction))
+	if f.Direction != "" && f.Direction != "inbox" && f.Direction != "outbox" {
+		return errors.New("direction must be 'inbox' or 'outbox'")
+	}
+
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return errors.New("from must be before to")
+	}
+	if f.ContactJID == "" && f.Direction == "" && f.From.IsZero() && f.To.IsZero() {
+		return errEmptyDeleteFilter
+	}
+	return nil
+}
+
+// prefixes returns the key prefixes the filter covers for a user
+func (f *MediaDeleteFilter) prefixes(userID string) []string {
+	base := fmt.Sprintf("users/%s/", userID)
+	if f.ContactJID == "" && f.Direction == "" {
+		return []string{base}
+	}
+
+	directions := []string{"inbox", "outbox"}
+	if f.Direction != "" {
+		directions = []string{f.Direction}
+	}
+
+	prefixes := make([]string, 0, len(directions))
+	for _, direction := range directions {
+		prefix := base + direction + "/"
+		if f.ContactJID != "" {
+			prefix += s3ContactSegment(f.ContactJID) + "/"
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// DeleteUserMedia deletes the media of a user matching filter, from the
+// primary storage and the mirror. Dates are matched against the time objects
+// were stored.
+func (m *S3Manager) DeleteUserMedia(ctx context.Context, userID string, filter MediaDeleteFilter) (*MediaDeleteResult, error) {
+	if err := filter.validate(); err != nil {
+		return nil, err
+	}
+
+	storage, config, ok := m.GetStorage(userID)
+	if !ok {
+		return nil, fmt.Errorf("media storage not initialized for user %s", userID)
+	}
+	deleter, ok := storage.(rangeDeleter)
+	if !ok {
+		return nil, fmt.Errorf("storage provider %s does not support scoped deletion", config.Provider)
+	}
+
+	start := time.Now()
+	result := &MediaDeleteResult{
+		UserID:   userID,
+		Filter:   filter,
+		Prefixes: filter.prefixes(userID),
+	}
+
+	var err error
+	for _, prefix := range result.Prefixes {
+		var objects, bytes int64
+		objects, bytes, err = deleter.DeleteModifiedBetween(ctx, prefix, filter.From, filter.To)
+		result.ObjectsDeleted += objects
+		result.BytesDeleted += bytes
+		if err != nil {
+			break
+		}
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	if mirror := m.existingMirrorManager(); mirror != nil {
+		if _, _, ok := mirror.GetStorage(userID); ok {
+			if _, mirrorErr := mirror.DeleteUserMedia(ctx, userID, filter); mirrorErr != nil {
+				log.Error().Err(mirrorErr).Str("userID", userID).Msg("Failed to delete mirrored media")
+			}
+		}
+	}
+
+	log.Info().Str("userID", userID).Strs("prefixes", result.Prefixes).Int64("objectsDeleted", result.ObjectsDeleted).Msg("User media deleted")
+	return result, err
+}
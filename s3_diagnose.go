@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// DiagnosticStep is the outcome of one operation of a storage diagnosis
+type DiagnosticStep struct {
+	Step      string `json:"step"`
+	OK        bool   `json:"ok"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Hint      string `json:"hint,omitempty"`
+}
+
+// DiagnosticReport collects the steps of a storage diagnosis
+type DiagnosticReport struct {
+	Provider string           `json:"provider"`
+	Endpoint string           `json:"endpoint,omitempty"`
+	Region   string           `json:"region,omitempty"`
+	Bucket   string           `json:"bucket"`
+	ProbeKey string           `json:"probeKey"`
+	OK       bool             `json:"ok"`
+	TotalMs  int64            `json:"totalMs"`
+	Steps    []DiagnosticStep `json:"steps"`
+}
+
+// run times fn and records it as a step, returning whether it succeeded
+func (r *DiagnosticReport) run(name string, config *S3Config, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	step := DiagnosticStep{
+		Step:      name,
+		OK:        err == nil,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		step.Error = err.Error()
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			step.Code = apiErr.ErrorCode()
+		}
+		step.Hint = diagnosticHint(name, step.Code, config)
+		r.OK = false
+	}
+	r.Steps = append(r.Steps, step)
+	return err == nil
+}
+
+func (r *DiagnosticReport) skip(name string) {
+	r.Steps = append(r.Steps, DiagnosticStep{Step: name, Skipped: true})
+}
+
+// diagnosticHint explains the most common misconfigurations behind an S3 error code
+func diagnosticHint(step, code string, config *S3Config) string {
+	switch code {
+	case "AccessDenied", "Forbidden":
+		actions := map[string]string{
+			"list":   "s3:ListBucket",
+			"put":    "s3:PutObject",
+			"head":   "s3:GetObject",
+			"get":    "s3:GetObject",
+			"delete": "s3:DeleteObject",
+		}
+		action, ok := actions[step]
+		if !ok {
+			return "the credentials are not allowed to perform this operation"
+		}
+		hint := fmt.Sprintf("the credentials need %s on the bucket", action)
+		if step == "put" && config.URLMode != MediaURLModePresigned {
+			hint += " and s3:PutObjectAcl for public-read uploads"
+		}
+		if config.SSEType == SSETypeKMS && (step == "put" || step == "get") {
+			hint += ", plus kms:GenerateDataKey and kms:Decrypt on the KMS key"
+		}
+		return hint
+	case "AccessControlListNotSupported":
+		return "the bucket has ACLs disabled, use url_mode \"presigned\" or a bucket policy for public access"
+	case "NoSuchBucket":
+		return "the bucket does not exist, check the bucket name and endpoint"
+	case "PermanentRedirect", "AuthorizationHeaderMalformed", "IllegalLocationConstraintException":
+		return "the bucket lives in a different region than the configured one"
+	case "SignatureDoesNotMatch":
+		return "the secret key is wrong, or the endpoint requires path_style"
+	case "InvalidAccessKeyId":
+		return "the access key is unknown to this endpoint"
+	case "KMS.NotFoundException", "KMS.DisabledException", "KMS.AccessDeniedException":
+		return "the KMS key is missing, disabled or not usable by these credentials"
+	}
+	if step == "public_read" {
+		return "the object URL is not publicly readable, check the bucket policy or public_url"
+	}
+	return ""
+}
+
+// Diagnose performs a full round trip on a probe object and reports the
+// latency and outcome of every step
+func (m *S3Manager) Diagnose(ctx context.Context, userID string) (*DiagnosticReport, error) {
+	storage, config, ok := m.GetStorage(userID)
+	if !ok {
+		return nil, fmt.Errorf("media storage not initialized for user %s", userID)
+	}
+
+	report := &DiagnosticReport{
+		Provider: config.Provider,
+		Endpoint: config.Endpoint,
+		Region:   config.Region,
+		Bucket:   config.Bucket,
+		ProbeKey: fmt.Sprintf("users/%s/.diagnostics/probe-%d.txt", userID, time.Now().UnixNano()),
+		OK:       true,
+	}
+	payload := []byte("wuzapi storage diagnostics probe " + time.Now().UTC().Format(time.RFC3339))
+
+	start := time.Now()
+	if config.Provider == StorageProviderS3 {
+		client, _, ok := m.GetClient(userID)
+		if !ok {
+			return nil, fmt.Errorf("S3 client not initialized for user %s", userID)
+		}
+		m.diagnoseS3(ctx, report, client, config, storage, payload)
+	} else {
+		m.diagnoseStorage(ctx, report, config, storage, payload)
+	}
+	report.TotalMs = time.Since(start).Milliseconds()
+
+	return report, nil
+}
+
+func (m *S3Manager) diagnoseS3(ctx context.Context, report *DiagnosticReport, client *s3.Client, config *S3Config, storage MediaStorage, payload []byte) {
+	key := report.ProbeKey
+
+	report.run("list", config, func() error {
+		_, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(config.Bucket),
+			Prefix:  aws.String(path.Dir(key) + "/"),
+			MaxKeys: aws.Int32(1),
+		})
+		return err
+	})
+
+	// Upload with the same parameters as real media so ACL and encryption
+	// problems show up here
+	uploaded := report.run("put", config, func() error {
+		input := putObjectInput(ctx, config, key, "text/plain")
+		input.Body = bytes.NewReader(payload)
+		_, err := client.PutObject(ctx, input)
+		return err
+	})
+	if !uploaded {
+		report.skip("head")
+		report.skip("get")
+		report.skip("public_read")
+		report.skip("delete")
+		return
+	}
+
+	report.run("head", config, func() error {
+		_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(config.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+
+	report.run("get", config, func() error {
+		output, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(config.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+		data, err := io.ReadAll(output.Body)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, payload) {
+			return errors.New("downloaded content does not match the uploaded probe")
+		}
+		return nil
+	})
+
+	report.run("public_read", config, func() error {
+		return fetchDiagnosticURL(ctx, storage.PublicURL(key))
+	})
+
+	report.run("delete", config, func() error {
+		_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(config.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+}
+
+// diagnoseStorage runs the steps available through MediaStorage for non S3 providers
+func (m *S3Manager) diagnoseStorage(ctx context.Context, report *DiagnosticReport, config *S3Config, storage MediaStorage, payload []byte) {
+	key := report.ProbeKey
+
+	report.run("test", config, func() error {
+		return storage.Test(ctx)
+	})
+
+	uploaded := report.run("put", config, func() error {
+		return storage.Upload(ctx, key, payload, "text/plain")
+	})
+	if !uploaded {
+		report.skip("head")
+		report.skip("delete")
+		return
+	}
+
+	if checker, ok := storage.(objectChecker); ok {
+		report.run("head", config, func() error {
+			exists, err := checker.Exists(ctx, key)
+			if err == nil && !exists {
+				err = errors.New("probe object not found after upload")
+			}
+			return err
+		})
+	} else {
+		report.skip("head")
+	}
+
+	// Local media is served through the authenticated /media route
+	if config.Provider != StorageProviderLocal {
+		report.run("public_read", config, func() error {
+			return fetchDiagnosticURL(ctx, storage.PublicURL(key))
+		})
+	}
+
+	report.run("delete", config, func() error {
+		return storage.Delete(ctx, key)
+	})
+}
+
+// fetchDiagnosticURL checks that a media URL can be downloaded anonymously
+func fetchDiagnosticURL(ctx context.Context, rawURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", rawURL, resp.StatusCode)
+	}
+	return nil
+}
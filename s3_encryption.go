@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// Client-side encryption modes
+const (
+	EncryptionNone = ""
+	// EncryptionKey wraps the data key with a per-user AES-256 key
+	EncryptionKey = "key"
+	// EncryptionKMS gets the data key from AWS KMS
+	EncryptionKMS = "kms"
+)
+
+// Encrypted objects start with a header followed by AES-256-GCM sealed chunks:
+//
+//	magic "WZE1" | mode (1) | wrapped key length (2) | wrapped key | nonce prefix (7)
+//
+// Every chunk holds up to encryptionChunkSize bytes of plaintext. Its nonce is
+// the prefix, a 4 byte counter and a flag marking the last chunk, so chunks
+// can't be reordered and truncation is detected.
+const (
+	encryptionMagic       = "WZE1"
+	encryptionChunkSize   = 64 * 1024
+	encryptionNoncePrefix = 7
+
+	encryptionModeKey byte = 1
+	encryptionModeKMS byte = 2
+)
+
+var errMediaDecryption = errors.New("failed to decrypt media")
+
+// normalizeEncryptionMode validates a client-side encryption mode
+func normalizeEncryptionMode(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "none":
+		return EncryptionNone, nil
+	case EncryptionKey:
+		return EncryptionKey, nil
+	case EncryptionKMS:
+		return EncryptionKMS, nil
+	}
+	return "", fmt.Errorf("unsupported encryption mode %q", mode)
+}
+
+// parseEncryptionKey decodes a base64 encoded 256 bit key
+func parseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes encoded as base64")
+	}
+	return key, nil
+}
+
+// isEncryptedMedia reports whether an object starts with the encryption header
+func isEncryptedMedia(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(encryptionMagic))
+}
+
+// kmsClient returns the KMS client created along the S3 client of a user
+func (m *S3Manager) kmsClient(userID string) (*kms.Client, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	client, ok := m.kmsClients[userID]
+	return client, ok
+}
+
+// newDataKey returns a fresh data key together with its wrapped form
+func (m *S3Manager) newDataKey(ctx context.Context, userID string, config *S3Config) ([]byte, []byte, byte, error) {
+	if config.Encryption == EncryptionKMS {
+		client, ok := m.kmsClient(userID)
+		if !ok {
+			return nil, nil, 0, fmt.Errorf("KMS client not initialized for user %s", userID)
+		}
+		output, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+			KeyId:   aws.String(config.KMSKeyID),
+			KeySpec: kmstypes.DataKeySpecAes256,
+		})
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to generate data key: %w", err)
+		}
+		return output.Plaintext, output.CiphertextBlob, encryptionModeKMS, nil
+	}
+
+	masterKey, err := parseEncryptionKey(config.EncryptionKey)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, 0, err
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, 0, err
+	}
+	return dataKey, gcm.Seal(nonce, nonce, dataKey, nil), encryptionModeKey, nil
+}
+
+// unwrapDataKey recovers the data key of an object
+func (m *S3Manager) unwrapDataKey(ctx context.Context, userID string, mode byte, wrapped []byte) ([]byte, error) {
+	switch mode {
+	case encryptionModeKMS:
+		client, ok := m.kmsClient(userID)
+		if !ok {
+			return nil, fmt.Errorf("KMS client not initialized for user %s", userID)
+		}
+		output, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: wrapped})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+		}
+		return output.Plaintext, nil
+
+	case encryptionModeKey:
+		_, config, ok := m.GetStorage(userID)
+		if !ok {
+			return nil, fmt.Errorf("media storage not initialized for user %s", userID)
+		}
+		masterKey, err := parseEncryptionKey(config.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := newGCM(masterKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(wrapped) < gcm.NonceSize() {
+			return nil, errMediaDecryption
+		}
+		dataKey, err := gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: wrong encryption key", errMediaDecryption)
+		}
+		return dataKey, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key mode %d", errMediaDecryption, mode)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefix:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptMedia encrypts body into a temporary file, which gives uploads a
+// seekable body of known size. The caller removes the file.
+func (m *S3Manager) encryptMedia(ctx context.Context, userID string, config *S3Config, body io.Reader) (*os.File, int64, error) {
+	dataKey, wrapped, mode, err := m.newDataKey(ctx, userID, config)
+	if err != nil {
+		return nil, 0, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	prefix := make([]byte, encryptionNoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.CreateTemp("", "wuzapi-encrypted-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create encryption spool: %w", err)
+	}
+	fail := func(err error) (*os.File, int64, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+
+	out := bufio.NewWriter(file)
+	header := append([]byte(encryptionMagic), mode)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	header = append(header, prefix...)
+	out.Write(header)
+
+	// Read one chunk ahead so the last chunk can be flagged
+	in := bufio.NewReaderSize(body, encryptionChunkSize)
+	buf := make([]byte, encryptionChunkSize)
+	sealed := make([]byte, 0, encryptionChunkSize+gcm.Overhead())
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fail(fmt.Errorf("failed to read media: %w", err))
+		}
+		_, peekErr := in.Peek(1)
+		last := peekErr != nil
+		sealed = gcm.Seal(sealed[:0], chunkNonce(prefix, counter, last), buf[:n], nil)
+		if _, err := out.Write(sealed); err != nil {
+			return fail(fmt.Errorf("failed to write encrypted media: %w", err))
+		}
+		if last {
+			break
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return fail(fmt.Errorf("failed to write encrypted media: %w", err))
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return file, size, nil
+}
+
+// decryptMedia returns a reader with the plaintext of an encrypted object
+func (m *S3Manager) decryptMedia(ctx context.Context, userID string, r io.Reader) (io.Reader, error) {
+	fixed := make([]byte, len(encryptionMagic)+3)
+	if _, err := io.ReadFull(r, fixed); err != nil || !isEncryptedMedia(fixed) {
+		return nil, fmt.Errorf("%w: invalid header", errMediaDecryption)
+	}
+	mode := fixed[len(encryptionMagic)]
+	wrapped := make([]byte, binary.BigEndian.Uint16(fixed[len(encryptionMagic)+1:]))
+	prefix := make([]byte, encryptionNoncePrefix)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, fmt.Errorf("%w: invalid header", errMediaDecryption)
+	}
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("%w: invalid header", errMediaDecryption)
+	}
+
+	dataKey, err := m.unwrapDataKey(ctx, userID, mode, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReader{
+		in:     bufio.NewReaderSize(r, encryptionChunkSize+gcm.Overhead()),
+		gcm:    gcm,
+		prefix: prefix,
+		chunk:  make([]byte, encryptionChunkSize+gcm.Overhead()),
+	}, nil
+}
+
+// decryptingReader opens the sealed chunks of an object one at a time
+type decryptingReader struct {
+	in      *bufio.Reader
+	gcm     cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.in, d.chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = fmt.Errorf("%w: truncated object", errMediaDecryption)
+			}
+			return 0, err
+		}
+		_, peekErr := d.in.Peek(1)
+		last := peekErr != nil
+		d.plain, err = d.gcm.Open(d.chunk[:0], chunkNonce(d.prefix, d.counter, last), d.chunk[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("%w: corrupted or truncated object", errMediaDecryption)
+		}
+		d.counter++
+		d.done = last
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// OpenMedia streams an object of a user, decrypting it when it was stored
+// with client-side encryption
+func (m *S3Manager) OpenMedia(ctx context.Context, userID, key string) (io.ReadCloser, error) {
+	storage, config, ok := m.GetStorage(userID)
+	if !ok {
+		return nil, fmt.Errorf("media storage not initialized for user %s", userID)
+	}
+	reader, ok := storage.(objectReader)
+	if !ok {
+		return nil, fmt.Errorf("storage provider %s does not support reading media", config.Provider)
+	}
+
+	object, err := reader.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(object)
+	header, _ := buffered.Peek(len(encryptionMagic))
+	if !isEncryptedMedia(header) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{buffered, object}, nil
+	}
+
+	plain, err := m.decryptMedia(ctx, userID, buffered)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{plain, object}, nil
+}
+
+// mediaProxyURL is the /media URL encrypted objects are downloaded from
+func mediaProxyURL(key string) string {
+	return strings.TrimRight(os.Getenv("MEDIA_BASE_URL"), "/") + "/media/" + key
+}
+
+// mediaURL returns the URL an object is downloaded from, the /media proxy
+// for encrypted media and the storage URL otherwise
+func mediaURL(storage MediaStorage, config *S3Config, key string) string {
+	if config.Encryption != EncryptionNone {
+		return mediaProxyURL(key)
+	}
+	return storage.PublicURL(key)
+}
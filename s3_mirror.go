@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	mirrorMaxAttempts    = 5
+	mirrorRetryBaseDelay = 2 * time.Second
+	mirrorMaxConcurrency = 4
+)
+
+// mirrorSemaphore bounds the number of mirror uploads running at once
+var mirrorSemaphore = make(chan struct{}, mirrorMaxConcurrency)
+
+// MirrorSettings is the secondary bucket media is copied to, stored as JSON
+// in the storage_mirror column
+type MirrorSettings struct {
+	Provider              string `json:"provider"`
+	Endpoint              string `json:"endpoint"`
+	Region                string `json:"region"`
+	Bucket                string `json:"bucket"`
+	AccessKey             string `json:"access_key,omitempty"`
+	SecretKey             string `json:"secret_key,omitempty"`
+	PathStyle             bool   `json:"path_style"`
+	PublicURL             string `json:"public_url"`
+	GCSCredentials        string `json:"gcs_credentials,omitempty"`
+	AzureConnectionString string `json:"azure_connection_string,omitempty"`
+	CredentialMode        string `json:"credential_mode,omitempty"`
+	RoleARN               string `json:"role_arn,omitempty"`
+	ExternalID            string `json:"external_id,omitempty"`
+	CABundle              string `json:"ca_bundle,omitempty"`
+	InsecureSkipVerify    bool   `json:"insecure_skip_verify,omitempty"`
+	HTTPProxy             string `json:"http_proxy,omitempty"`
+}
+
+// parseMirrorSettings decodes the storage_mirror column, empty when no mirror is set
+func parseMirrorSettings(raw string) (*MirrorSettings, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var mirror MirrorSettings
+	if err := json.Unmarshal([]byte(raw), &mirror); err != nil {
+		return nil, fmt.Errorf("invalid mirror settings: %w", err)
+	}
+	if mirror.Bucket == "" && mirror.Provider != StorageProviderLocal {
+		return nil, nil
+	}
+	return &mirror, nil
+}
+
+// encode returns the JSON stored in the storage_mirror column
+func (ms *MirrorSettings) encode() (string, error) {
+	if ms == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(ms)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// storageConfig builds the mirror configuration, inheriting how URLs are
+// issued and how long media is kept from the primary configuration
+func (ms *MirrorSettings) storageConfig(primary *S3Config) *S3Config {
+	return &S3Config{
+		Enabled:       true,
+		Provider:      ms.Provider,
+		Endpoint:      ms.Endpoint,
+		Region:        ms.Region,
+		Bucket:        ms.Bucket,
+		AccessKey:     ms.AccessKey,
+		SecretKey:     ms.SecretKey,
+		PathStyle:     ms.PathStyle,
+		PublicURL:     ms.PublicURL,
+		MediaDelivery: primary.MediaDelivery,
+		RetentionDays: primary.RetentionDays,
+
+		GCSCredentials:        ms.GCSCredentials,
+		AzureConnectionString: ms.AzureConnectionString,
+		URLMode:               primary.URLMode,
+		PresignTTL:            primary.PresignTTL,
+		ObjectMetadata:        primary.ObjectMetadata,
+		CredentialMode:        ms.CredentialMode,
+		RoleARN:               ms.RoleARN,
+		ExternalID:            ms.ExternalID,
+		CABundle:              ms.CABundle,
+		InsecureSkipVerify:    ms.InsecureSkipVerify,
+		HTTPProxy:             ms.HTTPProxy,
+	}
+}
+
+// mirrorManager returns the manager holding mirror storages, keyed by the
+// user ID of the primary configuration
+func (m *S3Manager) mirrorManager() *S3Manager {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mirror == nil {
+		m.mirror = &S3Manager{
+			clients:  make(map[string]*s3.Client),
+			configs:  make(map[string]*S3Config),
+			storages: make(map[string]MediaStorage),
+		}
+	}
+	return m.mirror
+}
+
+// existingMirrorManager returns the mirror manager without creating it
+func (m *S3Manager) existingMirrorManager() *S3Manager {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mirror
+}
+
+// configureMirror sets up or removes the mirror storage of a user. Mirror
+// failures are logged and never prevent the primary storage from working.
+func (m *S3Manager) configureMirror(userID string, config *S3Config) {
+	if config.Mirror == nil {
+		if mirror := m.existingMirrorManager(); mirror != nil {
+			mirror.RemoveClient(userID)
+		}
+		return
+	}
+
+	if err := m.mirrorManager().InitializeS3Client(userID, config.Mirror.storageConfig(config)); err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to initialize mirror storage")
+	}
+}
+
+// getMirror returns the mirror storage and configuration of a user
+func (m *S3Manager) getMirror(userID string) (MediaStorage, *S3Config, bool) {
+	mirror := m.existingMirrorManager()
+	if mirror == nil {
+		return nil, nil, false
+	}
+	return mirror.GetStorage(userID)
+}
+
+// mirrorMedia copies an uploaded object to the mirror storage in the
+// background. The content is spooled to a temporary file first since the
+// caller's reader is gone by the time the upload runs.
+func (m *S3Manager) mirrorMedia(ctx context.Context, userID, key string, body io.Reader, size int64, mimeType string) (map[string]interface{}, error) {
+	storage, config, ok := m.getMirror(userID)
+	if !ok {
+		return nil, nil
+	}
+
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return nil, fmt.Errorf("media can't be replayed for the mirror")
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind media for the mirror: %w", err)
+	}
+
+	spool, err := os.CreateTemp("", "wuzapi-mirror-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool media for the mirror: %w", err)
+	}
+	if _, err := io.Copy(spool, body); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, fmt.Errorf("failed to spool media for the mirror: %w", err)
+	}
+
+	// Keep the message metadata for the mirror copy
+	jobCtx := context.Background()
+	if meta := objectMetadataFromContext(ctx); meta != nil {
+		jobCtx = withObjectMetadata(jobCtx, meta)
+	}
+
+	go m.runMirrorUpload(jobCtx, userID, storage, config, key, spool, size, mimeType)
+
+	return map[string]interface{}{
+		"url":      storage.PublicURL(key),
+		"bucket":   config.Bucket,
+		"provider": config.Provider,
+		"status":   "pending",
+	}, nil
+}
+
+// runMirrorUpload uploads a spooled file to the mirror, retrying with
+// exponential backoff, and removes the spool file when done
+func (m *S3Manager) runMirrorUpload(ctx context.Context, userID string, storage MediaStorage, config *S3Config, key string, spool *os.File, size int64, mimeType string) {
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	mirrorSemaphore <- struct{}{}
+	defer func() { <-mirrorSemaphore }()
+
+	var err error
+	for attempt := 1; attempt <= mirrorMaxAttempts; attempt++ {
+		if _, err = spool.Seek(0, io.SeekStart); err != nil {
+			break
+		}
+
+		if streamer, ok := storage.(streamUploader); ok {
+			err = streamer.UploadStream(ctx, key, spool, size, mimeType)
+		} else {
+			var data []byte
+			data, err = io.ReadAll(spool)
+			if err == nil {
+				err = storage.Upload(ctx, key, data, mimeType)
+			}
+		}
+		if err == nil {
+			log.Debug().Str("userID", userID).Str("key", key).Str("bucket", config.Bucket).Msg("Media mirrored")
+			return
+		}
+		if !isRetryableUploadError(err) || attempt == mirrorMaxAttempts {
+			break
+		}
+
+		delay := mirrorRetryBaseDelay << (attempt - 1)
+		log.Warn().Err(err).Str("userID", userID).Str("key", key).Int("attempt", attempt).Dur("retryIn", delay).Msg("Mirror upload failed, retrying")
+		time.Sleep(delay)
+	}
+
+	log.Error().Err(err).Str("userID", userID).Str("key", key).Str("bucket", config.Bucket).Msg("Failed to mirror media")
+}
+
+// deleteMirrorObjects removes all mirrored media of a user
+func (m *S3Manager) deleteMirrorObjects(ctx context.Context, userID string) {
+	mirror := m.existingMirrorManager()
+	if mirror == nil {
+		return
+	}
+	if _, _, ok := mirror.GetStorage(userID); !ok {
+		return
+	}
+	if err := mirror.DeleteAllUserObjects(ctx, userID); err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to delete mirrored media")
+	}
+}
+
+// enforceMirrorRetention applies the retention period to the mirror bucket
+func (m *S3Manager) enforceMirrorRetention(ctx context.Context, userID string) {
+	mirror := m.existingMirrorManager()
+	if mirror == nil {
+		return
+	}
+	if _, _, ok := mirror.GetStorage(userID); !ok {
+		return
+	}
+	result, err := mirror.EnforceRetention(ctx, userID)
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Failed to enforce retention on mirrored media")
+		return
+	}
+	log.Info().Str("userID", userID).Int64("objectsDeleted", result.ObjectsDeleted).Msg("Mirror retention sweep completed")
+}
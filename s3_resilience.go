@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Upload retry and circuit breaker defaults, overridable with
+// S3_UPLOAD_MAX_ATTEMPTS, S3_BREAKER_THRESHOLD and S3_BREAKER_COOLDOWN
+const (
+	defaultUploadMaxAttempts = 3
+	uploadRetryBaseDelay     = 500 * time.Millisecond
+	uploadRetryMaxDelay      = 10 * time.Second
+	defaultBreakerThreshold  = 5
+	defaultBreakerCooldown   = time.Minute
+)
+
+// errStorageCircuitOpen is returned while uploads for a user are suspended
+var errStorageCircuitOpen = errors.New("media storage temporarily unavailable, circuit breaker is open")
+
+// uploadCircuit tracks consecutive upload failures of a user
+type uploadCircuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// uploadBreaker holds the per user circuits of S3Manager
+type uploadBreaker struct {
+	mu       sync.Mutex
+	circuits map[string]*uploadCircuit
+}
+
+// CircuitState describes the upload circuit breaker of a user
+type CircuitState struct {
+	Open      bool      `json:"open"`
+	Failures  int       `json:"failures"`
+	OpenUntil time.Time `json:"openUntil,omitempty"`
+}
+
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+func breakerCooldown() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("S3_BREAKER_COOLDOWN")); err == nil && v > 0 {
+		return v
+	}
+	return defaultBreakerCooldown
+}
+
+// allowUpload reports whether an upload may be attempted. Once the cooldown
+// has passed a single trial upload is let through to probe the bucket.
+func (m *S3Manager) allowUpload(userID string) bool {
+	m.breaker.mu.Lock()
+	defer m.breaker.mu.Unlock()
+
+	circuit, ok := m.breaker.circuits[userID]
+	if !ok || circuit.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(circuit.openUntil) || circuit.probing {
+		return false
+	}
+	circuit.probing = true
+	return true
+}
+
+// recordUploadResult updates the circuit of a user after an upload
+func (m *S3Manager) recordUploadResult(userID string, err error) {
+	m.breaker.mu.Lock()
+	defer m.breaker.mu.Unlock()
+
+	if m.breaker.circuits == nil {
+		m.breaker.circuits = make(map[string]*uploadCircuit)
+	}
+	circuit, ok := m.breaker.circuits[userID]
+	if !ok {
+		circuit = &uploadCircuit{}
+		m.breaker.circuits[userID] = circuit
+	}
+
+	if err == nil {
+		if !circuit.openUntil.IsZero() {
+			log.Info().Str("userID", userID).Msg("Media storage reachable again, circuit breaker closed")
+		}
+		delete(m.breaker.circuits, userID)
+		return
+	}
+
+	circuit.failures++
+	circuit.probing = false
+	if circuit.failures >= envInt("S3_BREAKER_THRESHOLD", defaultBreakerThreshold) {
+		circuit.openUntil = time.Now().Add(breakerCooldown())
+		log.Warn().Str("userID", userID).Int("failures", circuit.failures).Time("until", circuit.openUntil).Msg("Media storage unreachable, circuit breaker opened")
+	}
+}
+
+// CircuitState returns the upload circuit breaker state of a user
+func (m *S3Manager) CircuitState(userID string) CircuitState {
+	m.breaker.mu.Lock()
+	defer m.breaker.mu.Unlock()
+
+	circuit, ok := m.breaker.circuits[userID]
+	if !ok {
+		return CircuitState{}
+	}
+	return CircuitState{
+		Open:      !circuit.openUntil.IsZero(),
+		Failures:  circuit.failures,
+		OpenUntil: circuit.openUntil,
+	}
+}
+
+// ResetCircuit closes the circuit of a user, used when its configuration changes
+func (m *S3Manager) ResetCircuit(userID string) {
+	m.breaker.mu.Lock()
+	defer m.breaker.mu.Unlock()
+	delete(m.breaker.circuits, userID)
+}
+
+// isRetryableUploadError reports whether an upload error may succeed on retry.
+// Client errors such as denied access or a missing bucket are permanent.
+func isRetryableUploadError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &statusErr) {
+		status := statusErr.HTTPStatusCode()
+		if status >= 400 && status < 500 {
+			return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+		}
+	}
+	return true
+}
+
+// uploadWithRetry runs upload with jittered exponential backoff. Non-seekable
+// bodies can't be replayed and are attempted once.
+func (m *S3Manager) uploadWithRetry(ctx context.Context, userID string, body io.Reader, upload func() error) error {
+	if !m.allowUpload(userID) {
+		return errStorageCircuitOpen
+	}
+
+	seeker, seekable := body.(io.Seeker)
+	attempts := envInt("S3_UPLOAD_MAX_ATTEMPTS", defaultUploadMaxAttempts)
+	if !seekable {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr != nil {
+				break
+			}
+		}
+
+		err = upload()
+		if err == nil || !isRetryableUploadError(err) || attempt == attempts {
+			break
+		}
+
+		// Full jitter: sleep a random duration up to the exponential backoff
+		backoff := uploadRetryBaseDelay << (attempt - 1)
+		if backoff > uploadRetryMaxDelay {
+			backoff = uploadRetryMaxDelay
+		}
+		delay := time.Duration(rand.Int63n(int64(backoff)))
+		log.Warn().Err(err).Str("userID", userID).Int("attempt", attempt).Dur("retryIn", delay).Msg("Media upload failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			m.recordUploadResult(userID, ctx.Err())
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	m.recordUploadResult(userID, err)
+	return err
+}
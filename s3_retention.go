@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultRetentionInterval = time.Hour
+
+// errRetentionDisabled is returned when a user has no retention window configured
+var errRetentionDisabled = errors.New("retention is not configured for this user")
+
+// RetentionResult describes a single retention sweep for a user
+type RetentionResult struct {
+	UserID         string    `json:"userId"`
+	Provider       string    `json:"provider"`
+	RetentionDays  int       `json:"retentionDays"`
+	Cutoff         time.Time `json:"cutoff"`
+	ObjectsDeleted int64     `json:"objectsDeleted"`
+	BytesDeleted   int64     `json:"bytesDeleted"`
+	DurationMs     int64     `json:"durationMs"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// RetentionStats accumulates retention sweeps for a user since startup
+type RetentionStats struct {
+	Runs           int64     `json:"runs"`
+	Failures       int64     `json:"failures"`
+	ObjectsDeleted int64     `json:"objectsDeleted"`
+	BytesDeleted   int64     `json:"bytesDeleted"`
+	LastRun        time.Time `json:"lastRun"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+// retentionJanitor keeps sweep state for S3Manager
+type retentionJanitor struct {
+	mu       sync.Mutex
+	stats    map[string]*RetentionStats
+	running  map[string]bool
+	interval time.Duration
+	started  bool
+}
+
+// retentionInterval reads S3_RETENTION_INTERVAL (a Go duration such as 30m).
+// Zero or "off" disables the periodic janitor.
+func retentionInterval() time.Duration {
+	v := strings.TrimSpace(os.Getenv("S3_RETENTION_INTERVAL"))
+	if v == "" {
+		return defaultRetentionInterval
+	}
+	if v == "off" || v == "0" {
+		return 0
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval < time.Minute {
+		log.Warn().Str("value", v).Msg("Invalid S3_RETENTION_INTERVAL, using default")
+		return defaultRetentionInterval
+	}
+	return interval
+}
+
+// StartRetentionJanitor periodically deletes media older than each user's
+// retention window, since most S3-compatible stores ignore the Expires header
+func (m *S3Manager) StartRetentionJanitor(interval time.Duration) {
+	if interval <= 0 {
+		log.Info().Msg("S3 retention janitor disabled")
+		return
+	}
+
+	m.janitor.mu.Lock()
+	if m.janitor.started {
+		m.janitor.mu.Unlock()
+		return
+	}
+	m.janitor.started = true
+	m.janitor.interval = interval
+	m.janitor.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			results := m.EnforceRetentionAll(context.Background())
+			var objects int64
+			for _, result := range results {
+				objects += result.ObjectsDeleted
+			}
+			if len(results) > 0 {
+				log.Info().Int("users", len(results)).Int64("objectsDeleted", objects).Msg("S3 retention sweep completed")
+			}
+		}
+	}()
+
+	log.Info().Dur("interval", interval).Msg("S3 retention janitor started")
+}
+
+// EnforceRetentionAll sweeps every user with a retention window configured
+func (m *S3Manager) EnforceRetentionAll(ctx context.Context) []RetentionResult {
+	m.mu.RLock()
+	var userIDs []string
+	for userID, config := range m.configs {
+		if config.RetentionDays > 0 {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(userIDs)
+
+	results := make([]RetentionResult, 0, len(userIDs))
+	for _, userID := range userIDs {
+		result, err := m.EnforceRetention(ctx, userID)
+		if err != nil {
+			log.Error().Err(err).Str("userID", userID).Msg("S3 retention sweep failed")
+		}
+		if result != nil {
+			results = append(results, *result)
+		}
+	}
+	return results
+}
+
+// EnforceRetention deletes the user's objects older than the retention window
+func (m *S3Manager) EnforceRetention(ctx context.Context, userID string) (*RetentionResult, error) {
+	storage, config, ok := m.GetStorage(userID)
+	if !ok {
+		return nil, fmt.Errorf("media storage not initialized for user %s", userID)
+	}
+	if config.RetentionDays <= 0 {
+		return nil, errRetentionDisabled
+	}
+
+	// Skip users whose previous sweep is still running
+	m.janitor.mu.Lock()
+	if m.janitor.running == nil {
+		m.janitor.running = make(map[string]bool)
+	}
+	if m.janitor.running[userID] {
+		m.janitor.mu.Unlock()
+		return nil, fmt.Errorf("retention sweep already running for user %s", userID)
+	}
+	m.janitor.running[userID] = true
+	m.janitor.mu.Unlock()
+
+	defer func() {
+		m.janitor.mu.Lock()
+		delete(m.janitor.running, userID)
+		m.janitor.mu.Unlock()
+	}()
+
+	start := time.Now()
+	result := &RetentionResult{
+		UserID:        userID,
+		Provider:      config.Provider,
+		RetentionDays: config.RetentionDays,
+		Cutoff:        start.Add(-time.Duration(config.RetentionDays) * 24 * time.Hour).UTC(),
+	}
+	prefix := fmt.Sprintf("users/%s/", userID)
+
+	var err error
+	if sweeper, ok := storage.(retentionSweeper); ok {
+		result.ObjectsDeleted, result.BytesDeleted, err = sweeper.DeleteOlderThan(ctx, prefix, result.Cutoff)
+	} else {
+		err = fmt.Errorf("storage provider %s does not support retention sweeps", config.Provider)
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	m.recordRetention(userID, result)
+	m.enforceMirrorRetention(ctx, userID)
+	return result, err
+}
+
+func (m *S3Manager) recordRetention(userID string, result *RetentionResult) {
+	m.janitor.mu.Lock()
+	defer m.janitor.mu.Unlock()
+
+	if m.janitor.stats == nil {
+		m.janitor.stats = make(map[string]*RetentionStats)
+	}
+	stats, ok := m.janitor.stats[userID]
+	if !ok {
+		stats = &RetentionStats{}
+		m.janitor.stats[userID] = stats
+	}
+
+	stats.Runs++
+	stats.ObjectsDeleted += result.ObjectsDeleted
+	stats.BytesDeleted += result.BytesDeleted
+	stats.LastRun = time.Now().UTC()
+	stats.LastError = result.Error
+	if result.Error != "" {
+		stats.Failures++
+	}
+}
+
+// RetentionStats returns a copy of the sweep counters for a user
+func (m *S3Manager) RetentionStats(userID string) RetentionStats {
+	m.janitor.mu.Lock()
+	defer m.janitor.mu.Unlock()
+
+	if stats, ok := m.janitor.stats[userID]; ok {
+		return *stats
+	}
+	return RetentionStats{}
+}
+
+// AllRetentionStats returns a copy of the sweep counters for every user and
+// the janitor interval, zero when the janitor is not running
+func (m *S3Manager) AllRetentionStats() (map[string]RetentionStats, time.Duration) {
+	m.janitor.mu.Lock()
+	defer m.janitor.mu.Unlock()
+
+	all := make(map[string]RetentionStats, len(m.janitor.stats))
+	for userID, stats := range m.janitor.stats {
+		all[userID] = *stats
+	}
+	return all, m.janitor.interval
+}
+
+// deleteS3ObjectsBetween removes objects under prefix last modified within
+// [from, to), in batches of 1000
+func (m *S3Manager) deleteS3ObjectsBetween(ctx context.Context, userID, prefix string, from, to time.Time) (int64, int64, error) {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return 0, 0, fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+
+	var deleted, deletedBytes int64
+	var batch []types.ObjectIdentifier
+	var batchBytes int64
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		output, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(config.Bucket),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+		deleted += int64(len(batch) - len(output.Errors))
+		deletedBytes += batchBytes
+		batch = batch[:0]
+		batchBytes = 0
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("failed to delete %d objects: %s", len(output.Errors), aws.ToString(output.Errors[0].Message))
+		}
+		return nil
+	}
+
+	var continuationToken *string
+	for {
+		output, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(config.Bucket),
+			Prefix:            aws.String(prefix),
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return deleted, deletedBytes, fmt.Errorf("failed to list objects for user %s: %w", userID, err)
+		}
+
+		for _, obj := range output.Contents {
+			if obj.LastModified == nil || !inTimeRange(*obj.LastModified, from, to) {
+				continue
+			}
+			batch = append(batch, types.ObjectIdentifier{Key: obj.Key})
+			batchBytes += aws.ToInt64(obj.Size)
+			// Delete in batches of 1000 (S3 limit)
+			if len(batch) == 1000 {
+				if err := flush(); err != nil {
+					return deleted, deletedBytes, err
+				}
+			}
+		}
+
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		continuationToken = output.NextContinuationToken
+	}
+
+	if err := flush(); err != nil {
+		return deleted, deletedBytes, err
+	}
+	return deleted, deletedBytes, nil
+}
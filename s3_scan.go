@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Media scanners
+const (
+	ScannerClamd = "clamd"
+	ScannerHTTP  = "http"
+)
+
+// Actions taken on infected media
+const (
+	ScanActionQuarantine = "quarantine"
+	ScanActionReject     = "reject"
+)
+
+// Scan verdicts
+const (
+	ScanStatusClean    = "clean"
+	ScanStatusInfected = "infected"
+	ScanStatusError    = "error"
+)
+
+const (
+	defaultScanTimeout = 30
+	clamdChunkSize     = 64 * 1024
+)
+
+// ScanSettings is the antivirus scanner media is checked with before upload,
+// stored as JSON in the media_scan column
+type ScanSettings struct {
+	// Scanner is "clamd" for a clamd TCP socket or "http" for an external scanner
+	Scanner string `json:"scanner"`
+	// Address is host:port for clamd or the URL media is POSTed to for http
+	Address string `json:"address"`
+	// Action is "quarantine" to store infected media under a separate prefix
+	// or "reject" to drop it
+	Action string `json:"action"`
+	// Timeout bounds a single scan in seconds
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// ScanVerdict is the scan result included in the webhook payload
+type ScanVerdict struct {
+	Status    string `json:"status"`
+	Signature string `json:"signature,omitempty"`
+	Scanner   string `json:"scanner"`
+	Action    string `json:"action,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// MediaRejectedError is returned for infected media when the scan action is reject
+type MediaRejectedError struct {
+	Verdict *ScanVerdict
+}
+
+func (e *MediaRejectedError) Error() string {
+	return fmt.Sprintf("media rejected by %s scanner: %s", e.Verdict.Scanner, e.Verdict.Signature)
+}
+
+// rejectedMediaVerdict returns the verdict of media rejected by the scanner,
+// nil for any other error
+func rejectedMediaVerdict(err error) *ScanVerdict {
+	var rejected *MediaRejectedError
+	if errors.As(err, &rejected) {
+		return rejected.Verdict
+	}
+	return nil
+}
+
+// parseScanSettings decodes the media_scan column, empty when scanning is off
+func parseScanSettings(raw string) (*ScanSettings, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var scan ScanSettings
+	if err := json.Unmarshal([]byte(raw), &scan); err != nil {
+		return nil, fmt.Errorf("invalid scan settings: %w", err)
+	}
+	if scan.Scanner == "" {
+		return nil, nil
+	}
+	return &scan, nil
+}
+
+// encode returns the JSON stored in the media_scan column
+func (ss *ScanSettings) encode() (string, error) {
+	if ss == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(ss)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate normalizes the scanner settings
+func (ss *ScanSettings) validate() error {
+	ss.Scanner = strings.ToLower(strings.TrimSpace(ss.Scanner))
+	switch ss.Scanner {
+	case ScannerClamd:
+		if _, _, err := net.SplitHostPort(ss.Address); err != nil {
+			return errors.New("scan address must be host:port for clamd")
+		}
+	case ScannerHTTP:
+		if !strings.HasPrefix(ss.Address, "http://") && !strings.HasPrefix(ss.Address, "https://") {
+			return errors.New("scan address must be an http or https URL")
+		}
+	default:
+		return errors.New("scan scanner must be 'clamd' or 'http'")
+	}
+
+	ss.Action = strings.ToLower(strings.TrimSpace(ss.Action))
+	if ss.Action == "" {
+		ss.Action = ScanActionQuarantine
+	}
+	if ss.Action != ScanActionQuarantine && ss.Action != ScanActionReject {
+		return errors.New("scan action must be 'quarantine' or 'reject'")
+	}
+
+	if ss.Timeout < 0 {
+		return errors.New("scan timeout must not be negative")
+	}
+	return nil
+}
+
+func (ss *ScanSettings) timeout() time.Duration {
+	if ss.Timeout <= 0 {
+		return defaultScanTimeout * time.Second
+	}
+	return time.Duration(ss.Timeout) * time.Second
+}
+
+// quarantineKey moves an object key under the quarantine prefix of its user
+func quarantineKey(userID, key string) string {
+	base := fmt.Sprintf("users/%s/", userID)
+	return base + "quarantine/" + strings.TrimPrefix(key, base)
+}
+
+// seekableMedia returns body as a seekable reader so it can be read again
+// after scanning. Readers that can't seek are buffered in memory.
+func seekableMedia(body io.Reader) (io.ReadSeeker, int64, error) {
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return seeker, size, nil
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read media: %w", err)
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// scanMedia checks body with the configured scanner and rewinds it. Scanner
+// failures are reported in the verdict and don't block the upload.
+func scanMedia(ctx context.Context, settings *ScanSettings, body io.ReadSeeker, size int64, mimeType string) *ScanVerdict {
+	defer body.Seek(0, io.SeekStart)
+
+	ctx, cancel := context.WithTimeout(ctx, settings.timeout())
+	defer cancel()
+
+	verdict := &ScanVerdict{Scanner: settings.Scanner}
+	var infected bool
+	var err error
+	switch settings.Scanner {
+	case ScannerClamd:
+		infected, verdict.Signature, err = scanClamd(ctx, settings.Address, body)
+	case ScannerHTTP:
+		infected, verdict.Signature, err = scanHTTP(ctx, settings.Address, body, size, mimeType)
+	default:
+		err = fmt.Errorf("unsupported scanner %q", settings.Scanner)
+	}
+
+	switch {
+	case err != nil:
+		verdict.Status = ScanStatusError
+		verdict.Error = err.Error()
+	case infected:
+		verdict.Status = ScanStatusInfected
+		verdict.Action = settings.Action
+	default:
+		verdict.Status = ScanStatusClean
+	}
+	return verdict
+}
+
+// scanClamd streams body to clamd with the INSTREAM command
+func scanClamd(ctx context.Context, address string, body io.Reader) (bool, string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	out := bufio.NewWriter(conn)
+	out.WriteString("zINSTREAM\x00")
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			binary.Write(out, binary.BigEndian, uint32(n))
+			if _, err := out.Write(buf[:n]); err != nil {
+				return false, "", fmt.Errorf("failed to send media to clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return false, "", fmt.Errorf("failed to read media: %w", readErr)
+		}
+	}
+	binary.Write(out, binary.BigEndian, uint32(0))
+	if err := out.Flush(); err != nil {
+		return false, "", fmt.Errorf("failed to send media to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return false, "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return false, "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return true, strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return false, "", fmt.Errorf("clamd: %s", reply)
+}
+
+// scanHTTP POSTs body to an external scanner, which answers with
+// {"infected": bool, "signature": string}
+func scanHTTP(ctx context.Context, address string, body io.Reader, size int64, mimeType string) (bool, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, body)
+	if err != nil {
+		return false, "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", mimeType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, "", fmt.Errorf("scanner request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, "", fmt.Errorf("scanner returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Infected  bool   `json:"infected"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return false, "", fmt.Errorf("invalid scanner response: %w", err)
+	}
+	return result.Infected, result.Signature, nil
+}
+
+// logScanVerdict records infected media and scanner failures
+func logScanVerdict(userID, key string, verdict *ScanVerdict) {
+	switch verdict.Status {
+	case ScanStatusInfected:
+		log.Warn().Str("userID", userID).Str("key", key).Str("signature", verdict.Signature).Str("action", verdict.Action).Msg("Infected media detected")
+	case ScanStatusError:
+		log.Error().Str("userID", userID).Str("key", key).Str("error", verdict.Error).Msg("Media scan failed, uploading unscanned")
+	}
+}
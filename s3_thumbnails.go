@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// thumbnailMaxSize bounds the width and height of generated thumbnails
+	thumbnailMaxSize = 320
+	// thumbnailMaxSource is the largest image decoded for a thumbnail
+	thumbnailMaxSource     = 25 * 1024 * 1024
+	thumbnailFFmpegTimeout = 30 * time.Second
+)
+
+// thumbnailKey returns the key of the thumbnail of an object, in a thumbs
+// folder next to it so prefix deletions and retention cover both
+func thumbnailKey(key string) string {
+	base := path.Base(key)
+	return path.Dir(key) + "/thumbs/" + strings.TrimSuffix(base, path.Ext(base)) + ".jpg"
+}
+
+// supportsThumbnail reports whether a thumbnail can be made for a MIME type
+func supportsThumbnail(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "video/")
+}
+
+// generateThumbnail renders a JPEG thumbnail of an image or the first
+// second of a video. body is rewound afterwards.
+func generateThumbnail(ctx context.Context, body io.ReadSeeker, size int64, mimeType string) ([]byte, error) {
+	defer body.Seek(0, io.SeekStart)
+
+	var img image.Image
+	var err error
+	if strings.HasPrefix(mimeType, "video/") {
+		img, err = videoFrame(ctx, body)
+	} else {
+		if size > thumbnailMaxSource {
+			return nil, fmt.Errorf("image too large for a thumbnail (%d bytes)", size)
+		}
+		img, _, err = image.Decode(io.LimitReader(body, thumbnailMaxSource))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	thumb := resize.Thumbnail(thumbnailMaxSize, thumbnailMaxSize, img, resize.Lanczos3)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 75}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// videoFrame grabs a frame with ffmpeg, which needs a seekable file since
+// the index of most MP4 files is at the end
+func videoFrame(ctx context.Context, body io.ReadSeeker) (image.Image, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg not found, video thumbnails are disabled")
+	}
+
+	file, ok := body.(*os.File)
+	if !ok {
+		spool, err := os.CreateTemp("", "wuzapi-thumb-*")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}()
+		if _, err := io.Copy(spool, body); err != nil {
+			return nil, err
+		}
+		file = spool
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, thumbnailFFmpegTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-nostdin", "-loglevel", "error",
+		"-ss", "1", "-i", file.Name(), "-frames:v", "1", "-f", "image2", "-c:v", "png", "pipe:1")
+	cmd.Stderr = &stderr
+	frame, err := cmd.Output()
+	if err == nil && len(frame) == 0 {
+		// Videos shorter than a second, take the first frame instead
+		cmd = exec.CommandContext(ctx, ffmpeg, "-nostdin", "-loglevel", "error",
+			"-i", file.Name(), "-frames:v", "1", "-f", "image2", "-c:v", "png", "pipe:1")
+		cmd.Stderr = &stderr
+		frame, err = cmd.Output()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(frame))
+	return img, err
+}
+
+// uploadThumbnail stores the thumbnail of an object, encrypted like the
+// object itself, and returns its URL. Failures are logged and leave the
+// media without a thumbnail.
+func (m *S3Manager) uploadThumbnail(ctx context.Context, userID string, storage MediaStorage, config *S3Config, key string, thumb []byte) string {
+	thumbKey := thumbnailKey(key)
+	data, uploadMimeType := thumb, "image/jpeg"
+	if config.Encryption != EncryptionNone {
+		encrypted, _, err := m.encryptMedia(ctx, userID, config, bytes.NewReader(thumb))
+		if err != nil {
+			log.Warn().Err(err).Str("userID", userID).Str("key", thumbKey).Msg("Failed to encrypt thumbnail")
+			return ""
+		}
+		data, err = io.ReadAll(encrypted)
+		encrypted.Close()
+		os.Remove(encrypted.Name())
+		if err != nil {
+			log.Warn().Err(err).Str("userID", userID).Str("key", thumbKey).Msg("Failed to encrypt thumbnail")
+			return ""
+		}
+		uploadMimeType = "application/octet-stream"
+	}
+
+	if err := storage.Upload(ctx, thumbKey, data, uploadMimeType); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Str("key", thumbKey).Msg("Failed to upload thumbnail")
+		return ""
+	}
+
+	if config.Mirror != nil {
+		if _, err := m.mirrorMedia(ctx, userID, thumbKey, bytes.NewReader(data), int64(len(data)), uploadMimeType); err != nil {
+			log.Warn().Err(err).Str("userID", userID).Str("key", thumbKey).Msg("Failed to queue thumbnail for the mirror")
+		}
+	}
+
+	return mediaURL(storage, config, thumbKey)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// StorageUsage holds media storage counters for a user
+type StorageUsage struct {
+	UserID        string `json:"userId" db:"user_id"`
+	BytesUploaded int64  `json:"bytesUploaded" db:"bytes_uploaded"`
+	Objects       int64  `json:"objects" db:"objects"`
+	Deduplicated  int64  `json:"deduplicated" db:"deduplicated"`
+	Failures      int64  `json:"failures" db:"failures"`
+	LastUploadAt  int64  `json:"lastUploadAt" db:"last_upload_at"`
+	LastFailureAt int64  `json:"lastFailureAt" db:"last_failure_at"`
+}
+
+// usageTracker keeps the counters of this process for Prometheus. Totals that
+// survive restarts are kept in the storage_usage table.
+type usageTracker struct {
+	mu    sync.Mutex
+	users map[string]*StorageUsage
+}
+
+func init() {
+	metricsRegistry.MustRegister(storageCollector{})
+}
+
+// recordUpload counts a stored media file. Deduplicated files add no bytes.
+func (m *S3Manager) recordUpload(userID string, size int64, deduplicated bool) {
+	now := time.Now().Unix()
+	var uploadedBytes, dedupCount int64 = size, 0
+	if deduplicated {
+		uploadedBytes, dedupCount = 0, 1
+	}
+
+	m.usage.mu.Lock()
+	usage := m.usage.get(userID)
+	usage.BytesUploaded += uploadedBytes
+	usage.Objects++
+	usage.Deduplicated += dedupCount
+	usage.LastUploadAt = now
+	m.usage.mu.Unlock()
+
+	m.persistUsage(`
+		INSERT INTO storage_usage (user_id, bytes_uploaded, objects, deduplicated, last_upload_at)
+		VALUES ($1, $2, 1, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET
+			bytes_uploaded = storage_usage.bytes_uploaded + excluded.bytes_uploaded,
+			objects = storage_usage.objects + 1,
+			deduplicated = storage_usage.deduplicated + excluded.deduplicated,
+			last_upload_at = excluded.last_upload_at`,
+		userID, uploadedBytes, dedupCount, now)
+}
+
+// recordUploadFailure counts a media file that could not be stored
+func (m *S3Manager) recordUploadFailure(userID string) {
+	now := time.Now().Unix()
+
+	m.usage.mu.Lock()
+	usage := m.usage.get(userID)
+	usage.Failures++
+	usage.LastFailureAt = now
+	m.usage.mu.Unlock()
+
+	m.persistUsage(`
+		INSERT INTO storage_usage (user_id, failures, last_failure_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET
+			failures = storage_usage.failures + 1,
+			last_failure_at = excluded.last_failure_at`,
+		userID, now)
+}
+
+// get returns the counters of a user, the caller must hold mu
+func (t *usageTracker) get(userID string) *StorageUsage {
+	if t.users == nil {
+		t.users = make(map[string]*StorageUsage)
+	}
+	usage, ok := t.users[userID]
+	if !ok {
+		usage = &StorageUsage{UserID: userID}
+		t.users[userID] = usage
+	}
+	return usage
+}
+
+func (m *S3Manager) persistUsage(query string, args ...interface{}) {
+	m.mu.RLock()
+	db := m.db
+	m.mu.RUnlock()
+	if db == nil {
+		return
+	}
+
+	if _, err := db.Exec(query, args...); err != nil {
+		log.Error().Err(err).Interface("userID", args[0]).Msg("Failed to persist storage usage")
+	}
+}
+
+// StorageUsage returns the persisted usage of every user, or of one user
+// when userID is not empty
+func (m *S3Manager) StorageUsage(userID string) ([]StorageUsage, error) {
+	m.mu.RLock()
+	db := m.db
+	m.mu.RUnlock()
+	if db == nil {
+		return nil, fmt.Errorf("S3 manager has no database")
+	}
+
+	query := `SELECT user_id, bytes_uploaded, objects, deduplicated, failures, last_upload_at, last_failure_at FROM storage_usage`
+	var args []interface{}
+	if userID != "" {
+		query += " WHERE user_id = $1"
+		args = append(args, userID)
+	}
+	query += " ORDER BY user_id"
+
+	usage := []StorageUsage{}
+	if err := db.Select(&usage, query, args...); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+var (
+	storageUploadedBytesDesc = prometheus.NewDesc("wuzapi_storage_uploaded_bytes_total",
+		"Bytes of media uploaded to storage.", []string{"user_id"}, nil)
+	storageObjectsDesc = prometheus.NewDesc("wuzapi_storage_objects_total",
+		"Media files stored, including deduplicated ones.", []string{"user_id"}, nil)
+	storageDeduplicatedDesc = prometheus.NewDesc("wuzapi_storage_deduplicated_total",
+		"Media files not uploaded because identical content was already stored.", []string{"user_id"}, nil)
+	storageUploadFailuresDesc = prometheus.NewDesc("wuzapi_storage_upload_failures_total",
+		"Media files that could not be stored.", []string{"user_id"}, nil)
+	storageLastUploadDesc = prometheus.NewDesc("wuzapi_storage_last_upload_timestamp_seconds",
+		"Unix time of the last stored media file.", []string{"user_id"}, nil)
+	storageRetentionObjectsDesc = prometheus.NewDesc("wuzapi_storage_retention_deleted_objects_total",
+		"Media files deleted by the retention janitor.", []string{"user_id"}, nil)
+	storageRetentionBytesDesc = prometheus.NewDesc("wuzapi_storage_retention_deleted_bytes_total",
+		"Bytes of media deleted by the retention janitor.", []string{"user_id"}, nil)
+	storageCircuitOpenDesc = prometheus.NewDesc("wuzapi_storage_circuit_open",
+		"Whether uploads are suspended by the circuit breaker.", []string{"user_id"}, nil)
+)
+
+// storageCollector exports the media storage counters of this process
+type storageCollector struct{}
+
+func (storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storageUploadedBytesDesc
+	ch <- storageObjectsDesc
+	ch <- storageDeduplicatedDesc
+	ch <- storageUploadFailuresDesc
+	ch <- storageLastUploadDesc
+	ch <- storageRetentionObjectsDesc
+	ch <- storageRetentionBytesDesc
+	ch <- storageCircuitOpenDesc
+}
+
+func (storageCollector) Collect(ch chan<- prometheus.Metric) {
+	m := GetS3Manager()
+
+	m.usage.mu.Lock()
+	usage := make(map[string]StorageUsage, len(m.usage.users))
+	for userID, u := range m.usage.users {
+		usage[userID] = *u
+	}
+	m.usage.mu.Unlock()
+
+	for userID, u := range usage {
+		ch <- prometheus.MustNewConstMetric(storageUploadedBytesDesc, prometheus.CounterValue, float64(u.BytesUploaded), userID)
+		ch <- prometheus.MustNewConstMetric(storageObjectsDesc, prometheus.CounterValue, float64(u.Objects), userID)
+		ch <- prometheus.MustNewConstMetric(storageDeduplicatedDesc, prometheus.CounterValue, float64(u.Deduplicated), userID)
+		ch <- prometheus.MustNewConstMetric(storageUploadFailuresDesc, prometheus.CounterValue, float64(u.Failures), userID)
+		if u.LastUploadAt > 0 {
+			ch <- prometheus.MustNewConstMetric(storageLastUploadDesc, prometheus.GaugeValue, float64(u.LastUploadAt), userID)
+		}
+		open := 0.0
+		if m.CircuitState(userID).Open {
+			open = 1
+		}
+		ch <- prometheus.MustNewConstMetric(storageCircuitOpenDesc, prometheus.GaugeValue, open, userID)
+	}
+
+	retention, _ := m.AllRetentionStats()
+	for userID, stats := range retention {
+		ch <- prometheus.MustNewConstMetric(storageRetentionObjectsDesc, prometheus.CounterValue, float64(stats.ObjectsDeleted), userID)
+		ch <- prometheus.MustNewConstMetric(storageRetentionBytesDesc, prometheus.CounterValue, float64(stats.BytesDeleted), userID)
+	}
+}
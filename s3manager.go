@@ -3,21 +3,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/jmoiron/sqlx"
 	"github.com/rs/zerolog/log"
 )
 
-// S3Config holds S3 configuration for a user
+// S3Config holds the media storage configuration for a user
 type S3Config struct {
 	Enabled       bool
+	Provider      string
 	Endpoint      string
 	Region        string
 	Bucket        string
@@ -27,19 +35,233 @@ type S3Config struct {
 	PublicURL     string
 	MediaDelivery string
 	RetentionDays int
+
+	// GCSCredentials is a service account JSON key, empty to use the application
+	// default credentials, e.g. the metadata server
+	GCSCredentials string
+	// AzureConnectionString holds the account key or SAS, empty to use managed identity
+	AzureConnectionString string
+
+	// URLMode is "public" for plain object URLs or "presigned" for time-limited ones
+	URLMode string
+	// PresignTTL is the lifetime of presigned URLs in seconds
+	PresignTTL int
+
+	// SSEType is the server-side encryption applied to uploads: "", "sse-s3" or "sse-kms"
+	SSEType string
+	// KMSKeyID is the KMS key for sse-kms, empty to use the bucket default key
+	KMSKeyID string
+
+	// Dedup stores media under the SHA-256 of its content so identical files are kept once
+	Dedup bool
+
+	// ObjectMetadata attaches message details as S3 object metadata and tags
+	ObjectMetadata bool
+
+	// Mirror is a secondary bucket every upload is copied to, nil when not mirrored
+	Mirror *MirrorSettings
+
+	// CredentialMode selects how S3 credentials are obtained: "static",
+	// "default", "web_identity" or "assume_role"
+	CredentialMode string
+	// RoleARN is the role for web_identity and assume_role
+	RoleARN string
+	// ExternalID is passed to AssumeRole when the role trust policy requires it
+	ExternalID string
+
+	// Encryption encrypts media before upload: "", "key" or "kms"
+	Encryption string
+	// EncryptionKey is the base64 AES-256 key used by the "key" mode
+	EncryptionKey string
+
+	// Thumbnails stores a small JPEG preview of images and videos under thumbs/
+	Thumbnails bool
+
+	// CABundle holds PEM certificates trusted in addition to the system roots
+	CABundle string
+	// InsecureSkipVerify disables TLS certificate checks, for internal MinIO only
+	InsecureSkipVerify bool
+	// HTTPProxy routes S3 requests through an http, https or socks5 proxy
+	HTTPProxy string
+
+	// Scan is the antivirus scanner media is checked with, nil when not scanned
+	Scan *ScanSettings
 }
 
-// S3Manager manages S3 operations
+// Media URL modes
+const (
+	MediaURLModePublic    = "public"
+	MediaURLModePresigned = "presigned"
+
+	defaultPresignTTL = 3600
+	maxPresignTTL     = 7 * 24 * 3600 // S3 SigV4 limit
+)
+
+// presignDuration returns the configured presigned URL lifetime, clamped to S3 limits
+func (c *S3Config) presignDuration() time.Duration {
+	ttl := c.PresignTTL
+	if ttl <= 0 {
+		ttl = defaultPresignTTL
+	}
+	if ttl > maxPresignTTL {
+		ttl = maxPresignTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// normalizeMediaURLMode validates a URL mode, defaulting to public
+func normalizeMediaURLMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return MediaURLModePublic, nil
+	case MediaURLModePublic, MediaURLModePresigned:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unsupported media URL mode %q", mode)
+}
+
+// Server-side encryption types
+const (
+	SSETypeNone = ""
+	SSETypeS3   = "sse-s3"
+	SSETypeKMS  = "sse-kms"
+)
+
+// normalizeSSEType validates a server-side encryption type, also accepting
+// the S3 header values AES256 and aws:kms
+func normalizeSSEType(sseType string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(sseType)) {
+	case "", "none":
+		return SSETypeNone, nil
+	case SSETypeS3, "aes256":
+		return SSETypeS3, nil
+	case SSETypeKMS, "aws:kms":
+		return SSETypeKMS, nil
+	}
+	return "", fmt.Errorf("unsupported server-side encryption type %q", sseType)
+}
+
+// s3ConfigRow maps the S3 columns stored on the users table
+type s3ConfigRow struct {
+	ID                    string `db:"id"`
+	Enabled               bool   `db:"s3_enabled"`
+	Provider              string `db:"storage_provider"`
+	Endpoint              string `db:"s3_endpoint"`
+	Region                string `db:"s3_region"`
+	Bucket                string `db:"s3_bucket"`
+	AccessKey             string `db:"s3_access_key"`
+	SecretKey             string `db:"s3_secret_key"`
+	PathStyle             bool   `db:"s3_path_style"`
+	PublicURL             string `db:"s3_public_url"`
+	MediaDelivery         string `db:"media_delivery"`
+	RetentionDays         int    `db:"s3_retention_days"`
+	GCSCredentials        string `db:"gcs_credentials"`
+	AzureConnectionString string `db:"azure_connection_string"`
+	URLMode               string `db:"s3_url_mode"`
+	PresignTTL            int    `db:"s3_presign_ttl"`
+	SSEType               string `db:"s3_sse_type"`
+	KMSKeyID              string `db:"s3_kms_key_id"`
+	Dedup                 bool   `db:"s3_dedup"`
+	ObjectMetadata        bool   `db:"s3_object_metadata"`
+	Mirror                string `db:"storage_mirror"`
+	CredentialMode        string `db:"s3_credential_mode"`
+	RoleARN               string `db:"s3_role_arn"`
+	ExternalID            string `db:"s3_external_id"`
+	Encryption            string `db:"s3_encryption"`
+	EncryptionKey         string `db:"s3_encryption_key"`
+	Thumbnails            bool   `db:"s3_thumbnails"`
+	CABundle              string `db:"s3_ca_bundle"`
+	InsecureSkipVerify    bool   `db:"s3_insecure_skip_verify"`
+	HTTPProxy             string `db:"s3_http_proxy"`
+	Scan                  string `db:"media_scan"`
+}
+
+const s3ConfigColumns = `id, s3_enabled, s3_endpoint, s3_region, s3_bucket,
+	s3_access_key, s3_secret_key, s3_path_style, s3_public_url,
+	media_delivery, s3_retention_days, storage_provider, gcs_credentials,
+	azure_connection_string, s3_url_mode, s3_presign_ttl, s3_sse_type,
+	s3_kms_key_id, s3_dedup, s3_object_metadata, storage_mirror,
+	s3_credential_mode, s3_role_arn, s3_external_id, s3_encryption,
+	s3_encryption_key, s3_thumbnails, s3_ca_bundle, s3_insecure_skip_verify,
+	s3_http_proxy, media_scan`
+
+func (row s3ConfigRow) toConfig() *S3Config {
+	mirror, err := parseMirrorSettings(row.Mirror)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", row.ID).Msg("Ignoring storage mirror")
+	}
+	scan, err := parseScanSettings(row.Scan)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", row.ID).Msg("Ignoring media scan settings")
+	}
+
+	return &S3Config{
+		Enabled:       row.Enabled,
+		Provider:      row.Provider,
+		Endpoint:      row.Endpoint,
+		Region:        row.Region,
+		Bucket:        row.Bucket,
+		AccessKey:     row.AccessKey,
+		SecretKey:     row.SecretKey,
+		PathStyle:     row.PathStyle,
+		PublicURL:     row.PublicURL,
+		MediaDelivery: row.MediaDelivery,
+		RetentionDays: row.RetentionDays,
+
+		GCSCredentials:        row.GCSCredentials,
+		AzureConnectionString: row.AzureConnectionString,
+		URLMode:               row.URLMode,
+		PresignTTL:            row.PresignTTL,
+		SSEType:               row.SSEType,
+		KMSKeyID:              row.KMSKeyID,
+		Dedup:                 row.Dedup,
+		ObjectMetadata:        row.ObjectMetadata,
+		Mirror:                mirror,
+		CredentialMode:        row.CredentialMode,
+		RoleARN:               row.RoleARN,
+		ExternalID:            row.ExternalID,
+		Encryption:            row.Encryption,
+		EncryptionKey:         row.EncryptionKey,
+		Thumbnails:            row.Thumbnails,
+		CABundle:              row.CABundle,
+		InsecureSkipVerify:    row.InsecureSkipVerify,
+		HTTPProxy:             row.HTTPProxy,
+		Scan:                  scan,
+	}
+}
+
+// S3Manager manages per user media storage, S3 or any other MediaStorage provider
 type S3Manager struct {
-	mu      sync.RWMutex
-	clients map[string]*s3.Client
-	configs map[string]*S3Config
+	mu       sync.RWMutex
+	db       *sqlx.DB
+	clients  map[string]*s3.Client
+	configs  map[string]*S3Config
+	storages map[string]MediaStorage
+	janitor  retentionJanitor
+	breaker  uploadBreaker
+	usage    usageTracker
+
+	// mirror holds the secondary storages of users with mirroring enabled
+	mirror *S3Manager
+
+	// kmsClients generate and decrypt data keys for client-side encryption
+	kmsClients map[string]*kms.Client
+
+	// unconfigured holds when users without storage were last looked up, so
+	// their media events don't query the database every time
+	unconfigured map[string]time.Time
 }
 
+// s3UnconfiguredTTL is how long a user found without storage is not looked up
+// again, configurations saved on another replica are seen after it
+const s3UnconfiguredTTL = time.Minute
+
 // Global S3 manager instance
 var s3Manager = &S3Manager{
-	clients: make(map[string]*s3.Client),
-	configs: make(map[string]*S3Config),
+	clients:  make(map[string]*s3.Client),
+	configs:  make(map[string]*S3Config),
+	storages: make(map[string]MediaStorage),
 }
 
 // GetS3Manager returns the global S3 manager instance
@@ -47,65 +269,253 @@ func GetS3Manager() *S3Manager {
 	return s3Manager
 }
 
+// SetDB sets the database used to persist and load S3 configurations
+func (m *S3Manager) SetDB(db *sqlx.DB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.db = db
+}
+
+// LoadConfig reads the persisted S3 configuration of a user
+func (m *S3Manager) LoadConfig(userID string) (*S3Config, error) {
+	m.mu.Lock()
+	db := m.db
+	// The configuration is read fresh, whatever was known before
+	delete(m.unconfigured, userID)
+	m.mu.Unlock()
+	if db == nil {
+		return nil, fmt.Errorf("S3 manager has no database")
+	}
+
+	var row s3ConfigRow
+	err := db.Get(&row, "SELECT "+s3ConfigColumns+" FROM users WHERE id = $1", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load S3 config for user %s: %w", userID, err)
+	}
+	return row.toConfig(), nil
+}
+
+// LoadAllConfigs initializes S3 clients for every user with S3 enabled, so
+// settings survive restarts and every replica serves the same configuration
+func (m *S3Manager) LoadAllConfigs() error {
+	m.mu.RLock()
+	db := m.db
+	m.mu.RUnlock()
+	if db == nil {
+		return fmt.Errorf("S3 manager has no database")
+	}
+
+	var rows []s3ConfigRow
+	err := db.Select(&rows, "SELECT "+s3ConfigColumns+" FROM users WHERE s3_enabled = $1", true)
+	if err != nil {
+		return fmt.Errorf("failed to load S3 configs: %w", err)
+	}
+
+	loaded := 0
+	for _, row := range rows {
+		if err := m.InitializeS3Client(row.ID, row.toConfig()); err != nil {
+			log.Error().Err(err).Str("userID", row.ID).Msg("Failed to initialize S3 client on startup")
+			continue
+		}
+		loaded++
+	}
+
+	log.Info().Int("count", loaded).Msg("S3 configurations loaded")
+	return nil
+}
+
+// Reload re-reads the persisted configuration of a user and rebuilds its client
+func (m *S3Manager) Reload(userID string) error {
+	config, err := m.LoadConfig(userID)
+	if err != nil {
+		return err
+	}
+	return m.InitializeS3Client(userID, config)
+}
+
 // InitializeS3Client creates or updates S3 client for a user
 func (m *S3Manager) InitializeS3Client(userID string, config *S3Config) error {
+	// A new configuration gets a fresh circuit breaker
+	m.ResetCircuit(userID)
+
 	if !config.Enabled {
 		m.RemoveClient(userID)
+		m.markUnconfigured(userID)
 		return nil
 	}
 
+	provider, err := normalizeStorageProvider(config.Provider)
+	if err != nil {
+		return err
+	}
+	config.Provider = provider
+
+	urlMode, err := normalizeMediaURLMode(config.URLMode)
+	if err != nil {
+		return err
+	}
+	config.URLMode = urlMode
+
+	sseType, err := normalizeSSEType(config.SSEType)
+	if err != nil {
+		return err
+	}
+	config.SSEType = sseType
+
+	encryption, err := normalizeEncryptionMode(config.Encryption)
+	if err != nil {
+		return err
+	}
+	config.Encryption = encryption
+	if encryption == EncryptionKey {
+		if _, err := parseEncryptionKey(config.EncryptionKey); err != nil {
+			return err
+		}
+	}
+	if encryption == EncryptionKMS && provider != StorageProviderS3 {
+		return fmt.Errorf("kms encryption is only supported by the s3 provider")
+	}
+
+	m.configureMirror(userID, config)
+
+	if provider != StorageProviderS3 {
+		storage, err := newMediaStorage(config)
+		if err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.clients, userID)
+		m.configs[userID] = config
+		m.storages[userID] = storage
+
+		log.Info().Str("userID", userID).Str("provider", provider).Str("bucket", config.Bucket).Msg("Media storage initialized")
+		return nil
+	}
+
+	// Custom CA bundle, TLS verification and proxy, nil for the SDK default
+	httpClient, err := newS3HTTPClient(config)
+	if err != nil {
+		return err
+	}
+
+	// Static keys, the default chain or an assumed role, refreshed automatically
+	credProvider, err := newS3Credentials(userID, config, httpClient)
+	if err != nil {
+		return err
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Create custom credentials provider
-	credProvider := credentials.NewStaticCredentialsProvider(
-		config.AccessKey,
-		config.SecretKey,
-		"",
-	)
-
 	// Configure S3 client
 	cfg := aws.Config{
 		Region:      config.Region,
 		Credentials: credProvider,
 	}
-
-	if config.Endpoint != "" {
-		customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-			if service == s3.ServiceID {
-				return aws.Endpoint{
-					URL:               config.Endpoint,
-					HostnameImmutable: config.PathStyle,
-				}, nil
-			}
-			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
-		})
-		cfg.EndpointResolverWithOptions = customResolver
+	if httpClient != nil {
+		cfg.HTTPClient = httpClient
 	}
 
-	// Create S3 client
+	// Create S3 client. The endpoint is set on the S3 options only, so KMS
+	// keeps resolving the regional AWS endpoint.
 	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.UsePathStyle = config.PathStyle
+		if config.Endpoint != "" {
+			o.BaseEndpoint = aws.String(config.Endpoint)
+		}
 	})
 
 	m.clients[userID] = client
 	m.configs[userID] = config
+	m.storages[userID] = &s3Storage{manager: m, userID: userID}
+
+	if config.Encryption == EncryptionKMS {
+		if m.kmsClients == nil {
+			m.kmsClients = make(map[string]*kms.Client)
+		}
+		m.kmsClients[userID] = kms.NewFromConfig(cfg)
+	} else {
+		delete(m.kmsClients, userID)
+	}
 
 	log.Info().Str("userID", userID).Str("bucket", config.Bucket).Msg("S3 client initialized")
 	return nil
 }
 
+// TestConfig checks a configuration against its backend using a throwaway
+// client, leaving the user's active client untouched
+func (m *S3Manager) TestConfig(ctx context.Context, userID string, config *S3Config) error {
+	probe := &S3Manager{
+		clients:  make(map[string]*s3.Client),
+		configs:  make(map[string]*S3Config),
+		storages: make(map[string]MediaStorage),
+	}
+
+	probeConfig := *config
+	probeConfig.Enabled = true
+	if err := probe.InitializeS3Client(userID, &probeConfig); err != nil {
+		return err
+	}
+
+	storage, _, ok := probe.GetStorage(userID)
+	if !ok {
+		return fmt.Errorf("media storage not initialized for user %s", userID)
+	}
+	return storage.Test(ctx)
+}
+
 // RemoveClient removes S3 client for a user
 func (m *S3Manager) RemoveClient(userID string) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	delete(m.clients, userID)
 	delete(m.configs, userID)
+	delete(m.storages, userID)
+	delete(m.kmsClients, userID)
+	mirror := m.mirror
+	m.mu.Unlock()
+
+	if mirror != nil {
+		mirror.RemoveClient(userID)
+	}
+}
+
+// markUnconfigured records that a user has no storage configured
+func (m *S3Manager) markUnconfigured(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unconfigured == nil {
+		m.unconfigured = make(map[string]time.Time)
+	}
+	m.unconfigured[userID] = time.Now()
+}
+
+// ensureLoaded loads the persisted configuration when this instance has not
+// seen the user yet, or found no storage for it more than s3UnconfiguredTTL ago
+func (m *S3Manager) ensureLoaded(userID string) {
+	m.mu.RLock()
+	_, loaded := m.configs[userID]
+	checked, unconfigured := m.unconfigured[userID]
+	hasDB := m.db != nil
+	m.mu.RUnlock()
+
+	if loaded || !hasDB || (unconfigured && time.Since(checked) < s3UnconfiguredTTL) {
+		return
+	}
+	if err := m.Reload(userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			m.markUnconfigured(userID)
+			return
+		}
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load S3 config on demand")
+	}
 }
 
 // GetClient returns S3 client for a user
 func (m *S3Manager) GetClient(userID string) (*s3.Client, *S3Config, bool) {
+	m.ensureLoaded(userID)
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -115,6 +525,19 @@ func (m *S3Manager) GetClient(userID string) (*s3.Client, *S3Config, bool) {
 	return client, config, clientOk && configOk
 }
 
+// GetStorage returns the media storage backend configured for a user
+func (m *S3Manager) GetStorage(userID string) (MediaStorage, *S3Config, bool) {
+	m.ensureLoaded(userID)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	storage, storageOk := m.storages[userID]
+	config, configOk := m.configs[userID]
+
+	return storage, config, storageOk && configOk
+}
+
 // GenerateS3Key generates S3 object key based on message metadata
 func (m *S3Manager) GenerateS3Key(userID, contactJID, messageID string, mimeType string, isIncoming bool) string {
 	// Determine direction
@@ -124,8 +547,7 @@ func (m *S3Manager) GenerateS3Key(userID, contactJID, messageID string, mimeType
 	}
 
 	// Clean contact JID
-	contactJID = strings.ReplaceAll(contactJID, "@", "_")
-	contactJID = strings.ReplaceAll(contactJID, ":", "_")
+	contactJID = s3ContactSegment(contactJID)
 
 	// Get current time
 	now := time.Now()
@@ -134,6 +556,29 @@ func (m *S3Manager) GenerateS3Key(userID, contactJID, messageID string, mimeType
 	day := now.Format("25")
 
 	// Determine media type folder
+	mediaType := s3MediaFolder(mimeType)
+
+	// Get file extension
+	ext := s3KeyExtension(mimeType)
+
+	// Build S3 key
+	key := fmt.Sprintf("users/%s/%s/%s/%s/%s/%s/%s/%s%s",
+		userID,
+		direction,
+		contactJID,
+		year,
+		month,
+		day,
+		mediaType,
+		messageID,
+		ext,
+	)
+
+	return key
+}
+
+// s3MediaFolder maps a MIME type to the media folder used in object keys
+func s3MediaFolder(mimeType string) string {
 	mediaType := "documents"
 	if strings.HasPrefix(mimeType, "image/") {
 		mediaType = "images"
@@ -142,8 +587,11 @@ func (m *S3Manager) GenerateS3Key(userID, contactJID, messageID string, mimeType
 	} else if strings.HasPrefix(mimeType, "audio/") {
 		mediaType = "audio"
 	}
+	return mediaType
+}
 
-	// Get file extension
+// s3KeyExtension maps a MIME type to the file extension used in object keys
+func s3KeyExtension(mimeType string) string {
 	ext := ".bin"
 	switch {
 	case strings.Contains(mimeType, "jpeg"), strings.Contains(mimeType, "jpg"):
@@ -171,30 +619,51 @@ func (m *S3Manager) GenerateS3Key(userID, contactJID, messageID string, mimeType
 			ext = ".doc"
 		}
 	}
+	return ext
+}
 
-	// Build S3 key
-	key := fmt.Sprintf("users/%s/%s/%s/%s/%s/%s/%s/%s%s",
-		userID,
-		direction,
-		contactJID,
-		year,
-		month,
-		day,
-		mediaType,
-		messageID,
-		ext,
-	)
+// ObjectMetadata describes the message a stored media file belongs to
+type ObjectMetadata struct {
+	ContactJID string
+	MessageID  string
+	Direction  string
+	Instance   string
+	MediaType  string
+}
 
-	return key
+type objectMetadataKey struct{}
+
+// withObjectMetadata attaches message details to an upload context
+func withObjectMetadata(ctx context.Context, meta *ObjectMetadata) context.Context {
+	return context.WithValue(ctx, objectMetadataKey{}, meta)
 }
 
-// UploadToS3 uploads file to S3 and returns the key
-func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, data []byte, mimeType string) error {
-	client, config, ok := m.GetClient(userID)
-	if !ok {
-		return fmt.Errorf("S3 client not initialized for user %s", userID)
+func objectMetadataFromContext(ctx context.Context) *ObjectMetadata {
+	meta, _ := ctx.Value(objectMetadataKey{}).(*ObjectMetadata)
+	return meta
+}
+
+// s3Metadata returns the x-amz-meta-* headers for the object
+func (o *ObjectMetadata) s3Metadata() map[string]string {
+	return map[string]string{
+		"contact-jid": o.ContactJID,
+		"message-id":  o.MessageID,
+		"direction":   o.Direction,
+		"instance":    o.Instance,
 	}
+}
+
+// s3Tagging returns the object tags, usable as lifecycle rule filters
+func (o *ObjectMetadata) s3Tagging() string {
+	tags := url.Values{}
+	tags.Set("direction", o.Direction)
+	tags.Set("media-type", o.MediaType)
+	tags.Set("instance", o.Instance)
+	return tags.Encode()
+}
 
+// putObjectInput builds the upload parameters shared by single and multipart uploads
+func putObjectInput(ctx context.Context, config *S3Config, key string, mimeType string) *s3.PutObjectInput {
 	// Set content type and cache headers for preview
 	contentType := mimeType
 	if contentType == "" {
@@ -211,12 +680,17 @@ func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, d
 	input := &s3.PutObjectInput{
 		Bucket:       aws.String(config.Bucket),
 		Key:          aws.String(key),
-		Body:         bytes.NewReader(data),
 		ContentType:  aws.String(contentType),
 		CacheControl: aws.String("public, max-age=3600"),
 		ACL:          types.ObjectCannedACLPublicRead,
 	}
 
+	// Presigned buckets stay private, no ACL is needed (or allowed when ACLs are disabled)
+	if config.URLMode == MediaURLModePresigned {
+		input.ACL = ""
+		input.CacheControl = aws.String("private, max-age=3600")
+	}
+
 	if expires != nil {
 		input.Expires = expires
 	}
@@ -226,14 +700,217 @@ func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, d
 		input.ContentDisposition = aws.String("inline")
 	}
 
-	_, err := client.PutObject(ctx, input)
+	switch config.SSEType {
+	case SSETypeS3:
+		input.ServerSideEncryption = types.ServerSideEncryptionAes256
+	case SSETypeKMS:
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		if config.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(config.KMSKeyID)
+		}
+	}
+
+	if meta := objectMetadataFromContext(ctx); meta != nil && config.ObjectMetadata {
+		input.Metadata = meta.s3Metadata()
+		input.Tagging = aws.String(meta.s3Tagging())
+	}
+
+	return input
+}
+
+// UploadToS3 uploads file to S3 and returns the key
+func (m *S3Manager) UploadToS3(ctx context.Context, userID string, key string, data []byte, mimeType string) error {
+	return m.UploadStreamToS3(ctx, userID, key, bytes.NewReader(data), int64(len(data)), mimeType)
+}
+
+// Multipart upload defaults, overridable with S3_MULTIPART_THRESHOLD_MB and
+// S3_MULTIPART_PART_SIZE_MB
+const (
+	defaultMultipartThreshold = 16 << 20
+	defaultMultipartPartSize  = 8 << 20
+	minMultipartPartSize      = 5 << 20 // S3 minimum for every part but the last
+	maxMultipartParts         = 10000
+)
+
+func multipartSettings() (threshold int64, partSize int64) {
+	threshold = defaultMultipartThreshold
+	if v, err := strconv.ParseInt(os.Getenv("S3_MULTIPART_THRESHOLD_MB"), 10, 64); err == nil && v > 0 {
+		threshold = v << 20
+	}
+	partSize = defaultMultipartPartSize
+	if v, err := strconv.ParseInt(os.Getenv("S3_MULTIPART_PART_SIZE_MB"), 10, 64); err == nil && v > 0 {
+		partSize = v << 20
+	}
+	if partSize < minMultipartPartSize {
+		partSize = minMultipartPartSize
+	}
+	return threshold, partSize
+}
+
+// UploadStreamToS3 uploads from a reader. size is a hint, -1 when unknown;
+// payloads at or above the multipart threshold are sent in parts so only
+// one part is held in memory at a time.
+func (m *S3Manager) UploadStreamToS3(ctx context.Context, userID string, key string, body io.Reader, size int64, mimeType string) error {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+
+	threshold, partSize := multipartSettings()
+	if size >= 0 && size < threshold {
+		input := putObjectInput(ctx, config, key, mimeType)
+		if seeker, ok := body.(io.ReadSeeker); ok {
+			input.Body = seeker
+		} else {
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return fmt.Errorf("failed to read media: %w", err)
+			}
+			input.Body = bytes.NewReader(data)
+		}
+		input.ContentLength = aws.Int64(size)
+
+		_, err := client.PutObject(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to upload to S3: %w", err)
+		}
+		return nil
+	}
+
+	// Grow parts for very large known sizes to stay within the part limit
+	if size > 0 && size/partSize >= maxMultipartParts {
+		partSize = size/(maxMultipartParts-1) + 1
+	}
+
+	return m.multipartUpload(ctx, client, config, key, body, partSize, mimeType)
+}
+
+func (m *S3Manager) multipartUpload(ctx context.Context, client *s3.Client, config *S3Config, key string, body io.Reader, partSize int64, mimeType string) error {
+	params := putObjectInput(ctx, config, key, mimeType)
+	created, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             params.Bucket,
+		Key:                params.Key,
+		ContentType:        params.ContentType,
+		CacheControl:       params.CacheControl,
+		ContentDisposition: params.ContentDisposition,
+		ACL:                params.ACL,
+		Expires:            params.Expires,
+
+		ServerSideEncryption: params.ServerSideEncryption,
+		SSEKMSKeyId:          params.SSEKMSKeyId,
+		Metadata:             params.Metadata,
+		Tagging:              params.Tagging,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to upload to S3: %w", err)
+		return fmt.Errorf("failed to start multipart upload: %w", err)
 	}
 
+	abort := func(cause error) error {
+		// Use a fresh context so the abort still runs when ctx was cancelled
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, abortErr := client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   params.Bucket,
+			Key:      params.Key,
+			UploadId: created.UploadId,
+		})
+		if abortErr != nil {
+			log.Warn().Err(abortErr).Str("key", key).Msg("Failed to abort multipart upload")
+		}
+		return cause
+	}
+
+	var parts []types.CompletedPart
+	var total int64
+	buf := make([]byte, partSize)
+	for partNumber := int32(1); ; partNumber++ {
+		n, readErr := io.ReadFull(body, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return abort(fmt.Errorf("failed to read media: %w", readErr))
+		}
+		if n == 0 {
+			break
+		}
+		if partNumber > maxMultipartParts {
+			return abort(fmt.Errorf("media exceeds %d parts of %d bytes", maxMultipartParts, partSize))
+		}
+
+		uploaded, err := client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        params.Bucket,
+			Key:           params.Key,
+			UploadId:      created.UploadId,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return abort(fmt.Errorf("failed to upload part %d: %w", partNumber, err))
+		}
+
+		parts = append(parts, types.CompletedPart{
+			PartNumber:     aws.Int32(partNumber),
+			ETag:           uploaded.ETag,
+			ChecksumCRC32:  uploaded.ChecksumCRC32,
+			ChecksumCRC32C: uploaded.ChecksumCRC32C,
+			ChecksumSHA1:   uploaded.ChecksumSHA1,
+			ChecksumSHA256: uploaded.ChecksumSHA256,
+		})
+		total += int64(n)
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	if len(parts) == 0 {
+		// Nothing was read, an empty object does not need a multipart upload
+		abort(nil)
+		input := putObjectInput(ctx, config, key, mimeType)
+		input.Body = bytes.NewReader(nil)
+		if _, err := client.PutObject(ctx, input); err != nil {
+			return fmt.Errorf("failed to upload to S3: %w", err)
+		}
+		return nil
+	}
+
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          params.Bucket,
+		Key:             params.Key,
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(fmt.Errorf("failed to complete multipart upload: %w", err))
+	}
+
+	log.Debug().Str("key", key).Int("parts", len(parts)).Int64("bytes", total).Msg("Multipart upload completed")
 	return nil
 }
 
+// PresignGetURL returns a time-limited GET URL for an S3 object
+func (m *S3Manager) PresignGetURL(ctx context.Context, userID, key string, ttl time.Duration) (string, error) {
+	client, config, ok := m.GetClient(userID)
+	if !ok {
+		return "", fmt.Errorf("S3 client not initialized for user %s", userID)
+	}
+
+	if ttl <= 0 {
+		ttl = config.presignDuration()
+	}
+	if ttl > maxPresignTTL*time.Second {
+		ttl = maxPresignTTL * time.Second
+	}
+
+	presigned, err := s3.NewPresignClient(client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign URL: %w", err)
+	}
+	return presigned.URL, nil
+}
+
 // GetPublicURL generates public URL for S3 object
 func (m *S3Manager) GetPublicURL(userID, key string) string {
 	_, config, ok := m.GetClient(userID)
@@ -241,6 +918,15 @@ func (m *S3Manager) GetPublicURL(userID, key string) string {
 		return ""
 	}
 
+	if config.URLMode == MediaURLModePresigned {
+		presignedURL, err := m.PresignGetURL(context.Background(), userID, key, 0)
+		if err != nil {
+			log.Error().Err(err).Str("userID", userID).Str("key", key).Msg("Failed to presign media URL")
+			return ""
+		}
+		return presignedURL
+	}
+
 	// Use custom public URL if configured
 	if config.PublicURL != "" {
 		return fmt.Sprintf("%s/%s/%s", strings.TrimRight(config.PublicURL, "/"), config.Bucket, key)
@@ -288,40 +974,243 @@ func (m *S3Manager) TestConnection(ctx context.Context, userID string) error {
 // ProcessMediaForS3 handles the complete media upload process
 func (m *S3Manager) ProcessMediaForS3(ctx context.Context, userID, contactJID, messageID string,
 	data []byte, mimeType string, fileName string, isIncoming bool) (map[string]interface{}, error) {
+	return m.ProcessMediaStreamForS3(ctx, userID, contactJID, messageID, bytes.NewReader(data), int64(len(data)), mimeType, fileName, isIncoming)
+}
+
+// ProcessMediaFileForS3 uploads media that was already written to disk,
+// streaming it instead of loading the whole file into memory
+func (m *S3Manager) ProcessMediaFileForS3(ctx context.Context, userID, contactJID, messageID string,
+	path string, mimeType string, fileName string, isIncoming bool) (map[string]interface{}, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open media file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat media file: %w", err)
+	}
+
+	return m.ProcessMediaStreamForS3(ctx, userID, contactJID, messageID, file, info.Size(), mimeType, fileName, isIncoming)
+}
+
+// countingReader records how many bytes were read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ProcessMediaStreamForS3 uploads media from a reader and returns the
+// metadata added to webhooks. size is a hint, -1 when unknown.
+func (m *S3Manager) ProcessMediaStreamForS3(ctx context.Context, userID, contactJID, messageID string,
+	body io.Reader, size int64, mimeType string, fileName string, isIncoming bool) (map[string]interface{}, error) {
+
+	storage, config, ok := m.GetStorage(userID)
+	if !ok {
+		return nil, fmt.Errorf("media storage not initialized for user %s", userID)
+	}
 
 	// Generate S3 key
 	key := m.GenerateS3Key(userID, contactJID, messageID, mimeType, isIncoming)
 
-	// Upload to S3
-	err := m.UploadToS3(ctx, userID, key, data, mimeType)
+	if config.ObjectMetadata {
+		direction := "outbox"
+		if isIncoming {
+			direction = "inbox"
+		}
+		ctx = withObjectMetadata(ctx, &ObjectMetadata{
+			ContactJID: contactJID,
+			MessageID:  messageID,
+			Direction:  direction,
+			Instance:   userID,
+			MediaType:  s3MediaFolder(mimeType),
+		})
+	}
+
+	// Scan before anything is stored, infected media is quarantined or dropped
+	var verdict *ScanVerdict
+	quarantined := false
+	if config.Scan != nil {
+		seeker, seekSize, err := seekableMedia(body)
+		if err != nil {
+			return nil, err
+		}
+		body, size = seeker, seekSize
+		verdict = scanMedia(ctx, config.Scan, seeker, size, mimeType)
+		logScanVerdict(userID, key, verdict)
+		if verdict.Status == ScanStatusInfected {
+			if config.Scan.Action == ScanActionReject {
+				return nil, &MediaRejectedError{Verdict: verdict}
+			}
+			key = quarantineKey(userID, key)
+			quarantined = true
+		}
+	}
+
+	// Content addressed keys let identical media be stored once. Quarantined
+	// media keeps its own key so it is never shared with clean messages.
+	var err error
+	var hash string
+	dedup := config.Dedup && !quarantined
+	deduplicated := false
+	if dedup {
+		body, size, hash, err = hashMediaStream(body, size)
+		if err != nil {
+			return nil, err
+		}
+		key = m.GenerateDedupKey(userID, hash, mimeType)
+		deduplicated = m.dedupObjectExists(ctx, storage, userID, hash, key)
+	}
+
+	// Thumbnails are rendered from the original content, before encryption
+	var thumb []byte
+	if config.Thumbnails && !deduplicated && !quarantined && supportsThumbnail(mimeType) {
+		if seeker, ok := body.(io.ReadSeeker); ok {
+			var thumbErr error
+			thumb, thumbErr = generateThumbnail(ctx, seeker, size, mimeType)
+			if thumbErr != nil {
+				log.Warn().Err(thumbErr).Str("userID", userID).Str("key", key).Msg("Failed to generate thumbnail")
+			}
+		}
+	}
+
+	// Encrypted media is stored as opaque bytes and only readable through /media
+	uploadMimeType := mimeType
+	if config.Encryption != EncryptionNone && !deduplicated {
+		encrypted, encryptedSize, err := m.encryptMedia(ctx, userID, config, body)
+		if err != nil {
+			m.recordUploadFailure(userID)
+			return nil, fmt.Errorf("failed to encrypt media: %w", err)
+		}
+		defer func() {
+			encrypted.Close()
+			os.Remove(encrypted.Name())
+		}()
+		body, size = encrypted, encryptedSize
+		uploadMimeType = "application/octet-stream"
+	}
+
+	// Upload to the configured storage, streaming when the backend supports it
+	// Transient failures are retried, repeated ones open the circuit breaker
+	var uploaded int64
+	if deduplicated {
+		uploaded = size
+	} else {
+		err = m.uploadWithRetry(ctx, userID, body, func() error {
+			if streamer, ok := storage.(streamUploader); ok {
+				counter := &countingReader{r: body}
+				err := streamer.UploadStream(ctx, key, counter, size, uploadMimeType)
+				uploaded = counter.n
+				return err
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			uploaded = int64(len(data))
+			return storage.Upload(ctx, key, data, uploadMimeType)
+		})
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload to S3: %w", err)
+		m.recordUploadFailure(userID)
+		return nil, fmt.Errorf("failed to upload to %s: %w", config.Provider, err)
+	}
+	m.recordUpload(userID, uploaded, deduplicated)
+
+	if dedup {
+		m.recordMediaObject(userID, messageID, hash, key, uploaded, mimeType)
 	}
 
 	// Generate public URL
-	publicURL := m.GetPublicURL(userID, key)
+	publicURL := mediaURL(storage, config, key)
 
 	// Return S3 metadata
 	s3Data := map[string]interface{}{
 		"url":      publicURL,
 		"key":      key,
-		"bucket":   m.configs[userID].Bucket,
-		"size":     len(data),
+		"bucket":   config.Bucket,
+		"provider": config.Provider,
+		"urlMode":  config.URLMode,
+		"size":     uploaded,
 		"mimeType": mimeType,
 		"fileName": fileName,
 	}
 
+	if dedup {
+		s3Data["sha256"] = hash
+		s3Data["deduplicated"] = deduplicated
+	}
+
+	if verdict != nil {
+		s3Data["scan"] = verdict
+		s3Data["quarantined"] = quarantined
+	}
+
+	if config.Encryption != EncryptionNone {
+		s3Data["encrypted"] = true
+	} else if config.URLMode == MediaURLModePresigned {
+		if _, ok := storage.(urlSigner); ok {
+			s3Data["expiresAt"] = time.Now().Add(config.presignDuration()).Unix()
+		}
+	}
+
+	if len(thumb) > 0 {
+		if thumbnailURL := m.uploadThumbnail(ctx, userID, storage, config, key, thumb); thumbnailURL != "" {
+			s3Data["thumbnailURL"] = thumbnailURL
+		}
+	} else if config.Thumbnails && deduplicated && supportsThumbnail(mimeType) {
+		// The thumbnail was stored with the first copy of the content
+		s3Data["thumbnailURL"] = mediaURL(storage, config, thumbnailKey(key))
+	}
+
+	// Copy new objects to the mirror bucket in the background, deduplicated
+	// content was mirrored when it was first uploaded
+	if config.Mirror != nil && !deduplicated && !quarantined {
+		mirrorData, err := m.mirrorMedia(ctx, userID, key, body, uploaded, uploadMimeType)
+		if err != nil {
+			log.Error().Err(err).Str("userID", userID).Str("key", key).Msg("Failed to queue media for the mirror")
+			mirrorData = map[string]interface{}{"status": "failed"}
+		}
+		if mirrorData != nil {
+			s3Data["mirror"] = mirrorData
+		}
+	}
+
 	return s3Data, nil
 }
 
 // DeleteAllUserObjects deletes all user files from S3
 func (m *S3Manager) DeleteAllUserObjects(ctx context.Context, userID string) error {
+	prefix := fmt.Sprintf("users/%s/", userID)
+
+	m.deleteMirrorObjects(ctx, userID)
+
+	storage, storageConfig, ok := m.GetStorage(userID)
+	if ok && storageConfig.Provider != StorageProviderS3 {
+		deleter, ok := storage.(prefixDeleter)
+		if !ok {
+			return fmt.Errorf("storage provider %s does not support bulk deletion", storageConfig.Provider)
+		}
+		if err := deleter.DeletePrefix(ctx, prefix); err != nil {
+			return fmt.Errorf("failed to delete objects for user %s: %w", userID, err)
+		}
+		m.deleteMediaObjects(userID)
+		log.Info().Str("userID", userID).Str("provider", storageConfig.Provider).Msg("all user files removed from storage")
+		return nil
+	}
+
 	client, config, ok := m.GetClient(userID)
 	if !ok {
 		return fmt.Errorf("S3 client not initialized for user %s", userID)
 	}
-
-	prefix := fmt.Sprintf("users/%s/", userID)
 	var toDelete []types.ObjectIdentifier
 	var continuationToken *string
 
@@ -369,6 +1258,7 @@ func (m *S3Manager) DeleteAllUserObjects(ctx context.Context, userID string) err
 		}
 	}
 
+	m.deleteMediaObjects(userID)
 	log.Info().Str("userID", userID).Msg("all user files removed from S3")
 	return nil
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/rs/zerolog/log"
+)
+
+// sqsHTTPClient sends the SQS and SNS requests, the delivery context bounds
+// each attempt
+var sqsHTTPClient = &http.Client{Timeout: deliveryTimeout}
+
+// sqsClients are the SQS and SNS clients of a user
+type sqsClients struct {
+	sqs *sqs.Client
+	sns *sns.Client
+}
+
+// SQSSettings are the SQS queue and SNS topic the events of a user are
+// published to, stored as JSON in the sqs_settings column. Credentials work
+// like the S3 credential modes.
+type SQSSettings struct {
+	QueueURL string `json:"queue_url,omitempty"`
+	TopicARN string `json:"topic_arn,omitempty"`
+	// Region defaults to the region of the queue URL or topic ARN
+	Region string `json:"region,omitempty"`
+	// Endpoint replaces the AWS endpoint, e.g. for LocalStack
+	Endpoint string `json:"endpoint,omitempty"`
+
+	CredentialMode string `json:"credential_mode,omitempty"`
+	AccessKey      string `json:"access_key,omitempty"`
+	SecretKey      string `json:"secret_key,omitempty"`
+	RoleARN        string `json:"role_arn,omitempty"`
+	ExternalID     string `json:"external_id,omitempty"`
+}
+
+// parseSQSSettings decodes the sqs_settings column, nil when not set
+func parseSQSSettings(raw string) (*SQSSettings, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var settings SQSSettings
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return nil, fmt.Errorf("invalid SQS settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// encode returns the JSON stored in the sqs_settings column
+func (ss *SQSSettings) encode() (string, error) {
+	if ss == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(ss)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate checks the queue and topic and fills in the region
+func (ss *SQSSettings) validate() error {
+	if ss.QueueURL == "" && ss.TopicARN == "" {
+		return errors.New("queue_url or topic_arn is required")
+	}
+	region := ""
+	if ss.QueueURL != "" {
+		u, err := url.Parse(ss.QueueURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return errors.New("queue_url must be the URL of an SQS queue")
+		}
+		// https://sqs.<region>.amazonaws.com/<account>/<queue>
+		if parts := strings.Split(u.Hostname(), "."); len(parts) > 2 && parts[0] == "sqs" {
+			region = parts[1]
+		}
+	}
+	if ss.TopicARN != "" {
+		// arn:<partition>:sns:<region>:<account>:<topic>
+		parts := strings.Split(ss.TopicARN, ":")
+		if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" || parts[5] == "" {
+			return errors.New("topic_arn must be the ARN of an SNS topic")
+		}
+		if region == "" {
+			region = parts[3]
+		}
+	}
+	if ss.Region == "" {
+		ss.Region = region
+	}
+	if ss.Region == "" {
+		return errors.New("region is required")
+	}
+	if ss.Endpoint != "" {
+		if u, err := url.Parse(ss.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("endpoint must be an http or https URL")
+		}
+	}
+
+	mode, err := normalizeCredentialMode(ss.CredentialMode)
+	if err != nil {
+		return err
+	}
+	ss.CredentialMode = mode
+	if mode == CredentialModeStatic && (ss.AccessKey == "" || ss.SecretKey == "") {
+		return errors.New("access_key and secret_key are required with static credentials")
+	}
+	return nil
+}
+
+// redacted returns the settings without the secret key
+func (ss *SQSSettings) redacted() map[string]interface{} {
+	return map[string]interface{}{
+		"queue_url":       ss.QueueURL,
+		"topic_arn":       ss.TopicARN,
+		"region":          ss.Region,
+		"endpoint":        ss.Endpoint,
+		"fifo":            ss.fifo(ss.QueueURL) || ss.fifo(ss.TopicARN),
+		"credential_mode": ss.CredentialMode,
+		"access_key":      ss.AccessKey,
+		"has_secret_key":  ss.SecretKey != "",
+		"role_arn":        ss.RoleARN,
+		"external_id":     ss.ExternalID,
+	}
+}
+
+// fifo reports whether a queue URL or topic ARN names a FIFO queue or topic
+func (ss *SQSSettings) fifo(destination string) bool {
+	return strings.HasSuffix(destination, ".fifo")
+}
+
+// SQSSettings returns the SQS settings of a user, nil when none are
+// configured, loading them on first use
+func (m *DeliveryManager) SQSSettings(userID string) *SQSSettings {
+	m.mu.Lock()
+	settings, ok := m.sqsSettings[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok || db == nil {
+		return settings
+	}
+
+	var raw string
+	if err := db.Get(&raw, "SELECT sqs_settings FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load SQS settings")
+		return nil
+	}
+	settings, err := parseSQSSettings(raw)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Ignoring SQS settings")
+	}
+
+	m.mu.Lock()
+	m.sqsSettings[userID] = settings
+	m.mu.Unlock()
+	return settings
+}
+
+// SetSQSSettings stores the SQS settings of a user, nil removes them
+func (m *DeliveryManager) SetSQSSettings(userID string, settings *SQSSettings) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw, err := settings.encode()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET sqs_settings = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.sqsSettings, userID)
+	delete(m.sqsClients, userID)
+	m.mu.Unlock()
+	return nil
+}
+
+// userSQSClients returns the settings and clients of a user, creating the
+// clients on first use
+func (m *DeliveryManager) userSQSClients(userID string) (*SQSSettings, *sqsClients, error) {
+	settings := m.SQSSettings(userID)
+	if settings == nil {
+		return nil, nil, errors.New("SQS is not configured for the user")
+	}
+
+	m.mu.Lock()
+	clients, ok := m.sqsClients[userID]
+	m.mu.Unlock()
+	if ok {
+		return settings, clients, nil
+	}
+	provider, err := newS3Credentials(userID, &S3Config{
+		Region:         settings.Region,
+		AccessKey:      settings.AccessKey,
+		SecretKey:      settings.SecretKey,
+		CredentialMode: settings.CredentialMode,
+		RoleARN:        settings.RoleARN,
+		ExternalID:     settings.ExternalID,
+	}, sqsHTTPClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := aws.Config{
+		Region:      settings.Region,
+		Credentials: provider,
+		HTTPClient:  sqsHTTPClient,
+	}
+	clients = &sqsClients{
+		sqs: sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+			if settings.Endpoint != "" {
+				o.BaseEndpoint = aws.String(settings.Endpoint)
+			}
+		}),
+		sns: sns.NewFromConfig(cfg, func(o *sns.Options) {
+			if settings.Endpoint != "" {
+				o.BaseEndpoint = aws.String(settings.Endpoint)
+			}
+		}),
+	}
+
+	m.mu.Lock()
+	m.sqsClients[userID] = clients
+	m.mu.Unlock()
+	return settings, clients, nil
+}
+
+// Usage - like sendToUserWebHook, for the queue and topic of the user
+func sendToSQS(jsonData []byte, userID string, token string, eventType string) {
+	m := GetDeliveryManager()
+	settings := m.SQSSettings(userID)
+	if settings == nil {
+		return
+	}
+	if settings.QueueURL != "" {
+		m.Enqueue(&DeliveryEvent{
+			UserID:      userID,
+			Token:       token,
+			Channel:     DeliveryChannelSQS,
+			Destination: settings.QueueURL,
+			EventType:   eventType,
+			Payload:     string(jsonData),
+		})
+	}
+	if settings.TopicARN != "" {
+		m.Enqueue(&DeliveryEvent{
+			UserID:      userID,
+			Token:       token,
+			Channel:     DeliveryChannelSNS,
+			Destination: settings.TopicARN,
+			EventType:   eventType,
+			Payload:     string(jsonData),
+		})
+	}
+}
+
+// eventChatJID returns the chat an event belongs to, empty for events that
+// aren't about a chat
+func eventChatJID(payload string) string {
+	var event struct {
+		Event struct {
+			Info struct {
+				Chat string `json:"Chat"`
+			} `json:"Info"`
+			Chat string `json:"Chat"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		return ""
+	}
+	if event.Event.Info.Chat != "" {
+		return event.Event.Info.Chat
+	}
+	return event.Event.Chat
+}
+
+// payloadMessageID returns the WhatsApp message ID of an event, the IDs joined
+// by commas for receipts, empty for events that aren't about a message
+func payloadMessageID(payload string) string {
+	var event struct {
+		Event struct {
+			Info struct {
+				ID string `json:"ID"`
+			} `json:"Info"`
+			MessageIDs []string `json:"MessageIDs"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		return ""
+	}
+	if event.Event.Info.ID != "" {
+		return event.Event.Info.ID
+	}
+	return strings.Join(event.Event.MessageIDs, ",")
+}
+
+// awsEventAttributes are the message attributes of an event, the same values
+// as the RabbitMQ and Kafka headers. Empty values are left out, AWS rejects
+// them.
+func awsEventAttributes(event *DeliveryEvent) map[string]string {
+	attributes := deliveryHeaders(nil, event)
+	attributes["instanceId"] = event.UserID
+	attributes["instanceName"] = instanceName(event.Token)
+	attributes["eventType"] = event.EventType
+	for name, value := range attributes {
+		if value == "" {
+			delete(attributes, name)
+		}
+	}
+	return attributes
+}
+
+// publishToSQS sends an event to the SQS queue or SNS topic of its user. On
+// FIFO queues and topics the message group is the chat of the event, so the
+// events of a chat keep their order, and the delivery ID deduplicates retries.
+func (m *DeliveryManager) publishToSQS(ctx context.Context, event *DeliveryEvent) error {
+	settings, clients, err := m.userSQSClients(event.UserID)
+	if err != nil {
+		return err
+	}
+	fifo := settings.fifo(event.Destination)
+	group := eventChatJID(event.Payload)
+	if group == "" {
+		group = event.UserID
+	}
+	attributes := awsEventAttributes(event)
+	// Message bodies are text, compressed payloads are sent base64 encoded
+	data, encoding, err := encodePayload(event)
+	if err != nil {
+		return err
+	}
+	message := string(data)
+	if encoding != "" {
+		message = base64.StdEncoding.EncodeToString(data)
+		attributes["Content-Encoding"] = encoding
+		attributes["Content-Transfer-Encoding"] = "base64"
+		attributes["payloadDecoding"] = payloadDecoding(event, encoding, true)
+	}
+
+	if event.Channel == DeliveryChannelSNS {
+		input := &sns.PublishInput{
+			TopicArn:          aws.String(event.Destination),
+			Message:           aws.String(message),
+			MessageAttributes: make(map[string]snstypes.MessageAttributeValue, len(attributes)),
+		}
+		for name, value := range attributes {
+			input.MessageAttributes[name] = snstypes.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+		if fifo {
+			input.MessageGroupId = aws.String(group)
+			input.MessageDeduplicationId = aws.String(event.ID)
+		}
+		_, err := clients.sns.Publish(ctx, input)
+		return err
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(event.Destination),
+		MessageBody:       aws.String(message),
+		MessageAttributes: make(map[string]sqstypes.MessageAttributeValue, len(attributes)),
+	}
+	for name, value := range attributes {
+		input.MessageAttributes[name] = sqstypes.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	if fifo {
+		input.MessageGroupId = aws.String(group)
+		input.MessageDeduplicationId = aws.String(event.ID)
+	}
+	_, err = clients.sqs.SendMessage(ctx, input)
+	return err
+}
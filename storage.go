@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Supported media storage providers
+const (
+	StorageProviderS3    = "s3"
+	StorageProviderGCS   = "gcs"
+	StorageProviderAzure = "azure"
+	StorageProviderLocal = "local"
+)
+
+// MediaStorage is implemented by every media offload backend
+type MediaStorage interface {
+	Upload(ctx context.Context, key string, data []byte, mimeType string) error
+	Delete(ctx context.Context, key string) error
+	PublicURL(key string) string
+	Test(ctx context.Context) error
+}
+
+// prefixDeleter is implemented by backends that can remove all objects under a prefix
+type prefixDeleter interface {
+	DeletePrefix(ctx context.Context, prefix string) error
+}
+
+// streamUploader is implemented by backends that can upload from a reader
+// without buffering the whole payload. size is -1 when unknown.
+type streamUploader interface {
+	UploadStream(ctx context.Context, key string, body io.Reader, size int64, mimeType string) error
+}
+
+// retentionSweeper is implemented by backends that can delete objects under a
+// prefix older than a cutoff, returning the number of objects and bytes removed
+type retentionSweeper interface {
+	DeleteOlderThan(ctx context.Context, prefix string, cutoff time.Time) (int64, int64, error)
+}
+
+// rangeDeleter is implemented by backends that can delete objects under a
+// prefix last modified within [from, to). A zero bound leaves that side open.
+type rangeDeleter interface {
+	DeleteModifiedBetween(ctx context.Context, prefix string, from, to time.Time) (int64, int64, error)
+}
+
+// inTimeRange reports whether t falls within [from, to), zero bounds are open
+func inTimeRange(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	return to.IsZero() || t.Before(to)
+}
+
+// urlSigner is implemented by backends that can issue time-limited download URLs
+type urlSigner interface {
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// objectReader is implemented by backends that can stream an object back,
+// used by the /media proxy
+type objectReader interface {
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// isNotFoundError reports whether a storage error means the object is missing
+func isNotFoundError(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) || errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	var statusErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &statusErr) && statusErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+// normalizeStorageProvider validates a provider name, defaulting to S3
+func normalizeStorageProvider(provider string) (string, error) {
+	provider = strings.ToLower(strings.TrimSpace(provider))
+	switch provider {
+	case "":
+		return StorageProviderS3, nil
+	case StorageProviderS3, StorageProviderGCS, StorageProviderAzure, StorageProviderLocal:
+		return provider, nil
+	}
+	return "", fmt.Errorf("unsupported storage provider %q", provider)
+}
+
+// newMediaStorage builds a standalone backend for providers other than S3,
+// whose clients are kept by S3Manager itself
+func newMediaStorage(config *S3Config) (MediaStorage, error) {
+	switch config.Provider {
+	case StorageProviderGCS:
+		return NewGCSStorage(config)
+	case StorageProviderAzure:
+		return NewAzureBlobStorage(config)
+	case StorageProviderLocal:
+		return NewLocalStorage(config)
+	}
+	return nil, fmt.Errorf("unsupported storage provider %q", config.Provider)
+}
+
+// s3Storage adapts the per user S3 client kept by S3Manager to MediaStorage
+type s3Storage struct {
+	manager *S3Manager
+	userID  string
+}
+
+func (s *s3Storage) Upload(ctx context.Context, key string, data []byte, mimeType string) error {
+	return s.manager.UploadToS3(ctx, s.userID, key, data, mimeType)
+}
+
+func (s *s3Storage) UploadStream(ctx context.Context, key string, body io.Reader, size int64, mimeType string) error {
+	return s.manager.UploadStreamToS3(ctx, s.userID, key, body, size, mimeType)
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	client, config, ok := s.manager.GetClient(s.userID)
+	if !ok {
+		return fmt.Errorf("S3 client not initialized for user %s", s.userID)
+	}
+	_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *s3Storage) Exists(ctx context.Context, key string) (bool, error) {
+	client, config, ok := s.manager.GetClient(s.userID)
+	if !ok {
+		return false, fmt.Errorf("S3 client not initialized for user %s", s.userID)
+	}
+	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *s3Storage) PublicURL(key string) string {
+	return s.manager.GetPublicURL(s.userID, key)
+}
+
+func (s *s3Storage) Test(ctx context.Context) error {
+	return s.manager.TestConnection(ctx, s.userID)
+}
+
+func (s *s3Storage) DeleteOlderThan(ctx context.Context, prefix string, cutoff time.Time) (int64, int64, error) {
+	return s.manager.deleteS3ObjectsBetween(ctx, s.userID, prefix, time.Time{}, cutoff)
+}
+
+func (s *s3Storage) DeleteModifiedBetween(ctx context.Context, prefix string, from, to time.Time) (int64, int64, error) {
+	return s.manager.deleteS3ObjectsBetween(ctx, s.userID, prefix, from, to)
+}
+
+func (s *s3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	client, config, ok := s.manager.GetClient(s.userID)
+	if !ok {
+		return nil, fmt.Errorf("S3 client not initialized for user %s", s.userID)
+	}
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+func (s *s3Storage) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return s.manager.PresignGetURL(ctx, s.userID, key, ttl)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nfnt/resize"
+	"github.com/vincent-petithory/dataurl"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+// Placeholders look like {{name}} and may contain spaces around the name
+var templateVarPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// WhatsApp shows at most three reply buttons under a message
+const maxTemplateButtons = 3
+
+const messageTemplateColumns = "id, user_id, name, type, body, media, mime_type, file_name, buttons"
+
+var validTemplateTypes = map[string]bool{
+	"text":     true,
+	"image":    true,
+	"video":    true,
+	"document": true,
+}
+
+// TemplateButton is a reply button sent under the template, its text may
+// contain placeholders
+type TemplateButton struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// MessageTemplate is a named, per user message with {{variable}} placeholders
+type MessageTemplate struct {
+	ID       string           `db:"id" json:"id"`
+	UserID   string           `db:"user_id" json:"-"`
+	Name     string           `db:"name" json:"name"`
+	Type     string           `db:"type" json:"type"`
+	Body     string           `db:"body" json:"body"`
+	Media    string           `db:"media" json:"media"`
+	MimeType string           `db:"mime_type" json:"mime_type"`
+	FileName string           `db:"file_name" json:"file_name"`
+	Buttons  []TemplateButton `db:"-" json:"buttons,omitempty"`
+	// ButtonsJSON is the buttons column, kept in step by Normalize and
+	// getMessageTemplate
+	ButtonsJSON string `db:"buttons" json:"-"`
+}
+
+// getMessageTemplate loads a template of the user by name, returning
+// sql.ErrNoRows when there is none
+func getMessageTemplate(db *sqlx.DB, userID string, name string) (*MessageTemplate, error) {
+	var tpl MessageTemplate
+	err := db.Get(&tpl, "SELECT "+messageTemplateColumns+" FROM message_templates WHERE user_id = $1 AND name = $2", userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := tpl.decodeButtons(); err != nil {
+		return nil, err
+	}
+	return &tpl, nil
+}
+
+// listMessageTemplates loads the templates of the user sorted by name
+func listMessageTemplates(db *sqlx.DB, userID string) ([]MessageTemplate, error) {
+	var templates []MessageTemplate
+	err := db.Select(&templates, "SELECT "+messageTemplateColumns+" FROM message_templates WHERE user_id = $1 ORDER BY name ASC", userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range templates {
+		if err := templates[i].decodeButtons(); err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
+
+func (t *MessageTemplate) decodeButtons() error {
+	t.Buttons = nil
+	if t.ButtonsJSON == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(t.ButtonsJSON), &t.Buttons); err != nil {
+		return fmt.Errorf("invalid buttons of template %s: %w", t.Name, err)
+	}
+	return nil
+}
+
+// Normalize applies defaults and validates the template
+func (t *MessageTemplate) Normalize() error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return errors.New("missing name in payload")
+	}
+
+	t.Type = strings.ToLower(strings.TrimSpace(t.Type))
+	if t.Type == "" {
+		t.Type = "text"
+	}
+	if !validTemplateTypes[t.Type] {
+		return fmt.Errorf("invalid template type %q, must be one of text, image, video, document", t.Type)
+	}
+
+	if len(t.Buttons) > maxTemplateButtons {
+		return fmt.Errorf("at most %d buttons are allowed", maxTemplateButtons)
+	}
+	t.ButtonsJSON = ""
+	if len(t.Buttons) > 0 {
+		for i := range t.Buttons {
+			if strings.TrimSpace(t.Buttons[i].Text) == "" {
+				return errors.New("missing text for button")
+			}
+			if t.Buttons[i].ID == "" {
+				t.Buttons[i].ID = fmt.Sprintf("%d", i+1)
+			}
+		}
+		encoded, err := json.Marshal(t.Buttons)
+		if err != nil {
+			return err
+		}
+		t.ButtonsJSON = string(encoded)
+	}
+
+	if t.Type == "text" {
+		if strings.TrimSpace(t.Body) == "" {
+			return errors.New("missing body in payload")
+		}
+		t.Media = ""
+		t.MimeType = ""
+		t.FileName = ""
+		return nil
+	}
+
+	if t.Media == "" {
+		return fmt.Errorf("missing media in payload for %s template", t.Type)
+	}
+	if !strings.HasPrefix(t.Media, "data:") && !isHTTPURL(t.Media) {
+		return errors.New("media should be a data URL or an http(s) URL")
+	}
+	if t.Type == "document" && t.FileName == "" {
+		return errors.New("missing file_name in payload for document template")
+	}
+	return nil
+}
+
+// Variables returns the distinct placeholder names used by the template
+func (t *MessageTemplate) Variables() []string {
+	seen := make(map[string]bool)
+	vars := []string{}
+	sources := []string{t.Body, t.FileName}
+	for _, button := range t.Buttons {
+		sources = append(sources, button.Text)
+	}
+	for _, source := range sources {
+		for _, match := range templateVarPattern.FindAllStringSubmatch(source, -1) {
+			if !seen[match[1]] {
+				seen[match[1]] = true
+				vars = append(vars, match[1])
+			}
+		}
+	}
+	return vars
+}
+
+// renderTemplateString replaces placeholders with the given variables and
+// fails if any of them is missing, so half rendered messages are never sent
+func renderTemplateString(text string, vars map[string]interface{}) (string, error) {
+	missing := make(map[string]bool)
+	rendered := templateVarPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := templateVarPattern.FindStringSubmatch(placeholder)[1]
+		value, ok := vars[name]
+		if !ok || value == nil {
+			missing[name] = true
+			return placeholder
+		}
+		return fmt.Sprintf("%v", value)
+	})
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("missing template variables: %s", strings.Join(names, ", "))
+	}
+	return rendered, nil
+}
+
+// Render returns the body and file name with all variables substituted
+func (t *MessageTemplate) Render(vars map[string]interface{}) (string, string, error) {
+	body, err := renderTemplateString(t.Body, vars)
+	if err != nil {
+		return "", "", err
+	}
+	fileName, err := renderTemplateString(t.FileName, vars)
+	if err != nil {
+		return "", "", err
+	}
+	return body, fileName, nil
+}
+
+// RenderButtons returns the buttons with all variables substituted
+func (t *MessageTemplate) RenderButtons(vars map[string]interface{}) ([]TemplateButton, error) {
+	buttons := make([]TemplateButton, len(t.Buttons))
+	for i, button := range t.Buttons {
+		text, err := renderTemplateString(button.Text, vars)
+		if err != nil {
+			return nil, err
+		}
+		buttons[i] = TemplateButton{ID: button.ID, Text: text}
+	}
+	return buttons, nil
+}
+
+// loadTemplateMedia returns the media bytes and mime type for a template
+func loadTemplateMedia(media string, mimeType string) ([]byte, string, error) {
+	var data []byte
+	var contentType string
+
+	if strings.HasPrefix(media, "data:") {
+		dataURL, err := dataurl.DecodeString(media)
+		if err != nil {
+			return nil, "", errors.New("could not decode base64 encoded template media")
+		}
+		data = dataURL.Data
+		contentType = dataURL.ContentType()
+	} else if isHTTPURL(media) {
+		fetched, ct, err := fetchURLBytes(media)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to fetch template media from url: %v", err)
+		}
+		data = fetched
+		contentType = ct
+	} else {
+		return nil, "", errors.New("template media should be a data URL or an http(s) URL")
+	}
+
+	if mimeType != "" {
+		contentType = mimeType
+	}
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, nil
+}
+
+// templateMedia is the media of a template uploaded to WhatsApp, which can
+// be sent to any number of recipients
+type templateMedia struct {
+	uploaded  whatsmeow.UploadResponse
+	mimeType  string
+	length    uint64
+	thumbnail []byte
+}
+
+// uploadTemplateMedia loads the media of a non text template and uploads it
+func uploadTemplateMedia(client *whatsmeow.Client, t *MessageTemplate) (*templateMedia, error) {
+	filedata, mimeType, err := loadTemplateMedia(t.Media, t.MimeType)
+	if err != nil {
+		return nil, err
+	}
+	if mycli := clientManager.GetMyClient(t.UserID); mycli != nil {
+		filedata = stripOutgoingMetadata(mycli.db, t.UserID, filedata)
+	}
+
+	var mediaType whatsmeow.MediaType
+	switch t.Type {
+	case "image":
+		mediaType = whatsmeow.MediaImage
+	case "video":
+		mediaType = whatsmeow.MediaVideo
+	default:
+		mediaType = whatsmeow.MediaDocument
+	}
+
+	uploaded, err := client.Upload(context.Background(), filedata, mediaType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %v", err)
+	}
+
+	media := &templateMedia{
+		uploaded: uploaded,
+		mimeType: mimeType,
+		length:   uint64(len(filedata)),
+	}
+	if t.Type == "image" {
+		media.thumbnail = templateThumbnail(filedata)
+	}
+	return media, nil
+}
+
+// buildTemplateMessage renders a template into a message ready to be sent,
+// uploading the media first for non text templates
+func buildTemplateMessage(client *whatsmeow.Client, t *MessageTemplate, vars map[string]interface{}) (*waE2E.Message, error) {
+	var media *templateMedia
+	if t.Type != "text" {
+		var err error
+		if media, err = uploadTemplateMedia(client, t); err != nil {
+			return nil, err
+		}
+	}
+	return renderTemplateMessage(t, vars, media)
+}
+
+// renderTemplateMessage renders a template into a message with media already
+// uploaded by uploadTemplateMedia, media is nil for text templates
+func renderTemplateMessage(t *MessageTemplate, vars map[string]interface{}, media *templateMedia) (*waE2E.Message, error) {
+	body, fileName, err := t.Render(vars)
+	if err != nil {
+		return nil, err
+	}
+	buttons, err := t.RenderButtons(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Type == "text" {
+		if len(buttons) > 0 {
+			return templateButtonsMessage(body, buttons, waE2E.ButtonsMessage_EMPTY, nil), nil
+		}
+		return &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+			Text: proto.String(body),
+		}}, nil
+	}
+
+	uploaded := media.uploaded
+	switch t.Type {
+	case "image":
+		imageMessage := &waE2E.ImageMessage{
+			Caption:       proto.String(body),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(media.mimeType),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(media.length),
+			JPEGThumbnail: media.thumbnail,
+		}
+		if len(buttons) > 0 {
+			imageMessage.Caption = nil
+			return templateButtonsMessage(body, buttons, waE2E.ButtonsMessage_IMAGE, &waE2E.ButtonsMessage{
+				Header: &waE2E.ButtonsMessage_ImageMessage{ImageMessage: imageMessage},
+			}), nil
+		}
+		return &waE2E.Message{ImageMessage: imageMessage}, nil
+	case "video":
+		videoMessage := &waE2E.VideoMessage{
+			Caption:       proto.String(body),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(media.mimeType),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(media.length),
+		}
+		if len(buttons) > 0 {
+			videoMessage.Caption = nil
+			return templateButtonsMessage(body, buttons, waE2E.ButtonsMessage_VIDEO, &waE2E.ButtonsMessage{
+				Header: &waE2E.ButtonsMessage_VideoMessage{VideoMessage: videoMessage},
+			}), nil
+		}
+		return &waE2E.Message{VideoMessage: videoMessage}, nil
+	default:
+		documentMessage := &waE2E.DocumentMessage{
+			Caption:       proto.String(body),
+			FileName:      proto.String(fileName),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(media.mimeType),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(media.length),
+		}
+		if len(buttons) > 0 {
+			documentMessage.Caption = nil
+			return templateButtonsMessage(body, buttons, waE2E.ButtonsMessage_DOCUMENT, &waE2E.ButtonsMessage{
+				Header: &waE2E.ButtonsMessage_DocumentMessage{DocumentMessage: documentMessage},
+			}), nil
+		}
+		return &waE2E.Message{DocumentMessage: documentMessage}, nil
+	}
+}
+
+// templateButtonsMessage puts the body and reply buttons in a buttons
+// message, wrapped in a view once message like /chat/send/buttons does. msg
+// already holds the media header, it is nil for text templates.
+func templateButtonsMessage(body string, buttons []TemplateButton, headerType waE2E.ButtonsMessage_HeaderType, msg *waE2E.ButtonsMessage) *waE2E.Message {
+	if msg == nil {
+		msg = &waE2E.ButtonsMessage{}
+	}
+	msg.ContentText = proto.String(body)
+	msg.HeaderType = headerType.Enum()
+	for _, button := range buttons {
+		msg.Buttons = append(msg.Buttons, &waE2E.ButtonsMessage_Button{
+			ButtonID:       proto.String(button.ID),
+			ButtonText:     &waE2E.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(button.Text)},
+			Type:           waE2E.ButtonsMessage_Button_RESPONSE.Enum(),
+			NativeFlowInfo: &waE2E.ButtonsMessage_Button_NativeFlowInfo{},
+		})
+	}
+	return &waE2E.Message{ViewOnceMessage: &waE2E.FutureProofMessage{
+		Message: &waE2E.Message{ButtonsMessage: msg},
+	}}
+}
+
+// templateThumbnail builds a small jpeg preview, returning nil when the
+// image cannot be decoded so the message is still sent without one
+func templateThumbnail(filedata []byte) []byte {
+	img, _, err := image.Decode(bytes.NewReader(filedata))
+	if err != nil {
+		return nil
+	}
+	m := resize.Thumbnail(72, 72, img, resize.Lanczos3)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, nil); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+const maxUserListLimit = 1000
+
+// userKillTimeout is how long disabling waits for the connection loop of the
+// user to take the kill signal before disconnecting the client itself
+const userKillTimeout = 5 * time.Second
+
+// UserListFilter selects the users listed by GET /admin/users. Unset fields
+// match every user.
+type UserListFilter struct {
+	Connected *bool
+	LoggedIn  *bool
+	Disabled  *bool
+	// Event matches users subscribed to the event type, or to All
+	Event string
+	// Name matches users whose name contains it, ignoring case
+	Name   string
+	Limit  int
+	Offset int
+	// Paged is set when limit or offset was given, the list is then returned
+	// with its total
+	Paged bool
+}
+
+// parseUserListFilter reads the filter from the query parameters
+func parseUserListFilter(query url.Values) (*UserListFilter, error) {
+	filter := &UserListFilter{
+		Event: query.Get("event"),
+		Name:  strings.ToLower(query.Get("name")),
+	}
+	if filter.Event != "" && !Find(supportedEventTypes, filter.Event) {
+		return nil, errors.New("invalid event type " + strconv.Quote(filter.Event))
+	}
+
+	flags := []struct {
+		name string
+		dest **bool
+	}{
+		{"connected", &filter.Connected},
+		{"logged_in", &filter.LoggedIn},
+		{"disabled", &filter.Disabled},
+	}
+	for _, flag := range flags {
+		value := query.Get(flag.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New(flag.name + " must be true or false")
+		}
+		*flag.dest = &parsed
+	}
+
+	var err error
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			return nil, errors.New("limit must be a number")
+		}
+		filter.Paged = true
+	}
+	if value := query.Get("offset"); value != "" {
+		if filter.Offset, err = strconv.Atoi(value); err != nil {
+			return nil, errors.New("offset must be a number")
+		}
+		filter.Paged = true
+	}
+	if filter.Limit < 0 || filter.Offset < 0 {
+		return nil, errors.New("limit and offset must not be negative")
+	}
+	if filter.Limit == 0 || filter.Limit > maxUserListLimit {
+		filter.Limit = maxUserListLimit
+	}
+	return filter, nil
+}
+
+// matches reports whether a user passes the filter
+func (f *UserListFilter) matches(name string, events string, connected bool, loggedIn bool, disabled bool) bool {
+	if f.Connected != nil && *f.Connected != connected {
+		return false
+	}
+	if f.LoggedIn != nil && *f.LoggedIn != loggedIn {
+		return false
+	}
+	if f.Disabled != nil && *f.Disabled != disabled {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(strings.ToLower(name), f.Name) {
+		return false
+	}
+	if f.Event != "" {
+		subscribed := strings.Split(events, ",")
+		if !Find(subscribed, f.Event) && !Find(subscribed, "All") {
+			return false
+		}
+	}
+	return true
+}
+
+// page returns the part of users selected by limit and offset
+func (f *UserListFilter) page(users []map[string]interface{}) []map[string]interface{} {
+	if f.Offset >= len(users) {
+		return []map[string]interface{}{}
+	}
+	end := f.Offset + f.Limit
+	if end > len(users) {
+		end = len(users)
+	}
+	return users[f.Offset:end]
+}
+
+// setUserDisabled disables or enables a user. A disabled user is rejected by
+// the token check and its WhatsApp connection is closed, the session is kept
+// so it connects again once enabled. It returns false when the user doesn't
+// exist.
+func setUserDisabled(db *sqlx.DB, userID string, disabled bool) (bool, error) {
+	var token string
+	if err := db.Get(&token, "SELECT token FROM users WHERE id = $1", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	disabledAt := int64(0)
+	if disabled {
+		disabledAt = time.Now().Unix()
+	}
+	if _, err := db.Exec("UPDATE users SET disabled_at = $1 WHERE id = $2", disabledAt, userID); err != nil {
+		return true, err
+	}
+	userinfocache.Delete(token)
+	if !disabled {
+		return true, nil
+	}
+
+	if client := clientManager.GetWhatsmeowClient(userID); client != nil {
+		select {
+		case killchannel[userID] <- true:
+		case <-time.After(userKillTimeout):
+			log.Warn().Str("userID", userID).Msg("Connection loop did not take the kill signal, disconnecting")
+			client.Disconnect()
+			clientManager.DeleteWhatsmeowClient(userID)
+			clientManager.DeleteMyClient(userID)
+			clientManager.DeleteHTTPClient(userID)
+		}
+	}
+	// Keeps the instance from connecting on the next start
+	if _, err := db.Exec("UPDATE users SET connected = 0 WHERE id = $1", userID); err != nil {
+		return true, err
+	}
+	return true, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// WebhookActions are the commands a user webhook may answer a message event
+// with, so simple bots don't need a second API call
+type WebhookActions struct {
+	// Reply sends a text message to the chat of the event
+	Reply *struct {
+		Text string `json:"text"`
+		// Quote replies to the message of the event
+		Quote bool `json:"quote"`
+	} `json:"reply"`
+	// MarkRead marks the message of the event as read
+	MarkRead bool `json:"markRead"`
+}
+
+// webhookMessageEvent is the part of a message event the actions apply to
+type webhookMessageEvent struct {
+	Type  string `json:"type"`
+	Event struct {
+		Info struct {
+			ID       string    `json:"ID"`
+			Chat     types.JID `json:"Chat"`
+			Sender   types.JID `json:"Sender"`
+			IsFromMe bool      `json:"IsFromMe"`
+		} `json:"Info"`
+	} `json:"event"`
+}
+
+// runWebhookActions executes the actions in the response of a user webhook to
+// a message event. Responses that are not a JSON object are ignored, as are
+// messages sent by the session itself so a bot can't answer its own replies.
+func runWebhookActions(event *DeliveryEvent, body []byte) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '{' {
+		return
+	}
+	var actions WebhookActions
+	if err := json.Unmarshal(body, &actions); err != nil {
+		log.Debug().Err(err).Str("userID", event.UserID).Msg("Webhook response is not an action list")
+		return
+	}
+	if actions.Reply == nil && !actions.MarkRead {
+		return
+	}
+
+	var msg webhookMessageEvent
+	if err := json.Unmarshal([]byte(event.Payload), &msg); err != nil || msg.Type != "Message" {
+		log.Warn().Str("userID", event.UserID).Str("eventType", event.EventType).Msg("Webhook actions are only supported for Message events")
+		return
+	}
+	info := msg.Event.Info
+	if info.IsFromMe || info.Chat.IsEmpty() {
+		return
+	}
+
+	client := clientManager.GetWhatsmeowClient(event.UserID)
+	if client == nil {
+		log.Warn().Str("userID", event.UserID).Msg("No session to run webhook actions")
+		return
+	}
+
+	if actions.MarkRead {
+		if err := client.MarkRead([]types.MessageID{info.ID}, time.Now(), info.Chat, info.Sender); err != nil {
+			log.Error().Err(err).Str("userID", event.UserID).Str("id", info.ID).Msg("Webhook action markRead failed")
+		}
+	}
+
+	if actions.Reply != nil && actions.Reply.Text != "" {
+		reply := &waE2E.Message{
+			ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+				Text: proto.String(actions.Reply.Text),
+			},
+		}
+		if actions.Reply.Quote {
+			reply.ExtendedTextMessage.ContextInfo = &waE2E.ContextInfo{
+				StanzaID:      proto.String(info.ID),
+				Participant:   proto.String(info.Sender.ToNonAD().String()),
+				QuotedMessage: &waE2E.Message{Conversation: proto.String("")},
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+		defer cancel()
+		resp, err := client.SendMessage(ctx, info.Chat, reply, whatsmeow.SendRequestExtra{})
+		if err != nil {
+			log.Error().Err(err).Str("userID", event.UserID).Str("chat", info.Chat.String()).Msg("Webhook action reply failed")
+			return
+		}
+		log.Info().Str("userID", event.UserID).Str("id", resp.ID).Str("chat", info.Chat.String()).Msg("Webhook reply sent")
+		rememberSentMessage(event.UserID, info.Chat, resp.ID, resp.Timestamp)
+	}
+}
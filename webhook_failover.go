@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultWebhookFailoverThreshold = 3
+	maxWebhookFailoverThreshold     = 100
+	// webhookFailoverProbeInterval is how often the primary webhook is tried
+	// again while deliveries go to the failover URL
+	webhookFailoverProbeInterval = 30 * time.Second
+)
+
+// WebhookFailover is the secondary webhook of a user, stored as JSON in the
+// webhook_failover column. Deliveries switch to it after Threshold consecutive
+// failures of the primary webhook and switch back once the primary answers
+// again.
+type WebhookFailover struct {
+	URL       string `json:"url"`
+	Threshold int    `json:"threshold"`
+}
+
+// parseWebhookFailover decodes the webhook_failover column, nil when not set
+func parseWebhookFailover(raw string) (*WebhookFailover, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var failover WebhookFailover
+	if err := json.Unmarshal([]byte(raw), &failover); err != nil {
+		return nil, fmt.Errorf("invalid webhook failover: %w", err)
+	}
+	return &failover, nil
+}
+
+// encode returns the JSON stored in the webhook_failover column
+func (f *WebhookFailover) encode() (string, error) {
+	if f == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate checks the failover URL, the threshold defaults to 3 failures
+func (f *WebhookFailover) validate() error {
+	u, err := url.Parse(f.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an http or https URL")
+	}
+	if f.Threshold == 0 {
+		f.Threshold = defaultWebhookFailoverThreshold
+	}
+	if f.Threshold < 1 || f.Threshold > maxWebhookFailoverThreshold {
+		return fmt.Errorf("threshold must be between 1 and %d", maxWebhookFailoverThreshold)
+	}
+	return nil
+}
+
+// failoverState tracks the primary webhook of a user with a failover URL
+type failoverState struct {
+	failures int
+	active   bool
+	since    time.Time
+	probeAt  time.Time
+}
+
+// WebhookFailoverStatus is the failover configuration of a user and whether
+// deliveries currently go to the failover URL
+type WebhookFailoverStatus struct {
+	*WebhookFailover
+	Active              bool       `json:"active"`
+	ActiveSince         *time.Time `json:"active_since,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// WebhookFailover returns the failover webhook of a user, nil when none is
+// configured, loading it on first use
+func (m *DeliveryManager) WebhookFailover(userID string) *WebhookFailover {
+	m.mu.Lock()
+	failover, ok := m.failovers[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok || db == nil {
+		return failover
+	}
+
+	var raw string
+	if err := db.Get(&raw, "SELECT webhook_failover FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load webhook failover")
+		return nil
+	}
+	failover, err := parseWebhookFailover(raw)
+	if err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Ignoring webhook failover")
+	}
+
+	m.mu.Lock()
+	m.failovers[userID] = failover
+	m.mu.Unlock()
+	return failover
+}
+
+// SetWebhookFailover stores the failover webhook of a user, nil removes it.
+// Deliveries go back to the primary webhook in both cases.
+func (m *DeliveryManager) SetWebhookFailover(userID string, failover *WebhookFailover) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw, err := failover.encode()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET webhook_failover = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.failovers, userID)
+	delete(m.failoverStates, userID)
+	m.mu.Unlock()
+	return nil
+}
+
+// WebhookFailoverStatus returns the failover webhook of a user and its state,
+// nil when none is configured
+func (m *DeliveryManager) WebhookFailoverStatus(userID string) *WebhookFailoverStatus {
+	failover := m.WebhookFailover(userID)
+	if failover == nil {
+		return nil
+	}
+	status := &WebhookFailoverStatus{WebhookFailover: failover}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state, ok := m.failoverStates[userID]; ok {
+		status.Active = state.active
+		status.ConsecutiveFailures = state.failures
+		if state.active {
+			since := state.since
+			status.ActiveSince = &since
+		}
+	}
+	return status
+}
+
+// webhookTarget returns the URL a webhook delivery is sent to: the failover
+// URL while failover is engaged, except for one probe of the primary every
+// webhookFailoverProbeInterval
+func (m *DeliveryManager) webhookTarget(userID string, primary string) (string, bool) {
+	failover := m.WebhookFailover(userID)
+	if failover == nil {
+		return primary, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.failoverStates[userID]
+	if !ok || !state.active {
+		return primary, false
+	}
+	if now := time.Now(); now.After(state.probeAt) {
+		state.probeAt = now.Add(webhookFailoverProbeInterval)
+		return primary, false
+	}
+	return failover.URL, true
+}
+
+// webhookResult records the outcome of a request to the primary webhook,
+// engaging failover after too many consecutive failures and releasing it on
+// the first success
+func (m *DeliveryManager) webhookResult(event *DeliveryEvent, usedFailover bool, deliveryErr error) {
+	failover := m.WebhookFailover(event.UserID)
+	if failover == nil || usedFailover {
+		return
+	}
+
+	now := time.Now()
+	change := ""
+	m.mu.Lock()
+	state, ok := m.failoverStates[event.UserID]
+	if !ok {
+		state = &failoverState{}
+		m.failoverStates[event.UserID] = state
+	}
+	if deliveryErr == nil {
+		state.failures = 0
+		if state.active {
+			state.active = false
+			change = "recovered"
+		}
+	} else {
+		state.failures++
+		if !state.active && state.failures >= failover.Threshold {
+			state.active = true
+			state.since = now
+			state.probeAt = now.Add(webhookFailoverProbeInterval)
+			change = "engaged"
+		}
+	}
+	failures := state.failures
+	m.mu.Unlock()
+
+	if change == "" {
+		return
+	}
+	log.Warn().Str("userID", event.UserID).Str("primary", event.Destination).Str("failover", failover.URL).Str("state", change).Int("failures", failures).Msg("Webhook failover changed")
+
+	// Tell the user webhook, which now is the failover or the primary again,
+	// and the global consumers
+	postmap := map[string]interface{}{
+		"type": "WebhookFailover",
+		"event": map[string]interface{}{
+			"state":    change,
+			"primary":  event.Destination,
+			"failover": failover.URL,
+			"failures": failures,
+		},
+	}
+	jsonData, err := json.Marshal(postmap)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal webhook failover event")
+		return
+	}
+	sendToUserWebHook(event.Destination, "", jsonData, event.UserID, event.Token, "WebhookFailover")
+	sendToGlobalWebHook(jsonData, event.Token, event.UserID, "WebhookFailover")
+	sendToGlobalRabbit(jsonData, event.UserID, "WebhookFailover")
+	sendToKafka(jsonData, event.UserID, event.Token, "WebhookFailover")
+	sendToNATS(jsonData, event.UserID, event.Token, "WebhookFailover")
+	sendToSQS(jsonData, event.UserID, event.Token, "WebhookFailover")
+	sendToPubSub(jsonData, event.UserID, event.Token, "WebhookFailover")
+	sendToRedis(jsonData, event.UserID, event.Token, "WebhookFailover")
+	sendToUserRabbit(jsonData, event.UserID, event.Token, "WebhookFailover")
+}
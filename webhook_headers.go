@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const maxWebhookHeaders = 20
+
+// Headers set by the webhook client itself
+var reservedWebhookHeaders = map[string]bool{
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"X-Delivery-Id":     true,
+	"X-Attempt":         true,
+}
+
+// validateWebhookHeaders checks the extra headers sent to a user webhook and
+// returns them with canonical names
+func validateWebhookHeaders(headers map[string]string) (map[string]string, error) {
+	if len(headers) > maxWebhookHeaders {
+		return nil, fmt.Errorf("at most %d headers are allowed", maxWebhookHeaders)
+	}
+	valid := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if reservedWebhookHeaders[name] {
+			return nil, fmt.Errorf("header %s can't be overridden", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid value for header %s", name)
+		}
+		valid[name] = value
+	}
+	return valid, nil
+}
+
+// validHeaderName reports whether name is an RFC 7230 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// webhookHeaderNames lists the configured headers without their values, which
+// often hold credentials
+func webhookHeaderNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WebhookHeaders returns the extra headers sent to the webhook of a user,
+// loading them on first use
+func (m *DeliveryManager) WebhookHeaders(userID string) map[string]string {
+	m.mu.Lock()
+	headers, ok := m.headers[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok || db == nil {
+		return headers
+	}
+
+	var raw string
+	if err := db.Get(&raw, "SELECT webhook_headers FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load webhook headers")
+		return nil
+	}
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+			log.Warn().Err(err).Str("userID", userID).Msg("Ignoring invalid webhook headers")
+			headers = nil
+		}
+	}
+
+	m.mu.Lock()
+	m.headers[userID] = headers
+	m.mu.Unlock()
+	return headers
+}
+
+// SetWebhookHeaders stores the extra headers sent to the webhook of a user,
+// an empty map removes them
+func (m *DeliveryManager) SetWebhookHeaders(userID string, headers map[string]string) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw := ""
+	if len(headers) > 0 {
+		data, err := json.Marshal(headers)
+		if err != nil {
+			return err
+		}
+		raw = string(data)
+	}
+	if _, err := db.Exec("UPDATE users SET webhook_headers = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.headers, userID)
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// WebhookTLSSettings are the client certificate and CA bundle used to reach a
+// user webhook that requires mutual TLS, stored as JSON in the webhook_tls
+// column
+type WebhookTLSSettings struct {
+	// ClientCert and ClientKey are the PEM encoded certificate and key
+	// presented to the webhook
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	// CABundle holds PEM certificates trusted in addition to the system roots
+	CABundle string `json:"ca_bundle"`
+}
+
+// parseWebhookTLSSettings decodes the webhook_tls column, nil when not set
+func parseWebhookTLSSettings(raw string) (*WebhookTLSSettings, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var settings WebhookTLSSettings
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return nil, fmt.Errorf("invalid webhook TLS settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// encode returns the JSON stored in the webhook_tls column
+func (ts *WebhookTLSSettings) encode() (string, error) {
+	if ts == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(ts)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// validate checks that the settings can be turned into a TLS configuration
+func (ts *WebhookTLSSettings) validate() error {
+	if ts.ClientCert == "" && ts.ClientKey == "" && ts.CABundle == "" {
+		return errors.New("client_cert and client_key, or ca_bundle, are required")
+	}
+	if (ts.ClientCert == "") != (ts.ClientKey == "") {
+		return errors.New("client_cert and client_key must be set together")
+	}
+	_, err := ts.tlsConfig()
+	return err
+}
+
+// tlsConfig builds the TLS configuration of the webhook client. With a CA
+// bundle the webhook certificate is verified against it and the system roots.
+func (ts *WebhookTLSSettings) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: true}
+	if ts.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(ts.ClientCert), []byte(ts.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate or key: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if ts.CABundle != "" {
+		roots, err := parseCABundle(ts.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = roots
+		config.InsecureSkipVerify = false
+	}
+	return config, nil
+}
+
+// certificateInfo describes the client certificate without exposing the key
+func (ts *WebhookTLSSettings) certificateInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"has_client_cert": ts != nil && ts.ClientCert != "",
+		"has_ca_bundle":   ts != nil && ts.CABundle != "",
+	}
+	if ts == nil || ts.ClientCert == "" {
+		return info
+	}
+	cert, err := tls.X509KeyPair([]byte(ts.ClientCert), []byte(ts.ClientKey))
+	if err != nil || len(cert.Certificate) == 0 {
+		return info
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		info["subject"] = leaf.Subject.String()
+		info["issuer"] = leaf.Issuer.String()
+		info["not_after"] = leaf.NotAfter.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+// userWebhookClient returns the client for the webhook of a user: a client
+// with the user's certificate when mutual TLS is configured, otherwise the
+// session client
+func userWebhookClient(userID string) *resty.Client {
+	if client := GetDeliveryManager().webhookTLSClient(userID); client != nil {
+		return client
+	}
+	return webhookHTTPClient(userID)
+}
+
+// webhookTLSClient returns the mutual TLS client of a user, nil when none is
+// configured, building it on first use
+func (m *DeliveryManager) webhookTLSClient(userID string) *resty.Client {
+	m.mu.Lock()
+	client, ok := m.tlsClients[userID]
+	db := m.db
+	m.mu.Unlock()
+	if ok || db == nil {
+		return client
+	}
+
+	var row struct {
+		WebhookTLS string `db:"webhook_tls"`
+		ProxyURL   string `db:"proxy_url"`
+	}
+	if err := db.Get(&row, "SELECT webhook_tls, COALESCE(proxy_url, '') AS proxy_url FROM users WHERE id = $1", userID); err != nil {
+		log.Warn().Err(err).Str("userID", userID).Msg("Failed to load webhook TLS settings")
+		return nil
+	}
+	settings, err := parseWebhookTLSSettings(row.WebhookTLS)
+	if err == nil && settings != nil {
+		var config *tls.Config
+		if config, err = settings.tlsConfig(); err == nil {
+			client = resty.New().
+				SetRedirectPolicy(resty.FlexibleRedirectPolicy(15)).
+				SetTimeout(deliveryTimeout).
+				SetTLSClientConfig(config)
+			if row.ProxyURL != "" {
+				client.SetProxy(row.ProxyURL)
+			}
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("userID", userID).Msg("Ignoring webhook TLS settings")
+	}
+
+	m.mu.Lock()
+	m.tlsClients[userID] = client
+	m.mu.Unlock()
+	return client
+}
+
+// SetWebhookTLS stores the webhook TLS settings of a user, nil removes them
+func (m *DeliveryManager) SetWebhookTLS(userID string, settings *WebhookTLSSettings) error {
+	m.mu.Lock()
+	db := m.db
+	m.mu.Unlock()
+	if db == nil {
+		return errors.New("delivery manager not initialized")
+	}
+
+	raw, err := settings.encode()
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET webhook_tls = $1 WHERE id = $2", raw, userID); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.tlsClients, userID)
+	m.mu.Unlock()
+	return nil
+}
@@ -39,48 +39,42 @@ type MyClient struct {
 	db             *sqlx.DB
 }
 
-func sendToGlobalWebHook(jsonData []byte, token string, userID string) {
-	jsonDataStr := string(jsonData)
-
-	instance_name := ""
-	userinfo, found := userinfocache.Get(token)
-	if found {
-		instance_name = userinfo.(Values).Get("Name")
-	}
-
+func sendToGlobalWebHook(jsonData []byte, token string, userID string, eventType string) {
 	if *globalWebhook != "" {
-		log.Info().Str("url", *globalWebhook).Msg("Calling global webhook")
-		// Add extra information for the global webhook
-		globalData := map[string]string{
-			"jsonData":     jsonDataStr,
-			"token":        token,
-			"userID":       userID,
-			"instanceName": instance_name,
-		}
-		callHook(*globalWebhook, globalData, userID)
+		log.Info().Str("url", *globalWebhook).Msg("Queueing global webhook")
+		GetDeliveryManager().Enqueue(&DeliveryEvent{
+			UserID:      userID,
+			Token:       token,
+			Channel:     DeliveryChannelGlobalWebhook,
+			Destination: *globalWebhook,
+			EventType:   eventType,
+			Payload:     string(jsonData),
+		})
 	}
 }
 
-func sendToUserWebHook(webhookurl string, path string, jsonData []byte, userID string, token string) {
-
-	instance_name := ""
-	userinfo, found := userinfocache.Get(token)
-	if found {
-		instance_name = userinfo.(Values).Get("Name")
-	}
-	data := map[string]string{
-		"jsonData":     string(jsonData),
-		"token":        token,
-		"instanceName": instance_name,
-	}
-
-	log.Debug().Interface("webhookData", data).Msg("Data being sent to webhook")
-
+func sendToUserWebHook(webhookurl string, path string, jsonData []byte, userID string, token string, eventType string) {
 	if webhookurl != "" {
 		log.Info().Str("url", webhookurl).Msg("Calling user webhook")
 		if path == "" {
-			go callHook(webhookurl, data, userID)
+			// Queued and retried, the outbox survives restarts
+			GetDeliveryManager().Enqueue(&DeliveryEvent{
+				UserID:      userID,
+				Token:       token,
+				Channel:     DeliveryChannelWebhook,
+				Destination: webhookurl,
+				EventType:   eventType,
+				Payload:     string(jsonData),
+			})
 		} else {
+			// Events with a file are sent right away, the file is removed afterwards
+			data := map[string]string{
+				"jsonData":     string(jsonData),
+				"token":        token,
+				"instanceName": instanceName(token),
+			}
+			log.Debug().Interface("webhookData", data).Msg("Data being sent to webhook")
+
 			// Create a channel to capture the error from the goroutine
 			errChan := make(chan error, 1)
 			go func() {
@@ -171,6 +165,22 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 		return
 	}
 
+	// Drop events WhatsApp delivered again. Receipts are told apart by state
+	// so a read receipt isn't taken for the delivery receipt of the message.
+	dedupType := eventType
+	if state, ok := postmap["state"].(string); ok {
+		dedupType += ":" + state
+	}
+	if GetDeliveryManager().Duplicate(mycli.userID, eventMessageID(postmap["event"]), dedupType) {
+		return
+	}
+
+	// Run user event hooks, which may enrich, redact or drop the event
+	postmap, keep := GetHookManager().RunEventHooks(mycli.userID, postmap)
+	if !keep {
+		return
+	}
+
 	// Prepare webhook data
 	jsonData, err := json.Marshal(postmap)
 	if err != nil {
@@ -179,12 +189,32 @@ func sendEventWithWebHook(mycli *MyClient, postmap map[string]interface{}, path
 	}
 
 	// Call user webhook if configured
-	sendToUserWebHook(webhookurl, path, jsonData, mycli.userID, mycli.token)
+	sendToUserWebHook(webhookurl, path, jsonData, mycli.userID, mycli.token, eventType)
 
 	// Get global webhook if configured
-	go sendToGlobalWebHook(jsonData, mycli.token, mycli.userID)
+	sendToGlobalWebHook(jsonData, mycli.token, mycli.userID, eventType)
+
+	sendToGlobalRabbit(jsonData, mycli.userID, eventType)
 
-	go sendToGlobalRabbit(jsonData)
+	sendToKafka(jsonData, mycli.userID, mycli.token, eventType)
+	sendToNATS(jsonData, mycli.userID, mycli.token, eventType)
+	sendToSQS(jsonData, mycli.userID, mycli.token, eventType)
+	sendToPubSub(jsonData, mycli.userID, mycli.token, eventType)
+	sendToRedis(jsonData, mycli.userID, mycli.token, eventType)
+	sendToUserRabbit(jsonData, mycli.userID, mycli.token, eventType)
+	sendToEventStream(jsonData, mycli.userID, eventType)
+}
+
+// eventMessageID returns the ID of the message an event is about, empty for
+// events that are not about a message
+func eventMessageID(rawEvt interface{}) string {
+	switch evt := rawEvt.(type) {
+	case *events.Message:
+		return evt.Info.ID
+	case *events.Receipt:
+		return strings.Join(evt.MessageIDs, ",")
+	}
+	return ""
 }
 
 func checkIfSubscribedToEvent(subscribedEvents []string, eventType string, userId string) bool {
@@ -201,7 +231,7 @@ func checkIfSubscribedToEvent(subscribedEvents []string, eventType string, userI
 
 // Connects to Whatsapp Websocket on server startup if last state was connected
 func (s *server) connectOnStartup() {
-	rows, err := s.db.Queryx("SELECT id,name,token,jid,webhook,events,proxy_url,CASE WHEN s3_enabled THEN 'true' ELSE 'false' END AS s3_enabled,media_delivery FROM users WHERE connected=1")
+	rows, err := s.db.Queryx("SELECT id,name,token,jid,webhook,events,proxy_url,CASE WHEN s3_enabled THEN 'true' ELSE 'false' END AS s3_enabled,media_delivery FROM users WHERE connected=1 AND COALESCE(disabled_at, 0) = 0")
 	if err != nil {
 		log.Error().Err(err).Msg("DB Problem")
 		return
@@ -257,53 +287,6 @@ func (s *server) connectOnStartup() {
 			log.Info().Str("events", eventstring).Str("jid", jid).Msg("Attempt to connect")
 			killchannel[txtid] = make(chan bool)
 			go s.startClient(txtid, jid, token, subscribedEvents)
-
-			// Initialize S3 client if configured
-			go func(userID string) {
-				var s3Config struct {
-					Enabled       bool   `db:"s3_enabled"`
-					Endpoint      string `db:"s3_endpoint"`
-					Region        string `db:"s3_region"`
-					Bucket        string `db:"s3_bucket"`
-					AccessKey     string `db:"s3_access_key"`
-					SecretKey     string `db:"s3_secret_key"`
-					PathStyle     bool   `db:"s3_path_style"`
-					PublicURL     string `db:"s3_public_url"`
-					RetentionDays int    `db:"s3_retention_days"`
-				}
-
-				err := s.db.Get(&s3Config, `
-					SELECT s3_enabled, s3_endpoint, s3_region, s3_bucket, 
-						   s3_access_key, s3_secret_key, s3_path_style, 
-						   s3_public_url, s3_retention_days
-					FROM users WHERE id = $1`, userID)
-
-				if err != nil {
-					log.Error().Err(err).Str("userID", userID).Msg("Failed to get S3 config")
-					return
-				}
-
-				if s3Config.Enabled {
-					config := &S3Config{
-						Enabled:       s3Config.Enabled,
-						Endpoint:      s3Config.Endpoint,
-						Region:        s3Config.Region,
-						Bucket:        s3Config.Bucket,
-						AccessKey:     s3Config.AccessKey,
-						SecretKey:     s3Config.SecretKey,
-						PathStyle:     s3Config.PathStyle,
-						PublicURL:     s3Config.PublicURL,
-						RetentionDays: s3Config.RetentionDays,
-					}
-
-					err = GetS3Manager().InitializeS3Client(userID, config)
-					if err != nil {
-						log.Error().Err(err).Str("userID", userID).Msg("Failed to initialize S3 client on startup")
-					} else {
-						log.Info().Str("userID", userID).Msg("S3 client initialized on startup")
-					}
-				}
-			}(txtid)
 		}
 	}
 	err = rows.Err()
@@ -556,6 +539,9 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Connected, *events.PushNameSetting:
 		postmap["type"] = "Connected"
 		dowebhook = 1
+		if _, ok := evt.(*events.Connected); ok {
+			recordConnected(mycli.userID)
+		}
 		if len(mycli.WAClient.Store.PushName) == 0 {
 			break
 		}
@@ -604,6 +590,13 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		}
 
 		lastMessageCache.Set(mycli.userID, &evt.Info, cache.DefaultExpiration)
+		if !evt.Info.IsFromMe {
+			recordMessageReceived(mycli.userID)
+		} else {
+			// Sent from another device of the account, it can be edited
+			// and revoked through the API as well
+			rememberSentMessage(mycli.userID, evt.Info.Chat, evt.Info.ID, evt.Info.Timestamp)
+		}
 		myuserinfo, found := userinfocache.Get(mycli.token)
 		if !found {
 			err := mycli.db.Get(&s3Config, "SELECT CASE WHEN s3_enabled = 1 THEN 'true' ELSE 'false' END AS s3_enabled, media_delivery FROM users WHERE id = $1", txtid)
@@ -635,6 +628,11 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 
 		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Str("parts", strings.Join(metaParts, ", ")).Msg("Message Received")
 
+		mycli.handlePollMessage(evt, postmap)
+		if cards := contactCardsFromMessage(evt.Message); cards != nil {
+			postmap["contacts"] = cards
+		}
+
 		if !*skipMedia {
 			// try to get Image if any
 			img := evt.Message.GetImageMessage()
@@ -653,6 +651,12 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					log.Error().Err(err).Msg("Failed to download image")
 					return
 				}
+				recordMediaBytes(mycli.userID, len(data))
+
+				// Remove EXIF and other metadata before the image is stored or forwarded
+				if stripMetadataEnabled(mycli.db, txtid) {
+					data = stripMediaMetadataOrKeep(txtid, data, img.GetMimetype())
+				}
 
 				// Determine the file extension based on the MIME type
 				exts, _ := mime.ExtensionsByType(img.GetMimetype())
@@ -685,8 +689,16 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						filepath.Base(tmpPath),
 						isIncoming,
 					)
-					if err != nil {
+					if verdict := rejectedMediaVerdict(err); verdict != nil {
+						// Infected media is dropped, not even delivered as base64
+						postmap["scan"] = verdict
+						s3Config.MediaDelivery = "none"
+					} else if err != nil {
 						log.Error().Err(err).Msg("Failed to upload image to S3")
+						// Fall back to base64 so the media still reaches the webhook
+						if s3Config.MediaDelivery == "s3" {
+							s3Config.MediaDelivery = "base64"
+						}
 					} else {
 						postmap["s3"] = s3Data
 					}
@@ -735,6 +747,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					log.Error().Err(err).Msg("Failed to download audio")
 					return
 				}
+				recordMediaBytes(mycli.userID, len(data))
 
 				// Determine the file extension based on the MIME type
 				exts, _ := mime.ExtensionsByType(audio.GetMimetype())
@@ -773,8 +786,16 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 						filepath.Base(tmpPath),
 						isIncoming,
 					)
-					if err != nil {
+					if verdict := rejectedMediaVerdict(err); verdict != nil {
+						// Infected media is dropped, not even delivered as base64
+						postmap["scan"] = verdict
+						s3Config.MediaDelivery = "none"
+					} else if err != nil {
 						log.Error().Err(err).Msg("Failed to upload audio to S3")
+						// Fall back to base64 so the media still reaches the webhook
+						if s3Config.MediaDelivery == "s3" {
+							s3Config.MediaDelivery = "base64"
+						}
 					} else {
 						postmap["s3"] = s3Data
 					}
@@ -823,6 +844,12 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					log.Error().Err(err).Msg("Failed to download document")
 					return
 				}
+				recordMediaBytes(mycli.userID, len(data))
+
+				// Images sent as documents carry their metadata as well
+				if stripMetadataEnabled(mycli.db, txtid) {
+					data = stripMediaMetadataOrKeep(txtid, data, document.GetMimetype())
+				}
 
 				// Determine the file extension
 				extension := ""
@@ -845,6 +872,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					log.Error().Err(err).Msg("Failed to save document to temporary file")
 					return
 				}
+				// Release the buffer, the upload streams from the temporary file
+				data = nil
 
 				// Process S3 upload if enabled
 				if s3Config.Enabled == "true" && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
@@ -856,18 +885,26 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					}
 
 					// Process S3 upload
-					s3Data, err := GetS3Manager().ProcessMediaForS3(
+					s3Data, err := GetS3Manager().ProcessMediaFileForS3(
 						context.Background(),
 						txtid,
 						contactJID,
 						evt.Info.ID,
-						data,
+						tmpPath,
 						document.GetMimetype(),
 						filepath.Base(tmpPath),
 						isIncoming,
 					)
-					if err != nil {
+					if verdict := rejectedMediaVerdict(err); verdict != nil {
+						// Infected media is dropped, not even delivered as base64
+						postmap["scan"] = verdict
+						s3Config.MediaDelivery = "none"
+					} else if err != nil {
 						log.Error().Err(err).Msg("Failed to upload document to S3")
+						// Fall back to base64 so the media still reaches the webhook
+						if s3Config.MediaDelivery == "s3" {
+							s3Config.MediaDelivery = "base64"
+						}
 					} else {
 						postmap["s3"] = s3Data
 					}
@@ -916,6 +953,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					log.Error().Err(err).Msg("Failed to download video")
 					return
 				}
+				recordMediaBytes(mycli.userID, len(data))
 
 				// Determine the file extension based on the MIME type
 				exts, _ := mime.ExtensionsByType(video.GetMimetype())
@@ -927,6 +965,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					log.Error().Err(err).Msg("Failed to save video to temporary file")
 					return
 				}
+				// Release the buffer, the upload streams from the temporary file
+				data = nil
 
 				// Process S3 upload if enabled
 				if s3Config.Enabled == "true" && (s3Config.MediaDelivery == "s3" || s3Config.MediaDelivery == "both") {
@@ -938,18 +978,26 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 					}
 
 					// Process S3 upload
-					s3Data, err := GetS3Manager().ProcessMediaForS3(
+					s3Data, err := GetS3Manager().ProcessMediaFileForS3(
 						context.Background(),
 						txtid,
 						contactJID,
 						evt.Info.ID,
-						data,
+						tmpPath,
 						video.GetMimetype(),
 						filepath.Base(tmpPath),
 						isIncoming,
 					)
-					if err != nil {
+					if verdict := rejectedMediaVerdict(err); verdict != nil {
+						// Infected media is dropped, not even delivered as base64
+						postmap["scan"] = verdict
+						s3Config.MediaDelivery = "none"
+					} else if err != nil {
 						log.Error().Err(err).Msg("Failed to upload video to S3")
+						// Fall back to base64 so the media still reaches the webhook
+						if s3Config.MediaDelivery == "s3" {
+							s3Config.MediaDelivery = "base64"
+						}
 					} else {
 						postmap["s3"] = s3Data
 					}